@@ -50,9 +50,13 @@ export function activate(context: ExtensionContext) {
         // Only works for plaintext
         documentSelector: [{ scheme: 'file', language: 'plaintext' }],
         synchronize: {
+            // Send 'commentExtension' settings to the server on change
+            configurationSection: 'commentExtension',
             // Watch '.clientrc' files in the workspace
             fileEvents: workspace.createFileSystemWatcher('**/.clientrc')
         },
+        // Server settings at startup
+        initializationOptions: workspace.getConfiguration('commentExtension'),
         outputChannel: outputChannel,             // General logs
         traceOutputChannel: traceOutputChannel,   // Trace logs
     };
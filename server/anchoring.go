@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"go.lsp.dev/protocol"
+)
+
+// Comments are anchored by a pipeline of strategies, tried in the order of
+// the anchoringStrategies setting until one places the comment. The first
+// ones are exact, the last ones always succeed but may be off.
+
+const (
+	AnchorExact  = "exact"  // The recorded lines, unchanged
+	AnchorFuzzy  = "fuzzy"  // The most similar lines around the recorded position
+	AnchorBlame  = "blame"  // The recorded lines moved by the commits since the comment
+	AnchorSymbol = "symbol" // The same offset from the enclosing declaration
+	AnchorLine   = "line"   // The recorded line number
+)
+
+var defaultAnchoringStrategies = []string{AnchorExact, AnchorFuzzy, AnchorLine}
+
+// Lines around the recorded position searched by the fuzzy strategy
+const fuzzyAnchorWindow = 100
+
+// Minimum similarity of the lines found by the fuzzy strategy, from 0 to 1
+const fuzzyAnchorThreshold = 0.7
+
+// What a strategy anchors: the recorded patch in the current content
+type anchorInput struct {
+	content   string
+	patchText string
+	// Set by anchorPatch
+	lines   []string
+	patch   recordedPatch
+	profile anchoringProfile
+	// Only known for the comments of a file, blame needs them
+	filePath string
+	commit   string
+}
+
+// Lines recorded when the comment was made
+type recordedPatch struct {
+	start     int // Line of the first context line
+	before    []string
+	commented []string
+	after     []string
+}
+
+func (patch recordedPatch) block() []string {
+	return append(append(append([]string{}, patch.before...), patch.commented...), patch.after...)
+}
+
+// Line of the first commented line
+func (patch recordedPatch) commentedStart() int {
+	return patch.start + len(patch.before)
+}
+
+func parseRecordedPatch(patchText string) (recordedPatch, error) {
+	lines := strings.Split(patchText, "\n")
+	var start, length int
+	if _, err := fmt.Sscanf(lines[0], "@@ -%d,%d", &start, &length); err != nil {
+		return recordedPatch{}, fmt.Errorf("invalid patch header %q", lines[0])
+	}
+	patch := recordedPatch{start: start - 1}
+	inChange := false
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "@@") {
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, " "):
+			if inChange {
+				patch.after = append(patch.after, line[1:])
+			} else {
+				patch.before = append(patch.before, line[1:])
+			}
+		case strings.HasPrefix(line, "-"):
+			inChange = true
+			patch.commented = append(patch.commented, line[1:])
+		case strings.HasPrefix(line, "+"):
+			inChange = true
+		}
+	}
+	if patch.start < 0 {
+		patch.start = 0
+	}
+	return patch, nil
+}
+
+// Each strategy returns the line of the first commented line, or false
+var anchorStrategies = map[string]func(input anchorInput) (int, bool){
+	AnchorExact:  anchorExact,
+	AnchorFuzzy:  anchorFuzzy,
+	AnchorBlame:  anchorBlame,
+	AnchorSymbol: anchorSymbol,
+	AnchorLine:   anchorLine,
+}
+
+func validateAnchoringStrategies(strategies []string) error {
+	seen := map[string]bool{}
+	for _, strategy := range strategies {
+		if _, ok := anchorStrategies[strategy]; !ok {
+			return fmt.Errorf("unknown anchoring strategy %q", strategy)
+		}
+		if seen[strategy] {
+			return fmt.Errorf("anchoring strategy %q listed twice", strategy)
+		}
+		seen[strategy] = true
+	}
+	return nil
+}
+
+func (s Settings) anchoringStrategies() []string {
+	if len(s.AnchoringStrategies) == 0 {
+		return defaultAnchoringStrategies
+	}
+	return s.AnchoringStrategies
+}
+
+// Runs the strategies of the settings until one anchors the patch. Returns
+// the range of the commented lines and the strategy that found it.
+func anchorPatch(input anchorInput) (protocol.Range, string, error) {
+	patch, err := parseRecordedPatch(input.patchText)
+	if err != nil {
+		return protocol.Range{}, "", newCommentError(ErrAnchorFailed, "invalid patch: %w", err)
+	}
+	input.patch = patch
+	input.lines = strings.Split(input.content, "\n")
+	settings := getSettings()
+	input.profile = settings.anchoringProfile(input.filePath)
+	for _, strategy := range input.profile.strategies(settings.anchoringStrategies()) {
+		start := time.Now()
+		line, ok := anchorStrategies[strategy](input)
+		anchorMetrics.record(strategy, ok, time.Since(start))
+		if !ok {
+			anchorLog.debugf("Strategy %s could not anchor the patch at line %d", strategy, patch.commentedStart())
+			continue
+		}
+		anchorLog.debugf("Strategy %s anchored the patch of line %d at line %d", strategy, patch.commentedStart(), line)
+		return protocol.Range{
+			Start: protocol.Position{Line: uint32(line)},
+			End:   protocol.Position{Line: uint32(line + len(patch.commented))},
+		}, strategy, nil
+	}
+	return protocol.Range{}, "", newCommentError(ErrAnchorFailed, "no anchoring strategy placed the comment recorded at line %d", patch.commentedStart()+1)
+}
+
+func anchorExact(input anchorInput) (int, bool) {
+	block := input.patch.block()
+	if len(block) == 0 {
+		return 0, false
+	}
+	best := -1
+	for start := 0; start+len(block) <= len(input.lines); start++ {
+		if !input.profile.linesEqual(input.lines[start:start+len(block)], block) {
+			continue
+		}
+		if best == -1 || distance(start, input.patch.start) < distance(best, input.patch.start) {
+			best = start
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	return best + len(input.patch.before), true
+}
+
+func anchorFuzzy(input anchorInput) (int, bool) {
+	block := input.profile.normalize(input.patch.block())
+	size := len(input.patch.block())
+	if size == 0 || size > len(input.lines) {
+		return 0, false
+	}
+	matcher := dmp.New()
+	best, bestSimilarity := -1, 0.0
+	for start := input.patch.start - fuzzyAnchorWindow; start <= input.patch.start+fuzzyAnchorWindow; start++ {
+		if start < 0 || start+size > len(input.lines) {
+			continue
+		}
+		candidate := input.profile.normalize(input.lines[start : start+size])
+		longest := len(block)
+		if len(candidate) > longest {
+			longest = len(candidate)
+		}
+		similarity := 1.0
+		if longest > 0 {
+			similarity = 1 - float64(matcher.DiffLevenshtein(matcher.DiffMain(block, candidate, false)))/float64(longest)
+		}
+		if similarity > bestSimilarity || similarity == bestSimilarity && distance(start, input.patch.start) < distance(best, input.patch.start) {
+			best, bestSimilarity = start, similarity
+		}
+	}
+	if best == -1 || bestSimilarity < fuzzyAnchorThreshold {
+		return 0, false
+	}
+	return best + len(input.patch.before), true
+}
+
+// Follows the recorded lines through the changes made since the commit of
+// the comment, failing when they were changed.
+func anchorBlame(input anchorInput) (int, bool) {
+	if input.filePath == "" || input.commit == "" || !isWorkspaceTrusted() {
+		return 0, false
+	}
+	cmd := gitCommand("diff", "--no-color", "--no-ext-diff", "-U0", input.commit, "--", filepath.Base(input.filePath))
+	cmd.Dir = filepath.Dir(input.filePath)
+	output, err := cmd.Output()
+	if err != nil {
+		anchorLog.debugf("No blame anchoring for %s: %v", input.filePath, err)
+		return 0, false
+	}
+	// 1-based lines of the commit
+	first := input.patch.commentedStart() + 1
+	last := first + len(input.patch.commented) - 1
+	shift := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(line, "@@ ") {
+			continue
+		}
+		oldStart, oldLength, newLength, ok := parseHunkHeader(line)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case oldLength == 0 && oldStart < first:
+			// Lines inserted before
+			shift += newLength
+		case oldLength > 0 && oldStart+oldLength-1 < first:
+			shift += newLength - oldLength
+		case oldLength > 0 && oldStart <= last || oldLength == 0 && oldStart < last:
+			// The commented lines changed
+			return 0, false
+		}
+	}
+	return first - 1 + shift, true
+}
+
+// Parses "@@ -start[,length] +start[,length] @@", lengths default to 1
+func parseHunkHeader(header string) (int, int, int, bool) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 {
+		return 0, 0, 0, false
+	}
+	oldStart, oldLength, ok := parseHunkRange(strings.TrimPrefix(fields[1], "-"))
+	if !ok {
+		return 0, 0, 0, false
+	}
+	_, newLength, ok := parseHunkRange(strings.TrimPrefix(fields[2], "+"))
+	return oldStart, oldLength, newLength, ok
+}
+
+func parseHunkRange(text string) (int, int, bool) {
+	start, length := 0, 1
+	if strings.Contains(text, ",") {
+		if _, err := fmt.Sscanf(text, "%d,%d", &start, &length); err != nil {
+			return 0, 0, false
+		}
+		return start, length, true
+	}
+	if _, err := fmt.Sscanf(text, "%d", &start); err != nil {
+		return 0, 0, false
+	}
+	return start, length, true
+}
+
+// Lines declaring a function, a type... in the usual languages
+var declarationPattern = regexp.MustCompile(`^\s*(export\s+|public\s+|private\s+|protected\s+|static\s+|async\s+)*(func|def|class|struct|interface|type|fn|impl|enum|trait|module|function)\b`)
+
+// Finds the declaration closest above the commented lines and places the
+// comment at the same offset from it.
+func anchorSymbol(input anchorInput) (int, bool) {
+	recorded := append(append([]string{}, input.patch.before...), input.patch.commented...)
+	declaration := -1
+	for idx := len(recorded) - 1; idx >= 0; idx-- {
+		if declarationPattern.MatchString(recorded[idx]) {
+			declaration = idx
+			break
+		}
+	}
+	if declaration == -1 {
+		return 0, false
+	}
+	offset := len(input.patch.before) - declaration
+	expected := input.patch.start + declaration
+	text := strings.TrimSpace(recorded[declaration])
+	best := -1
+	for line, current := range input.lines {
+		if !input.profile.sameLine(strings.TrimSpace(current), text) || line+offset < 0 || line+offset >= len(input.lines) {
+			continue
+		}
+		if best == -1 || distance(line, expected) < distance(best, expected) {
+			best = line
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	return best + offset, true
+}
+
+// The recorded line, moved up when the file got shorter
+func anchorLine(input anchorInput) (int, bool) {
+	line := input.patch.commentedStart()
+	if last := len(input.lines) - 1; line > last {
+		line = last
+	}
+	if line < 0 {
+		line = 0
+	}
+	return line, true
+}
+
+func (profile anchoringProfile) linesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if !profile.sameLine(a[idx], b[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+func distance(a int, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Attempts, successes and time spent by each strategy, for comment/stats
+type AnchorStrategyMetrics struct {
+	Strategy string `json:"strategy"`
+	Attempts int    `json:"attempts"`
+	Anchored int    `json:"anchored"`
+	// Average time of an attempt
+	AverageMicros int64 `json:"averageMicros"`
+	total         time.Duration
+}
+
+type anchorMetricsState struct {
+	mutex      sync.Mutex
+	strategies map[string]*AnchorStrategyMetrics
+}
+
+var anchorMetrics = &anchorMetricsState{strategies: map[string]*AnchorStrategyMetrics{}}
+
+func (state *anchorMetricsState) record(strategy string, anchored bool, elapsed time.Duration) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	metrics := state.strategies[strategy]
+	if metrics == nil {
+		metrics = &AnchorStrategyMetrics{Strategy: strategy}
+		state.strategies[strategy] = metrics
+	}
+	metrics.Attempts++
+	if anchored {
+		metrics.Anchored++
+	}
+	metrics.total += elapsed
+	metrics.AverageMicros = metrics.total.Microseconds() / int64(metrics.Attempts)
+}
+
+// Metrics of the strategies used since the start, by name
+func (state *anchorMetricsState) report() []AnchorStrategyMetrics {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	report := []AnchorStrategyMetrics{}
+	for _, metrics := range state.strategies {
+		report = append(report, *metrics)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Strategy < report[j].Strategy
+	})
+	return report
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Languages drift differently: Python indentation is meaning while a C
+// formatter realigning a block changes nothing, C++ macros hide declarations
+// from the symbol strategy... Each language can tune the anchoring of its
+// files, unset fields keep the value of the built-in profile of the language,
+// then of the settings.
+type LanguageAnchoring struct {
+	ContextBefore *int `json:"contextBefore,omitempty"`
+	ContextAfter  *int `json:"contextAfter,omitempty"`
+	// Lines differing by their whitespace only match
+	IgnoreWhitespace *bool `json:"ignoreWhitespace,omitempty"`
+	// Tries the symbol strategy before the line fallback, or never
+	SymbolStrategy *bool `json:"symbolStrategy,omitempty"`
+}
+
+// Anchoring parameters resolved for a file
+type anchoringProfile struct {
+	contextBefore    int
+	contextAfter     int
+	ignoreWhitespace bool
+	// Unset keeps the strategies of the settings
+	symbolStrategy *bool
+}
+
+func boolValue(value bool) *bool {
+	return &value
+}
+
+var builtinLanguageAnchoring = map[string]LanguageAnchoring{
+	// Indentation decides the block of a line
+	"python": {IgnoreWhitespace: boolValue(false), SymbolStrategy: boolValue(true)},
+	"yaml":   {IgnoreWhitespace: boolValue(false), SymbolStrategy: boolValue(false)},
+	// Formatters realign code without changing it
+	"go":         {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(true)},
+	"javascript": {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(true)},
+	"typescript": {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(true)},
+	"java":       {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(true)},
+	"rust":       {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(true)},
+	// Macros declare functions the declaration pattern does not recognize
+	"c":   {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(false)},
+	"cpp": {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(false)},
+	// Paragraphs are rewrapped
+	"markdown": {IgnoreWhitespace: boolValue(true), SymbolStrategy: boolValue(false)},
+}
+
+var languageExtensions = map[string]string{
+	".py":   "python",
+	".pyi":  "python",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".go":   "go",
+	".js":   "javascript",
+	".jsx":  "javascript",
+	".mjs":  "javascript",
+	".ts":   "typescript",
+	".tsx":  "typescript",
+	".java": "java",
+	".rs":   "rust",
+	".c":    "c",
+	".h":    "c",
+	".cc":   "cpp",
+	".cpp":  "cpp",
+	".cxx":  "cpp",
+	".hh":   "cpp",
+	".hpp":  "cpp",
+	".md":   "markdown",
+}
+
+// Language of a file from its extension, empty when unknown
+func languageOfPath(path string) string {
+	return languageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+func validateLanguageAnchoring(languages map[string]LanguageAnchoring) error {
+	for language, anchoring := range languages {
+		if anchoring.ContextBefore != nil && *anchoring.ContextBefore < 0 ||
+			anchoring.ContextAfter != nil && *anchoring.ContextAfter < 0 {
+			return fmt.Errorf("context lines of %s must be positive", language)
+		}
+	}
+	return nil
+}
+
+// Anchoring parameters of a file: the settings, then the built-in profile of
+// its language, then the overrides of the user for it
+func (s Settings) anchoringProfile(filePath string) anchoringProfile {
+	profile := anchoringProfile{contextBefore: s.ContextBefore, contextAfter: s.ContextAfter}
+	language := languageOfPath(filePath)
+	if language == "" {
+		return profile
+	}
+	for _, anchoring := range []LanguageAnchoring{builtinLanguageAnchoring[language], s.LanguageAnchoring[language]} {
+		if anchoring.ContextBefore != nil {
+			profile.contextBefore = *anchoring.ContextBefore
+		}
+		if anchoring.ContextAfter != nil {
+			profile.contextAfter = *anchoring.ContextAfter
+		}
+		if anchoring.IgnoreWhitespace != nil {
+			profile.ignoreWhitespace = *anchoring.IgnoreWhitespace
+		}
+		if anchoring.SymbolStrategy != nil {
+			profile.symbolStrategy = anchoring.SymbolStrategy
+		}
+	}
+	return profile
+}
+
+// Adds or removes the symbol strategy of the configured ones. When added, it
+// runs before the line fallback which always succeeds.
+func (profile anchoringProfile) strategies(configured []string) []string {
+	if profile.symbolStrategy == nil || *profile.symbolStrategy == slices.Contains(configured, AnchorSymbol) {
+		return configured
+	}
+	if !*profile.symbolStrategy {
+		return slices.DeleteFunc(slices.Clone(configured), func(strategy string) bool {
+			return strategy == AnchorSymbol
+		})
+	}
+	if line := slices.Index(configured, AnchorLine); line >= 0 {
+		return slices.Insert(slices.Clone(configured), line, AnchorSymbol)
+	}
+	return append(slices.Clone(configured), AnchorSymbol)
+}
+
+// Compares two lines as the profile sees them
+func (profile anchoringProfile) sameLine(a string, b string) bool {
+	if profile.ignoreWhitespace {
+		return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+	}
+	return a == b
+}
+
+// Text of lines compared by the fuzzy strategy
+func (profile anchoringProfile) normalize(lines []string) string {
+	if !profile.ignoreWhitespace {
+		return strings.Join(lines, "\n")
+	}
+	normalized := make([]string, len(lines))
+	for idx, line := range lines {
+		normalized[idx] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.Join(normalized, "\n")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A comment moved out of its comment file into an archive bundle
+type ArchivedComment struct {
+	Path       string `json:"path"`   // Commented file, relative to the repository
+	Commit     string `json:"commit"` // Commit of the comment file
+	Comment    Patch  `json:"comment"`
+	ArchivedAt string `json:"archivedAt"` // RFC3339
+	// Last commit of the repository holding the file, when the comment was
+	// archived because the file was deleted
+	DeletedAfter string `json:"deletedAfter,omitempty"`
+}
+
+func archiveDir(repoDir string) string {
+	return filepath.Join(commentsDirOf(repoDir), metaDirName, "archive")
+}
+
+// Moves the comments resolved for longer than olderThan into a new gzipped
+// JSON lines bundle, keeping comment files small. Returns the number of
+// archived comments.
+func archiveResolvedComments(repoDir string, olderThan time.Duration) (int, error) {
+	now := time.Now()
+	type commentFileUpdate struct {
+		path        string
+		commentFile *CommentFile
+	}
+	updates := []commentFileUpdate{}
+	archived := []ArchivedComment{}
+	// The updated files stay locked until written
+	var locks commentFileLocks
+	defer func() { locks.release() }()
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		unlock, err := lockCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			unlock()
+			recordError(err)
+			return nil
+		}
+		kept := []Patch{}
+		for _, patch := range commentFile.Patches {
+			resolvedAt, err := time.Parse(time.RFC3339, patch.ResolvedAt)
+			if !patch.isClosed() || err != nil || now.Sub(resolvedAt) < olderThan {
+				kept = append(kept, patch)
+				continue
+			}
+			archived = append(archived, ArchivedComment{
+				Path:       filepath.ToSlash(rel),
+				Commit:     commentFile.Commit,
+				Comment:    patch,
+				ArchivedAt: now.UTC().Format(time.RFC3339),
+			})
+		}
+		if len(kept) == len(commentFile.Patches) {
+			unlock()
+			return nil
+		}
+		commentFile.Patches = kept
+		updates = append(updates, commentFileUpdate{commentFilePath, commentFile})
+		locks = append(locks, unlock)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error while listing comment files: %v", err)
+	}
+	if len(archived) == 0 {
+		return 0, nil
+	}
+
+	// Write the bundle before removing anything from the comment files
+	bundlePath := newBundlePath(repoDir, now)
+	if err := writeArchiveBundle(bundlePath, archived); err != nil {
+		return 0, err
+	}
+	for _, update := range updates {
+		if len(update.commentFile.Patches) == 0 {
+			if err := deleteCommentFile(update.path); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := writeCommentFile(update.path, update.commentFile); err != nil {
+			return 0, err
+		}
+	}
+	storeLog.infof("Archived %d comments in %s", len(archived), bundlePath)
+	return len(archived), updateCommentsRepoAfterChange()
+}
+
+// Path of a new archive bundle, named after its creation time
+func newBundlePath(repoDir string, now time.Time) string {
+	name := now.UTC().Format("20060102T150405Z")
+	bundlePath := filepath.Join(archiveDir(repoDir), name+".jsonl.gz")
+	for count := 2; ; count++ {
+		if _, err := os.Stat(bundlePath); os.IsNotExist(err) {
+			return bundlePath
+		}
+		bundlePath = filepath.Join(archiveDir(repoDir), fmt.Sprintf("%s-%d.jsonl.gz", name, count))
+	}
+}
+
+// Archives all the comments of deleted files and folders, so that they do not
+// stay in comment files of files that no longer exist. Returns the number of
+// archived comments.
+func archiveDeletedFiles(repoDir string, paths []string) (int, error) {
+	now := time.Now()
+	commentsDir := commentsDirOf(repoDir)
+	archived := []ArchivedComment{}
+	commentFilePaths := []string{}
+	// The archived files stay locked until deleted
+	var locks commentFileLocks
+	defer func() { locks.release() }()
+	addCommentFile := func(commentFilePath string, rel string) error {
+		if err := locks.lock(commentFilePath); err != nil {
+			return err
+		}
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			return err
+		}
+		for _, patch := range commentFile.Patches {
+			archived = append(archived, ArchivedComment{
+				Path:       filepath.ToSlash(rel),
+				Commit:     commentFile.Commit,
+				Comment:    patch,
+				ArchivedAt: now.UTC().Format(time.RFC3339),
+			})
+		}
+		commentFilePaths = append(commentFilePaths, commentFilePath)
+		return nil
+	}
+	for _, path := range paths {
+		rel, err := filepath.Rel(repoDir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		commentFilePath := filepath.Join(commentsDir, rel+".json")
+		if commentFileExists(commentFilePath) {
+			if err := addCommentFile(commentFilePath, rel); err != nil {
+				return 0, err
+			}
+		}
+		// Comments of the files of a deleted folder
+		commentDir := filepath.Join(commentsDir, rel)
+		if info, err := os.Stat(commentDir); err == nil && info.IsDir() {
+			err := walkCommentFiles(commentDir, func(commentFilePath string, fileRel string) error {
+				return addCommentFile(commentFilePath, filepath.Join(rel, fileRel))
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(commentFilePaths) == 0 {
+		return 0, nil
+	}
+	head, err := gitOutput("-C", repoDir, "rev-parse", "HEAD")
+	if err != nil {
+		gitLog.errorf("Deleting commit not recorded: %v", err)
+	}
+	for idx := range archived {
+		archived[idx].DeletedAfter = strings.TrimSpace(string(head))
+	}
+
+	// Write the bundle before removing the comment files
+	if len(archived) > 0 {
+		if err := writeArchiveBundle(newBundlePath(repoDir, now), archived); err != nil {
+			return 0, err
+		}
+	}
+	for _, commentFilePath := range commentFilePaths {
+		if err := deleteCommentFile(commentFilePath); err != nil {
+			return 0, err
+		}
+	}
+	storeLog.infof("Archived %d comments of %d deleted files", len(archived), len(commentFilePaths))
+	return len(archived), updateCommentsRepoAfterChange()
+}
+
+func writeArchiveBundle(bundlePath string, archived []ArchivedComment) error {
+	if err := os.MkdirAll(filepath.Dir(bundlePath), os.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	file, err := os.Create(bundlePath)
+	if err != nil {
+		return wrapFileError(err, "error while creating archive bundle: %w", err)
+	}
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, comment := range archived {
+		if err := encoder.Encode(comment); err != nil {
+			return fmt.Errorf("error while writing archive bundle: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error while writing archive bundle: %v", err)
+	}
+	return nil
+}
+
+// Archives the old resolved comments of the workspace if it is configured
+func (h *handler) archiveOldComments() {
+	days := getSettings().ArchiveAfterDays
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if days <= 0 || repoDir == "" {
+		return
+	}
+	if _, err := archiveResolvedComments(repoDir, time.Duration(days)*24*time.Hour); err != nil {
+		recordError(fmt.Errorf("error while archiving comments: %w", err))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Files attached to a comment (screenshots, logs...) are copied to the
+// attachments folder of the comments folder, one folder per attachment so
+// that the file keeps its name, and shared with the comments. The folder is
+// reserved: it does not hold comment files.
+
+const attachmentsDirName = "attachments"
+
+// Larger files belong to a bug tracker, not to the comments repository
+const maxAttachmentSize = 10 << 20
+
+type Attachment struct {
+	Name string `json:"name"`
+	// Relative to the comments folder: attachments/<uuid>/<name>
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Copies file to the attachments of the repository
+func storeAttachment(repoDir string, file string) (*Attachment, error) {
+	source, err := os.Open(file)
+	if err != nil {
+		return nil, wrapFileError(err, "error while opening attachment: %w", err)
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading attachment: %w", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("cannot attach folder %s", file)
+	}
+	if info.Size() > maxAttachmentSize {
+		return nil, fmt.Errorf("%s is %d bytes, more than the limit of %d", filepath.Base(file), info.Size(), maxAttachmentSize)
+	}
+	attachment := &Attachment{
+		Name: filepath.Base(file),
+		Path: path.Join(attachmentsDirName, newCommentUUID(), filepath.Base(file)),
+		Size: info.Size(),
+	}
+	target := filepath.Join(commentsDirOf(repoDir), filepath.FromSlash(attachment.Path))
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return nil, wrapFileError(err, "error while creating folders: %w", err)
+	}
+	destination, err := os.Create(target)
+	if err != nil {
+		return nil, wrapFileError(err, "error while writing attachment: %w", err)
+	}
+	_, err = io.Copy(destination, source)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, wrapFileError(err, "error while writing attachment: %w", err)
+	}
+	return attachment, nil
+}
+
+// Attaches file, a path or a file URI, to a comment
+func attachToComment(uri protocol.DocumentURI, id string, file string) error {
+	if strings.HasPrefix(file, "file://") {
+		file = uriToPath(protocol.DocumentURI(file))
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if repoDir == "" {
+			return fmt.Errorf("attachments are stored in a git repository")
+		}
+		attachment, err := storeAttachment(repoDir, file)
+		if err != nil {
+			return err
+		}
+		storeLog.infof("Attach %s to comment %s", attachment.Path, commentID(patch))
+		patch.Attachments = append(patch.Attachments, *attachment)
+		return nil
+	})
+}
+
+// Removes the files of the attachments of a deleted comment
+func removeAttachments(repoDir string, patch *Patch) {
+	for _, attachment := range patch.Attachments {
+		if !validAttachmentPath(attachment.Path) {
+			continue
+		}
+		dir := filepath.Dir(filepath.Join(commentsDirOf(repoDir), filepath.FromSlash(attachment.Path)))
+		if err := os.RemoveAll(dir); err != nil {
+			recordError(wrapFileError(err, "error while removing attachment: %w", err))
+		}
+	}
+}
+
+// Whether an attachment path stays in its folder of the attachments
+func validAttachmentPath(attachmentPath string) bool {
+	parts := strings.Split(attachmentPath, "/")
+	return len(parts) == 3 && parts[0] == attachmentsDirName && path.Clean(attachmentPath) == attachmentPath &&
+		parts[1] != ".." && parts[2] != ".."
+}
+
+// File URI of an attachment of the repository
+func attachmentURI(repoDir string, attachment Attachment) protocol.DocumentURI {
+	return pathToURI(filepath.Join(commentsDirOf(repoDir), filepath.FromSlash(attachment.Path)))
+}
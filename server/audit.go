@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Events of the audit log
+const (
+	AuditCommentAdded      = "comment.added"
+	AuditCommentResolved   = "comment.resolved"
+	AuditCommentReopened   = "comment.reopened"
+	AuditCommentWontFix    = "comment.wontfix"
+	AuditCommentEdited     = "comment.edited"
+	AuditCommentDeleted    = "comment.deleted"
+	AuditSuggestionAdded   = "suggestion.added"
+	AuditSuggestionApplied = "suggestion.applied"
+)
+
+// One line of the audit log, appended to the metadata folder of the
+// comments repository for every change made to the comments.
+type AuditEvent struct {
+	Time    string `json:"time"` // RFC3339
+	Event   string `json:"event"`
+	User    string `json:"user"`              // Who did the change
+	Author  string `json:"author,omitempty"`  // Author of the changed comment
+	Path    string `json:"path"`              // Commented file, relative to the repository
+	Comment string `json:"comment,omitempty"` // ID of the comment, its index in older logs
+	// Set on resolution of comments with an SLA
+	WithinSLA *bool `json:"withinSla,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+func auditLogPath(repoDir string) string {
+	return filepath.Join(commentsDirOf(repoDir), metaDirName, "audit.jsonl")
+}
+
+func appendAuditEvent(repoDir string, event AuditEvent) error {
+	if event.Time == "" {
+		event.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error while serializing audit event: %v", err)
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	path := auditLogPath(repoDir)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return wrapFileError(err, "error while opening audit log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return wrapFileError(err, "error while writing audit log: %w", err)
+	}
+	return nil
+}
+
+func readAuditLog(repoDir string) ([]AuditEvent, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	file, err := os.Open(auditLogPath(repoDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return []AuditEvent{}, nil
+	}
+	if err != nil {
+		return nil, wrapFileError(err, "error while opening audit log: %w", err)
+	}
+	defer file.Close()
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Lines can be mangled by merges, skip them
+			recordError(newCommentError(ErrStoreCorrupt, "invalid audit log line %d: %w", lineNumber, err))
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading audit log: %v", err)
+	}
+	return events, nil
+}
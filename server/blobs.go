@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Patches of a comment file are stored content-addressed: each line of a
+// patch is kept once in the blobs of the file and patches reference it by
+// hash. Comments on overlapping regions share most of their context lines.
+//
+// A reference is the diff operation of the line (' ', '-', '+' or '@' for the
+// hunk header) followed either by '#' and the hash of the line, or by the
+// line itself when it is too short to be worth a blob.
+
+const blobHashLength = 12
+
+// Lines up to this length are kept inline
+const inlineLineLength = 16
+
+func blobHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:blobHashLength]
+}
+
+// Replaces the patches by references to the blobs of the file. Patches whose
+// lines collide with another blob are kept inline.
+func encodePatchBlobs(commentFile *CommentFile) *CommentFile {
+	encoded := *commentFile
+	encoded.Blobs = map[string]string{}
+	encoded.Patches = make([]Patch, len(commentFile.Patches))
+	for idx, patch := range commentFile.Patches {
+		encoded.Patches[idx] = patch
+		refs, ok := patchRefs(patch.Patch, encoded.Blobs)
+		if !ok {
+			continue
+		}
+		encoded.Patches[idx].Patch = ""
+		encoded.Patches[idx].PatchRef = refs
+	}
+	if len(encoded.Blobs) == 0 {
+		encoded.Blobs = nil
+	}
+	if len(commentFile.Cells) > 0 {
+		// Each cell section has its own blobs
+		encoded.Cells = map[string]*CommentFile{}
+		for id, cell := range commentFile.Cells {
+			encoded.Cells[id] = encodePatchBlobs(cell)
+		}
+	}
+	return &encoded
+}
+
+func patchRefs(patchText string, blobs map[string]string) ([]string, bool) {
+	if patchText == "" || !strings.HasSuffix(patchText, "\n") {
+		return nil, false
+	}
+	lines := strings.Split(strings.TrimSuffix(patchText, "\n"), "\n")
+	refs := make([]string, 0, len(lines))
+	newBlobs := map[string]string{}
+	for _, line := range lines {
+		if line == "" {
+			return nil, false
+		}
+		operation, content := line[:1], line[1:]
+		if strings.HasPrefix(line, "@@") {
+			operation, content = "@", line
+		}
+		if len(content) <= inlineLineLength && !strings.HasPrefix(content, "#") {
+			refs = append(refs, operation+content)
+			continue
+		}
+		hash := blobHash(content)
+		if existing, ok := blobs[hash]; ok && existing != content {
+			return nil, false
+		}
+		newBlobs[hash] = content
+		refs = append(refs, operation+"#"+hash)
+	}
+	for hash, content := range newBlobs {
+		blobs[hash] = content
+	}
+	return refs, true
+}
+
+// Rebuilds the patches referencing the blobs of the file
+func decodePatchBlobs(commentFile *CommentFile) error {
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		if len(patch.PatchRef) == 0 {
+			continue
+		}
+		var patchText strings.Builder
+		for _, ref := range patch.PatchRef {
+			if ref == "" {
+				return fmt.Errorf("empty reference in patch %d", idx)
+			}
+			operation, content := ref[:1], ref[1:]
+			if strings.HasPrefix(content, "#") {
+				blob, ok := commentFile.Blobs[content[1:]]
+				if !ok {
+					return fmt.Errorf("missing blob %s in patch %d", content[1:], idx)
+				}
+				content = blob
+			}
+			if operation != "@" {
+				patchText.WriteString(operation)
+			}
+			patchText.WriteString(content)
+			patchText.WriteString("\n")
+		}
+		patch.Patch = patchText.String()
+		patch.PatchRef = nil
+	}
+	commentFile.Blobs = nil
+	for id, cell := range commentFile.Cells {
+		if err := decodePatchBlobs(cell); err != nil {
+			return fmt.Errorf("cell %s: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"go.lsp.dev/jsonrpc2"
+	"go.lsp.dev/protocol"
+)
+
+// Requests running in their own goroutine, cancelled by $/cancelRequest.
+// The other requests run on the read loop: a cancellation is only read once
+// they are done.
+type inflightRequests struct {
+	mutex   sync.Mutex
+	cancels map[jsonrpc2.ID]context.CancelFunc
+}
+
+func (inflight *inflightRequests) add(id jsonrpc2.ID, cancel context.CancelFunc) {
+	inflight.mutex.Lock()
+	defer inflight.mutex.Unlock()
+	if inflight.cancels == nil {
+		inflight.cancels = map[jsonrpc2.ID]context.CancelFunc{}
+	}
+	inflight.cancels[id] = cancel
+}
+
+func (inflight *inflightRequests) remove(id jsonrpc2.ID) {
+	inflight.mutex.Lock()
+	defer inflight.mutex.Unlock()
+	delete(inflight.cancels, id)
+}
+
+func (inflight *inflightRequests) cancel(id jsonrpc2.ID) {
+	inflight.mutex.Lock()
+	cancel, ok := inflight.cancels[id]
+	inflight.mutex.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// The ID of $/cancelRequest is either a number or a string
+func parseCancelParams(data json.RawMessage) (jsonrpc2.ID, error) {
+	var params struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return jsonrpc2.ID{}, err
+	}
+	var number int32
+	if err := json.Unmarshal(params.ID, &number); err == nil {
+		return jsonrpc2.NewNumberID(number), nil
+	}
+	var name string
+	if err := json.Unmarshal(params.ID, &name); err == nil {
+		return jsonrpc2.NewStringID(name), nil
+	}
+	return jsonrpc2.ID{}, fmt.Errorf("invalid request ID %s", params.ID)
+}
+
+// Runs a long request in its own goroutine, with a context
+// cancelled by $/cancelRequest. A cancelled request replies RequestCancelled
+// instead of its result.
+func (h *handler) goCancellable(ctx context.Context, reply jsonrpc2.Replier, req jsonrpc2.Request, fn func(ctx context.Context) (interface{}, error)) error {
+	call, ok := req.(*jsonrpc2.Call)
+	if !ok {
+		result, err := fn(ctx)
+		return reply(ctx, result, err)
+	}
+	requestCtx, cancel := context.WithCancel(ctx)
+	h.inflight.add(call.ID(), cancel)
+	go func() {
+		defer cancel()
+		result, err := fn(requestCtx)
+		h.inflight.remove(call.ID())
+		if requestCtx.Err() != nil {
+			protocolLog.debugf("Cancelled %s", req.Method())
+			reply(ctx, nil, protocol.ErrRequestCancelled)
+			return
+		}
+		reply(ctx, result, err)
+	}()
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Client capabilities of LSP 3.17, not part of go.lsp.dev/protocol yet
+type clientCapabilities317 struct {
+	Capabilities struct {
+		General *struct {
+			PositionEncodings []string `json:"positionEncodings"`
+		} `json:"general"`
+		TextDocument *struct {
+			Diagnostic *struct{} `json:"diagnostic"`
+			InlayHint  *struct{} `json:"inlayHint"`
+		} `json:"textDocument"`
+		NotebookDocument *struct {
+			Synchronization *struct{} `json:"synchronization"`
+		} `json:"notebookDocument"`
+		Workspace *struct {
+			Diagnostics *struct {
+				RefreshSupport bool `json:"refreshSupport"`
+			} `json:"diagnostics"`
+		} `json:"workspace"`
+	} `json:"capabilities"`
+}
+
+// Reads what the client supports from the params of initialize, so that only
+// these features are advertised and used.
+func (h *handler) setClientCapabilities(capabilities protocol.ClientCapabilities, rawParams json.RawMessage) {
+	var capabilities317 clientCapabilities317
+	if err := json.Unmarshal(rawParams, &capabilities317); err != nil {
+		protocolLog.debugf("Client capabilities of LSP 3.17 not read: %v", err)
+	}
+	textDocument317 := capabilities317.Capabilities.TextDocument
+	workspace317 := capabilities317.Capabilities.Workspace
+	// Pulled diagnostics are only up to date if the server can ask the client
+	// to pull them again
+	h.canPullDiagnostics = textDocument317 != nil && textDocument317.Diagnostic != nil &&
+		workspace317 != nil && workspace317.Diagnostics != nil && workspace317.Diagnostics.RefreshSupport
+	h.canShowInlayHints = textDocument317 != nil && textDocument317.InlayHint != nil
+	notebook317 := capabilities317.Capabilities.NotebookDocument
+	h.canSyncNotebooks = notebook317 != nil && notebook317.Synchronization != nil
+	if general := capabilities317.Capabilities.General; general != nil {
+		setPositionEncoding(negotiatePositionEncoding(general.PositionEncodings))
+	} else {
+		setPositionEncoding(PositionEncodingUTF16)
+	}
+
+	workspace := capabilities.Workspace
+	h.canWatchFiles = workspace != nil && workspace.DidChangeWatchedFiles != nil &&
+		workspace.DidChangeWatchedFiles.DynamicRegistration
+	h.canResolveCodeActions = supportsCodeActionResolve(capabilities)
+	h.foldingRange = foldingRangeCapabilities(capabilities)
+	h.hoverFormat = hoverFormat(capabilities)
+	h.canCreateProgress = capabilities.Window != nil && capabilities.Window.WorkDoneProgress
+	textDocument := capabilities.TextDocument
+	h.canRelateDiagnostics = textDocument != nil && textDocument.PublishDiagnostics != nil &&
+		textDocument.PublishDiagnostics.RelatedInformation
+	h.canFadeDiagnostics = supportsDiagnosticTag(capabilities, protocol.DiagnosticTagUnnecessary)
+	h.canListCodeActions = textDocument != nil && textDocument.CodeAction != nil &&
+		textDocument.CodeAction.CodeActionLiteralSupport != nil
+	h.canNestSymbols = textDocument != nil && textDocument.DocumentSymbol != nil &&
+		textDocument.DocumentSymbol.HierarchicalDocumentSymbolSupport
+}
+
+// Capabilities of the server matching the ones of the client
+func (h *handler) serverCapabilities(capabilities protocol.ClientCapabilities) serverCapabilities {
+	result := serverCapabilities{
+		InlayHintProvider: h.canShowInlayHints,
+		PositionEncoding:  getPositionEncoding(),
+		ServerCapabilities: protocol.ServerCapabilities{
+			TextDocumentSync: protocol.TextDocumentSyncOptions{
+				OpenClose: true,
+				Change:    protocol.TextDocumentSyncKindIncremental,
+				// Saves may reformat the document, see followReformat
+				Save: &protocol.SaveOptions{},
+			},
+			ExecuteCommandProvider: &protocol.ExecuteCommandOptions{
+				Commands: []string{"comment.add", "comment.addFromTemplate", "comment.reply", "comment.edit", "comment.resolve", "comment.setState", "comment.delete", "comment.search", "comment.archive", "comment.repair", "comment.upgrade", "comment.setAway", "comment.moveToChangelist", "comment.setSeverity", "comment.setPriority", "comment.setLabels", "comment.addRange", "comment.addLocation", "comment.publishDrafts", "comment.startReview", "comment.submitReview", "comment.assign", "comment.setDueDate", "comment.setExpiry", "comment.toggleChecklistItem", "comment.createIssue", "comment.convertToTodo", "comment.attach", "comment.vote", "comment.applySuggestion", "comment.addReference", "comment.expand", "comment.switchProfile", "comment.reauthenticate", "comment.debug.bundle", "review.openPullRequest", "review.submit"},
+			},
+		},
+	}
+	if h.canPullDiagnostics {
+		result.DiagnosticProvider = &DiagnosticOptions{
+			InterFileDependencies: false,
+			WorkspaceDiagnostics:  true,
+		}
+	}
+	if h.foldingRange != nil {
+		result.FoldingRangeProvider = true
+	}
+	if h.canSyncNotebooks {
+		result.NotebookDocumentSync = &NotebookDocumentSyncOptions{
+			NotebookSelector: []NotebookSelector{{Notebook: NotebookDocumentFilter{Pattern: "**/*.ipynb"}}},
+			// Cell ids are read again from the saved notebook
+			Save: true,
+		}
+	}
+
+	if textDocument := capabilities.TextDocument; textDocument != nil {
+		if textDocument.CodeAction != nil {
+			result.CodeActionProvider = protocol.CodeActionOptions{
+				CodeActionKinds: codeActionKinds(getSettings()),
+				ResolveProvider: h.canResolveCodeActions,
+			}
+		}
+		if textDocument.DocumentSymbol != nil {
+			result.DocumentSymbolProvider = true
+		}
+		if textDocument.DocumentHighlight != nil {
+			result.DocumentHighlightProvider = true
+		}
+		if textDocument.Hover != nil {
+			result.HoverProvider = true
+		}
+		if textDocument.DocumentLink != nil {
+			result.DocumentLinkProvider = &protocol.DocumentLinkOptions{}
+		}
+		if textDocument.SemanticTokens != nil {
+			result.SemanticTokensProvider = semanticTokensOptions{
+				Legend: semanticTokensLegend,
+				Full:   true,
+			}
+		}
+	}
+
+	if workspace := capabilities.Workspace; workspace != nil {
+		if workspace.Symbol != nil {
+			result.WorkspaceSymbolProvider = true
+		}
+		workspaceCapabilities := &protocol.ServerCapabilitiesWorkspace{}
+		if workspace.WorkspaceFolders {
+			workspaceCapabilities.WorkspaceFolders = &protocol.ServerCapabilitiesWorkspaceFolders{
+				Supported:           true,
+				ChangeNotifications: true,
+			}
+		}
+		if fileOperations := workspace.FileOperations; fileOperations != nil {
+			operations := &protocol.ServerCapabilitiesWorkspaceFileOperations{}
+			filters := &protocol.FileOperationRegistrationOptions{Filters: fileOperationFilters}
+			if fileOperations.WillRename {
+				operations.WillRename = filters
+			}
+			if fileOperations.WillDelete {
+				operations.WillDelete = filters
+			}
+			if fileOperations.DidDelete {
+				operations.DidDelete = filters
+			}
+			workspaceCapabilities.FileOperations = operations
+		}
+		if workspaceCapabilities.WorkspaceFolders != nil || workspaceCapabilities.FileOperations != nil {
+			result.Workspace = workspaceCapabilities
+		}
+	}
+	return result
+}
+
+// Delay grouping the diagnostics changes in a single refresh request
+const diagnosticsRefreshDelay = 100 * time.Millisecond
+
+var diagnosticsRefreshPending atomic.Bool
+
+// Asks the client to pull the diagnostics again, instead of publishing them
+func (h *handler) refreshDiagnostics() {
+	if !diagnosticsRefreshPending.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		time.Sleep(diagnosticsRefreshDelay)
+		diagnosticsRefreshPending.Store(false)
+		if _, err := h.conn.Call(context.Background(), "workspace/diagnostic/refresh", nil, nil); err != nil {
+			protocolLog.errorf("Error while refreshing diagnostics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comments of a changelist, the threads an author works through together
+type ChangelistReport struct {
+	Name     string         `json:"name"` // Empty for the comments of no changelist
+	Open     int            `json:"open"`
+	Resolved int            `json:"resolved"`
+	Comments []SearchResult `json:"comments"` // Open comments only
+}
+
+// Moves a comment to the changelist name, out of any changelist when empty
+func moveToChangelist(uri protocol.DocumentURI, id string, name string) error {
+	name = strings.TrimSpace(name)
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.Changelist = name
+		return nil
+	})
+}
+
+// Counts the comments of the workspace per changelist, sorted by name
+func changelistReports(repoDir string) ([]ChangelistReport, error) {
+	reports := map[string]*ChangelistReport{}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		for idx := range commentFile.Patches {
+			patch := &commentFile.Patches[idx]
+			report, ok := reports[patch.Changelist]
+			if !ok {
+				report = &ChangelistReport{Name: patch.Changelist, Comments: []SearchResult{}}
+				reports[patch.Changelist] = report
+			}
+			if patch.isClosed() {
+				report.Resolved++
+				continue
+			}
+			report.Open++
+			report.Comments = append(report.Comments, SearchResult{
+				URI:      pathToURI(filepath.Join(repoDir, rel)),
+				Path:     filepath.ToSlash(rel),
+				Index:    idx,
+				Message:  patch.Message,
+				State:    patch.State,
+				Priority: patch.Priority,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing comment files: %v", err)
+	}
+	sorted := []ChangelistReport{}
+	for _, report := range reports {
+		// Most urgent first, for triage
+		sort.SliceStable(report.Comments, func(i, j int) bool {
+			return priorityRank(report.Comments[i].Priority) < priorityRank(report.Comments[j].Priority)
+		})
+		sorted = append(sorted, *report)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted, nil
+}
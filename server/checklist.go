@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Task list items of comment messages, "- [ ] check the error paths", are
+// review checklists: comment/list reports their completion and
+// comment.toggleChecklistItem checks them without editing the message.
+
+type ChecklistItem struct {
+	Text    string `json:"text"`
+	Checked bool   `json:"checked"`
+}
+
+type Checklist struct {
+	Items []ChecklistItem `json:"items"`
+	Done  int             `json:"done"`
+	Total int             `json:"total"`
+}
+
+// "- [x] text", the box at the 2nd group
+var checklistItemRegexp = regexp.MustCompile(`^(\s*(?:[-*+]|\d+[.)])\s+\[)([ xX])(\]\s+)(.*)$`)
+
+// Lines of the message holding checklist items, outside of code blocks
+func checklistLines(lines []string) []int {
+	items := []int{}
+	fence := ""
+	for idx, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+		if checklistItemRegexp.MatchString(line) {
+			items = append(items, idx)
+		}
+	}
+	return items
+}
+
+// Checklist of a message, nil without items
+func parseChecklist(message string) *Checklist {
+	lines := strings.Split(message, "\n")
+	items := checklistLines(lines)
+	if len(items) == 0 {
+		return nil
+	}
+	checklist := &Checklist{Items: []ChecklistItem{}, Total: len(items)}
+	for _, line := range items {
+		match := checklistItemRegexp.FindStringSubmatch(strings.TrimRight(lines[line], "\r"))
+		item := ChecklistItem{Text: strings.TrimSpace(match[4]), Checked: match[2] != " "}
+		if item.Checked {
+			checklist.Done++
+		}
+		checklist.Items = append(checklist.Items, item)
+	}
+	return checklist
+}
+
+// Message with its checklist item at index checked or not
+func setChecklistItem(message string, item int, checked bool) (string, error) {
+	lines := strings.Split(message, "\n")
+	items := checklistLines(lines)
+	if item < 0 || item >= len(items) {
+		return "", fmt.Errorf("no checklist item %d, the comment has %d", item, len(items))
+	}
+	box := " "
+	if checked {
+		box = "x"
+	}
+	line := items[item]
+	lines[line] = checklistItemRegexp.ReplaceAllString(lines[line], "${1}"+box+"${3}${4}")
+	return strings.Join(lines, "\n"), nil
+}
+
+// Checks or unchecks an item of the checklist of a comment, toggles it when
+// checked is nil. The message is not recorded as a revision.
+func toggleChecklistItem(uri protocol.DocumentURI, id string, item int, checked *bool) error {
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		checklist := parseChecklist(patch.Message)
+		if checklist == nil {
+			return fmt.Errorf("comment %s has no checklist", commentID(patch))
+		}
+		if item < 0 || item >= checklist.Total {
+			return fmt.Errorf("no checklist item %d, the comment has %d", item, checklist.Total)
+		}
+		value := !checklist.Items[item].Checked
+		if checked != nil {
+			value = *checked
+		}
+		message, err := setChecklistItem(patch.Message, item, value)
+		if err != nil {
+			return err
+		}
+		patch.Message = message
+		return nil
+	})
+}
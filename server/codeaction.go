@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Preserved between textDocument/codeAction and codeAction/resolve
+type codeActionData struct {
+	Command string               `json:"command"`
+	URI     protocol.DocumentURI `json:"uri"`
+	Range   protocol.Range       `json:"range"`
+	// Template or category of the comment to add, see templates.go and
+	// CommentCategory
+	Template string `json:"template,omitempty"`
+	Category string `json:"category,omitempty"`
+	// Private for the notes, see notes.go
+	Visibility string `json:"visibility,omitempty"`
+	// Comment the action applies to, for the actions on existing comments
+	Index *int   `json:"index,omitempty"`
+	ID    string `json:"id,omitempty"`
+	// Filled on resolve: the patch that will anchor the comment
+	Anchor string `json:"anchor,omitempty"`
+}
+
+// Actions offered on the comments overlapping the requested range
+var threadActions = []struct {
+	title   string
+	command string
+}{
+	{"Reply to comment", "comment.reply"},
+	{"Edit comment", "comment.edit"},
+	{"Resolve comment", "comment.resolve"},
+	{"Delete comment", "comment.delete"},
+}
+
+// Returns the code actions for a range: adding a comment on a selection and
+// acting on the comments it overlaps. When the client supports it, the
+// actions are returned unresolved and completed by codeAction/resolve.
+func (h *handler) codeActions(params protocol.CodeActionParams) ([]protocol.CodeAction, error) {
+	uri := params.TextDocument.URI
+	actions := []protocol.CodeAction{}
+	if params.Range.Start != params.Range.End {
+		actions = append(actions, protocol.CodeAction{
+			Title: "Add a shared comment",
+			Kind:  "quickfix",
+			Data: codeActionData{
+				Command: "comment.add",
+				URI:     uri,
+				Range:   params.Range,
+			},
+		}, protocol.CodeAction{
+			Title: "Add a private note",
+			Kind:  "quickfix",
+			Data: codeActionData{
+				Command:    "comment.add",
+				URI:        uri,
+				Range:      params.Range,
+				Visibility: VisibilityPrivate,
+			},
+		})
+		var templates []CommentTemplate
+		if repoDir := getUserRepoDir(uriToPath(uri)); repoDir != "" {
+			var err error
+			if templates, err = loadTemplates(repoDir); err != nil {
+				recordError(err)
+			}
+		}
+		for _, category := range getSettings().CommentCategories {
+			actions = append(actions, protocol.CodeAction{
+				Title: category.actionTitle(),
+				Kind:  category.kind(),
+				Data: codeActionData{
+					Command:  "comment.add",
+					URI:      uri,
+					Range:    params.Range,
+					Category: category.Name,
+				},
+			})
+		}
+		for _, template := range templates {
+			var kind protocol.CodeActionKind = "quickfix"
+			if category := getSettings().commentCategory(template.Category); category != nil {
+				kind = category.kind()
+			}
+			actions = append(actions, protocol.CodeAction{
+				Title: template.actionTitle(),
+				Kind:  kind,
+				Data: codeActionData{
+					Command:  "comment.addFromTemplate",
+					URI:      uri,
+					Range:    params.Range,
+					Template: template.Name,
+				},
+			})
+		}
+	}
+
+	comments, err := anchorComments(uri)
+	if err != nil {
+		anchorLog.debugf("No comment actions for %s: %v", uri, err)
+	}
+	openCount := 0
+	for _, comment := range comments {
+		if !comment.Patch.isClosed() {
+			openCount++
+		}
+	}
+	if h.summarized(uri, openCount) {
+		actions = append(actions, protocol.CodeAction{
+			Title: fmt.Sprintf("Show all %d comments", openCount),
+			Kind:  "quickfix",
+			Data:  codeActionData{Command: "comment.expand", URI: uri},
+		})
+	}
+	// Comments of other files are addressed in the document holding them
+	for _, comment := range append(comments, anchorCrossFileComments(uri)...) {
+		if comment.Patch.isClosed() || !rangesOverlap(comment.Range, params.Range) {
+			continue
+		}
+		index := comment.Index
+		commentURI := uri
+		if comment.SourceURI != "" {
+			commentURI = comment.SourceURI
+		}
+		if comment.Patch.Suggestion != nil && !comment.Outdated && comment.SourceURI == "" {
+			actions = append(actions, protocol.CodeAction{
+				Title:       fmt.Sprintf("Apply suggestion \"%s\"", truncateMessage(comment.Patch.Message, 40)),
+				Kind:        "quickfix",
+				IsPreferred: true,
+				Data: codeActionData{
+					Command: "comment.applySuggestion",
+					URI:     uri,
+					Range:   comment.Range,
+					Index:   &index,
+					ID:      commentID(&comment.Patch),
+				},
+			})
+		}
+		for _, threadAction := range threadActions {
+			actions = append(actions, protocol.CodeAction{
+				Title: fmt.Sprintf("%s \"%s\"", threadAction.title, truncateMessage(comment.Patch.Message, 40)),
+				Kind:  "quickfix",
+				Data: codeActionData{
+					Command: threadAction.command,
+					URI:     commentURI,
+					Range:   comment.Range,
+					Index:   &index,
+					ID:      commentID(&comment.Patch),
+				},
+			})
+		}
+	}
+
+	actions = onlyCodeActionKinds(actions, params.Context.Only)
+	if h.canResolveCodeActions {
+		return actions, nil
+	}
+	for idx := range actions {
+		resolved, err := h.resolveCodeAction(actions[idx])
+		if err != nil {
+			return nil, err
+		}
+		actions[idx] = resolved
+	}
+	return actions, nil
+}
+
+func (h *handler) resolveCodeAction(action protocol.CodeAction) (protocol.CodeAction, error) {
+	var data codeActionData
+	rawData, _ := json.Marshal(action.Data)
+	if err := json.Unmarshal(rawData, &data); err != nil || data.URI == "" {
+		return action, fmt.Errorf("invalid code action data")
+	}
+
+	if data.Command == "comment.expand" {
+		action.Command = &protocol.Command{
+			Title:     action.Title,
+			Command:   data.Command,
+			Arguments: []interface{}{data.URI, true},
+		}
+		return action, nil
+	}
+	if data.Index != nil {
+		// Actions on an existing comment only need to address it, by its
+		// identifier which survives concurrent changes of the comment file
+		action.Command = &protocol.Command{
+			Title:     action.Title,
+			Command:   data.Command,
+			Arguments: []interface{}{data.URI, data.ID},
+		}
+		return action, nil
+	}
+
+	filePath := uriToPath(data.URI)
+	content, err := readSourceFile(filePath)
+	if err != nil {
+		return action, wrapFileError(err, "error while reading file %s: %w", filePath, err)
+	}
+	data.Anchor = buildCommentPatch(filePath, string(content), data.Range)
+	logDebugf("Resolved code action %s with anchor:\n%s", data.Command, data.Anchor)
+
+	action.Data = data
+	action.Command = &protocol.Command{
+		Title:     action.Title,
+		Command:   data.Command,
+		Arguments: []interface{}{data.URI, data.Range},
+	}
+	if category := getSettings().commentCategory(data.Category); category != nil {
+		// The client fills the body in, like for the other added comments
+		options := CommentOptions{Labels: category.Labels, Severity: category.Severity}
+		action.Command.Arguments = append(action.Command.Arguments, nil, options)
+	}
+	if data.Visibility == VisibilityPrivate {
+		options := CommentOptions{Visibility: VisibilityPrivate}
+		action.Command.Arguments = append(action.Command.Arguments, nil, options)
+	}
+	if data.Template != "" {
+		// The body to pre-fill the prompt of the client with
+		template, err := findTemplate(getUserRepoDir(filePath), data.Template)
+		if err != nil {
+			return action, err
+		}
+		action.Command.Arguments = append(action.Command.Arguments, template.Name, template.Body)
+	}
+	return action, nil
+}
+
+// Kinds of the code actions, those of the comment categories configured when
+// the client connects included
+func codeActionKinds(currentSettings Settings) []protocol.CodeActionKind {
+	kinds := []protocol.CodeActionKind{"quickfix"}
+	for _, category := range currentSettings.CommentCategories {
+		if !slices.Contains(kinds, category.kind()) {
+			kinds = append(kinds, category.kind())
+		}
+	}
+	return kinds
+}
+
+// Actions of the requested kinds or their sub-kinds, all of them when none is
+// requested
+func onlyCodeActionKinds(actions []protocol.CodeAction, only []protocol.CodeActionKind) []protocol.CodeAction {
+	if len(only) == 0 {
+		return actions
+	}
+	return slices.DeleteFunc(actions, func(action protocol.CodeAction) bool {
+		return !slices.ContainsFunc(only, func(kind protocol.CodeActionKind) bool {
+			return action.Kind == kind || strings.HasPrefix(string(action.Kind), string(kind)+".")
+		})
+	})
+}
+
+// Commands of resolved code actions, for the clients that do not accept
+// code actions
+func codeActionCommands(actions []protocol.CodeAction) []protocol.Command {
+	commands := []protocol.Command{}
+	for _, action := range actions {
+		if action.Command != nil {
+			commands = append(commands, *action.Command)
+		}
+	}
+	return commands
+}
+
+func supportsCodeActionResolve(capabilities protocol.ClientCapabilities) bool {
+	if capabilities.TextDocument == nil || capabilities.TextDocument.CodeAction == nil {
+		return false
+	}
+	codeAction := capabilities.TextDocument.CodeAction
+	if !codeAction.DataSupport || codeAction.ResolveSupport == nil {
+		return false
+	}
+	for _, property := range codeAction.ResolveSupport.Properties {
+		if property == "command" {
+			return true
+		}
+	}
+	return false
+}
+
+func positionBefore(a protocol.Position, b protocol.Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
+
+// Comment ranges end at the start of the line after the comment, a cursor
+// there is not in the comment.
+func rangesOverlap(comment protocol.Range, requested protocol.Range) bool {
+	if requested.Start == requested.End {
+		return !positionBefore(requested.Start, comment.Start) && positionBefore(requested.Start, comment.End)
+	}
+	return positionBefore(requested.Start, comment.End) && positionBefore(comment.Start, requested.End)
+}
+
+func truncateMessage(message string, length int) string {
+	message = strings.Join(strings.Fields(plainMarkdown(message)), " ")
+	runes := []rune(message)
+	if len(runes) <= length {
+		return message
+	}
+	return string(runes[:length-1]) + "…"
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comment as exposed to client extensions by comment/list and comment/get.
+// Comments are identified by their document and ID, or index in its comment
+// file for older clients.
+type CommentInfo struct {
+	URI        protocol.DocumentURI `json:"uri"`
+	Path       string               `json:"path,omitempty"` // Relative to the repository
+	Index      int                  `json:"index"`
+	ID         string               `json:"id"`
+	Message    string               `json:"message"`
+	Author     string               `json:"author,omitempty"`
+	Assignee   string               `json:"assignee,omitempty"`
+	Mentions   []string             `json:"mentions,omitempty"` // Users mentioned with @user
+	Labels     []string             `json:"labels,omitempty"`
+	State      string               `json:"state"`
+	Severity   string               `json:"severity,omitempty"`
+	Priority   string               `json:"priority,omitempty"`
+	DueDate    string               `json:"dueDate,omitempty"`
+	ExpiresAt  string               `json:"expiresAt,omitempty"`
+	CreatedAt  string               `json:"createdAt,omitempty"`
+	UpdatedAt  string               `json:"updatedAt,omitempty"`
+	Replies    []Reply              `json:"replies,omitempty"`
+	Changelist string               `json:"changelist,omitempty"`
+	References []ThreadReference    `json:"references,omitempty"`
+	// Missing when the comment cannot be anchored in the current content
+	Range *protocol.Range `json:"range,omitempty"`
+	// Other ranges of the comment found in the current content
+	SecondaryRanges []protocol.Range `json:"secondaryRanges,omitempty"`
+	Votes           VoteCounts       `json:"votes"`
+	// Other files of the repository the comment is about
+	OtherFiles []string `json:"otherFiles,omitempty"`
+	// Comment on the file as a whole, without range
+	FileLevel bool `json:"fileLevel,omitempty"`
+	// Not published yet by its author
+	Draft       bool         `json:"draft,omitempty"`
+	Visibility  string       `json:"visibility,omitempty"` // private for notes
+	Attachments []Attachment `json:"attachments,omitempty"`
+	IssueURL    string       `json:"issueUrl,omitempty"`
+	// Task list items of the message and their completion
+	Checklist *Checklist `json:"checklist,omitempty"`
+	// Replacement of the commented lines proposed by a suggestion comment
+	Suggestion *string `json:"suggestion,omitempty"`
+	// The commented code changed since the comment
+	Outdated bool `json:"outdated,omitempty"`
+}
+
+// Without uri, lists the comments of the whole workspace
+type ListCommentsParams struct {
+	URI protocol.DocumentURI `json:"uri,omitempty"`
+	// Only lists the comments of this changelist when set
+	Changelist string `json:"changelist,omitempty"`
+	// Only lists the comments created at least or at most this many days ago,
+	// when set. Comments without creation time are left out.
+	MinAgeDays float64 `json:"minAgeDays,omitempty"`
+	MaxAgeDays float64 `json:"maxAgeDays,omitempty"`
+	// Only lists the comments with at least one of these labels, when set
+	Labels []string `json:"labels,omitempty"`
+	// Only lists the comments of this review, when set
+	Review string `json:"review,omitempty"`
+	// Additional filter of the server itself
+	matches func(comment CommentInfo) bool
+	// Order of the comments, each streamed chunk is sorted on its own:
+	// newest, oldest, updated (recently updated first), priority (P0 first,
+	// then newest) or votes (best score first, then newest). In document
+	// order when empty.
+	Sort string `json:"sort,omitempty"`
+	// Streams the comments of each document with $/progress
+	PartialResultToken *protocol.ProgressToken `json:"partialResultToken,omitempty"`
+}
+
+// Orders of comment/list
+const (
+	SortNewest   = "newest"
+	SortOldest   = "oldest"
+	SortUpdated  = "updated"
+	SortPriority = "priority"
+	SortVotes    = "votes"
+)
+
+func (params ListCommentsParams) validate() error {
+	switch params.Sort {
+	case "", SortNewest, SortOldest, SortUpdated, SortPriority, SortVotes:
+	default:
+		return fmt.Errorf("unknown sort %q", params.Sort)
+	}
+	if params.MinAgeDays < 0 || params.MaxAgeDays < 0 {
+		return fmt.Errorf("ages must be positive")
+	}
+	return nil
+}
+
+// Whether a comment is within the ages of params
+func (params ListCommentsParams) matchesAge(comment CommentInfo, now time.Time) bool {
+	if params.MinAgeDays == 0 && params.MaxAgeDays == 0 {
+		return true
+	}
+	createdAt, err := time.Parse(time.RFC3339, comment.CreatedAt)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(createdAt).Hours() / 24
+	return age >= params.MinAgeDays && (params.MaxAgeDays == 0 || age <= params.MaxAgeDays)
+}
+
+// Whether a comment has one of the labels of params
+func (params ListCommentsParams) matchesLabels(comment CommentInfo) bool {
+	if len(params.Labels) == 0 {
+		return true
+	}
+	for _, label := range params.Labels {
+		if slices.ContainsFunc(comment.Labels, func(commentLabel string) bool { return strings.EqualFold(commentLabel, label) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts comments in the order of params, comments without time last
+func (params ListCommentsParams) sort(comments []CommentInfo) {
+	if params.Sort == "" {
+		return
+	}
+	timestamp := func(comment CommentInfo) string {
+		if params.Sort == SortUpdated && comment.UpdatedAt != "" {
+			return comment.UpdatedAt
+		}
+		return comment.CreatedAt
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		if params.Sort == SortPriority {
+			first, second := priorityRank(comments[i].Priority), priorityRank(comments[j].Priority)
+			if first != second {
+				return first < second
+			}
+		}
+		if params.Sort == SortVotes {
+			first, second := comments[i].Votes.score(), comments[j].Votes.score()
+			if first != second {
+				return first > second
+			}
+		}
+		first, second := timestamp(comments[i]), timestamp(comments[j])
+		if first == "" || second == "" {
+			return second == "" && first != ""
+		}
+		if params.Sort == SortOldest {
+			return first < second
+		}
+		return first > second
+	})
+}
+
+type GetCommentParams struct {
+	URI   protocol.DocumentURI `json:"uri"`
+	Index int                  `json:"index"`
+	// Identifier of the comment, preferred to its index when set
+	ID string `json:"id,omitempty"`
+}
+
+func newCommentInfo(uri protocol.DocumentURI, rel string, index int, patch Patch) CommentInfo {
+	state := patch.State
+	if state == "" {
+		state = StateOpen
+	}
+	return CommentInfo{
+		URI:         uri,
+		Path:        filepath.ToSlash(rel),
+		Index:       index,
+		ID:          commentID(&patch),
+		FileLevel:   patch.isFileLevel(),
+		Draft:       patch.Draft,
+		Visibility:  patch.Visibility,
+		Message:     patch.Message,
+		Author:      patch.author(),
+		Assignee:    patch.Assignee,
+		Mentions:    parseMentions(patch.Message),
+		Labels:      patch.Labels,
+		State:       state,
+		Severity:    patch.Severity,
+		Priority:    patch.Priority,
+		DueDate:     patch.DueDate,
+		ExpiresAt:   patch.ExpiresAt,
+		CreatedAt:   patch.CreatedAt,
+		UpdatedAt:   patch.UpdatedAt,
+		Replies:     patch.Replies,
+		Changelist:  patch.Changelist,
+		References:  patch.References,
+		Attachments: patch.Attachments,
+		IssueURL:    patch.IssueURL,
+		Checklist:   parseChecklist(patch.Message),
+		Suggestion:  patch.Suggestion,
+		OtherFiles:  patch.otherFiles(),
+		Votes:       patch.voteCounts(),
+	}
+}
+
+// Comments of a document, with their range when they can be anchored
+func documentComments(uri protocol.DocumentURI) ([]CommentInfo, error) {
+	filePath := uriToPath(uri)
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	rel := ""
+	if repoDir := getUserRepoDir(filePath); repoDir != "" {
+		rel, _ = filepath.Rel(repoDir, filePath)
+	}
+	anchors := map[int]anchoredComment{}
+	if anchored, err := anchorComments(uri); err == nil {
+		for _, comment := range anchored {
+			anchors[comment.Index] = comment
+		}
+	}
+	comments := []CommentInfo{}
+	for idx, patch := range commentFile.Patches {
+		comment := newCommentInfo(uri, rel, idx, patch)
+		if anchor, ok := anchors[idx]; ok && !anchor.FileLevel {
+			comment.Range = &anchor.Range
+			comment.SecondaryRanges = anchor.SecondaryRanges
+			comment.Outdated = anchor.Outdated
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+// Comments of params.URI, or of the whole workspace when empty
+func (h *handler) listComments(ctx context.Context, params ListCommentsParams) ([]CommentInfo, error) {
+	now := time.Now()
+	var reviewed []string
+	if params.Review != "" {
+		var err error
+		if reviewed, err = reviewComments(getRepoDirFromDir(h.rootPath), params.Review); err != nil {
+			return nil, err
+		}
+	}
+	selected := func(comments []CommentInfo) []CommentInfo {
+		filtered := []CommentInfo{}
+		for _, comment := range comments {
+			if params.Review != "" && !slices.Contains(reviewed, comment.ID) {
+				continue
+			}
+			if params.matches != nil && !params.matches(comment) {
+				continue
+			}
+			if (params.Changelist == "" || comment.Changelist == params.Changelist) && params.matchesAge(comment, now) && params.matchesLabels(comment) {
+				filtered = append(filtered, comment)
+			}
+		}
+		params.sort(filtered)
+		return filtered
+	}
+	if params.URI != "" {
+		comments, err := documentComments(params.URI)
+		if err != nil {
+			return nil, err
+		}
+		return selected(comments), nil
+	}
+	comments := []CommentInfo{}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return comments, nil
+	}
+	partial := h.partialResults(params.PartialResultToken)
+	rels, err := indexedCommentFiles(commentsDirOf(repoDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		documentList, err := documentComments(pathToURI(filepath.Join(repoDir, rel)))
+		if err != nil {
+			recordError(err)
+			continue
+		}
+		documentList = selected(documentList)
+		if len(documentList) > 0 && !partial.send(ctx, documentList) {
+			comments = append(comments, documentList...)
+		}
+	}
+	params.sort(comments)
+	return comments, nil
+}
+
+func getComment(params GetCommentParams) (*CommentInfo, error) {
+	comments, err := documentComments(params.URI)
+	if err != nil {
+		return nil, err
+	}
+	if params.ID != "" {
+		for idx := range comments {
+			if comments[idx].ID == params.ID {
+				return &comments[idx], nil
+			}
+		}
+		return nil, fmt.Errorf("no comment %s in %s", params.ID, params.URI)
+	}
+	if params.Index < 0 || params.Index >= len(comments) {
+		return nil, fmt.Errorf("no comment %d in %s", params.Index, params.URI)
+	}
+	return &comments[params.Index], nil
+}
+
+type AssignedToMeParams struct {
+	// Also lists the comments mentioning the user
+	IncludeMentions bool `json:"includeMentions,omitempty"`
+	// Streams the comments of each document with $/progress
+	PartialResultToken *protocol.ProgressToken `json:"partialResultToken,omitempty"`
+}
+
+// Open comments of the workspace assigned to the local user, or mentioning
+// them
+func (h *handler) listAssignedToMe(ctx context.Context, params AssignedToMeParams) ([]CommentInfo, error) {
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return []CommentInfo{}, nil
+	}
+	user := currentUser(repoDir)
+	return h.listComments(ctx, ListCommentsParams{
+		PartialResultToken: params.PartialResultToken,
+		matches: func(comment CommentInfo) bool {
+			if comment.State != StateOpen {
+				return false
+			}
+			return sameUser(comment.Assignee, user) ||
+				params.IncludeMentions && slices.ContainsFunc(comment.Mentions, func(mention string) bool { return sameUser(mention, user) })
+		},
+	})
+}
+
+type FileCommentsParams struct {
+	URI protocol.DocumentURI `json:"uri"`
+}
+
+// Comments on the document of params as a whole
+func fileComments(params FileCommentsParams) ([]CommentInfo, error) {
+	comments, err := documentComments(params.URI)
+	if err != nil {
+		return nil, err
+	}
+	fileLevel := []CommentInfo{}
+	for _, comment := range comments {
+		if comment.FileLevel {
+			fileLevel = append(fileLevel, comment)
+		}
+	}
+	return fileLevel, nil
+}
+
+// Sources of a comment/didChange notification
+const (
+	ChangeLocal  = "local"  // Command of this server
+	ChangeRemote = "remote" // Pull of the comments repository or change on disk
+)
+
+// Params of the comment/didChange notification, sent whenever comments
+// change so that client views can refresh only what changed.
+type CommentsDidChangeParams struct {
+	Reason string `json:"reason"` // local or remote
+	// Empty when any comment of the workspace may have changed
+	Changes []CommentChange `json:"changes"`
+}
+
+type CommentChange struct {
+	URI protocol.DocumentURI `json:"uri"`
+	// IDs of the changed comments, empty when any comment of the document
+	// may have changed
+	IDs []string `json:"ids,omitempty"`
+}
+
+func (h *handler) notifyCommentsChanged(ctx context.Context, reason string, changes ...CommentChange) {
+	if changes == nil {
+		changes = []CommentChange{}
+	}
+	protocolLog.debugf("Comments changed (%s): %d documents", reason, len(changes))
+	h.conn.Notify(ctx, "comment/didChange", CommentsDidChangeParams{Reason: reason, Changes: changes})
+}
+
+// Notifies the comments changed by a pull of the comments repository from
+// commit since
+func (h *handler) notifyPulledChanges(repoDir string, commentsDir string, since string) {
+	output, err := gitOutput("-C", commentsDir, "diff", "--name-only", since, "HEAD")
+	if err != nil {
+		gitLog.errorf("Error while listing pulled comment files: %v", err)
+		h.notifyCommentsChanged(context.Background(), ChangeRemote)
+		return
+	}
+	changes := []CommentChange{}
+	for _, name := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		name = commentFileKey(name)
+		if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, metaDirName+"/") {
+			continue
+		}
+		sourcePath := filepath.Join(repoDir, filepath.FromSlash(strings.TrimSuffix(name, ".json")))
+		changes = append(changes, CommentChange{URI: pathToURI(sourcePath)})
+	}
+	if len(changes) > 0 {
+		h.notifyCommentsChanged(context.Background(), ChangeRemote, changes...)
+	}
+}
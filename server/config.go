@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.lsp.dev/protocol"
+)
+
+// Section of the client configuration holding the server settings
+const configurationSection = "commentExtension"
+
+// Server settings, sent by the client in the initializationOptions of the
+// initialize request and updated with workspace/didChangeConfiguration.
+type Settings struct {
+	ContextBefore int    `json:"contextBefore"` // Context before patch
+	ContextAfter  int    `json:"contextAfter"`  // Context after patch
+	CommentFolder string `json:"commentFolder"` // See resolveCommentFolder
+	StorageFormat string `json:"storageFormat"` // Of the comment files, json or yaml
+	Severity      string `json:"severity"`      // hint, information, warning or error
+	// Language of the user, used to tag new comments and translate others
+	Language            string `json:"language"`
+	TranslationEndpoint string `json:"translationEndpoint"`
+	// Shared repository cloned in the comment folder, none by default
+	CommentsRepoURL string `json:"commentsRepoUrl"`
+	// Read-only copy of the comments repository, used when it is unreachable
+	CommentsMirrorURL string `json:"commentsMirrorUrl"`
+	// Comment server keeping the comments instead, the comment folder holds
+	// a replica, see remotestore.go. Read at startup.
+	CommentsServerURL string `json:"commentsServerUrl"`
+	LogLevel          string `json:"logLevel"` // debug, info, error or off
+	// Delays to acknowledge comments, per label
+	SLAs []SLARule `json:"slas"`
+	// Issue references of messages linked to trackers
+	IssueLinks []IssueLinkRule `json:"issueLinks"`
+	// Receives notifications (SLA breaches...) as JSON POST requests
+	WebhookURL string `json:"webhookUrl"`
+	// Tracker of the issues created from comments, see issues.go
+	IssueTracker *IssueTrackerConfig `json:"issueTracker"`
+	// Resolved comments older than this are archived, never when 0
+	ArchiveAfterDays int `json:"archiveAfterDays"`
+	// Diagnostic ranges are cut at this column so that editors drawing
+	// squiggles on very long lines stay readable, never when 0
+	MaxDiagnosticColumn int `json:"maxDiagnosticColumn"`
+	// Generated files and their generator input, receiving their comments
+	GeneratedFiles []GeneratedFileRule `json:"generatedFiles"`
+	// Page of a thread, opened from the code of its diagnostic
+	PermalinkURL string `json:"permalinkUrl"`
+	// Documents with more comments show a single summary diagnostic, never
+	// when 0
+	SummaryThreshold int `json:"summaryThreshold"`
+	// Strategies anchoring comments, tried in order: exact, fuzzy, blame,
+	// symbol and line. Defaults to exact, fuzzy then line.
+	AnchoringStrategies []string `json:"anchoringStrategies"`
+	// Anchoring tuned per language: python, go, c, cpp...
+	LanguageAnchoring map[string]LanguageAnchoring `json:"languageAnchoring"`
+	// Deleting, archiving, repairing comments and overwriting the mirror ask
+	// for confirmation first
+	ConfirmDestructiveOperations bool `json:"confirmDestructiveOperations"`
+	// Recorded as author of new comments instead of user.name and user.email
+	// of the git configuration
+	AuthorName  string `json:"authorName"`
+	AuthorEmail string `json:"authorEmail"`
+	// How diagnostics show the comments of each state: show, fade or hide.
+	// Faded comments are hidden by clients that cannot fade diagnostics.
+	StateDisplay map[string]string `json:"stateDisplay"`
+	// Only comments with one of these labels are published as diagnostics,
+	// all of them when empty. Comments with a hidden label never are.
+	DiagnosticLabels []string `json:"diagnosticLabels"`
+	HiddenLabels     []string `json:"hiddenLabels"`
+	// Identities available to the user and the one used by default
+	Profiles []IdentityProfile `json:"profiles"`
+	Profile  string            `json:"profile"`
+	// Kinds of comments offered by their own "add comment" code action
+	CommentCategories []CommentCategory `json:"commentCategories"`
+	// Comments resolved or deleted by the expiry sweep, see expiry.go
+	ExpiryRules []ExpiryRule `json:"expiryRules"`
+	// The comment folder is added to .git/info/exclude, to keep it out of
+	// git status without a .gitignore entry
+	ExcludeCommentFolder bool `json:"excludeCommentFolder"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		ContextBefore:                5,
+		ContextAfter:                 5,
+		CommentFolder:                "comments",
+		StorageFormat:                FormatJSON,
+		Severity:                     "hint",
+		LogLevel:                     "info",
+		ConfirmDestructiveOperations: true,
+		StateDisplay: map[string]string{
+			StateOpen:     DisplayShow,
+			StateResolved: DisplayFade,
+			StateWontFix:  DisplayHide,
+		},
+	}
+}
+
+var settingsMutex sync.RWMutex
+var settings = defaultSettings()
+
+func getSettings() Settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return settings
+}
+
+func setSettings(newSettings Settings) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	settings = newSettings
+	if logLevel, err := parseLogLevel(newSettings.LogLevel); err == nil {
+		setLogLevel(logLevel)
+	}
+}
+
+// Parses the settings sent by the client, either directly or nested in the
+// configuration section. Missing fields keep their current value.
+func parseSettings(current Settings, raw interface{}) (Settings, error) {
+	if raw == nil {
+		return current, nil
+	}
+	if rawMap, ok := raw.(map[string]interface{}); ok {
+		if section, ok := rawMap[configurationSection]; ok {
+			raw = section
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return current, err
+	}
+	newSettings := current
+	// Unmarshal merges into maps, keep the current one intact on errors
+	newSettings.LanguageAnchoring = maps.Clone(current.LanguageAnchoring)
+	newSettings.StateDisplay = maps.Clone(current.StateDisplay)
+	if err := json.Unmarshal(data, &newSettings); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if newSettings.ContextBefore < 0 || newSettings.ContextAfter < 0 {
+		return current, fmt.Errorf("invalid settings: context lines must be positive")
+	}
+	if newSettings.SummaryThreshold < 0 {
+		return current, fmt.Errorf("invalid settings: summary threshold must be positive")
+	}
+	if newSettings.MaxDiagnosticColumn < 0 {
+		return current, fmt.Errorf("invalid settings: maximum diagnostic column must be positive")
+	}
+	if _, ok := severities[strings.ToLower(newSettings.Severity)]; !ok {
+		return current, fmt.Errorf("invalid settings: unknown severity %q", newSettings.Severity)
+	}
+	if _, err := parseLogLevel(newSettings.LogLevel); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateIssueLinks(newSettings.IssueLinks); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateIssueTracker(newSettings.IssueTracker); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateGeneratedFiles(newSettings.GeneratedFiles); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateAnchoringStrategies(newSettings.AnchoringStrategies); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateLanguageAnchoring(newSettings.LanguageAnchoring); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateStateDisplay(newSettings.StateDisplay); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateCommentCategories(newSettings.CommentCategories); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateExpiryRules(newSettings.ExpiryRules); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if err := validateStorageFormat(newSettings.StorageFormat); err != nil {
+		return current, fmt.Errorf("invalid settings: %v", err)
+	}
+	if newSettings.CommentsServerURL != "" && !isHTTPRemote(newSettings.CommentsServerURL) {
+		return current, fmt.Errorf("invalid settings: the comment server URL must be http or https")
+	}
+	newSettings.AuthorName = strings.TrimSpace(newSettings.AuthorName)
+	newSettings.AuthorEmail = strings.TrimSpace(newSettings.AuthorEmail)
+	if strings.ContainsAny(newSettings.AuthorEmail, " <>") {
+		return current, fmt.Errorf("invalid settings: author email %q", newSettings.AuthorEmail)
+	}
+	newSettings.CommentFolder = filepath.Clean(newSettings.CommentFolder)
+	return newSettings, nil
+}
+
+var severities = map[string]protocol.DiagnosticSeverity{
+	"hint":        protocol.DiagnosticSeverityHint,
+	"information": protocol.DiagnosticSeverityInformation,
+	"warning":     protocol.DiagnosticSeverityWarning,
+	"error":       protocol.DiagnosticSeverityError,
+}
+
+// Severities the author of a comment can choose, by increasing importance
+var commentSeverities = map[string]protocol.DiagnosticSeverity{
+	"nit":        protocol.DiagnosticSeverityHint,
+	"suggestion": protocol.DiagnosticSeverityInformation,
+	"issue":      protocol.DiagnosticSeverityWarning,
+	"blocker":    protocol.DiagnosticSeverityError,
+}
+
+func validateCommentSeverity(severity string) error {
+	if _, ok := commentSeverities[severity]; severity != "" && !ok {
+		return fmt.Errorf("unknown comment severity %q, expected nit, suggestion, issue or blocker", severity)
+	}
+	return nil
+}
+
+// Priorities of comments for triage, P0 first. Unlike the severity, anyone
+// can prioritize a comment.
+var commentPriorities = []string{"P0", "P1", "P2", "P3"}
+
+func validateCommentPriority(priority string) error {
+	if priority != "" && !slices.Contains(commentPriorities, priority) {
+		return fmt.Errorf("unknown comment priority %q, expected P0, P1, P2 or P3", priority)
+	}
+	return nil
+}
+
+// Rank of a priority, comments without priority after the others
+func priorityRank(priority string) int {
+	if rank := slices.Index(commentPriorities, priority); rank >= 0 {
+		return rank
+	}
+	return len(commentPriorities)
+}
+
+// Severity of the diagnostic of a comment: the one chosen by its author, else
+// the one of the settings
+func (s Settings) commentSeverity(patch *Patch) protocol.DiagnosticSeverity {
+	if severity, ok := commentSeverities[patch.Severity]; ok {
+		return severity
+	}
+	return s.diagnosticSeverity()
+}
+
+func (s Settings) diagnosticSeverity() protocol.DiagnosticSeverity {
+	if severity, ok := severities[strings.ToLower(s.Severity)]; ok {
+		return severity
+	}
+	return protocol.DiagnosticSeverityHint
+}
+
+// Cuts rng at the maximum diagnostic column. The true range of the comment
+// is still returned by comment/list and comment/get.
+func (s Settings) presentedRange(rng protocol.Range) protocol.Range {
+	if s.MaxDiagnosticColumn <= 0 {
+		return rng
+	}
+	limit := uint32(s.MaxDiagnosticColumn)
+	if rng.Start.Character > limit {
+		rng.Start.Character = limit
+	}
+	if rng.End.Character > limit {
+		rng.End.Character = limit
+	}
+	return rng
+}
+
+// Displays of the comments of a state in diagnostics
+const (
+	DisplayShow = "show"
+	DisplayFade = "fade"
+	DisplayHide = "hide"
+)
+
+func validateStateDisplay(stateDisplay map[string]string) error {
+	for state, display := range stateDisplay {
+		if _, ok := stateTransitions[state]; !ok {
+			return fmt.Errorf("unknown comment state %q", state)
+		}
+		if display != DisplayShow && display != DisplayFade && display != DisplayHide {
+			return fmt.Errorf("display of %s comments must be show, fade or hide, not %q", state, display)
+		}
+	}
+	return nil
+}
+
+// Category of comments, e.g. security, added with a code action of its own
+// kind so that clients can group and filter the actions
+type CommentCategory struct {
+	Name string `json:"name"`
+	// Code action kind, quickfix.comment.<name> when empty
+	Kind string `json:"kind,omitempty"`
+	// Title of the code action, "Add <name> comment" when empty
+	Title string `json:"title,omitempty"`
+	// Given to the comments of the category
+	Labels   []string `json:"labels,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+}
+
+func validateCommentCategories(categories []CommentCategory) error {
+	names := map[string]bool{}
+	for _, category := range categories {
+		if strings.TrimSpace(category.Name) == "" {
+			return fmt.Errorf("comment category without name")
+		}
+		if names[category.Name] {
+			return fmt.Errorf("duplicate comment category %q", category.Name)
+		}
+		names[category.Name] = true
+		if slices.Contains(strings.Split(string(category.kind()), "."), "") {
+			return fmt.Errorf("invalid code action kind %q of comment category %s", category.Kind, category.Name)
+		}
+		if err := validateCommentSeverity(category.Severity); err != nil {
+			return fmt.Errorf("comment category %s: %v", category.Name, err)
+		}
+	}
+	return nil
+}
+
+func (category CommentCategory) kind() protocol.CodeActionKind {
+	if category.Kind != "" {
+		return protocol.CodeActionKind(category.Kind)
+	}
+	return protocol.CodeActionKind("quickfix.comment." + category.Name)
+}
+
+func (category CommentCategory) actionTitle() string {
+	if category.Title != "" {
+		return category.Title
+	}
+	return "Add " + category.Name + " comment"
+}
+
+// The category named name, nil when it is not configured
+func (s Settings) commentCategory(name string) *CommentCategory {
+	for idx := range s.CommentCategories {
+		if s.CommentCategories[idx].Name == name {
+			return &s.CommentCategories[idx]
+		}
+	}
+	return nil
+}
+
+// How diagnostics show the comments of state, shown when not configured
+func (s Settings) stateDisplay(state string) string {
+	if display, ok := s.StateDisplay[state]; ok {
+		return display
+	}
+	return DisplayShow
+}
+
+// Whether the labels of a comment let it be published as a diagnostic
+func (s Settings) publishesLabels(patch *Patch) bool {
+	if slices.ContainsFunc(s.HiddenLabels, patch.hasLabel) {
+		return false
+	}
+	return len(s.DiagnosticLabels) == 0 || slices.ContainsFunc(s.DiagnosticLabels, patch.hasLabel)
+}
+
+// Comments folder of the given repository
+func commentsDirOf(repoDir string) string {
+	return resolveCommentFolder(repoDir, getSettings().CommentFolder)
+}
+
+// Placeholders of the comment folder, to keep comments out of the source tree
+const (
+	repoNamePlaceholder    = "${repoName}"
+	xdgDataHomePlaceholder = "${xdgDataHome}"
+	gitDirPlaceholder      = "${gitDir}"
+)
+
+// The comment folder is relative to the repository unless it is absolute or
+// starts with ~/ or ~\, e.g. ../${repoName}-comments for a sibling repository,
+// ${xdgDataHome}/separate_comments/${repoName} or ${gitDir}/lsp-comments.
+func resolveCommentFolder(repoDir string, folder string) string {
+	if strings.Contains(folder, gitDirPlaceholder) {
+		folder = strings.ReplaceAll(folder, gitDirPlaceholder, gitDirOf(repoDir))
+	}
+	folder = strings.ReplaceAll(folder, repoNamePlaceholder, filepath.Base(repoDir))
+	if strings.Contains(folder, xdgDataHomePlaceholder) {
+		folder = strings.ReplaceAll(folder, xdgDataHomePlaceholder, xdgDataHome())
+	}
+	if folder == "~" || strings.HasPrefix(folder, "~/") || strings.HasPrefix(folder, `~\`) {
+		if home, err := os.UserHomeDir(); err == nil {
+			// Written on Windows or not, the project file is shared
+			folder = filepath.Join(home, filepath.FromSlash(strings.ReplaceAll(folder[1:], `\`, "/")))
+		}
+	}
+	if filepath.IsAbs(folder) {
+		return filepath.Clean(folder)
+	}
+	return filepath.Join(repoDir, folder)
+}
+
+// Base folder of the user data files, see the XDG base directory specification
+func xdgDataHome() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logErrorf("Error while locating the user data folder: %v", err)
+		return filepath.Join(os.TempDir(), "xdg-data")
+	}
+	return filepath.Join(home, ".local", "share")
+}
+
+// Git folder of the repository, shared by its worktrees. Read from the files
+// rather than asked to git: comment folders are resolved for every file.
+func gitDirOf(repoDir string) string {
+	gitDir := filepath.Join(repoDir, ".git")
+	// Worktrees and submodules have a .git file pointing to their folder
+	data, err := os.ReadFile(gitDir)
+	if err != nil {
+		return gitDir
+	}
+	target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir:")
+	if !ok {
+		return gitDir
+	}
+	gitDir = strings.TrimSpace(target)
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoDir, gitDir)
+	}
+	if commonDir, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(commonDir))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		gitDir = common
+	}
+	return filepath.Clean(gitDir)
+}
+
+// Path of a comments folder relative to the repository, false when it is
+// outside of it
+func commentsDirInRepo(repoDir string, commentsDir string) (string, bool) {
+	rel, err := filepath.Rel(repoDir, commentsDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// Whether a comment folder is in the repository or its git folder, see
+// resolveCommentFolder
+func commentFolderInRepo(repoDir string, folder string) bool {
+	commentsDir := resolveCommentFolder(repoDir, folder)
+	if _, ok := commentsDirInRepo(repoDir, commentsDir); ok {
+		return true
+	}
+	_, ok := commentsDirInRepo(gitDirOf(repoDir), commentsDir)
+	return ok
+}
+
+// Settings shared by the team in the project configuration file, written by
+// init. They take precedence over the client settings so that every member
+// stores comments at the same place.
+type ProjectSettings struct {
+	CommentFolder     string `json:"commentFolder,omitempty"`
+	StorageFormat     string `json:"storageFormat,omitempty"`
+	CommentsRepoURL   string `json:"commentsRepoUrl,omitempty"`
+	CommentsMirrorURL string `json:"commentsMirrorUrl,omitempty"`
+	CommentsServerURL string `json:"commentsServerUrl,omitempty"`
+	// The accuracy and latency of anchoring depend on the codebase
+	AnchoringStrategies []string `json:"anchoringStrategies,omitempty"`
+}
+
+// Applies the project configuration file of the repository, if any
+func loadProjectSettings(repoDir string, current Settings) (Settings, error) {
+	data, err := os.ReadFile(filepath.Join(repoDir, projectConfigName))
+	if os.IsNotExist(err) {
+		return current, nil
+	} else if err != nil {
+		return current, wrapFileError(err, "error while reading %s: %w", projectConfigName, err)
+	}
+	var project ProjectSettings
+	if err := json.Unmarshal(data, &project); err != nil {
+		return current, newCommentError(ErrStoreCorrupt, "invalid %s: %w", projectConfigName, err)
+	}
+	if project.CommentFolder != "" {
+		folder := filepath.Clean(project.CommentFolder)
+		if isWorkspaceTrusted() || commentFolderInRepo(repoDir, folder) {
+			current.CommentFolder = folder
+		} else {
+			// The file comes with the workspace, comments are written
+			// wherever it says once the user trusts it
+			logInfof("Ignore the comment folder %s of %s outside of the repository until the workspace is trusted", folder, projectConfigName)
+		}
+	}
+	if project.StorageFormat != "" {
+		if err := validateStorageFormat(project.StorageFormat); err != nil {
+			return current, newCommentError(ErrStoreCorrupt, "invalid %s: %w", projectConfigName, err)
+		}
+		current.StorageFormat = project.StorageFormat
+	}
+	if project.CommentsRepoURL != "" {
+		current.CommentsRepoURL = project.CommentsRepoURL
+	}
+	if project.CommentsMirrorURL != "" {
+		current.CommentsMirrorURL = project.CommentsMirrorURL
+	}
+	if project.CommentsServerURL != "" {
+		if !isHTTPRemote(project.CommentsServerURL) {
+			return current, newCommentError(ErrStoreCorrupt, "invalid %s: the comment server URL must be http or https", projectConfigName)
+		}
+		current.CommentsServerURL = project.CommentsServerURL
+	}
+	if len(project.AnchoringStrategies) > 0 {
+		if err := validateAnchoringStrategies(project.AnchoringStrategies); err != nil {
+			return current, newCommentError(ErrStoreCorrupt, "invalid %s: %w", projectConfigName, err)
+		}
+		current.AnchoringStrategies = project.AnchoringStrategies
+	}
+	return current, nil
+}
+
+func saveProjectSettings(repoDir string, current Settings) error {
+	project := ProjectSettings{
+		CommentFolder:       filepath.ToSlash(current.CommentFolder),
+		StorageFormat:       current.StorageFormat,
+		CommentsRepoURL:     current.CommentsRepoURL,
+		CommentsMirrorURL:   current.CommentsMirrorURL,
+		CommentsServerURL:   current.CommentsServerURL,
+		AnchoringStrategies: current.AnchoringStrategies,
+	}
+	data, err := json.MarshalIndent(project, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, projectConfigName), append(data, '\n'), 0644); err != nil {
+		return wrapFileError(err, "error while writing %s: %w", projectConfigName, err)
+	}
+	return nil
+}
+
+// Applies the project configuration of the workspace over the given settings
+func (h *handler) withProjectSettings(current Settings) Settings {
+	if h.rootPath == "" {
+		return current
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		repoDir = h.rootPath
+	}
+	newSettings, err := loadProjectSettings(repoDir, current)
+	if err != nil {
+		recordError(err)
+		return current
+	}
+	return newSettings
+}
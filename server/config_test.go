@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCommentFolder(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, "data"))
+	repoDir := filepath.Join(t.TempDir(), "project")
+	tests := []struct {
+		name   string
+		folder string
+		want   string
+	}{
+		{name: "relative", folder: "comments", want: filepath.Join(repoDir, "comments")},
+		{name: "sibling", folder: "../${repoName}-comments", want: filepath.Join(filepath.Dir(repoDir), "project-comments")},
+		{name: "absolute", folder: filepath.Join(home, "comments"), want: filepath.Join(home, "comments")},
+		{name: "home", folder: "~", want: home},
+		{name: "home slash", folder: "~/comments/${repoName}", want: filepath.Join(home, "comments", "project")},
+		{name: "home backslash", folder: `~\comments\${repoName}`, want: filepath.Join(home, "comments", "project")},
+		{name: "tilde folder", folder: "~comments", want: filepath.Join(repoDir, "~comments")},
+		{name: "xdg data home", folder: "${xdgDataHome}/separate_comments/${repoName}", want: filepath.Join(home, "data", "separate_comments", "project")},
+		{name: "git folder", folder: "${gitDir}/lsp-comments", want: filepath.Join(repoDir, ".git", "lsp-comments")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := resolveCommentFolder(repoDir, test.folder); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProjectCommentFolder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	defer workspaceUntrusted.Store(workspaceUntrusted.Load())
+	tests := []struct {
+		name    string
+		folder  string
+		trusted bool
+		want    string
+	}{
+		{name: "in repository", folder: "review/comments", want: "review/comments"},
+		{name: "in git folder", folder: "${gitDir}/lsp-comments", want: "${gitDir}/lsp-comments"},
+		{name: "sibling untrusted", folder: "../comments", want: "comments"},
+		{name: "sibling trusted", folder: "../comments", trusted: true, want: "../comments"},
+		{name: "home untrusted", folder: "~/.ssh", want: "comments"},
+		{name: "home trusted", folder: "~/comments", trusted: true, want: "~/comments"},
+		{name: "escaping untrusted", folder: "review/../../comments", want: "comments"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repoDir := t.TempDir()
+			config := `{"commentFolder": "` + test.folder + `"}`
+			if err := os.WriteFile(filepath.Join(repoDir, projectConfigName), []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			workspaceUntrusted.Store(!test.trusted)
+			settings, err := loadProjectSettings(repoDir, defaultSettings())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Clean(test.want); settings.CommentFolder != want {
+				t.Errorf("got comment folder %s, want %s", settings.CommentFolder, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.lsp.dev/protocol"
+)
+
+// Commands losing comments, or overwriting those of others, run only once
+// the user confirmed them, so that a misfired keybinding loses nothing.
+
+const confirmAction = "Confirm"
+const cancelAction = "Cancel"
+
+// Asks the user to confirm a destructive operation, false unless confirmed.
+// Must not be called from the handler goroutine: it waits for the client reply.
+func (h *handler) confirm(ctx context.Context, message string) bool {
+	if !getSettings().ConfirmDestructiveOperations {
+		return true
+	}
+	params := protocol.ShowMessageRequestParams{
+		Type:    protocol.MessageTypeWarning,
+		Message: message,
+		Actions: []protocol.MessageActionItem{{Title: confirmAction}, {Title: cancelAction}},
+	}
+	var chosen *protocol.MessageActionItem
+	if _, err := h.conn.Call(ctx, "window/showMessageRequest", params, &chosen); err != nil {
+		logErrorf("Error while asking for confirmation: %v", err)
+		return false
+	}
+	if chosen == nil || chosen.Title != confirmAction {
+		logInfof("Not confirmed: %s", message)
+		return false
+	}
+	return true
+}
+
+func (h *handler) confirmDelete(ctx context.Context, uri protocol.DocumentURI, id string) bool {
+	comment, err := getComment(GetCommentParams{URI: uri, ID: id})
+	if err != nil {
+		// Reported by the deletion
+		return true
+	}
+	message := fmt.Sprintf("Delete the comment \"%s\"", truncateMessage(comment.Message, 60))
+	if len(comment.Replies) > 0 {
+		message += fmt.Sprintf(" and its %d replies", len(comment.Replies))
+	}
+	return h.confirm(ctx, message+"? It cannot be restored.")
+}
+
+// Answer of the user to the force-push of the mirror, asked once a session
+// instead of at each sync
+type mirrorConsent struct {
+	mutex     sync.Mutex
+	asked     bool
+	confirmed bool
+}
+
+func (consent *mirrorConsent) get(ask func() bool) bool {
+	consent.mutex.Lock()
+	defer consent.mutex.Unlock()
+	if !consent.asked {
+		consent.confirmed = ask()
+		consent.asked = true
+	}
+	return consent.confirmed
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comment changed on both sides of a merge. The merge driver keeps our
+// version and records the conflict in the git folder of the repository, for
+// the user to choose with comment/resolveConflict.
+type MergeConflict struct {
+	ID string `json:"id"`
+	// Comment file holding the comment
+	Path string `json:"path"`
+	// Source file of the comment, filled for the client
+	URI protocol.DocumentURI `json:"uri,omitempty"`
+	Key string               `json:"key"`
+	// Id of the notebook cell holding the comment, if any
+	Cell   string `json:"cell,omitempty"`
+	Base   *Patch `json:"base,omitempty"` // Missing when added on both sides
+	Ours   Patch  `json:"ours"`
+	Theirs Patch  `json:"theirs"`
+}
+
+type ResolveConflictParams struct {
+	ID     string `json:"id"`
+	Choice string `json:"choice"` // ours or theirs
+}
+
+func conflictID(path string, key string) string {
+	sum := sha1.Sum([]byte(path + "\x00" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// File holding the pending conflicts of the git repository of dir
+func conflictsFilePath(dir string) (string, error) {
+	cmd := gitCommand("rev-parse", "--absolute-git-dir")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", newCommentError(ErrVCSUnavailable, "error while locating git folder: %w", err)
+	}
+	return filepath.Join(strings.TrimSpace(string(output)), "lsp-comments-conflicts.json"), nil
+}
+
+func loadConflicts(conflictsPath string) ([]MergeConflict, error) {
+	conflicts := []MergeConflict{}
+	data, err := os.ReadFile(conflictsPath)
+	if os.IsNotExist(err) {
+		return conflicts, nil
+	} else if err != nil {
+		return nil, wrapFileError(err, "error while reading conflicts: %w", err)
+	}
+	if err := json.Unmarshal(data, &conflicts); err != nil {
+		return nil, newCommentError(ErrStoreCorrupt, "error while parsing conflicts: %w", err)
+	}
+	return conflicts, nil
+}
+
+func saveConflicts(conflictsPath string, conflicts []MergeConflict) error {
+	if len(conflicts) == 0 {
+		if err := os.Remove(conflictsPath); err != nil && !os.IsNotExist(err) {
+			return wrapFileError(err, "error while removing conflicts: %w", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(conflicts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(conflictsPath, data, 0644); err != nil {
+		return wrapFileError(err, "error while writing conflicts: %w", err)
+	}
+	return nil
+}
+
+// Records the conflicts of a merge, replacing the previous ones of the file
+func recordConflicts(dir string, path string, conflicts []MergeConflict) error {
+	conflictsPath, err := conflictsFilePath(dir)
+	if err != nil {
+		return err
+	}
+	existing, err := loadConflicts(conflictsPath)
+	if err != nil {
+		return err
+	}
+	kept := existing[:0]
+	for _, conflict := range existing {
+		if conflict.Path != path {
+			kept = append(kept, conflict)
+		}
+	}
+	for _, conflict := range conflicts {
+		conflict.Path = path
+		if conflict.Cell != "" {
+			// Section of the comment file, see readCommentFile
+			conflict.Path += cellSeparator + conflict.Cell
+		}
+		conflict.ID = conflictID(path, conflict.Key)
+		kept = append(kept, conflict)
+	}
+	return saveConflicts(conflictsPath, kept)
+}
+
+// Repositories where comment files are merged: the workspace one and the
+// shared comments repository, if any.
+func (h *handler) conflictsFilePaths() []string {
+	if h.rootPath == "" {
+		return nil
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return nil
+	}
+	paths := []string{}
+	for _, dir := range []string{repoDir, commentsDirOf(repoDir)} {
+		conflictsPath, err := conflictsFilePath(dir)
+		if err != nil {
+			continue
+		}
+		if len(paths) == 0 || paths[0] != conflictsPath {
+			paths = append(paths, conflictsPath)
+		}
+	}
+	return paths
+}
+
+func (h *handler) conflicts() ([]MergeConflict, error) {
+	conflicts := []MergeConflict{}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	for _, conflictsPath := range h.conflictsFilePaths() {
+		found, err := loadConflicts(conflictsPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, conflict := range found {
+			commentFilePath, cell, inCell := splitCellPath(conflict.Path)
+			if rel, err := filepath.Rel(commentsDirOf(repoDir), strings.TrimSuffix(commentFilePath, ".json")); err == nil {
+				sourcePath := filepath.Join(repoDir, rel)
+				if inCell {
+					sourcePath += cellSeparator + cell
+				}
+				conflict.URI = pathToURI(sourcePath)
+			}
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts, nil
+}
+
+// Applies the version chosen by the user to the comment file
+func (h *handler) resolveConflict(ctx context.Context, params ResolveConflictParams) error {
+	if params.Choice != "ours" && params.Choice != "theirs" {
+		return fmt.Errorf("invalid choice %q", params.Choice)
+	}
+	for _, conflictsPath := range h.conflictsFilePaths() {
+		conflicts, err := loadConflicts(conflictsPath)
+		if err != nil {
+			return err
+		}
+		for idx, conflict := range conflicts {
+			if conflict.ID != params.ID {
+				continue
+			}
+			if params.Choice == "theirs" {
+				if err := replaceComment(conflict.Path, conflict.Key, conflict.Theirs); err != nil {
+					return err
+				}
+			}
+			if err := saveConflicts(conflictsPath, append(conflicts[:idx], conflicts[idx+1:]...)); err != nil {
+				return err
+			}
+			for uri := range h.openDocuments {
+				if commentFilePath, _, err := getCommentFilePath(uriToPath(uri)); err == nil && commentFilePath == conflict.Path {
+					h.publishDiagnostics(ctx, uri)
+				}
+			}
+			if params.Choice == "theirs" {
+				h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: conflict.URI})
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict %s", params.ID)
+}
+
+func replaceComment(commentFilePath string, key string, patch Patch) error {
+	unlock, err := lockCommentFile(commentFilePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	commentFile, err := readCommentFile(commentFilePath)
+	if err != nil {
+		return err
+	}
+	for idx := range commentFile.Patches {
+		if commentKey(&commentFile.Patches[idx]) == key {
+			commentFile.Patches[idx] = patch
+			return writeCommentFile(commentFilePath, commentFile)
+		}
+	}
+	return fmt.Errorf("comment of the conflict not found in %s", commentFilePath)
+}
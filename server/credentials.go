@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Sync runs without prompts: credentials come from the git credential
+// helpers and the SSH agent. When they are missing or rejected, the user is
+// asked to sign in again with comment.reauthenticate.
+
+const reauthenticateAction = "Sign in again"
+
+// Messages of git and ssh when credentials are missing or rejected
+var authFailurePatterns = []string{
+	"authentication failed",
+	"could not read username",
+	"could not read password",
+	"terminal prompts disabled",
+	"permission denied (publickey",
+	"invalid username or password",
+	"http basic: access denied",
+	"the requested url returned error: 401",
+	"the requested url returned error: 403",
+}
+
+func isAuthFailure(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	stderr := strings.ToLower(string(exitErr.Stderr))
+	for _, pattern := range authFailurePatterns {
+		if strings.Contains(stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Code of a failed sync, AUTH_FAILED when git was refused access
+func syncErrorCode(err error, code ErrorCode) ErrorCode {
+	if isAuthFailure(err) {
+		return ErrAuthFailed
+	}
+	return code
+}
+
+// Credential helpers take the credentials of an HTTP remote, SSH remotes use
+// the keys of the agent
+func isHTTPRemote(repoURL string) bool {
+	parsed, err := url.Parse(repoURL)
+	return err == nil && (parsed.Scheme == "https" || parsed.Scheme == "http")
+}
+
+// Asks the credential helpers to forget the credentials of the remote, so
+// that the next access asks for new ones
+func rejectCredential(ctx context.Context, repoDir string, repoURL string) error {
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return err
+	}
+	cmd := gitCommandContext(ctx, "credential", "reject")
+	cmd.Dir = repoDir
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n\n",
+		parsed.Scheme, parsed.Host, strings.TrimPrefix(parsed.Path, "/")))
+	return cmd.Run()
+}
+
+// Forgets the rejected credentials of the comments repository and reaches it
+// again, letting the credential helpers ask for new ones, then syncs.
+func (h *handler) reauthenticate(ctx context.Context) error {
+	repoURL := getSettings().CommentsRepoURL
+	if repoURL == "" {
+		return fmt.Errorf("no comments repository configured")
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return fmt.Errorf("workspace is not a git repository")
+	}
+	if !isHTTPRemote(repoURL) {
+		if err := gitSyncCommand(ctx, repoDir, "ls-remote", repoURL, "HEAD").Run(); err != nil {
+			return newCommentError(syncErrorCode(err, ErrVCSUnavailable),
+				"%s rejected the SSH key, add it to your SSH agent with ssh-add: %w", repoURL, err)
+		}
+	} else {
+		if err := rejectCredential(ctx, repoDir, repoURL); err != nil {
+			syncLog.errorf("Credentials of %s not rejected: %v", repoURL, err)
+		}
+		// Git stores the credentials in the helpers once accepted
+		if err := gitSyncCommand(ctx, repoDir, "ls-remote", repoURL, "HEAD").withCredentialPrompts().Run(); err != nil {
+			return newCommentError(syncErrorCode(err, ErrVCSUnavailable),
+				"%s still rejects the credentials, check the credential helper of git (git config credential.helper): %w", repoURL, err)
+		}
+	}
+	syncLog.infof("Signed in to %s", repoURL)
+	h.syncCommentsRepo(ctx)
+	h.conn.Notify(ctx, "window/showMessage", protocol.ShowMessageParams{
+		Type:    protocol.MessageTypeInfo,
+		Message: "Signed in to the comments repository, comments synchronised from " + h.sync.get().Source + ".",
+	})
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// A comment about several files, e.g. "rename this everywhere", is stored
+// once in the comment file of the file it was made on, with an anchor in each
+// of the other files. It is published in all of them: replying to it or
+// resolving it from any file changes the same thread.
+
+type FileAnchor struct {
+	Path  string `json:"path"` // Relative to the repository
+	Patch string `json:"patch"`
+}
+
+// Other files a comment is about, each once
+func (patch *Patch) otherFiles() []string {
+	var paths []string
+	for _, anchor := range patch.FileAnchors {
+		if !slices.Contains(paths, anchor.Path) {
+			paths = append(paths, anchor.Path)
+		}
+	}
+	return paths
+}
+
+// Comment of another file anchored in a document
+type crossFileComment struct {
+	sourcePath string // Relative to the repository
+	index      int
+	commit     string // Commit of the comment file
+	patch      Patch
+}
+
+// Comments with file anchors of each comment file, refreshed when the file
+// changes, so that finding the comments about a document does not read every
+// comment file
+type crossFileEntry struct {
+	modTime  time.Time
+	size     int64
+	comments []crossFileComment
+}
+
+var crossFileIndex = struct {
+	sync.Mutex
+	entries map[string]crossFileEntry
+}{entries: map[string]crossFileEntry{}}
+
+// Comments of the other files of the repository anchored in rel
+func crossFileComments(repoDir string, rel string) []crossFileComment {
+	rel = filepath.ToSlash(rel)
+	found := []crossFileComment{}
+	crossFileIndex.Lock()
+	defer crossFileIndex.Unlock()
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, sourcePath string) error {
+		info, err := os.Stat(storedCommentFilePath(commentFilePath))
+		if err != nil {
+			return nil
+		}
+		entry, ok := crossFileIndex.entries[commentFilePath]
+		if !ok || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+			entry = crossFileEntry{modTime: info.ModTime(), size: info.Size()}
+			if commentFile, err := readCommentFile(commentFilePath); err == nil {
+				for idx, patch := range commentFile.Patches {
+					if len(patch.FileAnchors) > 0 {
+						entry.comments = append(entry.comments, crossFileComment{
+							sourcePath: filepath.ToSlash(sourcePath),
+							index:      idx,
+							commit:     commentFile.Commit,
+							patch:      patch,
+						})
+					}
+				}
+			}
+			crossFileIndex.entries[commentFilePath] = entry
+		}
+		for _, comment := range entry.comments {
+			for _, anchor := range comment.patch.FileAnchors {
+				if anchor.Path == rel && comment.sourcePath != rel {
+					found = append(found, comment)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		anchorLog.debugf("Cannot list the comments of other files about %s: %v", rel, err)
+	}
+	return found
+}
+
+// Comments of other files anchored in the current content of a document. Their
+// source is the document holding them, that commands address.
+func anchorCrossFileComments(uri protocol.DocumentURI) []anchoredComment {
+	filePath := uriToPath(uri)
+	repoDir := getUserRepoDir(filePath)
+	if filePath == "" || repoDir == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(repoDir, filePath)
+	if err != nil {
+		return nil
+	}
+	candidates := crossFileComments(repoDir, rel)
+	if len(candidates) == 0 {
+		return nil
+	}
+	content, err := readSourceFile(filePath)
+	if err != nil {
+		return nil
+	}
+	comments := []anchoredComment{}
+	for _, candidate := range candidates {
+		if candidate.commit != "" && isWorkspaceTrusted() {
+			if present, err := isCommitInCurrentBranch(candidate.commit); err != nil || !present {
+				continue
+			}
+		}
+		comment := anchoredComment{
+			Index:     candidate.index,
+			Patch:     candidate.patch,
+			SourceURI: pathToURI(filepath.Join(repoDir, filepath.FromSlash(candidate.sourcePath))),
+		}
+		anchored := false
+		for _, anchor := range candidate.patch.FileAnchors {
+			if anchor.Path != filepath.ToSlash(rel) {
+				continue
+			}
+			position, _, err := anchorPatch(anchorInput{
+				content:   string(content),
+				patchText: anchor.Patch,
+				filePath:  filePath,
+				commit:    candidate.commit,
+			})
+			if err != nil {
+				anchorLog.debugf("Anchor of comment %d of %s not found in %s: %v", candidate.index, candidate.sourcePath, rel, err)
+				continue
+			}
+			if !anchored {
+				comment.Range = position
+				comment.Outdated = commentedCodeChanged(string(content), anchor.Patch, position)
+				anchored = true
+			} else {
+				comment.SecondaryRanges = append(comment.SecondaryRanges, position)
+			}
+		}
+		if anchored {
+			comments = append(comments, comment)
+		}
+	}
+	return comments
+}
+
+// Anchor of a comment in another file of its repository
+func buildFileAnchor(repoDir string, sourcePath string, location protocol.Location) (FileAnchor, error) {
+	filePath := uriToPath(location.URI)
+	if filePath == sourcePath {
+		return FileAnchor{}, fmt.Errorf("%s is the commented file, add a secondary range instead", filepath.Base(filePath))
+	}
+	if repoDir == "" || getUserRepoDir(filePath) != repoDir {
+		return FileAnchor{}, fmt.Errorf("%s is not in the repository of the comment", filePath)
+	}
+	rel, err := filepath.Rel(repoDir, filePath)
+	if err != nil {
+		return FileAnchor{}, fmt.Errorf("error while getting relative path : %v", err)
+	}
+	content, err := readSourceFile(filePath)
+	if err != nil {
+		return FileAnchor{}, wrapFileError(err, "error while reading file %s: %w", filePath, err)
+	}
+	return FileAnchor{
+		Path:  filepath.ToSlash(rel),
+		Patch: buildCommentPatch(filePath, string(content), location.Range),
+	}, nil
+}
+
+// Anchors a comment in another file of the repository
+func addCommentLocation(uri protocol.DocumentURI, id string, location protocol.Location) error {
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if patch.GeneratedFrom != "" {
+			return fmt.Errorf("comment %s was made on generated %s, it cannot be about other files", id, patch.GeneratedFrom)
+		}
+		anchor, err := buildFileAnchor(repoDir, uriToPath(uri), location)
+		if err != nil {
+			return err
+		}
+		patch.FileAnchors = append(patch.FileAnchors, anchor)
+		return nil
+	})
+}
+
+// Open documents other than uri its comments are about
+func (h *handler) crossFileTargets(uri protocol.DocumentURI) []protocol.DocumentURI {
+	filePath := uriToPath(uri)
+	repoDir := getUserRepoDir(filePath)
+	if repoDir == "" {
+		return nil
+	}
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return nil
+	}
+	paths := map[string]bool{}
+	for _, patch := range commentFile.Patches {
+		for _, anchor := range patch.FileAnchors {
+			paths[filepath.Join(repoDir, filepath.FromSlash(anchor.Path))] = true
+		}
+	}
+	targets := []protocol.DocumentURI{}
+	if len(paths) == 0 {
+		return targets
+	}
+	for _, open := range h.openURIs() {
+		if open != uri && paths[uriToPath(open)] {
+			targets = append(targets, open)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Content of the document in the bundles, read by replay
+const bundleDocumentName = "document.txt"
+
+// Recent log lines kept in memory for the bug report bundles
+const recentLogLines = 1000
+
+type logRing struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+var recentLogs = &logRing{}
+
+func (ring *logRing) Write(data []byte) (int, error) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		ring.lines = append(ring.lines, line)
+	}
+	if len(ring.lines) > recentLogLines {
+		ring.lines = append([]string{}, ring.lines[len(ring.lines)-recentLogLines:]...)
+	}
+	return len(data), nil
+}
+
+func (ring *logRing) text() string {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	return strings.Join(ring.lines, "\n") + "\n"
+}
+
+var (
+	emailRegexp    = regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)+`)
+	urlUserRegexp  = regexp.MustCompile(`(\w+://)[^/\s@]+@`)
+	secretsRegexp  = regexp.MustCompile(`(?i)((?:token|key|secret|password|signature)=)[^&\s"]+`)
+	redactedMarker = "<redacted>"
+)
+
+// Removes the emails, URL credentials and secrets of a text
+func redact(text string) string {
+	text = urlUserRegexp.ReplaceAllString(text, "${1}"+redactedMarker+"@")
+	text = secretsRegexp.ReplaceAllString(text, "${1}"+redactedMarker)
+	return emailRegexp.ReplaceAllString(text, redactedMarker)
+}
+
+// Settings without the secrets and personal data they can hold
+func redactedSettings(current Settings) Settings {
+	if current.WebhookURL != "" {
+		current.WebhookURL = redactedMarker
+	}
+	current.CommentsRepoURL = redact(current.CommentsRepoURL)
+	current.CommentsMirrorURL = redact(current.CommentsMirrorURL)
+	current.TranslationEndpoint = redact(current.TranslationEndpoint)
+	if current.IssueTracker != nil && current.IssueTracker.Token != "" {
+		tracker := *current.IssueTracker
+		tracker.Token = redactedMarker
+		current.IssueTracker = &tracker
+	}
+	profiles := make([]IdentityProfile, len(current.Profiles))
+	for idx, profile := range current.Profiles {
+		profiles[idx] = IdentityProfile{Name: profile.Name, User: redact(profile.User)}
+		if profile.SigningKey != "" {
+			profiles[idx].SigningKey = redactedMarker
+		}
+		if profile.SSHKey != "" {
+			profiles[idx].SSHKey = redactedMarker
+		}
+	}
+	current.Profiles = profiles
+	return current
+}
+
+// Comment file without the messages and identities, keeping what anchoring
+// depends on.
+func redactedCommentFile(commentFile *CommentFile) *CommentFile {
+	redacted := &CommentFile{Version: commentFile.Version, Commit: commentFile.Commit, Patches: make([]Patch, len(commentFile.Patches))}
+	for idx, patch := range commentFile.Patches {
+		redacted.Patches[idx] = Patch{
+			Message:   fmt.Sprintf("<%d characters>", len([]rune(patch.Message))),
+			Patch:     patch.Patch,
+			CreatedAt: patch.CreatedAt,
+			State:     patch.State,
+		}
+	}
+	return redacted
+}
+
+type bundleAnchor struct {
+	Index int             `json:"index"`
+	Range *protocol.Range `json:"range,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+func gitInfo(dir string) map[string]string {
+	info := map[string]string{}
+	commands := map[string][]string{
+		"version": {"--version"},
+		"head":    {"rev-parse", "HEAD"},
+		"branch":  {"rev-parse", "--abbrev-ref", "HEAD"},
+		"status":  {"status", "--short", "--branch"},
+	}
+	for name, args := range commands {
+		cmd := gitCommand(args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			info[name] = "error: " + err.Error()
+			continue
+		}
+		info[name] = redact(strings.TrimSpace(string(output)))
+	}
+	return info
+}
+
+// Writes a zip archive with the state needed to triage a bug, for the
+// document at uri when given, and returns its path.
+func (h *handler) debugBundle(uri protocol.DocumentURI) (string, error) {
+	files := map[string]interface{}{}
+	var documentContent []byte
+	serverInfo := map[string]interface{}{
+		"go":      runtime.Version(),
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"errors":  errorStats(),
+		"sync":    h.sync.get(),
+		"logging": logLevelsReport(),
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		serverInfo["version"] = buildInfo.Main.Version
+	}
+	files["server.json"] = serverInfo
+	files["settings.json"] = redactedSettings(getSettings())
+	if h.rootPath != "" {
+		files["git.json"] = gitInfo(h.rootPath)
+	}
+
+	if uri != "" {
+		filePath := uriToPath(uri)
+		document := map[string]interface{}{"path": redact(filePath)}
+		if commentFilePath, repoDir, err := getCommentFilePath(filePath); err == nil {
+			if repoDir != "" {
+				rel, _ := filepath.Rel(repoDir, filePath)
+				document["path"] = filepath.ToSlash(rel)
+			}
+			if commentFile, err := readCommentFile(commentFilePath); err != nil {
+				document["commentFileError"] = redact(err.Error())
+			} else {
+				files["comments.json"] = redactedCommentFile(commentFile)
+				if commentFile.Commit != "" {
+					present, err := isCommitInCurrentBranch(commentFile.Commit)
+					document["commitInBranch"] = present
+					if err != nil {
+						document["commitError"] = err.Error()
+					}
+				}
+				content, err := os.ReadFile(filePath)
+				if err != nil {
+					document["contentError"] = redact(err.Error())
+				} else {
+					anchors := []bundleAnchor{}
+					for idx, patch := range commentFile.Patches {
+						anchor := bundleAnchor{Index: idx}
+						rng, err := applyPatchAndGetPositions(string(content), patch.Patch)
+						if err != nil {
+							anchor.Error = err.Error()
+						} else {
+							anchor.Range = &rng
+						}
+						anchors = append(anchors, anchor)
+					}
+					files["anchors.json"] = anchors
+					// Lets maintainers replay the anchoring without the repository
+					documentContent = content
+				}
+			}
+		}
+		files["document.json"] = document
+	}
+
+	bundlePath := filepath.Join(os.TempDir(), fmt.Sprintf("lsp-comments-bundle-%s.zip", time.Now().Format("20060102-150405")))
+	bundle, err := os.Create(bundlePath)
+	if err != nil {
+		return "", wrapFileError(err, "error while creating bug report bundle: %w", err)
+	}
+	defer bundle.Close()
+	archive := zip.NewWriter(bundle)
+	for name, content := range files {
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		writer, err := archive.Create(name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if documentContent != nil {
+		writer, err := archive.Create(bundleDocumentName)
+		if err != nil {
+			return "", err
+		}
+		if _, err := writer.Write(documentContent); err != nil {
+			return "", err
+		}
+	}
+	writer, err := archive.Create("logs.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write([]byte(redact(recentLogs.text()))); err != nil {
+		return "", err
+	}
+	if err := archive.Close(); err != nil {
+		return "", wrapFileError(err, "error while writing bug report bundle: %w", err)
+	}
+	logInfof("Bug report bundle written to %s", bundlePath)
+	return bundlePath, nil
+}
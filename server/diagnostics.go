@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"go.lsp.dev/protocol"
+)
+
+// Pull diagnostics (LSP 3.17) are not part of go.lsp.dev/protocol yet, so the
+// types are declared here.
+
+type initializeResult struct {
+	Capabilities serverCapabilities   `json:"capabilities"`
+	ServerInfo   *protocol.ServerInfo `json:"serverInfo,omitempty"`
+}
+
+type serverCapabilities struct {
+	protocol.ServerCapabilities
+	DiagnosticProvider *DiagnosticOptions `json:"diagnosticProvider,omitempty"`
+	InlayHintProvider  bool               `json:"inlayHintProvider,omitempty"`
+	PositionEncoding   string             `json:"positionEncoding,omitempty"`
+	// Cells of the notebooks are commented like documents
+	NotebookDocumentSync *NotebookDocumentSyncOptions `json:"notebookDocumentSync,omitempty"`
+}
+
+type DiagnosticOptions struct {
+	Identifier            string `json:"identifier,omitempty"`
+	InterFileDependencies bool   `json:"interFileDependencies"`
+	WorkspaceDiagnostics  bool   `json:"workspaceDiagnostics"`
+}
+
+type DocumentDiagnosticParams struct {
+	TextDocument     protocol.TextDocumentIdentifier `json:"textDocument"`
+	Identifier       string                          `json:"identifier,omitempty"`
+	PreviousResultID string                          `json:"previousResultId,omitempty"`
+}
+
+type WorkspaceDiagnosticParams struct {
+	WorkDoneToken     *protocol.ProgressToken `json:"workDoneToken,omitempty"`
+	Identifier        string                  `json:"identifier,omitempty"`
+	PreviousResultIDs []PreviousResultID      `json:"previousResultIds"`
+}
+
+type PreviousResultID struct {
+	URI   protocol.DocumentURI `json:"uri"`
+	Value string               `json:"value"`
+}
+
+const (
+	DocumentDiagnosticReportKindFull      = "full"
+	DocumentDiagnosticReportKindUnchanged = "unchanged"
+)
+
+// Either a full report (with items) or an unchanged report (without). Items
+// is a pointer so that full reports always send it, even empty: clients clear
+// the diagnostics of the document with it.
+type DocumentDiagnosticReport struct {
+	Kind     string                 `json:"kind"`
+	ResultID string                 `json:"resultId,omitempty"`
+	Items    *[]protocol.Diagnostic `json:"items,omitempty"`
+}
+
+type WorkspaceDocumentDiagnosticReport struct {
+	DocumentDiagnosticReport
+	URI     protocol.DocumentURI `json:"uri"`
+	Version *int32               `json:"version"`
+}
+
+type WorkspaceDiagnosticReport struct {
+	Items []WorkspaceDocumentDiagnosticReport `json:"items"`
+}
+
+func (h *handler) documentDiagnosticReport(uri protocol.DocumentURI, previousResultID string) DocumentDiagnosticReport {
+	diagnostics, err := h.computeDiagnostics(uri)
+	if err != nil {
+		recordError(fmt.Errorf("documentDiagnosticReport: %w", err))
+	}
+	if diagnostics == nil {
+		diagnostics = []protocol.Diagnostic{}
+	}
+	resultID := diagnosticsResultID(diagnostics)
+	if previousResultID != "" && previousResultID == resultID {
+		return DocumentDiagnosticReport{Kind: DocumentDiagnosticReportKindUnchanged, ResultID: resultID}
+	}
+	return DocumentDiagnosticReport{Kind: DocumentDiagnosticReportKindFull, ResultID: resultID, Items: &diagnostics}
+}
+
+// Reports diagnostics for every file of the workspace that has a comment file.
+func (h *handler) workspaceDiagnosticReport(ctx context.Context, params WorkspaceDiagnosticParams) (*WorkspaceDiagnosticReport, error) {
+	report := &WorkspaceDiagnosticReport{Items: []WorkspaceDocumentDiagnosticReport{}}
+	if h.rootPath == "" {
+		return report, nil
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return report, nil
+	}
+	previous := map[protocol.DocumentURI]string{}
+	for _, resultID := range params.PreviousResultIDs {
+		previous[resultID.URI] = resultID.Value
+	}
+	// Files emptied of their comments are reported too, to clear them
+	files, err := commentIndexOf(commentsDirOf(repoDir))
+	if err != nil {
+		return nil, err
+	}
+	var documentURIs []protocol.DocumentURI
+	for rel := range files {
+		documentURIs = append(documentURIs, pathToURI(filepath.Join(repoDir, filepath.FromSlash(rel))))
+	}
+	slices.Sort(documentURIs)
+	// Anchoring every comment of a large workspace takes a while
+	progress := h.beginProgress(ctx, params.WorkDoneToken, "Anchoring comments")
+	for idx, documentURI := range documentURIs {
+		if err := ctx.Err(); err != nil {
+			progress.end(context.WithoutCancel(ctx), "Cancelled")
+			return nil, err
+		}
+		if idx%20 == 0 {
+			progress.report(ctx, fmt.Sprintf("%d/%d files", idx, len(documentURIs)), uint32(idx*100/len(documentURIs)))
+		}
+		report.Items = append(report.Items, WorkspaceDocumentDiagnosticReport{
+			DocumentDiagnosticReport: h.documentDiagnosticReport(documentURI, previous[documentURI]),
+			URI:                      documentURI,
+		})
+	}
+	progress.end(ctx, "")
+	return report, nil
+}
+
+// The result ID is a hash of the report content, so an unchanged set of
+// diagnostics always gets the same ID, even across server restarts.
+func diagnosticsResultID(diagnostics []protocol.Diagnostic) string {
+	data, err := json.Marshal(diagnostics)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Outdated comments are shown one level less severe than current ones
+func outdatedSeverity(severity protocol.DiagnosticSeverity) protocol.DiagnosticSeverity {
+	if severity < protocol.DiagnosticSeverityHint {
+		return severity + 1
+	}
+	return severity
+}
+
+func supportsDiagnosticTag(capabilities protocol.ClientCapabilities, tag protocol.DiagnosticTag) bool {
+	if capabilities.TextDocument == nil || capabilities.TextDocument.PublishDiagnostics == nil ||
+		capabilities.TextDocument.PublishDiagnostics.TagSupport == nil {
+		return false
+	}
+	for _, supported := range capabilities.TextDocument.PublishDiagnostics.TagSupport.ValueSet {
+		if supported == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Draft comments are written to the comment files like the others but only
+// shown to their author, and neither audited nor announced, until
+// comment.publishDrafts publishes all of them at once, like a pending review.
+
+type PublishDraftsResult struct {
+	Published int `json:"published"`
+}
+
+// Publishes the drafts of user in the comment files of the repository
+func publishDrafts(ctx context.Context, repoDir string, user string) (*PublishDraftsResult, error) {
+	result := &PublishDraftsResult{}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		unlock, err := lockCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		defer unlock()
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		published := publishFileDrafts(commentFile, user)
+		if len(published) == 0 {
+			return nil
+		}
+		if err := writeCommentFile(commentFilePath, commentFile); err != nil {
+			return err
+		}
+		sourcePath := filepath.Join(repoDir, rel)
+		for _, patch := range published {
+			err := appendAuditEvent(repoDir, AuditEvent{
+				Event:   AuditCommentAdded,
+				User:    user,
+				Author:  user,
+				Path:    filepath.ToSlash(rel),
+				Comment: commentID(patch),
+			})
+			if err != nil {
+				recordError(err)
+			}
+			if patch.Suggestion != nil {
+				auditSuggestion(repoDir, AuditSuggestionAdded, user, rel, patch)
+			}
+			go notifyMentions(repoDir, user, sourcePath, patch.Message)
+		}
+		result.Published += len(published)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Published == 0 {
+		return result, nil
+	}
+	storeLog.infof("Publish %d draft comments of %s", result.Published, user)
+	if err := updateCommentsRepoAfterChange(); err != nil {
+		return nil, newCommentError(ErrSyncConflict, "error while updating comments repository: %w", err)
+	}
+	return result, nil
+}
+
+// Clears the draft flag of the comments of user in a comment file and its
+// notebook cells, returning the published comments
+func publishFileDrafts(commentFile *CommentFile, user string) []*Patch {
+	published := []*Patch{}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		if !patch.Draft || patch.author() != user {
+			continue
+		}
+		patch.Draft = false
+		patch.UpdatedAt = now
+		published = append(published, patch)
+	}
+	for _, cell := range commentFile.Cells {
+		published = append(published, publishFileDrafts(cell, user)...)
+	}
+	return published
+}
+
+// Whether the comment is shown to user: drafts only are to their author
+func (patch *Patch) visibleTo(user string) bool {
+	return !patch.Draft || patch.author() == user
+}
+
+func (h *handler) publishDraftsCommand(ctx context.Context) (*PublishDraftsResult, error) {
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return nil, fmt.Errorf("workspace %s is not a git repository", h.rootPath)
+	}
+	result, err := publishDrafts(ctx, repoDir, currentUser(repoDir))
+	if err != nil {
+		return nil, err
+	}
+	if result.Published > 0 {
+		h.notifyCommentsChanged(ctx, ChangeLocal)
+		h.republishDiagnostics(ctx)
+	}
+	return result, nil
+}
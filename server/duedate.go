@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comments can be due by a date: their diagnostic is escalated one level when
+// the date is close, two once it is passed.
+
+const dueDateLayout = "2006-01-02"
+
+// A comment is due soon this long before the end of its due date
+const dueSoon = 48 * time.Hour
+
+func validateDueDate(date string) error {
+	if date == "" {
+		return nil
+	}
+	if _, err := time.Parse(dueDateLayout, date); err != nil {
+		return fmt.Errorf("invalid due date %q, expected YYYY-MM-DD", date)
+	}
+	return nil
+}
+
+// Levels the diagnostic of an open comment is escalated by and the mention
+// prefixed to its message, none when it is not due soon
+func (patch *Patch) dueEscalation(now time.Time) (int, string) {
+	if patch.DueDate == "" || patch.isClosed() {
+		return 0, ""
+	}
+	date, err := time.ParseInLocation(dueDateLayout, patch.DueDate, now.Location())
+	if err != nil {
+		return 0, ""
+	}
+	// Due until the end of the day
+	end := date.AddDate(0, 0, 1)
+	switch {
+	case !now.Before(end):
+		return 2, "[overdue]"
+	case end.Sub(now) <= dueSoon:
+		return 1, "[due " + patch.DueDate + "]"
+	}
+	return 0, ""
+}
+
+// Sets the due date of a comment, YYYY-MM-DD, none when empty
+func setCommentDueDate(uri protocol.DocumentURI, id string, date string) error {
+	if err := validateDueDate(date); err != nil {
+		return err
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.DueDate = date
+		return nil
+	})
+}
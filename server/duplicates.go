@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"go.lsp.dev/protocol"
+)
+
+// comment.add asks before adding a comment nearly identical to an open
+// comment of the same code, which is often the same finding made twice: the
+// user can reply to the existing thread instead.
+
+// Minimum similarity of the messages of duplicates, from 0 to 1
+const duplicateSimilarity = 0.85
+
+const (
+	duplicateReplyAction = "Reply to existing"
+	duplicateAddAction   = "Add anyway"
+)
+
+// Commented lines of an anchor without their context, position and
+// whitespace, so that moved or reindented code still matches
+func normalizedPatch(patchText string) string {
+	var lines []string
+	for _, line := range strings.Split(patchText, "\n") {
+		if commented, ok := strings.CutPrefix(line, "+"); ok {
+			lines = append(lines, strings.Join(strings.Fields(commented), " "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Similarity of two messages from 0 to 1, ignoring case, whitespace and
+// markdown syntax
+func messageSimilarity(a string, b string) float64 {
+	a = strings.ToLower(strings.Join(strings.Fields(plainMarkdown(a)), " "))
+	b = strings.ToLower(strings.Join(strings.Fields(plainMarkdown(b)), " "))
+	longest := max(len([]rune(a)), len([]rune(b)))
+	if longest == 0 {
+		return 1
+	}
+	matcher := dmp.New()
+	return 1 - float64(matcher.DiffLevenshtein(matcher.DiffMain(a, b, false)))/float64(longest)
+}
+
+// Open comment of the document the comment to add would duplicate, nil when
+// there is none
+func findDuplicateComment(uri protocol.DocumentURI, rng protocol.Range, message string, options CommentOptions) *anchoredComment {
+	filePath := uriToPath(uri)
+	if filePath == "" || options.AllowDuplicate {
+		return nil
+	}
+	comments, err := anchorComments(uri)
+	if err != nil || len(comments) == 0 {
+		return nil
+	}
+	anchor := ""
+	if !options.FileLevel {
+		content, err := readSourceFile(filePath)
+		if err != nil {
+			return nil
+		}
+		anchor = normalizedPatch(buildCommentPatch(filePath, string(content), rng))
+	}
+	private := options.Visibility == VisibilityPrivate
+	for idx := range comments {
+		patch := &comments[idx].Patch
+		if patch.isClosed() || patch.isPrivate() != private || patch.isFileLevel() != options.FileLevel {
+			continue
+		}
+		if !options.FileLevel && normalizedPatch(patch.Patch) != anchor {
+			continue
+		}
+		if messageSimilarity(patch.Message, message) >= duplicateSimilarity {
+			return &comments[idx]
+		}
+	}
+	return nil
+}
+
+// Asks whether to reply to the duplicated comment, add the comment anyway or
+// cancel, the chosen action or "" when cancelled. Must not be called from the
+// handler goroutine.
+func (h *handler) askDuplicate(ctx context.Context, duplicate *anchoredComment) string {
+	params := protocol.ShowMessageRequestParams{
+		Type: protocol.MessageTypeInfo,
+		Message: fmt.Sprintf("%s already commented this code: \"%s\". Reply to this thread instead of adding a new comment?",
+			duplicate.Patch.authorLabel(), truncateMessage(duplicate.Patch.Message, 60)),
+		Actions: []protocol.MessageActionItem{{Title: duplicateReplyAction}, {Title: duplicateAddAction}, {Title: cancelAction}},
+	}
+	var chosen *protocol.MessageActionItem
+	if _, err := h.conn.Call(ctx, "window/showMessageRequest", params, &chosen); err != nil {
+		// Clients that cannot ask add the comment as requested
+		logErrorf("Error while asking about a duplicate comment: %v", err)
+		return duplicateAddAction
+	}
+	if chosen == nil || chosen.Title == cancelAction {
+		return ""
+	}
+	return chosen.Title
+}
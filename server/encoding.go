@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Units of the character offsets of positions, negotiated with the client
+// on initialize (LSP 3.17). Clients that do not negotiate count in UTF-16.
+const (
+	PositionEncodingUTF8  = "utf-8"
+	PositionEncodingUTF16 = "utf-16"
+	PositionEncodingUTF32 = "utf-32"
+)
+
+var positionEncodingMutex sync.RWMutex
+var positionEncoding = PositionEncodingUTF16
+
+// Picks the first encoding offered by the client, they are listed by
+// preference
+func negotiatePositionEncoding(offered []string) string {
+	for _, encoding := range offered {
+		switch encoding {
+		case PositionEncodingUTF8, PositionEncodingUTF16, PositionEncodingUTF32:
+			return encoding
+		}
+	}
+	return PositionEncodingUTF16
+}
+
+func getPositionEncoding() string {
+	positionEncodingMutex.RLock()
+	defer positionEncodingMutex.RUnlock()
+	return positionEncoding
+}
+
+func setPositionEncoding(encoding string) {
+	positionEncodingMutex.Lock()
+	defer positionEncodingMutex.Unlock()
+	positionEncoding = encoding
+}
+
+// Length of text in the units of the position encoding
+func encodedLength(text string) int {
+	switch getPositionEncoding() {
+	case PositionEncodingUTF8:
+		return len(text)
+	case PositionEncodingUTF32:
+		return utf8.RuneCountInString(text)
+	}
+	return len(utf16.Encode([]rune(text)))
+}
+
+// Byte offset in text of a character offset in the units of the position
+// encoding. Offsets inside a character point to its start, false when past
+// the end of text.
+func byteOffset(text string, character int) (int, bool) {
+	encoding := getPositionEncoding()
+	if encoding == PositionEncodingUTF8 {
+		if character > len(text) {
+			return len(text), false
+		}
+		for character > 0 && character < len(text) && !utf8.RuneStart(text[character]) {
+			character--
+		}
+		return character, true
+	}
+	units := 0
+	for offset, r := range text {
+		if units >= character {
+			return offset, true
+		}
+		units += runeUnits(encoding, r)
+		if units > character {
+			return offset, true
+		}
+	}
+	return len(text), units == character
+}
+
+func runeUnits(encoding string, r rune) int {
+	if encoding == PositionEncodingUTF32 {
+		return 1
+	}
+	return utf16.RuneLen(r)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"go.lsp.dev/jsonrpc2"
+)
+
+type ErrorCode string
+
+const (
+	ErrAnchorFailed     ErrorCode = "ANCHOR_FAILED"     // A patch could not be anchored in the document
+	ErrStoreCorrupt     ErrorCode = "STORE_CORRUPT"     // A comment file could not be parsed
+	ErrSyncConflict     ErrorCode = "SYNC_CONFLICT"     // The comments repository could not be synchronised
+	ErrPermissionDenied ErrorCode = "PERMISSION_DENIED" // A file could not be read or written
+	ErrVCSUnavailable   ErrorCode = "VCS_UNAVAILABLE"   // A git command failed
+	ErrAuthFailed       ErrorCode = "AUTH_FAILED"       // The comments repository rejected the credentials
+	ErrSchemaTooNew     ErrorCode = "SCHEMA_TOO_NEW"    // A comment file was written by a newer server
+)
+
+// JSON-RPC code used for every CommentError, the ErrorCode is sent in data
+const commentErrorRPCCode jsonrpc2.Code = -32000
+
+type CommentError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *CommentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommentError) Unwrap() error {
+	return e.Err
+}
+
+func newCommentError(code ErrorCode, format string, args ...interface{}) error {
+	return &CommentError{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Wraps a file system error, flagging it as PERMISSION_DENIED when it comes
+// from missing rights.
+func wrapFileError(err error, format string, args ...interface{}) error {
+	wrapped := fmt.Errorf(format, args...)
+	if errors.Is(err, os.ErrPermission) {
+		return &CommentError{Code: ErrPermissionDenied, Err: wrapped}
+	}
+	return wrapped
+}
+
+func errorCodeOf(err error) ErrorCode {
+	var commentErr *CommentError
+	if errors.As(err, &commentErr) {
+		return commentErr.Code
+	}
+	return ""
+}
+
+var errorCountsMutex sync.Mutex
+var errorCounts = map[ErrorCode]int{}
+
+// Logs an error of background work with its code, counts it in the server
+// stats and shows it to the user
+func recordError(err error) {
+	if countError(err) {
+		notifyError(err)
+	}
+}
+
+// Logs an error with its code and counts it in the server stats, returns
+// whether it has a code
+func countError(err error) bool {
+	code := errorCodeOf(err)
+	if code == "" {
+		logErrorf("Error: %v", err)
+		return false
+	}
+	logErrorf("Error [%s]: %v", code, err)
+	errorCountsMutex.Lock()
+	errorCounts[code]++
+	errorCountsMutex.Unlock()
+	return true
+}
+
+func errorStats() map[ErrorCode]int {
+	errorCountsMutex.Lock()
+	defer errorCountsMutex.Unlock()
+	stats := make(map[ErrorCode]int, len(errorCounts))
+	for code, count := range errorCounts {
+		stats[code] = count
+	}
+	return stats
+}
+
+// Wraps a replier so that every CommentError is counted and sent to the
+// client as a JSON-RPC error with its code in the error data. It is not shown
+// with window/showMessage: the client already shows the failed request.
+func withErrorData(reply jsonrpc2.Replier) jsonrpc2.Replier {
+	return func(ctx context.Context, result interface{}, err error) error {
+		if err == nil {
+			return reply(ctx, result, nil)
+		}
+		countError(err)
+		code := errorCodeOf(err)
+		if code == "" {
+			return reply(ctx, result, err)
+		}
+		data, marshalErr := json.Marshal(map[string]ErrorCode{"code": code})
+		if marshalErr != nil {
+			return reply(ctx, result, err)
+		}
+		raw := json.RawMessage(data)
+		return reply(ctx, nil, &jsonrpc2.Error{
+			Code:    commentErrorRPCCode,
+			Message: err.Error(),
+			Data:    &raw,
+		})
+	}
+}
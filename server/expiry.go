@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comments expire on their own expiry date, when they have one, and by the
+// expiry rules of the settings, e.g. { "state": "resolved", "afterDays": 90,
+// "action": "delete" }. A background sweep resolves or deletes the expired
+// comments and logs them.
+
+const expiryCheckInterval = time.Hour
+
+// What happens to expired comments
+const (
+	ExpiryResolve = "resolve"
+	ExpiryDelete  = "delete"
+)
+
+type ExpiryRule struct {
+	State string `json:"state"` // Open when empty
+	// Since the last update of open comments, the resolution of the others
+	AfterDays int    `json:"afterDays"`
+	Action    string `json:"action"` // resolve or delete, resolve when empty
+}
+
+func (rule ExpiryRule) state() string {
+	if rule.State == "" {
+		return StateOpen
+	}
+	return rule.State
+}
+
+func (rule ExpiryRule) action() string {
+	if rule.Action == "" {
+		return ExpiryResolve
+	}
+	return rule.Action
+}
+
+func validateExpiryRules(rules []ExpiryRule) error {
+	for _, rule := range rules {
+		if _, ok := stateTransitions[rule.state()]; !ok {
+			return fmt.Errorf("unknown comment state %q in expiry rule", rule.State)
+		}
+		if rule.AfterDays <= 0 {
+			return fmt.Errorf("expiry of %s comments must be after a positive number of days", rule.state())
+		}
+		switch rule.action() {
+		case ExpiryDelete:
+		case ExpiryResolve:
+			if rule.state() != StateOpen {
+				return fmt.Errorf("%s comments can only expire by deletion", rule.state())
+			}
+		default:
+			return fmt.Errorf("unknown expiry action %q, expected resolve or delete", rule.Action)
+		}
+	}
+	return nil
+}
+
+// Parses an expiry date, YYYY-MM-DD (expiring at the end of the day) or
+// RFC3339, into the RFC3339 stored in comments
+func parseExpiry(expiry string) (string, error) {
+	if expiry == "" {
+		return "", nil
+	}
+	if date, err := time.Parse(dueDateLayout, expiry); err == nil {
+		return date.AddDate(0, 0, 1).UTC().Format(time.RFC3339), nil
+	}
+	if at, err := time.Parse(time.RFC3339, expiry); err == nil {
+		return at.UTC().Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("invalid expiry %q, expected YYYY-MM-DD or RFC3339", expiry)
+}
+
+// Sets when a comment expires, never when empty
+func setCommentExpiry(uri protocol.DocumentURI, id string, expiry string) error {
+	expiresAt, err := parseExpiry(expiry)
+	if err != nil {
+		return err
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.ExpiresAt = expiresAt
+		return nil
+	})
+}
+
+// What happens to a comment expired at now, and why, nothing when it is not
+func (patch *Patch) expiry(now time.Time, rules []ExpiryRule) (string, string) {
+	if patch.Draft {
+		return "", ""
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, patch.ExpiresAt); err == nil && !now.Before(expiresAt) && !patch.isClosed() {
+		return ExpiryResolve, "expired on " + patch.ExpiresAt
+	}
+	for _, rule := range rules {
+		if rule.state() != patch.state() {
+			continue
+		}
+		since := patch.UpdatedAt
+		if patch.isClosed() && patch.ResolvedAt != "" {
+			since = patch.ResolvedAt
+		}
+		if since == "" {
+			since = patch.CreatedAt
+		}
+		at, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			continue
+		}
+		if now.Sub(at) >= time.Duration(rule.AfterDays)*24*time.Hour {
+			return rule.action(), fmt.Sprintf("%s for more than %d days", rule.state(), rule.AfterDays)
+		}
+	}
+	return "", ""
+}
+
+type ExpiredComment struct {
+	Path    string `json:"path"` // Relative to the repository
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+}
+
+// Resolves or deletes the expired comments of the repository
+func expireComments(repoDir string, now time.Time, rules []ExpiryRule) ([]ExpiredComment, error) {
+	expired := []ExpiredComment{}
+	user := currentUser(repoDir)
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		unlock, err := lockCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		defer unlock()
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		kept := []Patch{}
+		changed := false
+		for idx := range commentFile.Patches {
+			patch := &commentFile.Patches[idx]
+			action, reason := patch.expiry(now, rules)
+			if action == "" {
+				kept = append(kept, *patch)
+				continue
+			}
+			changed = true
+			storeLog.infof("Expire comment %s of %s (%s): %s", commentID(patch), rel, reason, action)
+			expired = append(expired, ExpiredComment{
+				Path:    filepath.ToSlash(rel),
+				ID:      commentID(patch),
+				Message: patch.Message,
+				Action:  action,
+				Reason:  reason,
+			})
+			event := AuditEvent{
+				Event:   AuditCommentDeleted,
+				User:    user,
+				Author:  patch.author(),
+				Path:    filepath.ToSlash(rel),
+				Comment: commentID(patch),
+			}
+			if action == ExpiryDelete {
+				removeAttachments(repoDir, patch)
+			} else {
+				patch.State = StateResolved
+				patch.ResolvedAt = now.UTC().Format(time.RFC3339)
+				patch.UpdatedAt = patch.ResolvedAt
+				kept = append(kept, *patch)
+				event.Event = AuditCommentResolved
+			}
+			if err := appendAuditEvent(repoDir, event); err != nil {
+				recordError(err)
+			}
+		}
+		if !changed {
+			return nil
+		}
+		commentFile.Patches = kept
+		if len(kept) == 0 {
+			return deleteCommentFile(commentFilePath)
+		}
+		return writeCommentFile(commentFilePath, commentFile)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing comment files: %v", err)
+	}
+	if len(expired) > 0 {
+		if err := updateCommentsRepoAfterChange(); err != nil {
+			return nil, newCommentError(ErrSyncConflict, "error while updating comments repository: %w", err)
+		}
+	}
+	return expired, nil
+}
+
+// Expires comments until ctx is done
+func (h *handler) runExpirySweep(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		if repoDir := getRepoDirFromDir(h.rootPath); repoDir != "" {
+			expired, err := expireComments(repoDir, time.Now(), getSettings().ExpiryRules)
+			if err != nil {
+				recordError(err)
+			} else if len(expired) > 0 {
+				h.notifyCommentsChanged(ctx, ChangeLocal)
+				h.republishDiagnostics(ctx)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
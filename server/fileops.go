@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Every file and folder of the workspace, comments follow them when they
+// are renamed
+var fileOperationFilters = []protocol.FileOperationFilter{
+	{Scheme: "file", Pattern: protocol.FileOperationPattern{Glob: "**/*"}},
+}
+
+// Repository holding path, found from its closest existing folder so that
+// it also works for paths that do not exist yet
+func repoDirOfPath(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return getRepoDirFromDir(dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Comment file of filePath, the comment folder of a folder when it has no
+// .json suffix
+func commentPathOf(filePath string) string {
+	repoDir := repoDirOfPath(filePath)
+	if repoDir == "" {
+		return filePath + ".json"
+	}
+	rel, err := filepath.Rel(repoDir, filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filePath + ".json"
+	}
+	return filepath.Join(commentsDirOf(repoDir), rel+".json")
+}
+
+// Moves the comments of a renamed file or folder to the comment files of its
+// new path, before the client renames it.
+func migrateComments(oldPath string, newPath string) error {
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		return wrapFileError(err, "error while reading renamed file: %w", err)
+	}
+	if err := migrateNotes(oldPath, newPath, info.IsDir()); err != nil {
+		return err
+	}
+	oldCommentPath := commentPathOf(oldPath)
+	newCommentPath := commentPathOf(newPath)
+	if !info.IsDir() {
+		return moveCommentFile(oldCommentPath, newCommentPath)
+	}
+
+	// Comment files of a folder outside of a repository are stored next to
+	// the files and move with them, only the comment folder must be moved
+	oldCommentDir := strings.TrimSuffix(oldCommentPath, ".json")
+	newCommentDir := strings.TrimSuffix(newCommentPath, ".json")
+	if oldCommentDir == oldPath {
+		return nil
+	}
+	return moveCommentDir(oldCommentDir, newCommentDir)
+}
+
+// Moves the comment files of a comment folder to another
+func moveCommentDir(oldCommentDir string, newCommentDir string) error {
+	if _, err := os.Stat(oldCommentDir); os.IsNotExist(err) {
+		return nil
+	}
+	err := filepath.WalkDir(oldCommentDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") && !strings.HasSuffix(path, ".yaml") {
+			return err
+		}
+		path = commentFileKey(path)
+		rel, err := filepath.Rel(oldCommentDir, path)
+		if err != nil {
+			return err
+		}
+		return moveCommentFile(path, filepath.Join(newCommentDir, rel))
+	})
+	if err != nil {
+		return wrapFileError(err, "error while moving comments of %s: %w", oldCommentDir, err)
+	}
+	return os.RemoveAll(oldCommentDir)
+}
+
+// Moves a comment file, appending its comments to the destination file if it
+// already exists
+func moveCommentFile(oldCommentPath string, newCommentPath string) error {
+	if filepath.Clean(oldCommentPath) == filepath.Clean(newCommentPath) {
+		return nil
+	}
+	for _, path := range []string{oldCommentPath, newCommentPath} {
+		unlock, err := lockCommentFile(path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	commentFile, err := readCommentFile(oldCommentPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing, err := readCommentFile(newCommentPath); err == nil {
+		existing.Patches = append(existing.Patches, commentFile.Patches...)
+		commentFile = existing
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newCommentPath), os.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	if err := writeCommentFile(newCommentPath, commentFile); err != nil {
+		return err
+	}
+	if err := deleteCommentFile(oldCommentPath); err != nil {
+		return err
+	}
+	storeLog.infof("Moved comments from %s to %s", oldCommentPath, newCommentPath)
+	return nil
+}
+
+// Handles workspace/willRenameFiles. Comments are moved without workspace
+// edit: comment files are not opened in the editor.
+func (h *handler) willRenameFiles(ctx context.Context, params protocol.RenameFilesParams) error {
+	if !isWorkspaceTrusted() {
+		return newCommentError(ErrPermissionDenied, "comments are read-only until the workspace is trusted, they cannot follow the renamed files")
+	}
+	if status := h.sync.get(); status.ReadOnly {
+		return newCommentError(ErrPermissionDenied, "comments are read-only, they cannot follow the renamed files: %s", status.Error)
+	}
+	var changes []CommentChange
+	for _, file := range params.Files {
+		oldURI := protocol.DocumentURI(file.OldURI)
+		newURI := protocol.DocumentURI(file.NewURI)
+		if err := migrateComments(uriToPath(oldURI), uriToPath(newURI)); err != nil {
+			return fmt.Errorf("error while moving the comments of %s: %w", file.OldURI, err)
+		}
+		changes = append(changes, CommentChange{URI: oldURI}, CommentChange{URI: newURI})
+	}
+	if len(changes) > 0 {
+		h.notifyCommentsChanged(ctx, ChangeLocal, changes...)
+	}
+	return nil
+}
+
+// Handles workspace/willDeleteFiles and workspace/didDeleteFiles: the comments
+// of the deleted files are archived. Clients sending both archive on
+// willDeleteFiles, when the deleting commit can still be read, and the
+// notification finds nothing left.
+func (h *handler) archiveDeleted(ctx context.Context, params protocol.DeleteFilesParams) error {
+	if !isWorkspaceTrusted() {
+		return newCommentError(ErrPermissionDenied, "comments are read-only until the workspace is trusted, the comments of the deleted files are kept")
+	}
+	if status := h.sync.get(); status.ReadOnly {
+		return newCommentError(ErrPermissionDenied, "comments are read-only, the comments of the deleted files are kept: %s", status.Error)
+	}
+	pathsByRepo := map[string][]string{}
+	var changes []CommentChange
+	for _, file := range params.Files {
+		path := uriToPath(protocol.DocumentURI(file.URI))
+		if repoDir := repoDirOfPath(path); repoDir != "" {
+			pathsByRepo[repoDir] = append(pathsByRepo[repoDir], path)
+			changes = append(changes, CommentChange{URI: protocol.DocumentURI(file.URI)})
+		}
+	}
+	archived := 0
+	for repoDir, paths := range pathsByRepo {
+		count, err := archiveDeletedFiles(repoDir, paths)
+		if err != nil {
+			return fmt.Errorf("error while archiving the comments of deleted files: %w", err)
+		}
+		archived += count
+	}
+	if archived > 0 {
+		h.notifyCommentsChanged(ctx, ChangeLocal, changes...)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"go.lsp.dev/protocol"
+)
+
+// Returns the folding capabilities of the client, nil when it cannot fold
+func foldingRangeCapabilities(capabilities protocol.ClientCapabilities) *protocol.FoldingRangeClientCapabilities {
+	if capabilities.TextDocument == nil {
+		return nil
+	}
+	return capabilities.TextDocument.FoldingRange
+}
+
+// One folding range per comment spanning several lines, so that regions
+// under discussion can be collapsed.
+func (h *handler) foldingRanges(uri protocol.DocumentURI) []protocol.FoldingRange {
+	ranges := []protocol.FoldingRange{}
+	comments, err := anchorComments(uri)
+	if err != nil {
+		anchorLog.debugf("No comment folding ranges for %s: %v", uri, err)
+		return ranges
+	}
+	for _, comment := range comments {
+		if comment.Range.Start.Line >= comment.Range.End.Line {
+			continue
+		}
+		foldingRange := protocol.FoldingRange{
+			StartLine: comment.Range.Start.Line,
+			EndLine:   comment.Range.End.Line,
+			Kind:      protocol.RegionFoldingRange,
+		}
+		if !h.foldingRange.LineFoldingOnly {
+			foldingRange.StartCharacter = comment.Range.Start.Character
+			foldingRange.EndCharacter = comment.Range.End.Character
+		}
+		ranges = append(ranges, foldingRange)
+		if limit := h.foldingRange.RangeLimit; limit > 0 && uint32(len(ranges)) == limit {
+			break
+		}
+	}
+	return ranges
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files generated from another one, e.g.
+// { "pattern": "^(.*)\\.pb\\.go$", "source": "$1.proto" }. The pattern
+// matches the path relative to the repository, $1... in source are its
+// groups. Comments on generated files are attached to their source, where
+// the fix happens; without source they are refused.
+type GeneratedFileRule struct {
+	Pattern string `json:"pattern"`
+	Source  string `json:"source,omitempty"`
+}
+
+func validateGeneratedFiles(rules []GeneratedFileRule) error {
+	for _, rule := range rules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid generated file pattern %q: %v", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// Returns the generator input of filePath, and whether it is generated. The
+// source is empty for generated files without known source.
+func generatorInput(filePath string, repoDir string, rules []GeneratedFileRule) (string, bool) {
+	rel := filePath
+	if repoDir != "" {
+		if relativePath, err := filepath.Rel(repoDir, filePath); err == nil {
+			rel = relativePath
+		}
+	}
+	rel = filepath.ToSlash(rel)
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		match := pattern.FindStringSubmatchIndex(rel)
+		if match == nil {
+			continue
+		}
+		if rule.Source == "" {
+			return "", true
+		}
+		source := filepath.FromSlash(string(pattern.ExpandString(nil, rule.Source, rel, match)))
+		if repoDir != "" && !filepath.IsAbs(source) {
+			source = filepath.Join(repoDir, source)
+		}
+		return source, true
+	}
+	return "", false
+}
+
+// Redirects a comment on a generated file to the first line of its
+// generator input. Returns the file to comment and the generated file it is
+// about, relative to the repository, or the file itself when not generated.
+func redirectGeneratedComment(filePath string, repoDir string) (string, string, error) {
+	source, generated := generatorInput(filePath, repoDir, getSettings().GeneratedFiles)
+	if !generated {
+		return filePath, "", nil
+	}
+	if source == "" {
+		return "", "", fmt.Errorf("%s is a generated file, comment its generator input instead", filepath.Base(filePath))
+	}
+	if _, err := os.Stat(source); err != nil {
+		return "", "", wrapFileError(err, "generator input %s of %s not found: %w", source, filepath.Base(filePath), err)
+	}
+	generatedPath := filePath
+	if repoDir != "" {
+		if rel, err := filepath.Rel(repoDir, filePath); err == nil && !strings.HasPrefix(rel, "..") {
+			generatedPath = rel
+		}
+	}
+	anchorLog.infof("Comment on generated file %s attached to %s", filePath, source)
+	return source, filepath.ToSlash(generatedPath), nil
+}
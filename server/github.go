@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Minimal client of the GitHub REST API, for the pull requests reviewed from
+// the editor. GitHub Enterprise servers are reached at https://<host>/api/v3.
+
+var githubClient = &http.Client{Timeout: 30 * time.Second}
+
+type githubRepo struct {
+	apiURL string
+	owner  string
+	name   string
+	token  string
+}
+
+type githubPullRequest struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
+	Head    struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+}
+
+// Comment of a pull request on a line of its diff
+type githubReviewComment struct {
+	ID        int64  `json:"id"`
+	InReplyTo int64  `json:"in_reply_to_id,omitempty"`
+	Path      string `json:"path"`
+	// Lines in the head of the pull request, none when the comment is outdated
+	Line      *int   `json:"line,omitempty"`
+	StartLine *int   `json:"start_line,omitempty"`
+	Side      string `json:"side,omitempty"`
+	Body      string `json:"body"`
+	User      struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// Comment created with a review
+type githubDraftComment struct {
+	Path      string `json:"path"`
+	Body      string `json:"body"`
+	Line      int    `json:"line"`
+	StartLine int    `json:"start_line,omitempty"`
+	Side      string `json:"side"`
+}
+
+type githubReview struct {
+	CommitID string               `json:"commit_id"`
+	Body     string               `json:"body,omitempty"`
+	Event    string               `json:"event"` // APPROVE, REQUEST_CHANGES or COMMENT
+	Comments []githubDraftComment `json:"comments"`
+}
+
+// The GitHub repository of the origin remote of repoDir. The token comes
+// from GITHUB_TOKEN, GH_TOKEN or the git credential helpers.
+func githubRepoOf(ctx context.Context, repoDir string) (*githubRepo, error) {
+	parts := strings.Split(repoIdentity(repoDir), "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("the origin remote of %s is not a GitHub repository", repoDir)
+	}
+	host := parts[0]
+	repo := &githubRepo{apiURL: "https://" + host + "/api/v3", owner: parts[1], name: parts[2]}
+	if host == "github.com" {
+		repo.apiURL = "https://api.github.com"
+	}
+	for _, variable := range []string{"GITHUB_TOKEN", "GH_TOKEN"} {
+		if token := os.Getenv(variable); token != "" {
+			repo.token = token
+			return repo, nil
+		}
+	}
+	cmd := gitCommandContext(ctx, "credential", "fill")
+	cmd.Dir = repoDir
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", host))
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, newCommentError(ErrAuthFailed, "no GitHub token: set GITHUB_TOKEN or store credentials for %s (%w)", host, err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if password, ok := strings.CutPrefix(line, "password="); ok {
+			repo.token = password
+		}
+	}
+	if repo.token == "" {
+		return nil, newCommentError(ErrAuthFailed, "no GitHub token: set GITHUB_TOKEN or store credentials for %s", host)
+	}
+	return repo, nil
+}
+
+// Calls the API at path, relative to the repository, decoding the answer in
+// result when not nil
+func (repo *githubRepo) request(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("error while serializing GitHub request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s%s", repo.apiURL, repo.owner, repo.name, path)
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+repo.token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := githubClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while calling GitHub: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error while reading GitHub answer: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &failure)
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return newCommentError(ErrAuthFailed, "GitHub rejected the token: %s %s", resp.Status, failure.Message)
+		}
+		return fmt.Errorf("GitHub returned %s for %s %s: %s", resp.Status, method, path, failure.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("invalid GitHub answer for %s: %w", path, err)
+	}
+	return nil
+}
+
+// Creates an issue of the repository, for comment.createIssue
+func (repo *githubRepo) createIssue(ctx context.Context, issue issueDraft) (string, error) {
+	request := map[string]interface{}{"title": issue.Title, "body": issue.Body}
+	if len(issue.Labels) > 0 {
+		request["labels"] = issue.Labels
+	}
+	var created struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := repo.request(ctx, http.MethodPost, "/issues", request, &created); err != nil {
+		return "", err
+	}
+	return created.HTMLURL, nil
+}
+
+func (repo *githubRepo) pullRequest(ctx context.Context, number int) (*githubPullRequest, error) {
+	var pr githubPullRequest
+	if err := repo.request(ctx, http.MethodGet, fmt.Sprintf("/pulls/%d", number), nil, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// Review comments of a pull request, oldest first
+func (repo *githubRepo) reviewComments(ctx context.Context, number int) ([]githubReviewComment, error) {
+	const perPage = 100
+	comments := []githubReviewComment{}
+	for page := 1; ; page++ {
+		var pageComments []githubReviewComment
+		path := fmt.Sprintf("/pulls/%d/comments?per_page=%d&page=%d", number, perPage, page)
+		if err := repo.request(ctx, http.MethodGet, path, nil, &pageComments); err != nil {
+			return nil, err
+		}
+		comments = append(comments, pageComments...)
+		if len(pageComments) < perPage {
+			return comments, nil
+		}
+	}
+}
+
+// Submits a review, its comments are created with it
+func (repo *githubRepo) submitReview(ctx context.Context, number int, review githubReview) (int64, error) {
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := repo.request(ctx, http.MethodPost, fmt.Sprintf("/pulls/%d/reviews", number), review, &created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+func (repo *githubRepo) reviewCommentsOf(ctx context.Context, number int, review int64) ([]githubReviewComment, error) {
+	var comments []githubReviewComment
+	path := fmt.Sprintf("/pulls/%d/reviews/%d/comments?per_page=100", number, review)
+	if err := repo.request(ctx, http.MethodGet, path, nil, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (repo *githubRepo) replyToReviewComment(ctx context.Context, number int, comment int64, body string) (int64, error) {
+	var created githubReviewComment
+	path := fmt.Sprintf("/pulls/%d/comments/%d/replies", number, comment)
+	if err := repo.request(ctx, http.MethodPost, path, map[string]string{"body": body}, &created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
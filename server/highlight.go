@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Commented lines of a hunk of a recorded patch
+type hunkLines struct {
+	start int // Line of the first commented line, in the recorded content
+	count int
+}
+
+// Commented lines of every hunk of a patch. Anchoring only uses the first one.
+func patchHunks(patchText string) []hunkLines {
+	hunks := []hunkLines{}
+	var current *hunkLines
+	inChange := false
+	for _, line := range strings.Split(patchText, "\n") {
+		if strings.HasPrefix(line, "@@") {
+			oldStart, _, _, ok := parseHunkHeader(line)
+			if !ok {
+				return hunks
+			}
+			hunks = append(hunks, hunkLines{start: max(oldStart-1, 0)})
+			current = &hunks[len(hunks)-1]
+			inChange = false
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "-"):
+			inChange = true
+			current.count++
+		case strings.HasPrefix(line, " ") && !inChange:
+			current.start++
+		}
+	}
+	return hunks
+}
+
+// The comment whose lines hold line, the innermost when they overlap
+func commentAt(comments []anchoredComment, line uint32) *anchoredComment {
+	var found *anchoredComment
+	for idx := range comments {
+		rng := comments[idx].Range
+		if line < rng.Start.Line || line >= rng.End.Line && line != rng.Start.Line {
+			continue
+		}
+		if found == nil || rng.End.Line-rng.Start.Line < found.Range.End.Line-found.Range.Start.Line {
+			found = &comments[idx]
+		}
+	}
+	return found
+}
+
+// Highlights all the lines of the comment under the cursor, every hunk of its
+// patch, so that the extent of the comment is obvious.
+func documentHighlights(params protocol.DocumentHighlightParams) []protocol.DocumentHighlight {
+	highlights := []protocol.DocumentHighlight{}
+	comments, err := anchorComments(params.TextDocument.URI)
+	if err != nil {
+		anchorLog.debugf("No comment highlights for %s: %v", params.TextDocument.URI, err)
+		return highlights
+	}
+	active := commentAt(comments, params.Position.Line)
+	if active == nil || active.FileLevel {
+		return highlights
+	}
+	highlights = append(highlights, protocol.DocumentHighlight{Range: active.Range, Kind: protocol.DocumentHighlightKindText})
+	for _, secondary := range active.SecondaryRanges {
+		highlights = append(highlights, protocol.DocumentHighlight{Range: secondary, Kind: protocol.DocumentHighlightKindText})
+	}
+	hunks := patchHunks(active.Patch.Patch)
+	for _, hunk := range hunks[min(1, len(hunks)):] {
+		// Other hunks keep their distance to the anchored one
+		start := int(active.Range.Start.Line) + hunk.start - hunks[0].start
+		if start < 0 || hunk.count == 0 {
+			continue
+		}
+		highlights = append(highlights, protocol.DocumentHighlight{
+			Range: protocol.Range{
+				Start: protocol.Position{Line: uint32(start)},
+				End:   protocol.Position{Line: uint32(start + hunk.count)},
+			},
+			Kind: protocol.DocumentHighlightKindText,
+		})
+	}
+	return highlights
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Edits of a comment never lose its previous messages: each one is appended
+// to the history of the comment with who replaced it and when, so that
+// reviewers can see what changed in a contested thread.
+
+type CommentRevision struct {
+	Message  string `json:"message"`  // Message before the edit
+	Editor   string `json:"editor"`   // Who replaced it
+	EditedAt string `json:"editedAt"` // RFC3339
+}
+
+// Keeps the current message of a comment before it is replaced by editor
+func (patch *Patch) recordRevision(editor string, now time.Time) {
+	patch.History = append(patch.History, CommentRevision{
+		Message:  patch.Message,
+		Editor:   editor,
+		EditedAt: now.UTC().Format(time.RFC3339),
+	})
+}
+
+type CommentHistory struct {
+	Message   string            `json:"message"`   // Current message
+	Revisions []CommentRevision `json:"revisions"` // Oldest first
+}
+
+// History of the comment of params
+func commentHistory(params GetCommentParams) (*CommentHistory, error) {
+	index := params.Index
+	if params.ID != "" {
+		var err error
+		if index, err = commentIndexByID(params.URI, params.ID); err != nil {
+			return nil, err
+		}
+	}
+	filePath := uriToPath(params.URI)
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(commentFile.Patches) {
+		return nil, fmt.Errorf("no comment %d in %s", index, filePath)
+	}
+	patch := commentFile.Patches[index]
+	history := &CommentHistory{Message: patch.Message, Revisions: patch.History}
+	if history.Revisions == nil {
+		history.Revisions = []CommentRevision{}
+	}
+	return history, nil
+}
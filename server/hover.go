@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Hovering a commented line shows its thread, with who wrote each message
+// and when.
+
+// Format of the hovers preferred by the client, plain text when it does not
+// read markdown
+func hoverFormat(capabilities protocol.ClientCapabilities) protocol.MarkupKind {
+	if textDocument := capabilities.TextDocument; textDocument != nil && textDocument.Hover != nil {
+		if slices.Contains(textDocument.Hover.ContentFormat, protocol.Markdown) {
+			return protocol.Markdown
+		}
+	}
+	return protocol.PlainText
+}
+
+func (h *handler) hover(params protocol.HoverParams) *protocol.Hover {
+	comments, err := anchorComments(params.TextDocument.URI)
+	if err != nil {
+		anchorLog.debugf("No comment hover for %s: %v", params.TextDocument.URI, err)
+	}
+	comments = append(comments, anchorCrossFileComments(params.TextDocument.URI)...)
+	comment := commentAt(comments, params.Position.Line)
+	if comment == nil {
+		return nil
+	}
+	markdown := h.hoverFormat == protocol.Markdown
+	// Messages are markdown, shown without their syntax in plain text
+	body := plainMarkdown
+	if markdown {
+		body = sanitizeMarkdown
+	}
+	var text strings.Builder
+	now := time.Now()
+	text.WriteString(hoverHeader(comment.Patch.authorLabel(), comment.Patch.CreatedAt, comment.Patch.UpdatedAt, now, markdown))
+	if comment.Patch.Severity != "" {
+		text.WriteString(" [" + comment.Patch.Severity + "]")
+	}
+	if comment.Patch.isClosed() {
+		text.WriteString(" (" + comment.Patch.state() + ")")
+	}
+	if comment.SourceURI != "" {
+		text.WriteString(" · from " + filepath.Base(uriToPath(comment.SourceURI)))
+	}
+	if votes := votesSummary(comment.Patch.voteCounts()); votes != "" {
+		text.WriteString(" · " + votes)
+	}
+	text.WriteString("\n\n" + body(displayMessage(comment.Patch)))
+	if suggestion := comment.Patch.Suggestion; suggestion != nil {
+		if markdown {
+			text.WriteString("\n\nSuggested change:\n\n" + suggestionMarkdown(uriToPath(params.TextDocument.URI), *suggestion))
+		} else {
+			text.WriteString("\n\nSuggested change:\n" + strings.TrimSuffix(*suggestion, "\n"))
+		}
+	}
+	if issueURL := comment.Patch.IssueURL; issueURL != "" {
+		if markdown {
+			text.WriteString("\n\nIssue: <" + issueURL + ">")
+		} else {
+			text.WriteString("\n\nIssue: " + issueURL)
+		}
+	}
+	if len(comment.Patch.Attachments) > 0 {
+		text.WriteString("\n\n" + attachmentsHover(getUserRepoDir(uriToPath(params.TextDocument.URI)), comment.Patch.Attachments, markdown))
+	}
+	for _, reply := range comment.Patch.Replies {
+		author := reply.Author
+		if author == "" {
+			author = "anonymous"
+		}
+		if markdown {
+			text.WriteString("\n\n---\n\n")
+		} else {
+			text.WriteString("\n\n↳ ")
+		}
+		text.WriteString(hoverHeader(author, reply.CreatedAt, reply.UpdatedAt, now, markdown) + "\n\n" + body(reply.Message))
+	}
+	rng := comment.Range
+	return &protocol.Hover{
+		Contents: protocol.MarkupContent{Kind: h.hoverFormat, Value: text.String()},
+		Range:    &rng,
+	}
+}
+
+// Links to the attached files, their paths in plain text
+func attachmentsHover(repoDir string, attachments []Attachment, markdown bool) string {
+	lines := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		if !markdown || repoDir == "" {
+			lines = append(lines, "Attachment: "+attachment.Name+" ("+attachment.Path+")")
+			continue
+		}
+		name := strings.NewReplacer("[", "\\[", "]", "\\]", "<", "\\<").Replace(attachment.Name)
+		lines = append(lines, fmt.Sprintf("Attachment: [%s](<%s>)", name, attachmentURI(repoDir, attachment)))
+	}
+	separator := "\n"
+	if markdown {
+		// Hard line breaks
+		separator = "  \n"
+	}
+	return strings.Join(lines, separator)
+}
+
+// "author · 2 days ago, updated 3 hours ago", the author in bold in markdown
+func hoverHeader(author string, createdAt string, updatedAt string, now time.Time, markdown bool) string {
+	if markdown {
+		// Angle brackets of the email would be read as HTML
+		author = "**" + strings.NewReplacer("<", "\\<", ">", "\\>", "*", "\\*").Replace(author) + "**"
+	}
+	if createdAt == "" {
+		return author
+	}
+	header := fmt.Sprintf("%s · %s", author, relativeTime(createdAt, now))
+	if updatedAt != "" && updatedAt != createdAt {
+		header += ", updated " + relativeTime(updatedAt, now)
+	}
+	return header
+}
+
+// "3 hours ago", "2 days ago"... The timestamp as is when it is not RFC3339.
+func relativeTime(timestamp string, now time.Time) string {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	elapsed := now.Sub(parsed)
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, unit := range units {
+		count := int(elapsed / unit.duration)
+		if count == 1 {
+			return "1 " + unit.name + " ago"
+		}
+		if count > 1 {
+			return fmt.Sprintf("%d %ss ago", count, unit.name)
+		}
+	}
+	return "just now"
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+)
+
+// Returns the identity of the local user: the one of the active profile, else
+// the email of the settings, else from the git configuration of dir the email
+// if there is one, the user name otherwise.
+func currentUser(dir string) string {
+	if profile, ok := activeProfile(dir); ok && profile.User != "" {
+		return profile.User
+	}
+	if email := getSettings().AuthorEmail; email != "" {
+		return email
+	}
+	for _, key := range []string{"user.email", "user.name"} {
+		cmd := gitCommand("config", key)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		if err != nil {
+			continue
+		}
+		if user := strings.TrimSpace(string(output)); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// Returns the name shown for the local user: the one of the settings, else
+// user.name from the git configuration of dir. Empty when none is set.
+func currentAuthorName(dir string) string {
+	if name := getSettings().AuthorName; name != "" {
+		return name
+	}
+	cmd := gitCommand("config", "user.name")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The comments folder has a generated index of its comment files, with their
+// number of comments by state, so that workspace-wide operations only parse
+// the files holding comments. The index is updated by the writes of the
+// server; files changed by others are reindexed when their modification time
+// or size differ from the indexed ones.
+
+// Version of the index format, older indexes are rebuilt
+const commentIndexVersion = 1
+
+type CommentIndexEntry struct {
+	Count  int            `json:"count"`
+	States map[string]int `json:"states"`
+	// Last update of a comment of the file, RFC3339
+	UpdatedAt string `json:"updatedAt,omitempty"`
+	// Of the comment file when indexed
+	ModTime string `json:"modTime,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+type CommentIndex struct {
+	Version int `json:"version"`
+	// By path of the source file relative to the comments folder, slash
+	// separated
+	Files map[string]*CommentIndexEntry `json:"files"`
+}
+
+// Indexes loaded by the server by comments folder
+var commentIndexes = struct {
+	mutex   sync.Mutex
+	indexes map[string]*CommentIndex
+	// Indexes to check against the comment files before their next use
+	stale map[string]bool
+}{indexes: map[string]*CommentIndex{}, stale: map[string]bool{}}
+
+func commentIndexPath(commentsDir string) string {
+	return filepath.Join(commentsDir, metaDirName, "index.json")
+}
+
+func indexEntryOf(commentFile *CommentFile) *CommentIndexEntry {
+	entry := &CommentIndexEntry{States: map[string]int{}}
+	var add func(commentFile *CommentFile)
+	add = func(commentFile *CommentFile) {
+		for idx := range commentFile.Patches {
+			patch := &commentFile.Patches[idx]
+			entry.Count++
+			entry.States[patch.state()]++
+			updatedAt := patch.UpdatedAt
+			if updatedAt == "" {
+				updatedAt = patch.CreatedAt
+			}
+			if updatedAt > entry.UpdatedAt {
+				entry.UpdatedAt = updatedAt
+			}
+		}
+		for _, cell := range commentFile.Cells {
+			add(cell)
+		}
+	}
+	add(commentFile)
+	return entry
+}
+
+// Modification time and size of the comment file, nothing for stores not
+// keeping files
+func statCommentFile(commentFilePath string) (string, int64) {
+	info, err := os.Stat(storedCommentFilePath(commentFilePath))
+	if err != nil {
+		return "", 0
+	}
+	return info.ModTime().UTC().Format(time.RFC3339Nano), info.Size()
+}
+
+// Whether the indexed entry still describes the comment file
+func (entry *CommentIndexEntry) current(commentFilePath string) bool {
+	modTime, size := statCommentFile(commentFilePath)
+	return modTime != "" && entry.ModTime == modTime && entry.Size == size
+}
+
+// Indexes the comment file, removes it from the index when it is gone
+func (index *CommentIndex) reindex(commentsDir string, commentFilePath string) {
+	rel, err := filepath.Rel(commentsDir, strings.TrimSuffix(commentFilePath, ".json"))
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	commentFile, err := getCommentStore().Get(commentFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		delete(index.Files, rel)
+		return
+	}
+	if err != nil {
+		// Indexed without comments until repaired
+		recordError(err)
+		commentFile = &CommentFile{}
+	}
+	entry := indexEntryOf(commentFile)
+	entry.ModTime, entry.Size = statCommentFile(commentFilePath)
+	index.Files[rel] = entry
+}
+
+// Reindexes the comment files changed since they were indexed and drops the
+// removed ones, reports whether the index changed
+func (index *CommentIndex) reconcile(commentsDir string) (bool, error) {
+	changed := false
+	seen := map[string]bool{}
+	err := getCommentStore().List(commentsDir, func(commentFilePath string, rel string) error {
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		if entry, ok := index.Files[rel]; ok && entry.current(commentFilePath) {
+			return nil
+		}
+		index.reindex(commentsDir, commentFilePath)
+		changed = true
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	for rel := range index.Files {
+		if !seen[rel] {
+			delete(index.Files, rel)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func readCommentIndex(commentsDir string) *CommentIndex {
+	index := &CommentIndex{Version: commentIndexVersion, Files: map[string]*CommentIndexEntry{}}
+	data, err := os.ReadFile(commentIndexPath(commentsDir))
+	if err != nil {
+		return index
+	}
+	var stored CommentIndex
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Version != commentIndexVersion || stored.Files == nil {
+		storeLog.infof("Rebuild comment index of %s", commentsDir)
+		return index
+	}
+	return &stored
+}
+
+func writeCommentIndex(commentsDir string, index *CommentIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error while serializing comment index: %v", err)
+	}
+	path := commentIndexPath(commentsDir)
+	if err := os.MkdirAll(filepath.Dir(path), fs.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Generated by each server, unlike the rest of the folder
+		if err := appendOnce(filepath.Join(filepath.Dir(path), ".gitignore"), "/"+filepath.Base(path)); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return wrapFileError(err, "error while writing comment index: %w", err)
+	}
+	return nil
+}
+
+// Index of the comments folder, loaded and checked against the comment files
+// on first use. Must be called with commentIndexes locked.
+func loadedCommentIndex(commentsDir string) (*CommentIndex, error) {
+	commentsDir = filepath.Clean(commentsDir)
+	index, loaded := commentIndexes.indexes[commentsDir]
+	if loaded && !commentIndexes.stale[commentsDir] {
+		return index, nil
+	}
+	if !loaded {
+		index = readCommentIndex(commentsDir)
+	}
+	changed, err := index.reconcile(commentsDir)
+	if err != nil {
+		return nil, fmt.Errorf("error while indexing comment files: %w", err)
+	}
+	if changed || !loaded {
+		if err := writeCommentIndex(commentsDir, index); err != nil {
+			// Rebuilt again next session
+			recordError(err)
+		}
+	}
+	commentIndexes.indexes[commentsDir] = index
+	delete(commentIndexes.stale, commentsDir)
+	return index, nil
+}
+
+// Indexed comment files of the comments folder by path of their source file
+// relative to it
+func commentIndexOf(commentsDir string) (map[string]CommentIndexEntry, error) {
+	commentIndexes.mutex.Lock()
+	defer commentIndexes.mutex.Unlock()
+	index, err := loadedCommentIndex(commentsDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]CommentIndexEntry, len(index.Files))
+	for rel, entry := range index.Files {
+		files[rel] = *entry
+	}
+	return files, nil
+}
+
+// Paths of the source files with comments relative to the comments folder,
+// sorted
+func indexedCommentFiles(commentsDir string) ([]string, error) {
+	files, err := commentIndexOf(commentsDir)
+	if err != nil {
+		return nil, err
+	}
+	rels := []string{}
+	for rel, entry := range files {
+		if entry.Count > 0 {
+			rels = append(rels, filepath.FromSlash(rel))
+		}
+	}
+	sort.Strings(rels)
+	return rels, nil
+}
+
+// Loaded comments folder holding the comment file, "" when none does
+func indexedCommentsDirOf(commentFilePath string) string {
+	owner := ""
+	for commentsDir := range commentIndexes.indexes {
+		rel, err := filepath.Rel(commentsDir, commentFilePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if strings.HasPrefix(filepath.ToSlash(rel), metaDirName+"/") {
+			return ""
+		}
+		if len(commentsDir) > len(owner) {
+			owner = commentsDir
+		}
+	}
+	return owner
+}
+
+// Updates the indexes holding the comment files after they were written,
+// removed or changed by others. Indexes not loaded yet catch up on first use.
+func commentFilesWritten(commentFilePaths ...string) {
+	commentIndexes.mutex.Lock()
+	defer commentIndexes.mutex.Unlock()
+	changed := map[string]bool{}
+	for _, commentFilePath := range commentFilePaths {
+		commentFilePath = commentFileKey(filepath.Clean(commentFilePath))
+		commentsDir := indexedCommentsDirOf(commentFilePath)
+		if commentsDir == "" || !strings.HasSuffix(commentFilePath, ".json") {
+			continue
+		}
+		commentIndexes.indexes[commentsDir].reindex(commentsDir, commentFilePath)
+		changed[commentsDir] = true
+	}
+	for commentsDir := range changed {
+		if err := writeCommentIndex(commentsDir, commentIndexes.indexes[commentsDir]); err != nil {
+			recordError(err)
+		}
+	}
+}
+
+// Whether the comment file is as the server indexed it, e.g. because the
+// server wrote it itself. False when its index is not loaded or is stale.
+func commentFileIndexed(commentFilePath string) bool {
+	commentIndexes.mutex.Lock()
+	defer commentIndexes.mutex.Unlock()
+	commentFilePath = commentFileKey(filepath.Clean(commentFilePath))
+	commentsDir := indexedCommentsDirOf(commentFilePath)
+	if commentsDir == "" || commentIndexes.stale[commentsDir] || !strings.HasSuffix(commentFilePath, ".json") {
+		return false
+	}
+	rel, err := filepath.Rel(commentsDir, strings.TrimSuffix(commentFilePath, ".json"))
+	if err != nil {
+		return false
+	}
+	entry, ok := commentIndexes.indexes[commentsDir].Files[filepath.ToSlash(rel)]
+	if !ok {
+		// Removed since indexed
+		modTime, _ := statCommentFile(commentFilePath)
+		return modTime == ""
+	}
+	return entry.current(commentFilePath)
+}
+
+// Checks the index of the comments folder against the comment files before
+// its next use, after they were changed in bulk e.g. by a pull
+func invalidateCommentIndex(commentsDir string) {
+	commentIndexes.mutex.Lock()
+	defer commentIndexes.mutex.Unlock()
+	commentIndexes.stale[filepath.Clean(commentsDir)] = true
+}
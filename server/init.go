@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Project settings shared by the team, committed at the repository root
+const projectConfigName = ".lsp-comments.json"
+
+// Comment folder of the private storage backend, out of the working tree
+const privateCommentFolder = gitDirPlaceholder + "/lsp-comments"
+
+const mergeDriverName = "lsp-comments"
+
+// Marks the lines written by init in files shared with the user
+const initMarker = "# lsp-comments"
+
+type wizard struct {
+	reader *bufio.Reader
+	writer io.Writer
+}
+
+func (w *wizard) ask(question string, defaultValue string) string {
+	fmt.Fprintf(w.writer, "%s [%s]: ", question, defaultValue)
+	answer, _ := w.reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultValue
+	}
+	return answer
+}
+
+func (w *wizard) confirm(question string, defaultValue bool) bool {
+	defaultAnswer := "y/N"
+	if defaultValue {
+		defaultAnswer = "Y/n"
+	}
+	switch strings.ToLower(w.ask(question, defaultAnswer)) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	default:
+		return defaultValue
+	}
+}
+
+// Interactive setup of the comments in the current git repository:
+//
+//	separate_comments init
+func runInit(input io.Reader, output io.Writer) int {
+	w := &wizard{reader: bufio.NewReader(input), writer: output}
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(output, "init: %v\n", err)
+		return 1
+	}
+	repoDir := getRepoDirFromDir(cwd)
+	if repoDir == "" {
+		fmt.Fprintln(output, "init: run this command inside a git repository")
+		return 1
+	}
+	if err := initRepository(w, repoDir); err != nil {
+		fmt.Fprintf(output, "init: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(output, "Comments are ready. Commit the changes to share the setup with your team.")
+	return 0
+}
+
+func initRepository(w *wizard, repoDir string) error {
+	current, err := loadProjectSettings(repoDir, defaultSettings())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w.writer, "Setting up comments for %s\n", repoDir)
+	fmt.Fprintln(w.writer, "Storage backends:")
+	fmt.Fprintln(w.writer, "  folder     - comment files are committed with the code")
+	fmt.Fprintln(w.writer, "  repository - comment files live in a separate shared git repository")
+	fmt.Fprintln(w.writer, "  private    - comment files stay out of git status, in the .git folder by default")
+	fmt.Fprintln(w.writer, "  server     - a comment server keeps the comments, the comment folder holds a replica")
+	backend := w.ask("Storage backend", "folder")
+	if backend != "folder" && backend != "repository" && backend != "private" && backend != "server" {
+		return fmt.Errorf("unknown storage backend %q", backend)
+	}
+	if backend == "private" && current.CommentFolder == defaultSettings().CommentFolder {
+		current.CommentFolder = privateCommentFolder
+	}
+	fmt.Fprintln(w.writer, "The comment folder is relative to the repository unless absolute, ${repoName},")
+	fmt.Fprintln(w.writer, "${gitDir} and ${xdgDataHome} keep it out of the source tree, e.g. ../${repoName}-comments")
+	current.CommentFolder = filepath.Clean(w.ask("Comment folder", current.CommentFolder))
+	commentsDir := resolveCommentFolder(repoDir, current.CommentFolder)
+	commentsRel, inRepo := commentsDirInRepo(repoDir, commentsDir)
+	current.StorageFormat = w.ask("Format of the comment files, json or yaml", current.StorageFormat)
+	if err := validateStorageFormat(current.StorageFormat); err != nil {
+		return err
+	}
+
+	if backend == "server" {
+		current.CommentsServerURL = w.ask("URL of the comment server, its token is read from "+commentServerTokenVariable, current.CommentsServerURL)
+		if !isHTTPRemote(current.CommentsServerURL) {
+			return fmt.Errorf("the server backend needs an http or https URL")
+		}
+		current.CommentsRepoURL, current.CommentsMirrorURL = "", ""
+		// The replica is synced by the server
+		if inRepo {
+			if err := appendOnce(filepath.Join(repoDir, ".gitignore"), "/"+filepath.ToSlash(commentsRel)+"/"); err != nil {
+				return err
+			}
+		}
+	} else if backend == "repository" {
+		current.CommentsServerURL = ""
+		current.CommentsRepoURL = w.ask("URL of the shared comments repository", current.CommentsRepoURL)
+		if current.CommentsRepoURL == "" {
+			return fmt.Errorf("the repository backend needs a repository URL")
+		}
+		current.CommentsMirrorURL = w.ask("URL of a read-only mirror used when it is unreachable, none if empty", current.CommentsMirrorURL)
+		if _, err := os.Stat(commentsDir); os.IsNotExist(err) && w.confirm("Clone it now?", true) {
+			// Run in a terminal, git can ask for credentials
+			cmd := gitRemoteCommand(context.Background(), "clone", current.CommentsRepoURL, commentsDir).interactive()
+			cmd.Stdout, cmd.Stderr = w.writer, w.writer
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("error while cloning %s: %v", current.CommentsRepoURL, err)
+			}
+		}
+		// The comments are versioned by their own repository
+		if inRepo {
+			if err := appendOnce(filepath.Join(repoDir, ".gitignore"), "/"+filepath.ToSlash(commentsRel)+"/"); err != nil {
+				return err
+			}
+		}
+	} else {
+		if backend == "folder" && !inRepo {
+			fmt.Fprintln(w.writer, "The comment folder is outside of the repository, comments are not committed with the code")
+		}
+		current.CommentsRepoURL, current.CommentsMirrorURL, current.CommentsServerURL = "", "", ""
+		if err := os.MkdirAll(commentsDir, os.ModePerm); err != nil {
+			return fmt.Errorf("error while creating comment folder: %v", err)
+		}
+	}
+
+	if err := saveProjectSettings(repoDir, current); err != nil {
+		return err
+	}
+	fmt.Fprintf(w.writer, "Wrote %s\n", projectConfigName)
+	if backend == "private" {
+		// Neither the comments nor their configuration show in git status
+		if err := excludeFromRepo(repoDir, "/"+projectConfigName); err != nil {
+			return err
+		}
+		if err := excludeCommentsDir(repoDir, commentsDir); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if w.confirm("Install the merge driver for comment files?", true) {
+		if err := installMergeDriver(repoDir, commentsDir); err != nil {
+			return err
+		}
+	}
+	if backend == "repository" && w.confirm("Install a hook pulling comments after each pull?", true) {
+		if err := installPullHook(repoDir, commentsDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Declares the merge driver in the .gitattributes of the folder holding the
+// comment files and in the local git configuration.
+func installMergeDriver(repoDir string, commentsDir string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error while locating the server executable: %v", err)
+	}
+	for _, pattern := range []string{"*.json", "*.yaml"} {
+		if err := appendOnce(filepath.Join(commentsDir, ".gitattributes"), pattern+" merge="+mergeDriverName); err != nil {
+			return err
+		}
+	}
+	settings := [][]string{
+		{"merge." + mergeDriverName + ".name", "merge of LSP comment files"},
+		{"merge." + mergeDriverName + ".driver", fmt.Sprintf("%q merge %%O %%A %%B %%P", executable)},
+	}
+	// Both repositories can hold comment files depending on the backend
+	for _, dir := range []string{repoDir, commentsDir} {
+		if getRepoDirFromDir(dir) != dir && dir != repoDir {
+			continue
+		}
+		for _, setting := range settings {
+			cmd := gitCommand("config", setting[0], setting[1])
+			cmd.Dir = dir
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("error while configuring the merge driver: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func installPullHook(repoDir string, commentsDir string) error {
+	cmd := gitCommand("rev-parse", "--git-path", "hooks")
+	cmd.Dir = repoDir
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error while locating git hooks: %v", err)
+	}
+	hooksDir := strings.TrimSpace(string(output))
+	if !filepath.IsAbs(hooksDir) {
+		hooksDir = filepath.Join(repoDir, hooksDir)
+	}
+	hookPath := filepath.Join(hooksDir, "post-merge")
+	if _, err := os.Stat(hookPath); os.IsNotExist(err) {
+		if err := os.WriteFile(hookPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+			return fmt.Errorf("error while creating hook: %v", err)
+		}
+	}
+	// Hooks run at the root of the repository
+	commentFolder := commentsDir
+	if rel, ok := commentsDirInRepo(repoDir, commentsDir); ok {
+		commentFolder = filepath.ToSlash(rel)
+	}
+	line := fmt.Sprintf("git -C %q pull --quiet || true %s", commentFolder, initMarker)
+	return appendOnce(hookPath, line)
+}
+
+// Adds the comment folder to the excluded files of the repository when it is
+// in the working tree, see Settings.ExcludeCommentFolder
+func excludeCommentsDir(repoDir string, commentsDir string) error {
+	rel, ok := commentsDirInRepo(repoDir, commentsDir)
+	if !ok || rel == ".git" || strings.HasPrefix(rel, ".git"+string(filepath.Separator)) {
+		return nil
+	}
+	return excludeFromRepo(repoDir, "/"+filepath.ToSlash(rel)+"/")
+}
+
+// Adds a pattern to the excluded files of the repository, the .gitignore
+// that is not committed
+func excludeFromRepo(repoDir string, pattern string) error {
+	gitDir := gitDirOf(repoDir)
+	if _, err := os.Stat(gitDir); err != nil {
+		// Not a git repository
+		return nil
+	}
+	return appendOnce(filepath.Join(gitDir, "info", "exclude"), pattern)
+}
+
+// Appends a line to a file unless it is already there
+func appendOnce(path string, line string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error while reading %s: %v", path, err)
+	}
+	for _, existing := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(existing) == line {
+			return nil
+		}
+	}
+	content := string(data)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	info, err := os.Stat(path)
+	mode := os.FileMode(0644)
+	if err == nil {
+		mode = info.Mode()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("error while creating folders: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content+line+"\n"), mode); err != nil {
+		return fmt.Errorf("error while writing %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Inlay hints (LSP 3.17) are not part of go.lsp.dev/protocol yet
+
+type InlayHintParams struct {
+	TextDocument protocol.TextDocumentIdentifier `json:"textDocument"`
+	Range        protocol.Range                  `json:"range"`
+}
+
+type InlayHint struct {
+	Position    protocol.Position `json:"position"`
+	Label       string            `json:"label"`
+	Tooltip     string            `json:"tooltip,omitempty"`
+	PaddingLeft bool              `json:"paddingLeft,omitempty"`
+}
+
+// Hints at the end of the first line of each open comment, with its author
+// and replies count: "◆ paul, 3 replies".
+func inlayHints(params InlayHintParams) ([]InlayHint, error) {
+	hints := []InlayHint{}
+	comments, err := anchorComments(params.TextDocument.URI)
+	if err != nil {
+		anchorLog.debugf("No comment hints for %s: %v", params.TextDocument.URI, err)
+		return hints, nil
+	}
+	content, err := readSourceFile(uriToPath(params.TextDocument.URI))
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading file: %w", err)
+	}
+	lines := strings.Split(string(content), "\n")
+	for _, comment := range comments {
+		line := comment.Range.Start.Line
+		if comment.Patch.isClosed() || int(line) >= len(lines) ||
+			line < params.Range.Start.Line || line > params.Range.End.Line {
+			continue
+		}
+		lineText := strings.TrimRight(lines[line], "\r")
+		hints = append(hints, InlayHint{
+			Position:    protocol.Position{Line: line, Character: uint32(encodedLength(lineText))},
+			Label:       inlayHintLabel(comment.Patch),
+			Tooltip:     truncateMessage(comment.Patch.Message, 200),
+			PaddingLeft: true,
+		})
+	}
+	return hints, nil
+}
+
+func inlayHintLabel(patch Patch) string {
+	parts := []string{}
+	if author := patch.author(); author != "" {
+		// Local part of emails
+		parts = append(parts, strings.SplitN(author, "@", 2)[0])
+	}
+	switch len(patch.Replies) {
+	case 0:
+	case 1:
+		parts = append(parts, "1 reply")
+	default:
+		parts = append(parts, fmt.Sprintf("%d replies", len(patch.Replies)))
+	}
+	return strings.TrimSpace("◆ " + strings.Join(parts, ", "))
+}
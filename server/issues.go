@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// comment.createIssue files a comment in the issue tracker of the settings,
+// e.g. { "provider": "jira", "url": "https://jira.example.com",
+// "project": "APP", "token": "..." }, and records the issue URL on the
+// comment. Trackers are added to issueTrackerProviders.
+
+var trackerClient = &http.Client{Timeout: 30 * time.Second}
+
+type IssueTrackerConfig struct {
+	Provider string `json:"provider"` // github, gitlab or jira
+	// Server of the tracker, the public GitHub or GitLab when empty
+	URL string `json:"url"`
+	// owner/name on GitHub, the project path on GitLab, the project key on
+	// Jira. The origin remote when empty on GitHub.
+	Project string `json:"project"`
+	// Read from the environment variable of the provider when empty
+	Token string `json:"token"`
+	// Jira Cloud authenticates user (an email) and token
+	User      string `json:"user"`
+	IssueType string `json:"issueType"` // Jira, Task when empty
+}
+
+// Issue created from a comment
+type issueDraft struct {
+	Title  string
+	Body   string
+	Labels []string
+}
+
+type issueTracker interface {
+	// Creates the issue and returns its page
+	createIssue(ctx context.Context, issue issueDraft) (string, error)
+}
+
+type issueTrackerProvider struct {
+	tokenVariable string
+	open          func(ctx context.Context, config IssueTrackerConfig, repoDir string) (issueTracker, error)
+}
+
+var issueTrackerProviders = map[string]issueTrackerProvider{
+	"github": {"GITHUB_TOKEN", openGitHubTracker},
+	"gitlab": {"GITLAB_TOKEN", openGitLabTracker},
+	"jira":   {"JIRA_API_TOKEN", openJiraTracker},
+}
+
+func validateIssueTracker(config *IssueTrackerConfig) error {
+	if config == nil {
+		return nil
+	}
+	if _, ok := issueTrackerProviders[config.Provider]; !ok {
+		return fmt.Errorf("unknown issue tracker %q, expected github, gitlab or jira", config.Provider)
+	}
+	if config.Provider == "jira" && (config.URL == "" || config.Project == "") {
+		return fmt.Errorf("the jira issue tracker needs a url and a project")
+	}
+	if config.Provider == "gitlab" && config.Project == "" {
+		return fmt.Errorf("the gitlab issue tracker needs a project")
+	}
+	return nil
+}
+
+func openIssueTracker(ctx context.Context, config *IssueTrackerConfig, repoDir string) (issueTracker, error) {
+	if config == nil {
+		return nil, fmt.Errorf("configure an issue tracker to create issues")
+	}
+	provider, ok := issueTrackerProviders[config.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown issue tracker %q", config.Provider)
+	}
+	resolved := *config
+	if resolved.Token == "" {
+		resolved.Token = os.Getenv(provider.tokenVariable)
+	}
+	return provider.open(ctx, resolved, repoDir)
+}
+
+// Files a comment in the issue tracker, once
+func createIssueFromComment(ctx context.Context, uri protocol.DocumentURI, id string) (string, error) {
+	filePath := uriToPath(uri)
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	index, err := commentIndexIn(commentFile, filePath, id)
+	if err != nil {
+		return "", err
+	}
+	patch := &commentFile.Patches[index]
+	if patch.IssueURL != "" {
+		return "", fmt.Errorf("comment %s is already tracked by %s", commentID(patch), patch.IssueURL)
+	}
+	repoDir := getUserRepoDir(filePath)
+	tracker, err := openIssueTracker(ctx, getSettings().IssueTracker, repoDir)
+	if err != nil {
+		return "", err
+	}
+	issueURL, err := tracker.createIssue(ctx, issueOfComment(repoDir, filePath, patch))
+	if err != nil {
+		return "", err
+	}
+	storeLog.infof("Created issue %s from comment %s", issueURL, commentID(patch))
+	err = updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.IssueURL = issueURL
+		return nil
+	})
+	return issueURL, err
+}
+
+// Issue about a comment: its first line as title, the whole thread and where
+// it is as body
+func issueOfComment(repoDir string, filePath string, patch *Patch) issueDraft {
+	location := filepath.Base(filePath)
+	if repoDir != "" {
+		if rel, err := filepath.Rel(repoDir, filePath); err == nil {
+			location = filepath.ToSlash(rel)
+		}
+	}
+	body := patch.Message
+	for _, reply := range patch.Replies {
+		body += "\n\n" + reply.Author + ": " + reply.Message
+	}
+	body += "\n\n---\nFrom a comment of " + patch.authorLabel() + " on " + location
+	if link := commentPermalink(getSettings(), patch, location); link != "" {
+		body += "\n" + link
+	}
+	title, _, _ := strings.Cut(strings.TrimSpace(patch.Message), "\n")
+	return issueDraft{
+		Title:  truncateMessage(title, 80),
+		Body:   body,
+		Labels: patch.Labels,
+	}
+}
+
+func openGitHubTracker(ctx context.Context, config IssueTrackerConfig, repoDir string) (issueTracker, error) {
+	if config.Project == "" {
+		if repoDir == "" {
+			return nil, fmt.Errorf("set the project of the github issue tracker")
+		}
+		repo, err := githubRepoOf(ctx, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		if config.Token != "" {
+			repo.token = config.Token
+		}
+		return repo, nil
+	}
+	owner, name, ok := strings.Cut(config.Project, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid github project %q, expected owner/name", config.Project)
+	}
+	if config.Token == "" {
+		return nil, newCommentError(ErrAuthFailed, "no GitHub token: set the token of the issue tracker or GITHUB_TOKEN")
+	}
+	repo := &githubRepo{apiURL: "https://api.github.com", owner: owner, name: name, token: config.Token}
+	if config.URL != "" {
+		repo.apiURL = strings.TrimSuffix(config.URL, "/") + "/api/v3"
+	}
+	return repo, nil
+}
+
+type gitlabTracker struct {
+	apiURL  string
+	project string
+	token   string
+}
+
+func openGitLabTracker(ctx context.Context, config IssueTrackerConfig, repoDir string) (issueTracker, error) {
+	if config.Token == "" {
+		return nil, newCommentError(ErrAuthFailed, "no GitLab token: set the token of the issue tracker or GITLAB_TOKEN")
+	}
+	server := "https://gitlab.com"
+	if config.URL != "" {
+		server = strings.TrimSuffix(config.URL, "/")
+	}
+	return &gitlabTracker{apiURL: server + "/api/v4", project: config.Project, token: config.Token}, nil
+}
+
+func (tracker *gitlabTracker) createIssue(ctx context.Context, issue issueDraft) (string, error) {
+	request := map[string]string{"title": issue.Title, "description": issue.Body}
+	if len(issue.Labels) > 0 {
+		request["labels"] = strings.Join(issue.Labels, ",")
+	}
+	var created struct {
+		WebURL string `json:"web_url"`
+	}
+	address := tracker.apiURL + "/projects/" + url.PathEscape(tracker.project) + "/issues"
+	headers := map[string]string{"PRIVATE-TOKEN": tracker.token}
+	if err := trackerRequest(ctx, "GitLab", address, headers, request, &created); err != nil {
+		return "", err
+	}
+	return created.WebURL, nil
+}
+
+type jiraTracker struct {
+	server    string
+	project   string
+	issueType string
+	auth      string // Authorization header
+}
+
+func openJiraTracker(ctx context.Context, config IssueTrackerConfig, repoDir string) (issueTracker, error) {
+	if config.Token == "" {
+		return nil, newCommentError(ErrAuthFailed, "no Jira token: set the token of the issue tracker or JIRA_API_TOKEN")
+	}
+	tracker := &jiraTracker{
+		server:    strings.TrimSuffix(config.URL, "/"),
+		project:   config.Project,
+		issueType: config.IssueType,
+		auth:      "Bearer " + config.Token,
+	}
+	if tracker.issueType == "" {
+		tracker.issueType = "Task"
+	}
+	if config.User != "" {
+		tracker.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(config.User+":"+config.Token))
+	}
+	return tracker, nil
+}
+
+func (tracker *jiraTracker) createIssue(ctx context.Context, issue issueDraft) (string, error) {
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": tracker.project},
+		"summary":     issue.Title,
+		"description": issue.Body,
+		"issuetype":   map[string]string{"name": tracker.issueType},
+	}
+	if len(issue.Labels) > 0 {
+		// Jira labels cannot hold spaces
+		labels := make([]string, len(issue.Labels))
+		for idx, label := range issue.Labels {
+			labels[idx] = strings.ReplaceAll(label, " ", "-")
+		}
+		fields["labels"] = labels
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	headers := map[string]string{"Authorization": tracker.auth}
+	request := map[string]interface{}{"fields": fields}
+	if err := trackerRequest(ctx, "Jira", tracker.server+"/rest/api/2/issue", headers, request, &created); err != nil {
+		return "", err
+	}
+	return tracker.server + "/browse/" + created.Key, nil
+}
+
+// Posts body to a tracker API, decoding the answer in result
+func trackerRequest(ctx context.Context, name string, address string, headers map[string]string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error while serializing %s request: %v", name, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := trackerClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while calling %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error while reading %s answer: %w", name, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return newCommentError(ErrAuthFailed, "%s rejected the token: %s", name, resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s: %s", name, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	if err := json.Unmarshal(answer, result); err != nil {
+		return fmt.Errorf("invalid %s answer: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Links issue references of comments to a tracker, e.g.
+// { "pattern": "JIRA-\\d+", "url": "https://jira.example.com/browse/$0" }.
+// $0 is the whole reference, $1... the groups of the pattern.
+type IssueLinkRule struct {
+	Pattern string `json:"pattern"`
+	URL     string `json:"url"`
+}
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+func validateIssueLinks(rules []IssueLinkRule) error {
+	for _, rule := range rules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid issue link pattern %q: %v", rule.Pattern, err)
+		}
+		if rule.URL == "" {
+			return fmt.Errorf("issue link pattern %q has no url", rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// Returns the targets of the URLs and issue references of a message
+func messageLinks(message string, rules []IssueLinkRule) []protocol.DocumentLink {
+	links := []protocol.DocumentLink{}
+	seen := map[string]bool{}
+	add := func(target string, tooltip string) {
+		if seen[target] {
+			return
+		}
+		seen[target] = true
+		links = append(links, protocol.DocumentLink{Target: protocol.DocumentURI(target), Tooltip: tooltip})
+	}
+	for _, url := range urlRegexp.FindAllString(message, -1) {
+		add(strings.TrimRight(url, ".,;:!?"), url)
+	}
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		for _, match := range pattern.FindAllStringSubmatchIndex(message, -1) {
+			target := pattern.ExpandString(nil, rule.URL, message, match)
+			add(string(target), message[match[0]:match[1]])
+		}
+	}
+	return links
+}
+
+// Links of the comments of a document, over their commented range
+func documentLinks(uri protocol.DocumentURI) []protocol.DocumentLink {
+	links := []protocol.DocumentLink{}
+	comments, err := anchorComments(uri)
+	if err != nil {
+		anchorLog.debugf("No comment links for %s: %v", uri, err)
+		return links
+	}
+	rules := getSettings().IssueLinks
+	repoDir := getUserRepoDir(uriToPath(uri))
+	for _, comment := range comments {
+		message := comment.Patch.Message
+		for _, reply := range comment.Patch.Replies {
+			message += "\n" + reply.Message
+		}
+		for _, link := range messageLinks(message, rules) {
+			link.Range = comment.Range
+			links = append(links, link)
+		}
+		if repoDir == "" {
+			continue
+		}
+		if comment.Patch.IssueURL != "" {
+			links = append(links, protocol.DocumentLink{
+				Range:   comment.Range,
+				Target:  protocol.DocumentURI(comment.Patch.IssueURL),
+				Tooltip: "Issue of the comment",
+			})
+		}
+		for _, attachment := range comment.Patch.Attachments {
+			links = append(links, protocol.DocumentLink{
+				Range:   comment.Range,
+				Target:  attachmentURI(repoDir, attachment),
+				Tooltip: attachment.Name,
+			})
+		}
+	}
+	return links
+}
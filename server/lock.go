@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Comment files are read, changed and written back by the server of every
+// editor window and by the command line. An advisory lock file next to the
+// comment file serialises these changes, and files are replaced by a rename
+// so that readers never see a partial write.
+
+const (
+	lockTimeout       = 5 * time.Second
+	lockRetryInterval = 20 * time.Millisecond
+	// Age of the locks left by crashed processes. Holders touch their lock
+	// while they hold it, a change as long as an upgrade keeps it fresh.
+	staleLockAge          = 30 * time.Second
+	lockHeartbeatInterval = staleLockAge / 3
+)
+
+// Locks the comment file until the returned function is called. Not
+// reentrant: the holder must not lock the file again.
+func lockCommentFile(commentFilePath string) (func(), error) {
+	return acquireCommentLock(commentFilePath, lockTimeout)
+}
+
+// Locks the comment file if it is free, returns a nil function otherwise.
+// For the changes that can wait for the next reader, when the file may be
+// locked by the caller itself.
+func tryLockCommentFile(commentFilePath string) (func(), error) {
+	unlock, err := acquireCommentLock(commentFilePath, 0)
+	if errors.Is(err, errCommentFileLocked) {
+		return nil, nil
+	}
+	return unlock, err
+}
+
+var errCommentFileLocked = errors.New("comment file is locked")
+
+func acquireCommentLock(commentFilePath string, timeout time.Duration) (func(), error) {
+	if notebookFilePath, _, ok := splitCellPath(commentFilePath); ok {
+		commentFilePath = notebookFilePath
+	}
+	lockPath := commentFilePath + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), fs.ModePerm); err != nil {
+		return nil, wrapFileError(err, "error while creating folders: %w", err)
+	}
+	// Identifies this holder, a lock broken as stale is not removed by the
+	// process that held it
+	token := fmt.Sprintf("%d %s", os.Getpid(), newCommentUUID())
+	deadline := time.Now().Add(timeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(file, token)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, wrapFileError(err, "error while locking comment file: %w", err)
+			}
+			stopHeartbeat := keepLockFresh(lockPath, token, lockHeartbeatInterval)
+			return func() {
+				stopHeartbeat()
+				if data, err := os.ReadFile(lockPath); err != nil || strings.TrimSpace(string(data)) != token {
+					storeLog.errorf("Lock of %s was broken while held", commentFilePath)
+					return
+				}
+				if err := os.Remove(lockPath); err != nil {
+					storeLog.errorf("Error while unlocking %s: %v", commentFilePath, err)
+				}
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, wrapFileError(err, "error while locking comment file: %w", err)
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			breakStaleLock(lockPath, info)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("comment file %s is being changed by another process, remove %s if none is running: %w", commentFilePath, lockPath, errCommentFileLocked)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// Touches the lock every interval until the returned function is called, so
+// that it does not look stale while held. Stops early if the lock was broken.
+func keepLockFresh(lockPath string, token string, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if data, err := os.ReadFile(lockPath); err != nil || strings.TrimSpace(string(data)) != token {
+				return
+			}
+			now := time.Now()
+			if err := os.Chtimes(lockPath, now, now); err != nil {
+				storeLog.errorf("Error while refreshing the lock %s: %v", lockPath, err)
+			}
+		}
+	}()
+	// Waits for the last touch, which must not refresh the lock of the next
+	// holder
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Removes a stale lock. Processes finding it stale at the same time race:
+// the lock is renamed first, so that only one of them gets it, and put back
+// if it is not the stale one anymore but the lock of a process that broke it
+// first.
+func breakStaleLock(lockPath string, stale fs.FileInfo) {
+	brokenPath := fmt.Sprintf("%s.%d.%s", lockPath, os.Getpid(), newCommentUUID())
+	if err := os.Rename(lockPath, brokenPath); err != nil {
+		// Broken by another process, or released
+		return
+	}
+	if info, err := os.Stat(brokenPath); err == nil && !os.SameFile(info, stale) {
+		// Link fails if yet another process took the lock meanwhile
+		if err := os.Link(brokenPath, lockPath); err != nil {
+			storeLog.errorf("Error while restoring the lock %s: %v", lockPath, err)
+		}
+	} else {
+		storeLog.infof("Removed the stale lock %s", lockPath)
+	}
+	os.Remove(brokenPath)
+}
+
+// Locks of the comment files changed together, released together
+type commentFileLocks []func()
+
+func (locks *commentFileLocks) lock(commentFilePath string) error {
+	unlock, err := lockCommentFile(commentFilePath)
+	if err != nil {
+		return err
+	}
+	*locks = append(*locks, unlock)
+	return nil
+}
+
+func (locks commentFileLocks) release() {
+	for _, unlock := range locks {
+		unlock()
+	}
+}
+
+// Locks the comment file of a source file, see lockCommentFile
+func lockDocumentComments(filePath string) (func(), error) {
+	commentFilePath, _, err := getCommentFilePath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return lockCommentFile(commentFilePath)
+}
+
+// Writes the file through a temporary file renamed over it
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const foreignLockToken = "1 6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14"
+
+// Lock file of another process, changed age ago
+func writeForeignLock(t *testing.T, lockPath string, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(lockPath, []byte(foreignLockToken+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := time.Now().Add(-age)
+	if err := os.Chtimes(lockPath, changed, changed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readLockToken(t *testing.T, lockPath string) string {
+	t.Helper()
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestAcquireCommentLock(t *testing.T) {
+	tests := []struct {
+		name string
+		// Age of the lock of another process, none when zero
+		foreignAge time.Duration
+		wantLocked bool
+	}{
+		{name: "free"},
+		{name: "held", foreignAge: time.Second, wantLocked: true},
+		{name: "held for long", foreignAge: staleLockAge - time.Second, wantLocked: true},
+		{name: "stale", foreignAge: staleLockAge + time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commentFilePath := filepath.Join(t.TempDir(), "main.go.json")
+			lockPath := commentFilePath + ".lock"
+			if test.foreignAge != 0 {
+				writeForeignLock(t, lockPath, test.foreignAge)
+			}
+			unlock, err := acquireCommentLock(commentFilePath, 0)
+			if test.wantLocked {
+				if !errors.Is(err, errCommentFileLocked) {
+					t.Fatalf("got error %v, want %v", err, errCommentFileLocked)
+				}
+				if token := readLockToken(t, lockPath); token != foreignLockToken {
+					t.Errorf("lock holds %q, want the lock of the other process", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token := readLockToken(t, lockPath); token == "" || token == foreignLockToken {
+				t.Errorf("lock holds %q, want ours", token)
+			}
+			unlock()
+			if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+				t.Errorf("lock still exists after unlock: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnlockKeepsTheLockOfTheProcessBreakingIt(t *testing.T) {
+	commentFilePath := filepath.Join(t.TempDir(), "main.go.json")
+	lockPath := commentFilePath + ".lock"
+	unlock, err := lockCommentFile(commentFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Broken as stale and taken by another process
+	writeForeignLock(t, lockPath, 0)
+	unlock()
+	if token := readLockToken(t, lockPath); token != foreignLockToken {
+		t.Errorf("lock holds %q, want the lock of the other process", token)
+	}
+}
+
+func TestBreakStaleLock(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether another process broke the stale lock and took it since
+		retaken  bool
+		wantLock bool
+	}{
+		{name: "stale", retaken: false, wantLock: false},
+		{name: "taken by another process", retaken: true, wantLock: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			lockPath := filepath.Join(dir, "main.go.json.lock")
+			writeForeignLock(t, lockPath, staleLockAge+time.Minute)
+			stale, err := os.Stat(lockPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.retaken {
+				// Renamed over it, a removed file may give its inode to the new one
+				writeForeignLock(t, lockPath+".new", 0)
+				if err := os.Rename(lockPath+".new", lockPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			breakStaleLock(lockPath, stale)
+			_, err = os.Stat(lockPath)
+			if exists := err == nil; exists != test.wantLock {
+				t.Errorf("lock exists %v, want %v", exists, test.wantLock)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if entry.Name() != "main.go.json.lock" {
+					t.Errorf("left %s behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestKeepLockFresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		wantFresh bool
+	}{
+		{name: "held", token: foreignLockToken, wantFresh: true},
+		{name: "broken", token: "2 3b8e41f0c2d9", wantFresh: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lockPath := filepath.Join(t.TempDir(), "main.go.json.lock")
+			writeForeignLock(t, lockPath, staleLockAge+time.Minute)
+			stop := keepLockFresh(lockPath, test.token, 5*time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			stop()
+			info, err := os.Stat(lockPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fresh := time.Since(info.ModTime()) < staleLockAge; fresh != test.wantFresh {
+				t.Errorf("lock fresh %v, want %v", fresh, test.wantFresh)
+			}
+		})
+	}
+}
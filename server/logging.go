@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type LogLevel int32
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelError
+	LogLevelOff
+)
+
+var logLevels = map[string]LogLevel{
+	"debug": LogLevelDebug,
+	"info":  LogLevelInfo,
+	"error": LogLevelError,
+	"off":   LogLevelOff,
+}
+
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(int32(LogLevelInfo))
+}
+
+func parseLogLevel(level string) (LogLevel, error) {
+	logLevel, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return LogLevelInfo, fmt.Errorf("unknown log level %q", level)
+	}
+	return logLevel, nil
+}
+
+func setLogLevel(level LogLevel) {
+	currentLogLevel.Store(int32(level))
+}
+
+func logf(level LogLevel, format string, args ...interface{}) {
+	if level < LogLevel(currentLogLevel.Load()) {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func logDebugf(format string, args ...interface{}) {
+	logf(LogLevelDebug, format, args...)
+}
+
+func logInfof(format string, args ...interface{}) {
+	logf(LogLevelInfo, format, args...)
+}
+
+func logErrorf(format string, args ...interface{}) {
+	logf(LogLevelError, format, args...)
+}
+
+// Logs can be filtered by category, each with its own level. Categories
+// without level follow the global one.
+type LogCategory string
+
+const (
+	LogAnchor   LogCategory = "anchor"   // Anchoring of patches in documents
+	LogStore    LogCategory = "store"    // Comment files
+	LogSync     LogCategory = "sync"     // Comments repository and mirror
+	LogProtocol LogCategory = "protocol" // LSP messages
+	LogGit      LogCategory = "git"      // Git commands
+)
+
+// Level of a category following the global level
+const inheritedLogLevel = -1
+
+var categoryLevels = map[LogCategory]*atomic.Int32{
+	LogAnchor:   {},
+	LogStore:    {},
+	LogSync:     {},
+	LogProtocol: {},
+	LogGit:      {},
+}
+
+func init() {
+	for _, level := range categoryLevels {
+		level.Store(inheritedLogLevel)
+	}
+}
+
+type categoryLogger LogCategory
+
+var (
+	anchorLog   = categoryLogger(LogAnchor)
+	storeLog    = categoryLogger(LogStore)
+	syncLog     = categoryLogger(LogSync)
+	protocolLog = categoryLogger(LogProtocol)
+	gitLog      = categoryLogger(LogGit)
+)
+
+func (logger categoryLogger) logf(level LogLevel, format string, args ...interface{}) {
+	minLevel := categoryLevels[LogCategory(logger)].Load()
+	if minLevel == inheritedLogLevel {
+		minLevel = currentLogLevel.Load()
+	}
+	if level < LogLevel(minLevel) {
+		return
+	}
+	log.Printf("["+string(logger)+"] "+format, args...)
+}
+
+func (logger categoryLogger) debugf(format string, args ...interface{}) {
+	logger.logf(LogLevelDebug, format, args...)
+}
+
+func (logger categoryLogger) infof(format string, args ...interface{}) {
+	logger.logf(LogLevelInfo, format, args...)
+}
+
+func (logger categoryLogger) errorf(format string, args ...interface{}) {
+	logger.logf(LogLevelError, format, args...)
+}
+
+// Parameters of comment/debug.setLevel. Without category, sets the global
+// level; an empty level makes the category follow the global level again.
+type SetLogLevelParams struct {
+	Category LogCategory `json:"category,omitempty"`
+	Level    string      `json:"level"`
+}
+
+func setCategoryLogLevel(params SetLogLevelParams) error {
+	if params.Category == "" {
+		level, err := parseLogLevel(params.Level)
+		if err != nil {
+			return err
+		}
+		setLogLevel(level)
+		return nil
+	}
+	categoryLevel, ok := categoryLevels[params.Category]
+	if !ok {
+		return fmt.Errorf("unknown log category %q", params.Category)
+	}
+	if params.Level == "" {
+		categoryLevel.Store(inheritedLogLevel)
+		return nil
+	}
+	level, err := parseLogLevel(params.Level)
+	if err != nil {
+		return err
+	}
+	categoryLevel.Store(int32(level))
+	return nil
+}
+
+// Current levels by category, "default" being the global one
+func logLevelsReport() map[string]string {
+	names := map[LogLevel]string{}
+	for name, level := range logLevels {
+		names[level] = name
+	}
+	report := map[string]string{"default": names[LogLevel(currentLogLevel.Load())]}
+	for category, level := range categoryLevels {
+		if level.Load() != inheritedLogLevel {
+			report[string(category)] = names[LogLevel(level.Load())]
+		}
+	}
+	return report
+}
@@ -3,24 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
-	dmp "github.com/sergi/go-diff/diffmatchpatch"
 	"go.lsp.dev/jsonrpc2"
 	"go.lsp.dev/protocol"
 )
 
-var contextBefore int = 5 // Context before patch
-var contextAfter int = 5  // Context after patch
-
 type stdrwc struct{}
 
 func (s stdrwc) Read(p []byte) (int, error) {
@@ -36,17 +36,28 @@ func (s stdrwc) Close() error {
 }
 
 func main() {
-	log.SetOutput(os.Stderr)
-	log.Println("Start LSP server...")
-
-	err := updateCommentsRepo()
-	if err != nil {
-		log.Fatalf("error while updating comments: %v", err)
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Stdin, os.Stdout))
+		case "merge":
+			os.Exit(runMergeDriver(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:], os.Stdout))
+		case "pre-receive":
+			os.Exit(runPreReceive(os.Args[2:], os.Stdin, os.Stderr))
+		case "serve":
+			os.Exit(runServe(os.Args[2:], os.Stderr))
+		}
 	}
+	log.Println("Start LSP server...")
 
 	stream := jsonrpc2.NewStream(stdrwc{})
 	conn := jsonrpc2.NewConn(stream)
-	handler := handler{conn: conn}
+	handler := handler{openDocuments: map[protocol.DocumentURI]bool{}, savedContents: map[protocol.DocumentURI]string{}, symbolIndex: newCommentIndex()}
+	handler.trace.conn = conn
+	handler.conn = &tracingConn{Conn: conn, tracer: &handler.trace}
 
 	conn.Go(context.Background(), func(ctx context.Context, reply jsonrpc2.Replier, req jsonrpc2.Request) error {
 		return handler.handle(ctx, reply, req)
@@ -61,35 +72,250 @@ func main() {
 }
 
 type handler struct {
-	conn jsonrpc2.Conn
+	conn          jsonrpc2.Conn
+	rootPath      string                        // Workspace root sent by the client on initialize
+	openDocuments map[protocol.DocumentURI]bool // Documents opened in the editor
+	// Changes of openDocuments, which other goroutines read with openURIs
+	documentsMutex sync.RWMutex
+	// Content of the open documents when last saved, see followReformat
+	savedContents map[protocol.DocumentURI]string
+	// Other folders of a multi-root workspace, where references are resolved
+	workspaceFolders []string
+	// The client can register a watcher for workspace/didChangeWatchedFiles
+	canWatchFiles bool
+	// The client can resolve code action commands with codeAction/resolve
+	canResolveCodeActions bool
+	// The client can show progress of operations started by the server
+	canCreateProgress bool
+	// The client pulls diagnostics and can be asked to pull them again
+	canPullDiagnostics bool
+	// The client shows inlay hints
+	canShowInlayHints bool
+	// The client sends the cells of notebooks with notebookDocument/*
+	canSyncNotebooks bool
+	// Format of the hovers, markdown or plain text
+	hoverFormat protocol.MarkupKind
+	// The client accepts code actions, not only commands
+	canListCodeActions bool
+	// The client shows nested document symbols
+	canNestSymbols bool
+	// The client accepts diagnostics with related information
+	canRelateDiagnostics bool
+	// The client fades diagnostics tagged unnecessary, resolved comments are
+	// hidden otherwise
+	canFadeDiagnostics bool
+	// Folding support of the client, nil when folding ranges are not provided
+	foldingRange *protocol.FoldingRangeClientCapabilities
+	expanded     expandedDocuments
+	// State of the comments repository, primary or mirror
+	sync syncState
+	// Errors recently shown to the user
+	errorThrottle errorThrottle
+	// Comments of all the files, for workspace/symbol
+	symbolIndex *commentIndex
+	// Long requests that $/cancelRequest can cancel
+	inflight inflightRequests
+	// Trace of the messages sent to the client
+	trace tracer
+	// Whether the mirror can be force-pushed
+	mirrorConsent mirrorConsent
+	// Pull request being reviewed
+	review reviewState
+}
+
+// Documents opened in the editor, for goroutines other than the handler's
+func (h *handler) openURIs() []protocol.DocumentURI {
+	h.documentsMutex.RLock()
+	defer h.documentsMutex.RUnlock()
+	uris := make([]protocol.DocumentURI, 0, len(h.openDocuments))
+	for uri := range h.openDocuments {
+		uris = append(uris, uri)
+	}
+	return uris
 }
 
 func (h *handler) handle(ctx context.Context, reply jsonrpc2.Replier, req jsonrpc2.Request) error {
+	reply = withErrorData(h.trace.traceRequest(reply, req))
+	protocolLog.debugf("Received %s", req.Method())
 	switch req.Method() {
 	case "initialize":
 		var params protocol.InitializeParams
 		if err := json.Unmarshal(req.Params(), &params); err != nil {
 			return reply(ctx, nil, err)
 		}
-		result := protocol.InitializeResult{
-			Capabilities: protocol.ServerCapabilities{
-				TextDocumentSync: protocol.TextDocumentSyncKindIncremental,
-				CodeActionProvider: protocol.CodeActionOptions{
-					CodeActionKinds: []protocol.CodeActionKind{
-						"quickfix",
-					},
-				},
-				ExecuteCommandProvider: &protocol.ExecuteCommandOptions{
-					Commands: []string{"comment.add"},
-				},
-			},
+		setErrorNotifier(h.showError)
+		setTranslationListener(func() { h.republishDiagnostics(context.Background()) })
+		h.trace.set(params.Trace)
+		if params.RootURI != "" {
+			h.rootPath = uriToPath(params.RootURI)
+		} else if len(params.WorkspaceFolders) > 0 {
+			h.rootPath = uriToPath(protocol.DocumentURI(params.WorkspaceFolders[0].URI))
+		}
+		workspaceUntrusted.Store(h.rootPath != "" && !isTrustedFolder(h.rootPath))
+		h.setWorkspaceFolders(protocol.WorkspaceFoldersChangeEvent{Added: params.WorkspaceFolders})
+		options, err := parseSettings(getSettings(), params.InitializationOptions)
+		if err != nil {
+			logErrorf("Ignore initialization options: %v", err)
+		} else {
+			setSettings(options)
+		}
+		setSettings(h.withProjectSettings(getSettings()))
+		// Default to the editor language to tag and translate comments
+		if current := getSettings(); current.Language == "" && params.Locale != "" {
+			current.Language = normalizeLanguage(params.Locale)
+			setSettings(current)
 		}
+		h.setClientCapabilities(params.Capabilities, req.Params())
+		result := initializeResult{Capabilities: h.serverCapabilities(params.Capabilities)}
 		return reply(ctx, result, nil)
+	case "initialized":
+		if isWorkspaceTrusted() {
+			h.startWorkspace(ctx)
+		} else {
+			go h.askWorkspaceTrust(ctx)
+		}
+		if h.canWatchFiles {
+			go h.registerCommentsWatcher(ctx)
+		}
+		return nil
+	case protocol.MethodSetTrace:
+		var params protocol.SetTraceParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			protocolLog.errorf("Ignore invalid trace: %v", err)
+			return nil
+		}
+		h.trace.set(params.Value)
+		protocolLog.infof("Trace set to %s", params.Value)
+		return nil
+	case "$/cancelRequest":
+		id, err := parseCancelParams(req.Params())
+		if err != nil {
+			protocolLog.errorf("Ignore invalid cancellation: %v", err)
+			return nil
+		}
+		h.inflight.cancel(id)
+		return nil
+	case "workspace/didChangeWatchedFiles":
+		var params protocol.DidChangeWatchedFilesParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.commentFilesChanged(ctx, params.Changes)
+		return nil
+	case "workspace/willRenameFiles":
+		var params protocol.RenameFilesParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		if err := h.willRenameFiles(ctx, params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, nil, nil)
+	case "workspace/willDeleteFiles":
+		var params protocol.DeleteFilesParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		if err := h.archiveDeleted(ctx, params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, nil, nil)
+	case "workspace/didDeleteFiles":
+		var params protocol.DeleteFilesParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		if err := h.archiveDeleted(ctx, params); err != nil {
+			recordError(err)
+		}
+		return nil
 	case "textDocument/didOpen":
 		var params protocol.DidOpenTextDocumentParams
 		if err := json.Unmarshal(req.Params(), &params); err != nil {
 			return reply(ctx, nil, err)
 		}
+		h.documentsMutex.Lock()
+		h.openDocuments[params.TextDocument.URI] = true
+		h.documentsMutex.Unlock()
+		h.rememberContent(params.TextDocument.URI)
+		h.publishDiagnostics(ctx, params.TextDocument.URI)
+		if !isWorkspaceTrusted() {
+			return nil
+		}
+		if err := markCommentsViewed(params.TextDocument.URI); err != nil {
+			logDebugf("Comments not marked as viewed: %v", err)
+		}
+		return nil
+	case "textDocument/didClose":
+		var params protocol.DidCloseTextDocumentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.documentsMutex.Lock()
+		delete(h.openDocuments, params.TextDocument.URI)
+		h.documentsMutex.Unlock()
+		delete(h.savedContents, params.TextDocument.URI)
+		h.expanded.set(params.TextDocument.URI, false)
+		return nil
+	case "notebookDocument/didOpen":
+		var params DidOpenNotebookDocumentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.didOpenNotebook(ctx, params)
+		return nil
+	case "notebookDocument/didChange":
+		var params DidChangeNotebookDocumentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.didChangeNotebook(ctx, params)
+		return nil
+	case "notebookDocument/didSave":
+		var params DidSaveNotebookDocumentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.didSaveNotebook(ctx, params)
+		return nil
+	case "notebookDocument/didClose":
+		var params DidCloseNotebookDocumentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.didCloseNotebook(params)
+		return nil
+	case "workspace/didChangeWorkspaceFolders":
+		var params protocol.DidChangeWorkspaceFoldersParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.setWorkspaceFolders(params.Event)
+		return nil
+	case "workspace/didChangeConfiguration":
+		var params protocol.DidChangeConfigurationParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		newSettings, err := parseSettings(getSettings(), params.Settings)
+		if err != nil {
+			logErrorf("Ignore configuration change: %v", err)
+			return nil
+		}
+		newSettings = h.withProjectSettings(newSettings)
+		setSettings(newSettings)
+		logInfof("Configuration changed: %+v", newSettings)
+		// Display comments with the new settings
+		for uri := range h.openDocuments {
+			h.publishDiagnostics(ctx, uri)
+		}
+		return nil
+	case "textDocument/didSave":
+		var params protocol.DidSaveTextDocumentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		h.followReformat(ctx, params.TextDocument.URI)
 		h.publishDiagnostics(ctx, params.TextDocument.URI)
 		return nil
 	case "textDocument/didChange":
@@ -104,50 +330,996 @@ func (h *handler) handle(ctx context.Context, reply jsonrpc2.Replier, req jsonrp
 		if err := json.Unmarshal(req.Params(), &params); err != nil {
 			return reply(ctx, nil, err)
 		}
-		action := protocol.CodeAction{
-			Title: "Add a new comment",
-			Kind:  "quickfix",
-			Command: &protocol.Command{
-				Title:     "Add a new comment",
-				Command:   "comment.add",
-				Arguments: []interface{}{params.TextDocument.URI, params.Range},
-			},
+		actions, err := h.codeActions(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		if !h.canListCodeActions {
+			return reply(ctx, codeActionCommands(actions), nil)
+		}
+		return reply(ctx, actions, nil)
+	case "textDocument/documentSymbol":
+		var params protocol.DocumentSymbolParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		symbols := documentSymbols(params.TextDocument.URI)
+		if !h.canNestSymbols {
+			return reply(ctx, flatSymbols(params.TextDocument.URI, symbols), nil)
+		}
+		return reply(ctx, symbols, nil)
+	case "textDocument/hover":
+		var params protocol.HoverParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, h.hover(params), nil)
+	case "textDocument/documentHighlight":
+		var params protocol.DocumentHighlightParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, documentHighlights(params), nil)
+	case "textDocument/foldingRange":
+		var params protocol.FoldingRangeParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		if h.foldingRange == nil {
+			return reply(ctx, nil, fmt.Errorf("folding ranges are not supported by the client"))
+		}
+		return reply(ctx, h.foldingRanges(params.TextDocument.URI), nil)
+	case "textDocument/inlayHint":
+		var params InlayHintParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		hints, err := inlayHints(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, hints, nil)
+	case "textDocument/semanticTokens/full":
+		var params protocol.SemanticTokensParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		tokens, err := semanticTokens(params.TextDocument.URI)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, tokens, nil)
+	case "textDocument/documentLink":
+		var params protocol.DocumentLinkParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		links := append(documentLinks(params.TextDocument.URI), h.referenceLinks(params.TextDocument.URI)...)
+		return reply(ctx, links, nil)
+	case "workspace/symbol":
+		var params protocol.WorkspaceSymbolParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+			return h.workspaceSymbols(ctx, params.Query, h.partialResults(params.PartialResultToken))
+		})
+	case "codeAction/resolve":
+		var action protocol.CodeAction
+		if err := json.Unmarshal(req.Params(), &action); err != nil {
+			return reply(ctx, nil, err)
+		}
+		resolved, err := h.resolveCodeAction(action)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, resolved, nil)
+	case "textDocument/diagnostic":
+		var params DocumentDiagnosticParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, h.documentDiagnosticReport(params.TextDocument.URI, params.PreviousResultID), nil)
+	case "workspace/diagnostic":
+		var params WorkspaceDiagnosticParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+			return h.workspaceDiagnosticReport(ctx, params)
+		})
+	case "comment/participation":
+		var params ParticipationParams
+		if len(req.Params()) > 0 {
+			if err := json.Unmarshal(req.Params(), &params); err != nil {
+				return reply(ctx, nil, err)
+			}
+		}
+		report, err := h.participationReport(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, report, nil)
+	case "comment/completeMention":
+		var params MentionCompletionParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		completions, err := h.completeMention(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, completions, nil)
+	case "comment/syncStatus":
+		return reply(ctx, h.sync.get(), nil)
+	case "comment/debug.setLevel":
+		var params SetLogLevelParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		if err := setCategoryLogLevel(params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, logLevelsReport(), nil)
+	case "comment/list":
+		var params ListCommentsParams
+		if len(req.Params()) > 0 {
+			if err := json.Unmarshal(req.Params(), &params); err != nil {
+				return reply(ctx, nil, err)
+			}
+		}
+		if err := params.validate(); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+			return h.listComments(ctx, params)
+		})
+	case "comment/listAssignedToMe":
+		var params AssignedToMeParams
+		if len(req.Params()) > 0 {
+			if err := json.Unmarshal(req.Params(), &params); err != nil {
+				return reply(ctx, nil, err)
+			}
+		}
+		return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+			return h.listAssignedToMe(ctx, params)
+		})
+	case "comment/reviews":
+		repoDir := getRepoDirFromDir(h.rootPath)
+		if repoDir == "" {
+			return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+		}
+		reviews, err := loadReviews(repoDir)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, reviews, nil)
+	case "comment/templates":
+		repoDir := getRepoDirFromDir(h.rootPath)
+		if repoDir == "" {
+			return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+		}
+		templates, err := loadTemplates(repoDir)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, templates, nil)
+	case "comment/changelists":
+		repoDir := getRepoDirFromDir(h.rootPath)
+		if repoDir == "" {
+			return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+		}
+		reports, err := changelistReports(repoDir)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, reports, nil)
+	case "comment/references":
+		var params ThreadReferencesParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		references, err := h.threadReferences(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, references, nil)
+	case "comment/fileComments":
+		var params FileCommentsParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		comments, err := fileComments(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, comments, nil)
+	case "comment/history":
+		var params GetCommentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		history, err := commentHistory(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, history, nil)
+	case "comment/get":
+		var params GetCommentParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		comment, err := getComment(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, comment, nil)
+	case "comment/conflicts":
+		conflicts, err := h.conflicts()
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, conflicts, nil)
+	case "comment/resolveConflict":
+		var params ResolveConflictParams
+		if err := json.Unmarshal(req.Params(), &params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		if err := h.resolveConflict(ctx, params); err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, nil, nil)
+	case "comment/stats":
+		var params StatsParams
+		if len(req.Params()) > 0 {
+			if err := json.Unmarshal(req.Params(), &params); err != nil {
+				return reply(ctx, nil, err)
+			}
 		}
-		return reply(ctx, []protocol.CodeAction{action}, nil)
+		stats, err := h.stats(params)
+		if err != nil {
+			return reply(ctx, nil, err)
+		}
+		return reply(ctx, stats, nil)
 	case "workspace/executeCommand":
 		var params protocol.ExecuteCommandParams
 		if err := json.Unmarshal(req.Params(), &params); err != nil {
 			return reply(ctx, nil, err)
 		}
-		log.Printf("Execute command %s with %d arguments", params.Command, len(params.Arguments))
+		protocolLog.infof("Execute command %s with %d arguments", params.Command, len(params.Arguments))
+		if err := h.checkWritable(params.Command); err != nil {
+			return reply(ctx, nil, err)
+		}
 		switch params.Command {
 		case "comment.add":
+			if len(params.Arguments) < 3 || len(params.Arguments) > 4 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			uriStr, ok := params.Arguments[0].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for URI"))
+			}
+			uri := protocol.DocumentURI(uriStr)
+			rangeMap, ok := params.Arguments[1].(map[string]interface{})
+			if !ok && params.Arguments[1] != nil {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for range"))
+			}
+			var rng protocol.Range
+			rangeData, _ := json.Marshal(rangeMap)
+			json.Unmarshal(rangeData, &rng)
+			contentBody, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for contentBody"))
+			}
+			var options CommentOptions
+			if len(params.Arguments) == 4 {
+				optionsData, _ := json.Marshal(params.Arguments[3])
+				if err := json.Unmarshal(optionsData, &options); err != nil {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for options"))
+				}
+			}
+			if params.Arguments[1] == nil {
+				// No range, the comment is about the whole file
+				options.FileLevel = true
+			}
+			duplicate := findDuplicateComment(uri, rng, contentBody, options)
+			if duplicate == nil {
+				// Add comment function
+				err := h.addComment(ctx, uri, rng, contentBody, options)
+				if err != nil {
+					return reply(ctx, nil, err)
+				}
+				h.publishDiagnostics(ctx, uri)
+				h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri})
+				return reply(ctx, nil, nil)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				switch h.askDuplicate(ctx, duplicate) {
+				case duplicateReplyAction:
+					if err := replyToComment(uri, commentID(&duplicate.Patch), contentBody); err != nil {
+						return nil, err
+					}
+					h.publishDiagnostics(ctx, uri)
+					h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{commentID(&duplicate.Patch)}})
+				case duplicateAddAction:
+					if err := h.addComment(ctx, uri, rng, contentBody, options); err != nil {
+						return nil, err
+					}
+					h.publishDiagnostics(ctx, uri)
+					h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri})
+				default:
+					return nil, protocol.ErrRequestCancelled
+				}
+				return nil, nil
+			})
+		case "comment.addFromTemplate":
+			// Arguments: uri, range, the template name and optionally the body
+			// completed by the user, the body of the template otherwise
+			if len(params.Arguments) < 3 || len(params.Arguments) > 4 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			uriStr, ok := params.Arguments[0].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for URI"))
+			}
+			uri := protocol.DocumentURI(uriStr)
+			var rng protocol.Range
+			rangeData, _ := json.Marshal(params.Arguments[1])
+			if err := json.Unmarshal(rangeData, &rng); err != nil {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for range"))
+			}
+			name, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for template"))
+			}
+			template, err := findTemplate(getUserRepoDir(uriToPath(uri)), name)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			body := template.Body
+			if len(params.Arguments) == 4 {
+				if body, ok = params.Arguments[3].(string); !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for contentBody"))
+				}
+			}
+			if strings.TrimSpace(body) == "" {
+				return reply(ctx, nil, fmt.Errorf("comment cannot be empty"))
+			}
+			if err := h.addComment(ctx, uri, rng, body, template.options()); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri})
+			return reply(ctx, nil, nil)
+		case "comment.reply":
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			message, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for message"))
+			}
+			if err := replyToComment(uri, id, message); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.edit":
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			message, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for message"))
+			}
+			if err := editComment(uri, id, message); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.resolve":
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if err := resolveComment(uri, id); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.setState":
+			// Arguments: uri, comment ID, then open, resolved or wontfix
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			state, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for state"))
+			}
+			if err := setCommentState(uri, id, state); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.delete":
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				if !h.confirmDelete(ctx, uri, id) {
+					return nil, protocol.ErrRequestCancelled
+				}
+				if err := deleteComment(uri, id); err != nil {
+					return nil, err
+				}
+				h.publishDiagnostics(ctx, uri)
+				h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri})
+				return nil, nil
+			})
+		case "comment.search":
+			query, options, err := parseSearchArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			repoDir := getRepoDirFromDir(h.rootPath)
+			if repoDir == "" {
+				return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				return searchComments(ctx, repoDir, query, options)
+			})
+		case "comment.archive":
+			// Optional argument: archive comments resolved for this many days
+			days := float64(getSettings().ArchiveAfterDays)
+			if len(params.Arguments) > 0 {
+				days, _ = params.Arguments[0].(float64)
+			}
+			if days <= 0 {
+				return reply(ctx, nil, fmt.Errorf("invalid archive threshold"))
+			}
+			repoDir := getRepoDirFromDir(h.rootPath)
+			if repoDir == "" {
+				return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				if !h.confirm(ctx, fmt.Sprintf("Archive the comments resolved more than %g days ago? They leave the documents and the listings.", days)) {
+					return nil, protocol.ErrRequestCancelled
+				}
+				progress := h.beginProgress(ctx, params.WorkDoneToken, "Archiving comments")
+				count, err := archiveResolvedComments(repoDir, time.Duration(days*24)*time.Hour)
+				progress.end(ctx, fmt.Sprintf("%d comments archived", count))
+				if err != nil {
+					return nil, err
+				}
+				for _, uri := range h.openURIs() {
+					h.publishDiagnostics(ctx, uri)
+				}
+				if count > 0 {
+					h.notifyCommentsChanged(ctx, ChangeLocal)
+				}
+				return count, nil
+			})
+		case "comment.repair":
+			// Optional argument: dry run, only report what would be merged
+			dryRun := false
+			if len(params.Arguments) > 0 {
+				dryRun, _ = params.Arguments[0].(bool)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				if !dryRun {
+					// Only merges ask for confirmation
+					planned, err := repairCommentStore(h.rootPath, true)
+					if err != nil {
+						return nil, err
+					}
+					if len(planned.Merges) > 0 && !h.confirm(ctx, fmt.Sprintf("Merge %d groups of duplicate comment files? The duplicates are removed.", len(planned.Merges))) {
+						return nil, protocol.ErrRequestCancelled
+					}
+				}
+				progress := h.beginProgress(ctx, params.WorkDoneToken, "Repairing comments")
+				report, err := repairCommentStore(h.rootPath, dryRun)
+				progress.end(ctx, "")
+				if err != nil {
+					return nil, err
+				}
+				if !dryRun {
+					h.notifyCommentsChanged(ctx, ChangeLocal)
+				}
+				return report, nil
+			})
+		case "comment.startReview":
+			// Arguments: title, then optional base commit of the reviewed changes
+			if len(params.Arguments) < 1 || len(params.Arguments) > 2 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			title, ok := params.Arguments[0].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for title"))
+			}
+			base := ""
+			if len(params.Arguments) == 2 {
+				if base, ok = params.Arguments[1].(string); !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for base commit"))
+				}
+			}
+			repoDir := getRepoDirFromDir(h.rootPath)
+			if repoDir == "" {
+				return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+			}
+			review, err := startReview(repoDir, currentUser(repoDir), title, base)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return reply(ctx, review, nil)
+		case "comment.submitReview":
+			repoDir := getRepoDirFromDir(h.rootPath)
+			if repoDir == "" {
+				return reply(ctx, nil, fmt.Errorf("workspace is not a git repository"))
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				review, err := submitLocalReview(ctx, repoDir, currentUser(repoDir))
+				if err != nil {
+					return nil, err
+				}
+				h.notifyCommentsChanged(ctx, ChangeLocal)
+				h.republishDiagnostics(ctx)
+				return review, nil
+			})
+		case "comment.assign":
+			// Arguments: uri, comment ID and the assignee, empty to unassign
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			assignee, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for assignee"))
+			}
+			if err := assignComment(uri, id, assignee); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.setDueDate":
+			// Arguments: uri, comment ID and the due date, YYYY-MM-DD, empty to clear
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
 			if len(params.Arguments) != 3 {
 				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
 			}
+			date, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for due date"))
+			}
+			if err := setCommentDueDate(uri, id, date); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.setExpiry":
+			// Arguments: uri, comment ID and the expiry, YYYY-MM-DD or RFC3339,
+			// empty to clear
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			expiry, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for expiry"))
+			}
+			if err := setCommentExpiry(uri, id, expiry); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.toggleChecklistItem":
+			// Arguments: uri, comment ID, the item index in the checklist and
+			// optionally whether it is checked, toggled otherwise
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) < 3 || len(params.Arguments) > 4 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			item, ok := params.Arguments[2].(float64)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for checklist item"))
+			}
+			var checked *bool
+			if len(params.Arguments) == 4 {
+				value, ok := params.Arguments[3].(bool)
+				if !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for checked"))
+				}
+				checked = &value
+			}
+			if err := toggleChecklistItem(uri, id, int(item), checked); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.createIssue":
+			// Arguments: uri and comment ID. Returns the URL of the issue.
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				issueURL, err := createIssueFromComment(ctx, uri, id)
+				if err != nil {
+					return nil, err
+				}
+				h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+				return issueURL, nil
+			})
+		case "comment.convertToTodo":
+			// Arguments: uri and comment ID. The editor applies the edit.
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				if err := h.convertToTodo(ctx, uri, id); err != nil {
+					return nil, err
+				}
+				h.publishDiagnostics(ctx, uri)
+				h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+				return nil, nil
+			})
+		case "comment.applySuggestion":
+			// Arguments: uri and comment ID. The editor applies the edit.
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				if err := h.applySuggestion(ctx, uri, id); err != nil {
+					return nil, err
+				}
+				h.publishDiagnostics(ctx, uri)
+				h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+				return nil, nil
+			})
+		case "comment.vote":
+			// Arguments: uri, comment ID and 1 to vote up, -1 down, 0 to withdraw
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			vote, ok := params.Arguments[2].(float64)
+			if !ok || vote != float64(int(vote)) {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for vote"))
+			}
+			if err := voteComment(uri, id, int(vote)); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.attach":
+			// Arguments: uri, comment ID and the path or URI of the attached file
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			file, ok := params.Arguments[2].(string)
+			if !ok || file == "" {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for attached file"))
+			}
+			if err := attachToComment(uri, id, file); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.publishDrafts":
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				return h.publishDraftsCommand(ctx)
+			})
+		case "comment.upgrade":
+			// Optional argument: dry run, only report what would be upgraded
+			dryRun := false
+			if len(params.Arguments) > 0 {
+				dryRun, _ = params.Arguments[0].(bool)
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				progress := h.beginProgress(ctx, params.WorkDoneToken, "Upgrading comments")
+				report, err := upgradeCommentStore(ctx, h.rootPath, dryRun)
+				progress.end(ctx, "")
+				if err != nil {
+					return nil, err
+				}
+				if !dryRun && len(report.Files) > 0 {
+					h.notifyCommentsChanged(ctx, ChangeLocal)
+					h.republishDiagnostics(ctx)
+				}
+				return report, nil
+			})
+		case "comment.setAway":
+			// Arguments: away, then optional backup user and last away day (YYYY-MM-DD)
+			if len(params.Arguments) < 1 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			away, ok := params.Arguments[0].(bool)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for away"))
+			}
+			backup, until := "", ""
+			if len(params.Arguments) > 1 {
+				backup, _ = params.Arguments[1].(string)
+			}
+			if len(params.Arguments) > 2 {
+				until, _ = params.Arguments[2].(string)
+			}
+			err := h.setAway(away, backup, until)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return reply(ctx, nil, nil)
+		case "comment.moveToChangelist":
+			// Arguments: uri, comment ID and changelist name, empty to remove it from its changelist
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			name, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for changelist"))
+			}
+			if err := moveToChangelist(uri, id, name); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.setSeverity":
+			// Arguments: uri, comment ID and nit, suggestion, issue or blocker, empty for the
+			// severity of the settings
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			severity, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for severity"))
+			}
+			if err := setCommentSeverity(uri, id, severity); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.setPriority":
+			// Arguments: uri, comment ID and P0 to P3, empty for none
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			priority, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for priority"))
+			}
+			if err := setCommentPriority(uri, id, priority); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.addLocation":
+			// Arguments: uri, comment ID and a location in another file of the
+			// repository the comment is also about
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			var location protocol.Location
+			locationData, _ := json.Marshal(params.Arguments[2])
+			if err := json.Unmarshal(locationData, &location); err != nil || location.URI == "" {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for location"))
+			}
+			if err := addCommentLocation(uri, id, location); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.addRange":
+			// Arguments: uri, comment ID and another range of the file the comment
+			// is about
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			rangeMap, ok := params.Arguments[2].(map[string]interface{})
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for range"))
+			}
+			var rng protocol.Range
+			rangeData, _ := json.Marshal(rangeMap)
+			json.Unmarshal(rangeData, &rng)
+			if err := addCommentRange(uri, id, rng); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.setLabels":
+			// Arguments: uri, comment ID and the labels replacing those of the comment
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 3 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			rawLabels, ok := params.Arguments[2].([]interface{})
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for labels"))
+			}
+			labels := []string{}
+			for _, rawLabel := range rawLabels {
+				label, ok := rawLabel.(string)
+				if !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for label"))
+				}
+				labels = append(labels, label)
+			}
+			if err := setCommentLabels(uri, id, labels); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.publishDiagnostics(ctx, uri)
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.addReference":
+			// Arguments: uri and ID of the comment, then uri and range of the referenced code
+			uri, id, err := commentArguments(params.Arguments)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if len(params.Arguments) != 4 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			targetURI, ok := params.Arguments[2].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for referenced URI"))
+			}
+			var rng protocol.Range
+			rangeData, _ := json.Marshal(params.Arguments[3])
+			if err := json.Unmarshal(rangeData, &rng); err != nil {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for range"))
+			}
+			if err := addReference(uri, id, protocol.DocumentURI(targetURI), rng); err != nil {
+				return reply(ctx, nil, err)
+			}
+			h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri, IDs: []string{id}})
+			return reply(ctx, nil, nil)
+		case "comment.expand":
+			// Arguments: uri, then optional expand, toggled when missing
+			if len(params.Arguments) < 1 || len(params.Arguments) > 2 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
 			uriStr, ok := params.Arguments[0].(string)
 			if !ok {
 				return reply(ctx, nil, fmt.Errorf("invalid argument type for URI"))
 			}
-			uri := protocol.DocumentURI(uriStr)
-			rangeMap, ok := params.Arguments[1].(map[string]interface{})
-			if !ok {
-				return reply(ctx, nil, fmt.Errorf("invalid argument type for range"))
+			uri := protocol.DocumentURI(uriStr)
+			expand := !h.expanded.isExpanded(uri)
+			if len(params.Arguments) == 2 {
+				if expand, ok = params.Arguments[1].(bool); !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for expand"))
+				}
+			}
+			h.expanded.set(uri, expand)
+			h.publishDiagnostics(ctx, uri)
+			return reply(ctx, nil, nil)
+		case "comment.debug.bundle":
+			// Optional argument: document whose comments are not displayed as expected
+			var uri protocol.DocumentURI
+			if len(params.Arguments) > 0 {
+				uriString, ok := params.Arguments[0].(string)
+				if !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for uri"))
+				}
+				uri = protocol.DocumentURI(uriString)
+			}
+			bundlePath, err := h.debugBundle(uri)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			return reply(ctx, bundlePath, nil)
+		case "comment.switchProfile":
+			// Arguments: profile name, empty to use the profile of the settings
+			if len(params.Arguments) != 1 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
 			}
-			var rng protocol.Range
-			rangeData, _ := json.Marshal(rangeMap)
-			json.Unmarshal(rangeData, &rng)
-			contentBody, ok := params.Arguments[2].(string)
+			name, ok := params.Arguments[0].(string)
 			if !ok {
-				return reply(ctx, nil, fmt.Errorf("invalid argument type for contentBody"))
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for profile"))
 			}
-			// Add comment function
-			err := h.addComment(ctx, uri, rng, contentBody)
-			if err != nil {
+			if err := h.switchProfile(name); err != nil {
 				return reply(ctx, nil, err)
 			}
-			h.publishDiagnostics(ctx, uri)
 			return reply(ctx, nil, nil)
+		case "review.openPullRequest":
+			if len(params.Arguments) != 1 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			number, ok := params.Arguments[0].(float64)
+			if !ok || number < 1 {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for pull request number"))
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				return h.openPullRequest(ctx, int(number))
+			})
+		case "review.submit":
+			// Arguments: verdict, then optional review message
+			if len(params.Arguments) < 1 {
+				return reply(ctx, nil, fmt.Errorf("invalid arguments count"))
+			}
+			verdict, ok := params.Arguments[0].(string)
+			if !ok {
+				return reply(ctx, nil, fmt.Errorf("invalid argument type for verdict"))
+			}
+			body := ""
+			if len(params.Arguments) > 1 {
+				if body, ok = params.Arguments[1].(string); !ok {
+					return reply(ctx, nil, fmt.Errorf("invalid argument type for message"))
+				}
+			}
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				return h.submitReview(ctx, verdict, body)
+			})
+		case "comment.reauthenticate":
+			// Credential helpers can wait for the user, the read loop must not
+			return h.goCancellable(ctx, reply, req, func(ctx context.Context) (interface{}, error) {
+				return nil, h.reauthenticate(ctx)
+			})
 		default:
 			return reply(ctx, nil, fmt.Errorf("unrecognised command"))
 		}
@@ -157,132 +1329,512 @@ func (h *handler) handle(ctx context.Context, reply jsonrpc2.Replier, req jsonrp
 }
 
 type CommentFile struct {
+	// Schema of the file, none in the files of the first versions
+	Version int     `json:"version,omitempty"`
 	Commit  string  `json:"commit"`
 	Patches []Patch `json:"patches"`
+	// Lines of the patches by hash, only in stored files
+	Blobs map[string]string `json:"blobs,omitempty"`
+	// Comments of the cells of a notebook by cell id, see notebook.go
+	Cells map[string]*CommentFile `json:"cells,omitempty"`
 }
 
 type Patch struct {
+	// UUID given at creation, addressing the comment whatever its position in
+	// the comment file. Comments older than schema version 3 are given a
+	// hash instead, see assignCommentIDs.
+	ID      string `json:"id,omitempty"`
 	Message string `json:"message"`
-	Patch   string `json:"patch"`
+	// Not published yet, only shown to its author, see drafts.go
+	Draft bool `json:"draft,omitempty"`
+	// Private notes are kept in a local store, see notes.go. Shared when
+	// empty.
+	Visibility string `json:"visibility,omitempty"`
+	Patch      string `json:"patch,omitempty"`
+	// Lines of the patch in the blobs of the file, only in stored files
+	PatchRef []string `json:"patchRef,omitempty"`
+	// Other ranges of the comment (e.g. the call sites of a commented
+	// signature), each anchored on its own
+	SecondaryPatches []string `json:"secondaryPatches,omitempty"`
+	// Anchors in other files of the repository, see crossfile.go
+	FileAnchors []FileAnchor `json:"fileAnchors,omitempty"`
+	Language    string       `json:"language,omitempty"` // Language the message is written in
+	// Who authored, replied to or viewed the thread
+	Participants []Participation `json:"participants,omitempty"`
+	// Name of the author when the comment was made, shown with its identity
+	AuthorName string   `json:"authorName,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+	CreatedAt  string   `json:"createdAt,omitempty"` // RFC3339
+	// Last edit, reply or state change
+	UpdatedAt     string `json:"updatedAt,omitempty"`     // RFC3339
+	SLABreachedAt string `json:"slaBreachedAt,omitempty"` // RFC3339
+	Assignee      string `json:"assignee,omitempty"`
+	// Date the comment is to be addressed by, YYYY-MM-DD, see duedate.go
+	DueDate string `json:"dueDate,omitempty"`
+	// Resolved by the expiry sweep from then on, see expiry.go
+	ExpiresAt string `json:"expiresAt,omitempty"` // RFC3339
+	// Chosen by the author: nit, suggestion, issue or blocker. The severity
+	// of the settings applies when empty.
+	Severity string `json:"severity,omitempty"`
+	// Triage order, P0 to P3
+	Priority   string  `json:"priority,omitempty"`
+	State      string  `json:"state,omitempty"`      // Open when empty
+	ResolvedAt string  `json:"resolvedAt,omitempty"` // RFC3339, when closed
+	Replies    []Reply `json:"replies,omitempty"`
+	// Named group the comment is worked on with, none when empty
+	Changelist string `json:"changelist,omitempty"`
+	// Generated file the comment was made on, attached to its source
+	GeneratedFrom string `json:"generatedFrom,omitempty"`
+	// Locations of other repositories the comment refers to
+	References []ThreadReference `json:"references,omitempty"`
+	// Review comment of a GitHub pull request the thread was imported from
+	// or submitted as
+	GitHubComment int64 `json:"githubComment,omitempty"`
+	// Previous messages, oldest first, see history.go
+	History []CommentRevision `json:"history,omitempty"`
+	// Vote of each user, 1 up or -1 down, see votes.go
+	Votes map[string]int `json:"votes,omitempty"`
+	// Files of the comments folder, see attachments.go
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Code replacing the commented lines, proposed by a suggestion comment
+	Suggestion *string `json:"suggestion,omitempty"`
+	// Issue created from the comment, see issues.go
+	IssueURL string `json:"issueUrl,omitempty"`
+}
+
+// Comments on the file as a whole have no patch
+func (patch *Patch) isFileLevel() bool {
+	return patch.Patch == "" && len(patch.PatchRef) == 0
+}
+
+func (patch *Patch) hasLabel(label string) bool {
+	for _, patchLabel := range patch.Labels {
+		if strings.EqualFold(patchLabel, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// Optional last argument of comment.add
+type CommentOptions struct {
+	Labels   []string `json:"labels,omitempty"`
+	Assignee string   `json:"assignee,omitempty"`
+	Severity string   `json:"severity,omitempty"` // nit, suggestion, issue or blocker
+	// Other ranges of the file the comment is about
+	SecondaryRanges []protocol.Range `json:"secondaryRanges,omitempty"`
+	// Ranges of other files of the repository the comment is also about
+	OtherLocations []protocol.Location `json:"otherLocations,omitempty"`
+	// Comment on the file as a whole, e.g. "this module needs tests". The
+	// range is ignored, comment.add also takes a null range.
+	FileLevel bool `json:"fileLevel,omitempty"`
+	// Kept to its author until comment.publishDrafts
+	Draft bool `json:"draft,omitempty"`
+	// shared (default) or private: a personal note that is never synced
+	Visibility string `json:"visibility,omitempty"`
+	// Adds the comment without asking when it duplicates an open comment
+	AllowDuplicate bool `json:"allowDuplicate,omitempty"`
+	// YYYY-MM-DD
+	DueDate string `json:"dueDate,omitempty"`
+	// YYYY-MM-DD or RFC3339, or a number of days from now
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	TTLDays   int    `json:"ttlDays,omitempty"`
+	// Replacement of the commented lines, makes a suggestion comment
+	Suggestion *string `json:"suggestion,omitempty"`
+	Priority   string  `json:"priority,omitempty"` // P0 to P3
 }
 
 func loadCommentFile(filePath string) (*CommentFile, error) {
-	commentFilePath, _, err := getCommentFilePath(filePath)
+	commentFilePath, repoDir, err := getCommentFilePath(filePath)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Load comment file : %s", commentFilePath)
-	data, err := os.ReadFile(commentFilePath)
+	storeLog.debugf("Load comment file : %s", commentFilePath)
+	commentFile, err := readCommentFile(commentFilePath)
+	return withNotes(commentFile, err, repoDir, commentFilePath)
+}
+
+func readCommentFile(commentFilePath string) (*CommentFile, error) {
+	if notebookFilePath, id, ok := splitCellPath(commentFilePath); ok {
+		return readCellSection(notebookFilePath, id)
+	}
+	commentFile, err := getCommentStore().Get(commentFilePath)
 	if err != nil {
 		return nil, err
 	}
-	var commentFile CommentFile
-	err = json.Unmarshal(data, &commentFile)
+	migrated, err := migrateCommentFile(commentFilePath, commentFile)
 	if err != nil {
 		return nil, err
 	}
-	return &commentFile, nil
+	if migrated && isWorkspaceTrusted() {
+		writeBackMigratedCommentFile(commentFilePath)
+	}
+	return commentFile, nil
+}
+
+// Callers changing a comment file hold its lock from the read to the write,
+// see lockCommentFile
+func writeCommentFile(commentFilePath string, commentFile *CommentFile) error {
+	if notebookFilePath, id, ok := splitCellPath(commentFilePath); ok {
+		return writeCellSection(notebookFilePath, id, commentFile)
+	}
+	// Comments are addressed by their ID, which must not change once given
+	assignCommentIDs(commentFile)
+	if err := getCommentStore().Put(commentFilePath, commentFile); err != nil {
+		return err
+	}
+	commentFilesWritten(commentFilePath)
+	return nil
+}
+
+func deleteCommentFile(commentFilePath string) error {
+	if err := getCommentStore().Delete(commentFilePath); err != nil {
+		return err
+	}
+	commentFilesWritten(commentFilePath)
+	return nil
 }
 
 func isCommitInCurrentBranch(commit string) (bool, error) {
-	cmd := exec.Command("git", "branch", "--contains", commit)
+	gitLog.debugf("git branch --contains %s", commit)
+	cmd := gitCommand("branch", "--contains", commit)
 	output, err := cmd.Output()
 	if err != nil {
-		return false, err
+		return false, newCommentError(ErrVCSUnavailable, "git branch --contains %s failed: %w", commit, err)
 	}
 	branches := strings.TrimSpace(string(output))
 	return branches != "", nil
 }
 
+// Returns true when the lines of rng differ from the commented lines recorded
+// in the patch
+func commentedCodeChanged(content string, patchText string, rng protocol.Range) bool {
+	var recorded []string
+	for _, patchLine := range strings.Split(patchText, "\n") {
+		if strings.HasPrefix(patchLine, "-") {
+			recorded = append(recorded, patchLine[1:])
+		}
+	}
+	lines := strings.Split(content, "\n")
+	start := int(rng.Start.Line)
+	if start+len(recorded) > len(lines) {
+		return true
+	}
+	for idx, line := range recorded {
+		if lines[start+idx] != line {
+			return true
+		}
+	}
+	return false
+}
+
+// Anchors a patch with the strategies that do not need to know its file
 func applyPatchAndGetPositions(originalText string, patchText string) (protocol.Range, error) {
-	dmp := dmp.New()
+	rng, _, err := anchorPatch(anchorInput{content: originalText, patchText: patchText})
+	return rng, err
+}
+
+// Returns the number of context lines before and after the changed lines of
+// the first hunk of a patch.
+func patchContextLines(patchText string) (int, int) {
+	lines := strings.Split(patchText, "\n")
+	before, after := 0, 0
+	inChange := false
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "@@") {
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, " "):
+			if inChange {
+				after++
+			} else {
+				before++
+			}
+		case strings.HasPrefix(line, "-"), strings.HasPrefix(line, "+"):
+			inChange = true
+			after = 0
+		}
+	}
+	return before, after
+}
+
+func (h *handler) publishDiagnostics(ctx context.Context, uri protocol.DocumentURI) {
+	if h.canPullDiagnostics {
+		h.refreshDiagnostics()
+		return
+	}
+	h.publishDocumentDiagnostics(ctx, uri)
+	// The comments of the document may be shown in other files too
+	for _, target := range h.crossFileTargets(uri) {
+		h.publishDocumentDiagnostics(ctx, target)
+	}
+}
 
-	// Convertir le texte du patch en objets Patch
-	patches, err := dmp.PatchFromText(patchText)
+func (h *handler) publishDocumentDiagnostics(ctx context.Context, uri protocol.DocumentURI) {
+	protocolLog.debugf("publishDiagnostics: Start function")
+	diagnostics, err := h.computeDiagnostics(uri)
 	if err != nil {
-		return protocol.Range{}, err
+		recordError(fmt.Errorf("publishDiagnostics: %w", err))
+		return
+	}
+
+	// Envoyer les diagnostics à l'éditeur
+	params := protocol.PublishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: diagnostics,
 	}
 
-	// Appliquer le patch pour obtenir le nouveau texte et les résultats
-	_, results := dmp.PatchApply(patches, originalText)
-	if len(results) == 0 {
-		return protocol.Range{}, fmt.Errorf("could not apply current patch")
+	// Envoyer la notification
+	h.conn.Notify(ctx, "textDocument/publishDiagnostics", params)
+}
+
+// Returns one diagnostic per comment that can still be anchored in the
+// current content of the document.
+func (h *handler) computeDiagnostics(uri protocol.DocumentURI) ([]protocol.Diagnostic, error) {
+	comments, err := anchorComments(uri)
+	crossFile := anchorCrossFileComments(uri)
+	if err != nil && len(crossFile) == 0 {
+		return nil, err
 	}
 
-	for idx, p := range patches {
-		log.Printf("patch %d : start1: %d, length1: %d, start2: %d, length2: %d", idx, p.Start1, p.Length1, p.Start2, p.Length2)
+	currentSettings := getSettings()
+	filePath := uriToPath(uri)
+	rel := filePath
+	if repoDir := getUserRepoDir(filePath); repoDir != "" {
+		rel, _ = filepath.Rel(repoDir, filePath)
+	}
+	var related map[int][]protocol.DiagnosticRelatedInformation
+	if h.canRelateDiagnostics {
+		related = diagnosticsRelatedInformation(uri, comments)
+	}
+	// Indexes of the comments of other files are in their comment files
+	ownCount := len(comments)
+	comments = append(comments, crossFile...)
+	// Drafts are only shown to their author, assignments stand out for the
+	// assignee
+	user := ""
+	if slices.ContainsFunc(comments, func(comment anchoredComment) bool {
+		return comment.Patch.Draft || comment.Patch.Assignee != ""
+	}) {
+		user = currentUser(filepath.Dir(filePath))
+	}
+	now := time.Now()
+	var diagnostics, secondaries, faded []protocol.Diagnostic
+	for commentIdx, comment := range comments {
+		if !comment.Patch.visibleTo(user) {
+			continue
+		}
+		display := currentSettings.stateDisplay(comment.Patch.state())
+		if display == DisplayFade && !h.canFadeDiagnostics {
+			display = DisplayHide
+		}
+		if display == DisplayHide || !currentSettings.publishesLabels(&comment.Patch) {
+			continue
+		}
+		severity := currentSettings.commentSeverity(&comment.Patch)
+		if comment.Patch.SLABreachedAt != "" {
+			severity = escalateSeverity(severity)
+		}
+		assignedToUser := !comment.Patch.isClosed() && sameUser(comment.Patch.Assignee, user)
+		if assignedToUser {
+			severity = escalateSeverity(severity)
+		}
+		dueLevels, dueMention := comment.Patch.dueEscalation(now)
+		for range dueLevels {
+			severity = escalateSeverity(severity)
+		}
+		message := threadMessage(comment.Patch)
+		var tags []protocol.DiagnosticTag
+		if comment.Patch.isClosed() {
+			message = "[" + comment.Patch.state() + "] " + message
+		}
+		if comment.FileLevel {
+			message = "[file] " + message
+		}
+		if comment.Patch.Draft {
+			message = "[draft] " + message
+		}
+		if comment.Patch.isPrivate() {
+			message = "[private] " + message
+		}
+		if assignedToUser {
+			message = "[assigned to you] " + message
+		}
+		if dueMention != "" {
+			message = dueMention + " " + message
+		}
+		if comment.Patch.Priority != "" {
+			message = "[" + comment.Patch.Priority + "] " + message
+		}
+		var relatedInformation []protocol.DiagnosticRelatedInformation
+		if comment.SourceURI != "" {
+			message = "[from " + filepath.Base(uriToPath(comment.SourceURI)) + "] " + message
+		} else if commentIdx < ownCount {
+			relatedInformation = related[comment.Index]
+		}
+		if display == DisplayFade {
+			// The least visible severity
+			severity = protocol.DiagnosticSeverityHint
+			tags = []protocol.DiagnosticTag{protocol.DiagnosticTagUnnecessary}
+		} else if comment.Outdated {
+			severity = outdatedSeverity(severity)
+			message = "[outdated] " + message
+		}
+		code, codeDescription := diagnosticCode(currentSettings, rel, &comment.Patch)
+		diagnostic := protocol.Diagnostic{
+			Range:           currentSettings.presentedRange(comment.Range),
+			Severity:        severity,
+			Code:            code,
+			CodeDescription: codeDescription,
+			Message:         message,
+			Tags:            tags,
+			// Lets the client address the comment in commands
+			Data:               diagnosticData{Index: comment.Index, ID: commentID(&comment.Patch), URI: comment.SourceURI},
+			RelatedInformation: relatedInformation,
+		}
+		// Secondary ranges are related to the main one, or have their own
+		// diagnostic when the client cannot relate them
+		var secondaryDiagnostics []protocol.Diagnostic
+		for _, secondary := range comment.SecondaryRanges {
+			if h.canRelateDiagnostics {
+				diagnostic.RelatedInformation = append(diagnostic.RelatedInformation, protocol.DiagnosticRelatedInformation{
+					Location: protocol.Location{URI: uri, Range: secondary},
+					Message:  "Also commented here",
+				})
+				continue
+			}
+			secondaryDiagnostic := diagnostic
+			secondaryDiagnostic.Range = currentSettings.presentedRange(secondary)
+			secondaryDiagnostic.Message = "[continued] " + message
+			secondaryDiagnostics = append(secondaryDiagnostics, secondaryDiagnostic)
+		}
+		if display == DisplayFade {
+			faded = append(faded, diagnostic)
+			faded = append(faded, secondaryDiagnostics...)
+			continue
+		}
+		diagnostics = append(diagnostics, diagnostic)
+		secondaries = append(secondaries, secondaryDiagnostics...)
+	}
+	if h.summarized(uri, len(diagnostics)) {
+		// Faded comments would clutter the summarized document again
+		return h.summarizeDiagnostics(uri, diagnostics), nil
 	}
+	return append(append(diagnostics, secondaries...), faded...), nil
+}
 
-	// Trouver les positions où les patches ont été appliqués
-	patchLine := patches[0].Start1
-	patchLength := patches[0].Length1
+type diagnosticData struct {
+	Index int    `json:"index"` // Index of the comment in the comment file
+	ID    string `json:"id"`    // Stable identifier, preferred by commands
+	// Document holding the comment when it was made on another file
+	URI protocol.DocumentURI `json:"uri,omitempty"`
+}
 
-	start := protocol.Position{Line: uint32(patchLine + contextBefore), Character: 0}
-	end := protocol.Position{Line: uint32(patchLine + patchLength - contextAfter), Character: 0}
-	log.Printf("range is from line %d to line %d", start.Line, end.Line)
-	return protocol.Range{Start: start, End: end}, nil
+// A comment with its position in the current content of its document
+type anchoredComment struct {
+	Index int // Index of the comment in the comment file
+	Patch Patch
+	Range protocol.Range
+	// Secondary ranges still found in the content
+	SecondaryRanges []protocol.Range
+	// Comment on the whole file, its range is the start of the file
+	FileLevel bool
+	// The commented code changed since the comment, it was anchored by
+	// approximate matching
+	Outdated bool
+	// Document holding a comment made on another file, empty for the
+	// comments of the document itself
+	SourceURI protocol.DocumentURI
 }
 
-func (h *handler) publishDiagnostics(ctx context.Context, uri protocol.DocumentURI) {
-	log.Printf("publishDiagnostics: Start function")
+// Returns the comments of a document that can still be anchored in its
+// current content.
+func anchorComments(uri protocol.DocumentURI) ([]anchoredComment, error) {
 	filePath := uriToPath(uri)
+	if filePath == "" {
+		// Cell of a notebook not saved yet
+		return nil, nil
+	}
 	// Load file content
-	currentContentBytes, err := os.ReadFile(filePath)
+	currentContentBytes, err := readSourceFile(filePath)
 	if err != nil {
-		log.Printf("publishDiagnostics: error while reading file %s: %v", filePath, err)
-		return
+		return nil, wrapFileError(err, "error while reading file %s: %w", filePath, err)
 	}
 	currentContent := string(currentContentBytes)
 
 	// Load comments and patches
 	commentFile, err := loadCommentFile(filePath)
 	if err != nil {
-		log.Printf("No comments found for %s: %v", filePath, err)
-		return
+		return nil, fmt.Errorf("no comments found for %s: %w", filePath, err)
 	}
 
-	// Check if commit is on current branch
-	if commentFile.Commit != "" {
+	// Check if commit is on current branch, untrusted workspaces show every
+	// stored comment
+	if commentFile.Commit != "" && isWorkspaceTrusted() {
 		commitPresent, err := isCommitInCurrentBranch(commentFile.Commit)
 		if err != nil {
-			log.Printf("Error while checking commit: %v", err)
-			return
+			return nil, fmt.Errorf("error while checking commit: %w", err)
 		}
 		if !commitPresent {
-			log.Printf("Commit %s is not on current branch. No comment will be displayed.", commentFile.Commit)
-			return
+			return nil, fmt.Errorf("commit %s is not on current branch, no comment will be displayed", commentFile.Commit)
 		}
 	}
 
-	var diagnostics []protocol.Diagnostic
-	for _, patch := range commentFile.Patches {
-		position, err := applyPatchAndGetPositions(currentContent, patch.Patch)
+	var comments []anchoredComment
+	for idx, patch := range commentFile.Patches {
+		if patch.isFileLevel() {
+			// Shown at the start of the file, whatever its content
+			comments = append(comments, anchoredComment{Index: idx, Patch: patch, FileLevel: true})
+			continue
+		}
+		position, _, err := anchorPatch(anchorInput{
+			content:   currentContent,
+			patchText: patch.Patch,
+			filePath:  filePath,
+			commit:    commentFile.Commit,
+		})
 		if err != nil {
-			log.Printf("Error while applying the patch: %v", err)
+			countError(fmt.Errorf("error while applying the patch of comment %d of %s: %w", idx, filePath, err))
 			continue
 		}
-		diagnostic := protocol.Diagnostic{
+		comment := anchoredComment{
+			Index:    idx,
+			Patch:    patch,
 			Range:    position,
-			Severity: protocol.DiagnosticSeverityHint,
-			Message:  patch.Message,
+			Outdated: commentedCodeChanged(currentContent, patch.Patch, position),
 		}
-		diagnostics = append(diagnostics, diagnostic)
+		for secondaryIdx, secondaryPatch := range patch.SecondaryPatches {
+			secondary, _, err := anchorPatch(anchorInput{
+				content:   currentContent,
+				patchText: secondaryPatch,
+				filePath:  filePath,
+				commit:    commentFile.Commit,
+			})
+			if err != nil {
+				// The comment is still shown on its main range
+				anchorLog.debugf("Secondary range %d of comment %d of %s not found: %v", secondaryIdx, idx, filePath, err)
+				continue
+			}
+			comment.SecondaryRanges = append(comment.SecondaryRanges, secondary)
+		}
+		comments = append(comments, comment)
 	}
+	return comments, nil
+}
 
-	// Envoyer les diagnostics à l'éditeur
-	params := protocol.PublishDiagnosticsParams{
-		URI:         uri,
-		Diagnostics: diagnostics,
+func uriToPath(uri protocol.DocumentURI) string {
+	if path, ok := notebooks.cellPath(uri); ok {
+		return path
 	}
-
-	// Envoyer la notification
-	h.conn.Notify(ctx, "textDocument/publishDiagnostics", params)
+	return uriToFilePath(uri)
 }
 
-func uriToPath(uri protocol.DocumentURI) string {
+// Path of a file URI, or of the notebook of a cell URI
+func uriToFilePath(uri protocol.DocumentURI) string {
 	parsed, err := url.Parse(string(uri))
 	if err != nil {
-		log.Printf("Failed to parse URI: %v", err)
+		logErrorf("Failed to parse URI: %v", err)
 		return ""
 	}
 	path := parsed.Path
@@ -299,15 +1851,38 @@ func uriToPath(uri protocol.DocumentURI) string {
 	// Decode URL-encoded characters
 	path, err = url.PathUnescape(path)
 	if err != nil {
-		log.Printf("Failed to unescape path: %v", err)
+		logErrorf("Failed to unescape path: %v", err)
 		return ""
 	}
 	return path
 }
 
+func pathToURI(path string) protocol.DocumentURI {
+	if notebookPath, _, ok := splitCellPath(path); ok {
+		if uri, open := notebooks.cellURI(path); open {
+			return uri
+		}
+		// Cells of closed notebooks have no URI
+		path = notebookPath
+	}
+	path = filepath.ToSlash(path)
+	// Windows paths need a leading '/' after the scheme
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return protocol.DocumentURI((&url.URL{Scheme: "file", Path: path}).String())
+}
+
 func getUserRepoDir(filePath string) string {
-	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
-	cmd.Dir = filepath.Dir(filePath)
+	return getRepoDirFromDir(filepath.Dir(filePath))
+}
+
+func getRepoDirFromDir(dir string) string {
+	if !isWorkspaceTrusted() {
+		return findRepoDir(dir)
+	}
+	cmd := gitCommand("rev-parse", "--show-toplevel")
+	cmd.Dir = dir
 	output, err := cmd.Output()
 	if err != nil {
 		return ""
@@ -316,9 +1891,9 @@ func getUserRepoDir(filePath string) string {
 	return repoDir
 }
 
-func (h *handler) addComment(ctx context.Context, uri protocol.DocumentURI, rng protocol.Range, commentBody string) error {
+func (h *handler) addComment(ctx context.Context, uri protocol.DocumentURI, rng protocol.Range, commentBody string, options CommentOptions) error {
 	// Generate patch
-	err := generateAndSaveCommentPatch(uri, rng, commentBody)
+	err := generateAndSaveCommentPatch(uri, rng, commentBody, options)
 	if err != nil {
 		return err
 	}
@@ -331,6 +1906,11 @@ func (h *handler) addComment(ctx context.Context, uri protocol.DocumentURI, rng
 // - The current comment file path
 // - The root of the current git repository (if there is one)
 func getCommentFilePath(filePath string) (string, string, error) {
+	if notebookPath, id, ok := splitCellPath(filePath); ok {
+		// Section of the comment file of the notebook
+		commentFilePath, userRepoDir, err := getCommentFilePath(notebookPath)
+		return commentFilePath + cellSeparator + id, userRepoDir, err
+	}
 	userRepoDir := getUserRepoDir(filePath)
 	if userRepoDir != "" {
 		// If there is a git setup, we can retrieve the commitHash and the relative path
@@ -339,37 +1919,25 @@ func getCommentFilePath(filePath string) (string, string, error) {
 		if err != nil {
 			return "", userRepoDir, fmt.Errorf("error while getting relative path : %v", err)
 		}
-		commentFilePath := filepath.Join(userRepoDir, "comments", gitRelativePath+".json")
+		commentFilePath := filepath.Join(commentsDirOf(userRepoDir), gitRelativePath+".json")
 		return commentFilePath, userRepoDir, nil
 	} else {
 		return filePath + ".json", "", nil
 	}
 }
 
-func generateAndSaveCommentPatch(uri protocol.DocumentURI, rng protocol.Range, commentText string) error {
-	filePath := uriToPath(uri)
-	// Current file content
-	currentContentBytes, err := os.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("error while reading file %s: %v", filePath, err)
-	}
-	currentContent := string(currentContentBytes)
-	commentFilePath, userRepoDir, err := getCommentFilePath(filePath)
-	if err != nil {
-		return err
-	}
-	var commitHash = ""
-	if userRepoDir != "" {
-		// Current commit hash
-		cmd := exec.Command("git", "rev-parse", "HEAD")
-		cmd.Dir = userRepoDir
-		commitBytes, err := cmd.Output()
-		if err != nil {
-			return fmt.Errorf("erreur lors de la récupération du commit courant: %v", err)
-		}
-		commitHash = strings.TrimSpace(string(commitBytes))
-	}
+// Folder of the comments repository holding data that is not a comment file
+const metaDirName = ".lsp-comments"
 
+// Calls fn for every comment file found under commentsDir, with the path of
+// the commented source file relative to the repository root.
+func walkCommentFiles(commentsDir string, fn func(commentFilePath string, rel string) error) error {
+	return getCommentStore().List(commentsDir, fn)
+}
+
+// Builds the patch anchoring a comment on rng: the selected lines surrounded
+// by context lines.
+func buildCommentPatch(filePath string, currentContent string, rng protocol.Range) string {
 	// Extract current text
 	lines := strings.Split(currentContent, "\n")
 	linesCount := len(lines)
@@ -383,6 +1951,8 @@ func generateAndSaveCommentPatch(uri protocol.DocumentURI, rng protocol.Range, c
 		endLine = linesCount - 1
 	}
 	// Get context lines
+	profile := getSettings().anchoringProfile(filePath)
+	contextBefore, contextAfter := profile.contextBefore, profile.contextAfter
 	contextStart := startLine - contextBefore
 	if contextStart < 0 {
 		contextStart = 0
@@ -409,66 +1979,290 @@ func generateAndSaveCommentPatch(uri protocol.DocumentURI, rng protocol.Range, c
 	for i := endLine + 1; i < contextEnd; i++ {
 		patchText += " " + lines[i] + "\n"
 	}
+	return patchText
+}
+
+func generateAndSaveCommentPatch(uri protocol.DocumentURI, rng protocol.Range, commentText string, options CommentOptions) error {
+	if uriToPath(uri) == "" {
+		return fmt.Errorf("save the notebook before commenting its new cells")
+	}
+	if err := validateCommentSeverity(options.Severity); err != nil {
+		return err
+	}
+	if err := validateDueDate(options.DueDate); err != nil {
+		return err
+	}
+	expiresAt, err := parseExpiry(options.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if options.TTLDays < 0 {
+		return fmt.Errorf("invalid time to live of %d days", options.TTLDays)
+	}
+	if options.TTLDays > 0 && expiresAt == "" {
+		expiresAt = time.Now().AddDate(0, 0, options.TTLDays).UTC().Format(time.RFC3339)
+	}
+	if err := validateCommentPriority(options.Priority); err != nil {
+		return err
+	}
+	if err := validateVisibility(options.Visibility); err != nil {
+		return err
+	}
+	if options.Visibility == VisibilityPrivate {
+		if options.Draft {
+			return fmt.Errorf("private notes are never published, they cannot be drafts")
+		}
+		if len(options.OtherLocations) > 0 {
+			return fmt.Errorf("private notes are about a single file")
+		}
+	}
+	if options.Suggestion != nil {
+		if options.FileLevel {
+			return fmt.Errorf("a suggestion replaces the commented lines, it cannot be about the whole file")
+		}
+		if options.Severity == "" {
+			options.Severity = "suggestion"
+		}
+		suggestion := normalizeSuggestion(*options.Suggestion)
+		options.Suggestion = &suggestion
+	}
+	filePath, generatedFrom, err := redirectGeneratedComment(uriToPath(uri), getUserRepoDir(uriToPath(uri)))
+	if err != nil {
+		return err
+	}
+	if generatedFrom != "" {
+		// Ranges of generated files mean nothing in their source
+		rng = protocol.Range{}
+	}
+	// Current file content
+	currentContentBytes, err := readSourceFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error while reading file %s: %v", filePath, err)
+	}
+	currentContent := string(currentContentBytes)
+	_, userRepoDir, err := getCommentFilePath(filePath)
+	if err != nil {
+		return err
+	}
+	var commitHash = ""
+	if userRepoDir != "" {
+		// Current commit hash
+		cmd := gitCommand("rev-parse", "HEAD")
+		cmd.Dir = userRepoDir
+		commitBytes, err := cmd.Output()
+		if err != nil {
+			return newCommentError(ErrVCSUnavailable, "erreur lors de la récupération du commit courant: %w", err)
+		}
+		commitHash = strings.TrimSpace(string(commitBytes))
+	}
+
+	// File level comments are stored without patch
+	var patchText string
+	if !options.FileLevel {
+		patchText = buildCommentPatch(filePath, currentContent, rng)
+	}
+	var secondaryPatches []string
+	if generatedFrom == "" && !options.FileLevel {
+		for _, secondary := range options.SecondaryRanges {
+			secondaryPatches = append(secondaryPatches, buildCommentPatch(filePath, currentContent, secondary))
+		}
+	}
+	var fileAnchors []FileAnchor
+	if generatedFrom == "" {
+		for _, location := range options.OtherLocations {
+			anchor, err := buildFileAnchor(userRepoDir, filePath, location)
+			if err != nil {
+				return err
+			}
+			fileAnchors = append(fileAnchors, anchor)
+		}
+	}
 
 	// Load or create comment file
+	unlock, err := lockDocumentComments(filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	var commentFile CommentFile
-	if _, err := os.Stat(commentFilePath); os.IsNotExist(err) {
+	existing, err := loadCommentFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
 		// If the file does not exist, create it
 		commentFile = CommentFile{
+			Version: commentFileVersion,
 			Commit:  commitHash,
 			Patches: []Patch{},
 		}
+	} else if err != nil {
+		return err
 	} else {
-		// Load the existing file
-		data, err := os.ReadFile(commentFilePath)
-		if err != nil {
-			return fmt.Errorf("error while reading comment file: %v", err)
-		}
-		err = json.Unmarshal(data, &commentFile)
-		if err != nil {
-			return fmt.Errorf("error while parsing comment file: %v", err)
-		}
+		commentFile = *existing
 	}
 
 	// Add the new comment
+	now := time.Now().UTC().Format(time.RFC3339)
 	newPatch := Patch{
-		Message: commentText,
-		Patch:   patchText,
+		ID:               newCommentUUID(),
+		Message:          commentText,
+		Patch:            patchText,
+		SecondaryPatches: secondaryPatches,
+		FileAnchors:      fileAnchors,
+		Language:         normalizeLanguage(getSettings().Language),
+		Labels:           normalizeLabels(options.Labels),
+		Severity:         options.Severity,
+		Draft:            options.Draft,
+		DueDate:          options.DueDate,
+		ExpiresAt:        expiresAt,
+		Suggestion:       options.Suggestion,
+		Priority:         options.Priority,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		// Set when the comment was made on a file generated from this one
+		GeneratedFrom: generatedFrom,
+	}
+	if options.Visibility == VisibilityPrivate {
+		newPatch.Visibility = VisibilityPrivate
+	}
+	author := currentUser(filepath.Dir(filePath))
+	newPatch.recordParticipation(author, ParticipationAuthored)
+	if name := currentAuthorName(filepath.Dir(filePath)); name != author {
+		newPatch.AuthorName = name
+	}
+	if options.Assignee != "" && userRepoDir != "" {
+		// Assign to the backup of away users
+		roster, err := loadRoster(userRepoDir)
+		if err != nil {
+			return err
+		}
+		newPatch.Assignee = roster.route(options.Assignee, time.Now())
+	} else {
+		newPatch.Assignee = options.Assignee
 	}
 	commentFile.Patches = append(commentFile.Patches, newPatch)
 
 	// Save the comment file
-	data, err := json.MarshalIndent(commentFile, "", "  ")
+	err = saveCommentFile(filePath, &commentFile)
 	if err != nil {
-		return fmt.Errorf("error while serializing comment file: %v", err)
+		return err
 	}
-	err = os.MkdirAll(filepath.Dir(commentFilePath), fs.ModePerm)
-	if err != nil {
-		return fmt.Errorf("error while creating folders: %v", err)
+	if newPatch.isPrivate() {
+		// Neither reviewed, synced, audited nor announced
+		return nil
 	}
-	err = os.WriteFile(commentFilePath, data, 0644)
-	if err != nil {
-		return fmt.Errorf("error while writing comment file: %v", err)
+	if userRepoDir != "" {
+		if err := addToActiveReview(userRepoDir, author, newPatch.ID); err != nil {
+			recordError(err)
+		}
+	}
+	if newPatch.Draft {
+		// Shared, audited and announced when published
+		return nil
 	}
 
 	// Update the comments repository
 	err = updateCommentsRepoAfterChange()
 	if err != nil {
-		return fmt.Errorf("error while updating comments repository: %v", err)
+		return newCommentError(ErrSyncConflict, "error while updating comments repository: %w", err)
+	}
+	if userRepoDir != "" {
+		relativePath, _ := filepath.Rel(userRepoDir, filePath)
+		err = appendAuditEvent(userRepoDir, AuditEvent{
+			Event:   AuditCommentAdded,
+			User:    author,
+			Author:  author,
+			Path:    filepath.ToSlash(relativePath),
+			Comment: newPatch.ID,
+		})
+		if err != nil {
+			recordError(err)
+		}
+		if newPatch.Suggestion != nil {
+			auditSuggestion(userRepoDir, AuditSuggestionAdded, author, relativePath, &newPatch)
+		}
+		go notifyMentions(userRepoDir, author, filePath, commentText)
 	}
 	return nil
 }
 
-func updateCommentsRepo() error {
-	if _, err := os.Stat("comments"); os.IsNotExist(err) {
+// Keeps the comments on the comment server of the settings, if any. Only
+// trusted workspaces use it: its token is sent to the URL of the project
+// configuration file, which comes with the code.
+func (h *handler) useCommentServer() {
+	serverURL := getSettings().CommentsServerURL
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if serverURL == "" || repoDir == "" {
+		return
+	}
+	setCommentStore(newRemoteStore(serverURL, commentsDirOf(repoDir)))
+	syncLog.infof("Comments kept by %s", serverURL)
+}
+
+// Starts the background work of a trusted workspace
+func (h *handler) startWorkspace(ctx context.Context) {
+	h.useCommentServer()
+	// Cloning can take a while, the diagnostics are published again when done
+	go func() {
+		h.syncCommentsRepo(ctx)
+		h.archiveOldComments()
+		h.offerUpgrade(ctx)
+	}()
+	go h.runSLAChecker(ctx)
+	go h.runSyncRetry(ctx)
+	go h.runExpirySweep(ctx)
+	if repoDir := getRepoDirFromDir(h.rootPath); repoDir != "" {
+		go h.watchCommentStore(ctx, commentsDirOf(repoDir))
+	}
+}
+
+// Creates the comment folder of the workspace, or clones/pulls it when a
+// comments repository is configured.
+func (h *handler) updateCommentsRepo(ctx context.Context) error {
+	if h.rootPath == "" || !isWorkspaceTrusted() {
+		return nil
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		repoDir = h.rootPath
+	}
+	commentsDir := commentsDirOf(repoDir)
+	if getSettings().ExcludeCommentFolder {
+		if err := excludeCommentsDir(repoDir, commentsDir); err != nil {
+			recordError(fmt.Errorf("error while excluding the comment folder: %w", err))
+		}
+	}
+	repoURL := getSettings().CommentsRepoURL
+	if _, err := os.Stat(commentsDir); os.IsNotExist(err) {
+		if repoURL == "" {
+			if err := os.MkdirAll(commentsDir, fs.ModePerm); err != nil {
+				return wrapFileError(err, "error while creating comment folder: %w", err)
+			}
+			return nil
+		}
 		// Clone repository
-		os.Mkdir("comments", os.ModeDir)
-		//		cmd := exec.Command("git", "clone", "https://github.com/paulbaron/TestLSPComments.git", "comments")
-		//		return cmd.Run()
-	} else {
+		cmd := gitSyncCommand(ctx, repoDir, "clone", repoURL, commentsDir)
+		if err := cmd.Run(); err != nil {
+			return h.failover(ctx, repoDir, commentsDir, newCommentError(syncErrorCode(err, ErrVCSUnavailable), "error while cloning %s: %w", repoURL, err))
+		}
+		invalidateCommentIndex(commentsDir)
+	} else if repoURL != "" {
 		// Update repository
-		//		cmd := exec.Command("git", "-C", "comments", "pull")
-		//		return cmd.Run()
+		head, _ := gitOutput("-C", commentsDir, "rev-parse", "HEAD")
+		cmd := gitSyncCommand(ctx, repoDir, "-C", commentsDir, "pull")
+		if err := cmd.Run(); err != nil {
+			pullErr := newCommentError(syncErrorCode(err, ErrSyncConflict), "error while pulling comments: %w", err)
+			if isRemoteReachable(ctx, repoDir, repoURL) {
+				return pullErr
+			}
+			return h.failover(ctx, repoDir, commentsDir, pullErr)
+		}
+		invalidateCommentIndex(commentsDir)
+		// Clients watching files are notified by the file events
+		if len(head) > 0 && !h.canWatchFiles {
+			h.notifyPulledChanges(repoDir, commentsDir, strings.TrimSpace(string(head)))
+		}
+	}
+	if repoURL != "" {
+		h.primarySynced(repoDir, commentsDir)
 	}
 	return nil
 }
@@ -476,19 +2270,19 @@ func updateCommentsRepo() error {
 func updateCommentsRepoAfterChange() error {
 	// Not working RN
 	/*
-		cmd := exec.Command("git", "-C", "comments", "add", ".")
+		cmd := gitCommand("-C", "comments", "add", ".")
 		err := cmd.Run()
 		if err != nil {
 			return fmt.Errorf("error while adding files to git: %v", err)
 		}
 
-		cmd = exec.Command("git", "-C", "comments", "commit", "-m", "Mise à jour des commentaires")
+		cmd = gitCommand("-C", "comments", "commit", "-m", "Mise à jour des commentaires")
 		err = cmd.Run()
 		if err != nil {
 			return fmt.Errorf("error on files commit: %v", err)
 		}
 
-		cmd = exec.Command("git", "-C", "comments", "push")
+		cmd = gitCommand("-C", "comments", "push")
 		err = cmd.Run()
 		if err != nil {
 			return fmt.Errorf("error while pushing new commit: %v", err)
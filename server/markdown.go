@@ -0,0 +1,183 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Comment messages are Markdown: code snippets, lists, links... Markdown
+// hovers render them once sanitized, so that a message cannot inject markup in
+// the editor. Diagnostics, titles and plain hovers show them without syntax.
+
+// Part of a message, code is never rewritten
+type markdownSegment struct {
+	text  string
+	code  bool
+	fence string // Opening fence of a code block, empty for inline code
+}
+
+var markdownFence = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+
+// Splits text in code blocks, code spans and the text around them
+func splitMarkdownCode(text string) []markdownSegment {
+	segments := []markdownSegment{}
+	var prose strings.Builder
+	flushProse := func() {
+		if prose.Len() > 0 {
+			segments = append(segments, splitCodeSpans(prose.String())...)
+			prose.Reset()
+		}
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for idx := 0; idx < len(lines); idx++ {
+		fence := markdownFence.FindStringSubmatch(lines[idx])
+		if fence == nil {
+			prose.WriteString(lines[idx])
+			continue
+		}
+		flushProse()
+		block := markdownSegment{code: true, fence: fence[1], text: lines[idx]}
+		// Unclosed blocks run to the end of the message
+		for idx++; idx < len(lines); idx++ {
+			block.text += lines[idx]
+			if closing := markdownFence.FindStringSubmatch(lines[idx]); closing != nil &&
+				closing[1][0] == fence[1][0] && len(closing[1]) >= len(fence[1]) {
+				break
+			}
+		}
+		segments = append(segments, block)
+	}
+	flushProse()
+	return segments
+}
+
+// Splits text in code spans, delimited by runs of backticks of the same
+// length, and the text around them
+func splitCodeSpans(text string) []markdownSegment {
+	segments := []markdownSegment{}
+	start := 0
+	for idx := 0; idx < len(text); {
+		if text[idx] != '`' {
+			idx++
+			continue
+		}
+		run := idx
+		for run < len(text) && text[run] == '`' {
+			run++
+		}
+		delimiter := text[idx:run]
+		end := -1
+		for search := run; search < len(text); {
+			found := strings.Index(text[search:], delimiter)
+			if found < 0 {
+				break
+			}
+			found += search
+			after := found + len(delimiter)
+			if after < len(text) && text[after] == '`' {
+				// Longer run, not the closing delimiter
+				for after < len(text) && text[after] == '`' {
+					after++
+				}
+				search = after
+				continue
+			}
+			end = after
+			break
+		}
+		if end < 0 {
+			idx = run
+			continue
+		}
+		if idx > start {
+			segments = append(segments, markdownSegment{text: text[start:idx]})
+		}
+		segments = append(segments, markdownSegment{text: text[idx:end], code: true})
+		start, idx = end, end
+	}
+	if start < len(text) {
+		segments = append(segments, markdownSegment{text: text[start:]})
+	}
+	return segments
+}
+
+var (
+	// Link targets may hold a level of parentheses
+	markdownUnsafeLink = regexp.MustCompile(`(?i)\[([^\]]*)\]\(\s*<?\s*(?:javascript|vbscript|data):(?:[^()]|\([^()]*\))*\)`)
+	markdownHTMLTag    = regexp.MustCompile(`</?[A-Za-z][^>]*>|<!--.*?-->`)
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]+)\]\(\s*<?((?:[^()\s>]|\([^()\s]*\))+)>?(?:[^()]|\([^()]*\))*\)`)
+	markdownStrong     = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	markdownEmphasis   = regexp.MustCompile(`\*(\S(?:[^*]*?\S)?)\*`)
+	markdownHeading    = regexp.MustCompile(`(?m)^ {0,3}#{1,6}\s+`)
+	markdownBlockquote = regexp.MustCompile(`(?m)^ {0,3}>\s?`)
+	markdownEscape     = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!<>~|])")
+)
+
+// Message rendered in markdown without raw HTML nor script links, code is
+// kept as written
+func sanitizeMarkdown(text string) string {
+	var sanitized strings.Builder
+	for _, segment := range splitMarkdownCode(text) {
+		if segment.code {
+			sanitized.WriteString(segment.text)
+			continue
+		}
+		prose := markdownUnsafeLink.ReplaceAllString(segment.text, "$1")
+		// Escaped, tags show as typed
+		prose = strings.ReplaceAll(prose, "<", "&lt;")
+		sanitized.WriteString(prose)
+	}
+	return sanitized.String()
+}
+
+// Escaped ASCII characters are moved to this private use block while the
+// syntax is removed
+const markdownEscapeBase = 0xE000
+
+// Message without markdown syntax, for plain text: code without its fences
+// and backticks, links followed by their target, no emphasis nor HTML
+func plainMarkdown(text string) string {
+	var plain strings.Builder
+	for _, segment := range splitMarkdownCode(text) {
+		switch {
+		case segment.fence != "":
+			lines := strings.SplitAfter(strings.TrimSuffix(segment.text, "\n"), "\n")
+			body := lines[1:]
+			if len(body) > 0 && markdownFence.MatchString(body[len(body)-1]) {
+				body = body[:len(body)-1]
+			}
+			plain.WriteString(strings.Join(body, ""))
+		case segment.code:
+			plain.WriteString(strings.TrimSpace(strings.Trim(segment.text, "`")))
+		default:
+			// Escaped characters are hidden from the other rules
+			prose := markdownEscape.ReplaceAllStringFunc(segment.text, func(escape string) string {
+				return string(markdownEscapeBase + rune(escape[1]))
+			})
+			prose = markdownHTMLTag.ReplaceAllString(prose, "")
+			prose = markdownImage.ReplaceAllString(prose, "$1")
+			prose = markdownUnsafeLink.ReplaceAllString(prose, "$1")
+			prose = markdownLink.ReplaceAllString(prose, "$1 ($2)")
+			prose = markdownStrong.ReplaceAllString(prose, "$1$2")
+			prose = markdownEmphasis.ReplaceAllString(prose, "$1")
+			// Text following a code span on its line does not start a line
+			head, rest := "", prose
+			if plain.Len() > 0 && !strings.HasSuffix(plain.String(), "\n") {
+				var found bool
+				if head, rest, found = strings.Cut(prose, "\n"); found {
+					head += "\n"
+				}
+			}
+			rest = markdownHeading.ReplaceAllString(rest, "")
+			rest = markdownBlockquote.ReplaceAllString(rest, "")
+			plain.WriteString(strings.Map(func(r rune) rune {
+				if r >= markdownEscapeBase && r < markdownEscapeBase+0x80 {
+					return r - markdownEscapeBase
+				}
+				return r
+			}, head+rest))
+		}
+	}
+	return strings.TrimRight(plain.String(), "\n")
+}
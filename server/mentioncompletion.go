@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comment body typed by the user in the client, with the cursor offset in
+// the units of the position encoding.
+type MentionCompletionParams struct {
+	Text   string `json:"text"`
+	Offset int    `json:"offset"`
+}
+
+type Contributor struct {
+	Name    string
+	Email   string
+	Commits int
+}
+
+var shortlogRegexp = regexp.MustCompile(`^\s*(\d+)\s+(.*?)\s*<([^>]*)>\s*$`)
+
+// Returns the contributors of the repository, most active first
+func repositoryContributors(repoDir string) ([]Contributor, error) {
+	cmd := gitCommand("shortlog", "-sne", "HEAD")
+	cmd.Dir = repoDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, newCommentError(ErrVCSUnavailable, "git shortlog failed: %w", err)
+	}
+	contributors := []Contributor{}
+	for _, line := range strings.Split(string(output), "\n") {
+		match := shortlogRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		commits, _ := strconv.Atoi(match[1])
+		contributors = append(contributors, Contributor{Name: match[2], Email: match[3], Commits: commits})
+	}
+	return contributors, nil
+}
+
+// Completes the @mention before the cursor with the contributors of the
+// repository. Mentions use the same identity as comment authors: the email.
+func (h *handler) completeMention(params MentionCompletionParams) (*protocol.CompletionList, error) {
+	list := &protocol.CompletionList{Items: []protocol.CompletionItem{}}
+	offset, ok := byteOffset(params.Text, params.Offset)
+	if params.Offset < 0 || !ok {
+		return nil, fmt.Errorf("invalid offset %d", params.Offset)
+	}
+	before := params.Text[:offset]
+	at := strings.LastIndex(before, "@")
+	if at < 0 || (at > 0 && !strings.ContainsAny(before[at-1:at], " \t\n")) {
+		return list, nil
+	}
+	prefix := before[at+1:]
+	if strings.ContainsAny(prefix, " \t\n") {
+		return list, nil
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return list, nil
+	}
+	contributors, err := repositoryContributors(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Range of the mention being typed
+	startPosition := textPosition(before[:at])
+	replaced := protocol.Range{Start: startPosition, End: textPosition(before)}
+	lowerPrefix := strings.ToLower(prefix)
+	for idx, contributor := range contributors {
+		if !strings.Contains(strings.ToLower(contributor.Name), lowerPrefix) &&
+			!strings.Contains(strings.ToLower(contributor.Email), lowerPrefix) {
+			continue
+		}
+		mention := "@" + contributor.Email
+		list.Items = append(list.Items, protocol.CompletionItem{
+			Label:      mention,
+			Detail:     fmt.Sprintf("%s (%d commits)", contributor.Name, contributor.Commits),
+			Kind:       protocol.CompletionItemKindReference,
+			FilterText: "@" + contributor.Name + " " + contributor.Email,
+			SortText:   fmt.Sprintf("%05d", idx),
+			TextEdit:   &protocol.TextEdit{Range: replaced, NewText: mention},
+		})
+	}
+	return list, nil
+}
+
+// Position at the end of text
+func textPosition(text string) protocol.Position {
+	line := strings.Count(text, "\n")
+	lastLine := text[strings.LastIndex(text, "\n")+1:]
+	return protocol.Position{Line: uint32(line), Character: uint32(encodedLength(lastLine))}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Git merge driver for comment files, declared in .gitattributes by init:
+//
+//	separate_comments merge %O %A %B %P
+//
+// Merges the comments of both sides instead of producing JSON conflicts.
+// Comments changed on both sides are recorded for comment/conflicts.
+func runMergeDriver(args []string) int {
+	if len(args) != 3 && len(args) != 4 {
+		fmt.Fprintln(os.Stderr, "usage: merge <base> <ours> <theirs> [path]")
+		return 2
+	}
+	versions := make([]*CommentFile, 3)
+	for idx, path := range args[:3] {
+		// Migrated on their next read, the sides are temporary files without
+		// history
+		commentFile, err := getCommentStore().Get(path)
+		if err == nil {
+			err = checkSchemaVersion(path, commentFile)
+		}
+		if err != nil {
+			// An added file has an empty base
+			if info, statErr := os.Stat(path); statErr == nil && info.Size() == 0 {
+				versions[idx] = &CommentFile{}
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "merge: %v\n", err)
+			return 1
+		}
+		// Sides not migrated yet, the base at least when both sides were
+		// migrated since, are matched on the IDs their migration gives
+		assignCommentIDs(commentFile)
+		versions[idx] = commentFile
+	}
+	merged, conflicts := mergeCommentVersions(versions[0], versions[1], versions[2])
+	if err := writeCommentFile(args[1], merged); err != nil {
+		fmt.Fprintf(os.Stderr, "merge: %v\n", err)
+		return 1
+	}
+	if len(args) == 4 {
+		// Git runs the driver at the root of the repository
+		cwd, _ := os.Getwd()
+		if err := recordConflicts(cwd, filepath.Join(cwd, args[3]), conflicts); err != nil {
+			fmt.Fprintf(os.Stderr, "merge: %v\n", err)
+			return 1
+		}
+	}
+	if len(conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "merge: %d comments of %s changed on both sides, kept ours until resolved\n", len(conflicts), args[len(args)-1])
+	}
+	return 0
+}
+
+// Comments are matched on their ID. Older comments have none, they are
+// matched on their anchor and creation time (or message for comments without
+// creation time).
+func commentKey(patch *Patch) string {
+	if patch.ID != "" {
+		return patch.ID
+	}
+	if patch.CreatedAt != "" {
+		return patch.Patch + "\x00" + patch.CreatedAt
+	}
+	return patch.Patch + "\x00" + patch.Message
+}
+
+func sameComment(a *Patch, b *Patch) bool {
+	dataA, _ := json.Marshal(a)
+	dataB, _ := json.Marshal(b)
+	return string(dataA) == string(dataB)
+}
+
+// Three-way merge of comment files: comments added on either side are kept,
+// comments deleted on one side are removed if the other side did not change
+// them, and a comment changed on one side only takes that change. When both
+// sides changed a comment differently, ours is kept and the conflict returned.
+func mergeCommentVersions(base *CommentFile, ours *CommentFile, theirs *CommentFile) (*CommentFile, []MergeConflict) {
+	index := func(commentFile *CommentFile) map[string]*Patch {
+		patches := map[string]*Patch{}
+		for idx := range commentFile.Patches {
+			patches[commentKey(&commentFile.Patches[idx])] = &commentFile.Patches[idx]
+		}
+		return patches
+	}
+	basePatches, theirPatches := index(base), index(theirs)
+	ourPatches := index(ours)
+
+	// Patches of an older side still need an upgrade
+	merged := &CommentFile{Version: min(ours.Version, theirs.Version), Commit: ours.Commit, Patches: []Patch{}}
+	conflicts := []MergeConflict{}
+	if merged.Commit == "" {
+		merged.Commit = theirs.Commit
+	}
+	for idx := range ours.Patches {
+		ourPatch := &ours.Patches[idx]
+		key := commentKey(ourPatch)
+		basePatch, inBase := basePatches[key]
+		theirPatch, inTheirs := theirPatches[key]
+		switch {
+		case inBase && !inTheirs && sameComment(basePatch, ourPatch):
+			// Deleted by them
+			continue
+		case inBase && inTheirs && sameComment(basePatch, ourPatch):
+			merged.Patches = append(merged.Patches, *theirPatch)
+		default:
+			if inTheirs && !sameComment(ourPatch, theirPatch) && !(inBase && sameComment(basePatch, theirPatch)) {
+				conflict := MergeConflict{Key: key, Ours: *ourPatch, Theirs: *theirPatch}
+				if inBase {
+					conflict.Base = basePatch
+				}
+				conflicts = append(conflicts, conflict)
+			}
+			merged.Patches = append(merged.Patches, *ourPatch)
+		}
+	}
+	for idx := range theirs.Patches {
+		theirPatch := &theirs.Patches[idx]
+		key := commentKey(theirPatch)
+		if _, inOurs := ourPatches[key]; inOurs {
+			continue
+		}
+		basePatch, inBase := basePatches[key]
+		if inBase && sameComment(basePatch, theirPatch) {
+			// Deleted by us
+			continue
+		}
+		merged.Patches = append(merged.Patches, *theirPatch)
+	}
+	cells, cellConflicts := mergeCellSections(base, ours, theirs)
+	merged.Cells = cells
+	return merged, append(conflicts, cellConflicts...)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommentKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Patch
+		same bool
+	}{
+		{
+			name: "same ID, edited",
+			a:    Patch{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "Why?", Patch: testPatch},
+			b:    Patch{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "Why this?", Patch: "@@ -2,1 +2,1 @@\n-b\n+c\n"},
+			same: true,
+		},
+		{
+			name: "different IDs, same comment",
+			a:    Patch{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "Why?", Patch: testPatch},
+			b:    Patch{ID: "3b8e41f0c2d9", Message: "Why?", Patch: testPatch},
+			same: false,
+		},
+		{
+			name: "no ID, same creation time, edited",
+			a:    Patch{Message: "Why?", Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"},
+			b:    Patch{Message: "Why this?", Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"},
+			same: true,
+		},
+		{
+			name: "no ID, different creation times",
+			a:    Patch{Message: "Why?", Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"},
+			b:    Patch{Message: "Why?", Patch: testPatch, CreatedAt: "2024-01-03T03:04:05Z"},
+			same: false,
+		},
+		{
+			name: "no ID nor creation time, same message",
+			a:    Patch{Message: "Why?", Patch: testPatch},
+			b:    Patch{Message: "Why?", Patch: testPatch},
+			same: true,
+		},
+		{
+			name: "no ID nor creation time, different messages",
+			a:    Patch{Message: "Why?", Patch: testPatch},
+			b:    Patch{Message: "Why this?", Patch: testPatch},
+			same: false,
+		},
+		{
+			name: "no ID, different anchors",
+			a:    Patch{Message: "Why?", Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"},
+			b:    Patch{Message: "Why?", Patch: "@@ -2,1 +2,1 @@\n-b\n+c\n", CreatedAt: "2024-01-02T03:04:05Z"},
+			same: false,
+		},
+		{
+			name: "ID against no ID",
+			a:    Patch{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "Why?", Patch: testPatch},
+			b:    Patch{Message: "Why?", Patch: testPatch},
+			same: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := commentKey(&test.a) == commentKey(&test.b); same != test.same {
+				t.Errorf("same key %v, want %v", same, test.same)
+			}
+		})
+	}
+}
+
+func TestMergeCommentVersions(t *testing.T) {
+	first := Patch{ID: "first", Message: "Why?", Patch: testPatch}
+	second := Patch{ID: "second", Message: "Rename it", Patch: testPatch}
+	edited := func(patch Patch, message string) Patch {
+		patch.Message = message
+		return patch
+	}
+	tests := []struct {
+		name          string
+		base          []Patch
+		ours          []Patch
+		theirs        []Patch
+		want          []string // Messages of the merged comments
+		wantConflicts int
+	}{
+		{
+			name:   "added on both sides",
+			base:   []Patch{first},
+			ours:   []Patch{first, second},
+			theirs: []Patch{first, {ID: "third", Message: "New", Patch: testPatch}},
+			want:   []string{"Why?", "Rename it", "New"},
+		},
+		{
+			name:   "deleted by them",
+			base:   []Patch{first, second},
+			ours:   []Patch{first, second},
+			theirs: []Patch{second},
+			want:   []string{"Rename it"},
+		},
+		{
+			name:   "deleted by us",
+			base:   []Patch{first, second},
+			ours:   []Patch{second},
+			theirs: []Patch{first, second},
+			want:   []string{"Rename it"},
+		},
+		{
+			name:   "deleted by them, changed by us",
+			base:   []Patch{first},
+			ours:   []Patch{edited(first, "Why this?")},
+			theirs: []Patch{},
+			want:   []string{"Why this?"},
+		},
+		{
+			name:   "changed by them",
+			base:   []Patch{first},
+			ours:   []Patch{first},
+			theirs: []Patch{edited(first, "Why this?")},
+			want:   []string{"Why this?"},
+		},
+		{
+			name:   "changed the same way",
+			base:   []Patch{first},
+			ours:   []Patch{edited(first, "Why this?")},
+			theirs: []Patch{edited(first, "Why this?")},
+			want:   []string{"Why this?"},
+		},
+		{
+			name:          "changed on both sides",
+			base:          []Patch{first},
+			ours:          []Patch{edited(first, "Why this?")},
+			theirs:        []Patch{edited(first, "Why that?")},
+			want:          []string{"Why this?"},
+			wantConflicts: 1,
+		},
+		{
+			name:          "added on both sides with the same ID",
+			base:          []Patch{},
+			ours:          []Patch{first},
+			theirs:        []Patch{edited(first, "Why that?")},
+			want:          []string{"Why?"},
+			wantConflicts: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, conflicts := mergeCommentVersions(
+				&CommentFile{Version: commentFileVersion, Patches: test.base},
+				&CommentFile{Version: commentFileVersion, Patches: test.ours},
+				&CommentFile{Version: commentFileVersion, Patches: test.theirs},
+			)
+			messages := []string{}
+			for _, patch := range merged.Patches {
+				messages = append(messages, patch.Message)
+			}
+			if len(messages) != len(test.want) {
+				t.Fatalf("merged %q, want %q", messages, test.want)
+			}
+			for idx := range messages {
+				if messages[idx] != test.want[idx] {
+					t.Fatalf("merged %q, want %q", messages, test.want)
+				}
+			}
+			if len(conflicts) != test.wantConflicts {
+				t.Errorf("got %d conflicts, want %d", len(conflicts), test.wantConflicts)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type ReviewerMetrics struct {
+	Reviewer           string `json:"reviewer"`
+	CommentsOpened     int    `json:"commentsOpened"`
+	CommentsResolved   int    `json:"commentsResolved"`
+	ResolvedWithinSLA  int    `json:"resolvedWithinSla"`
+	SuggestionsOpened  int    `json:"suggestionsOpened"`
+	SuggestionsApplied int    `json:"suggestionsApplied"`
+	// SuggestionsApplied / SuggestionsOpened, 0 without suggestions
+	SuggestionAcceptanceRate float64 `json:"suggestionAcceptanceRate"`
+}
+
+type StatsParams struct {
+	// Replace reviewer identities by "Reviewer N"
+	Anonymize bool `json:"anonymize,omitempty"`
+}
+
+// Computes the metrics of every comment author from the audit log, sorted
+// by number of opened comments.
+func reviewerMetrics(repoDir string, anonymize bool) ([]ReviewerMetrics, error) {
+	events, err := readAuditLog(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	byReviewer := map[string]*ReviewerMetrics{}
+	get := func(reviewer string) *ReviewerMetrics {
+		if byReviewer[reviewer] == nil {
+			byReviewer[reviewer] = &ReviewerMetrics{Reviewer: reviewer}
+		}
+		return byReviewer[reviewer]
+	}
+	for _, event := range events {
+		switch event.Event {
+		case AuditCommentAdded:
+			get(event.User).CommentsOpened++
+		case AuditCommentResolved:
+			metrics := get(event.Author)
+			metrics.CommentsResolved++
+			if event.WithinSLA == nil || *event.WithinSLA {
+				metrics.ResolvedWithinSLA++
+			}
+		case AuditSuggestionAdded:
+			get(event.User).SuggestionsOpened++
+		case AuditSuggestionApplied:
+			get(event.Author).SuggestionsApplied++
+		}
+	}
+
+	leaderboard := []ReviewerMetrics{}
+	for _, metrics := range byReviewer {
+		if metrics.Reviewer == "" {
+			continue
+		}
+		if metrics.SuggestionsOpened > 0 {
+			metrics.SuggestionAcceptanceRate = float64(metrics.SuggestionsApplied) / float64(metrics.SuggestionsOpened)
+		}
+		leaderboard = append(leaderboard, *metrics)
+	}
+	sort.Slice(leaderboard, func(i, j int) bool {
+		if leaderboard[i].CommentsOpened != leaderboard[j].CommentsOpened {
+			return leaderboard[i].CommentsOpened > leaderboard[j].CommentsOpened
+		}
+		return leaderboard[i].Reviewer < leaderboard[j].Reviewer
+	})
+	if anonymize {
+		for idx := range leaderboard {
+			leaderboard[idx].Reviewer = fmt.Sprintf("Reviewer %d", idx+1)
+		}
+	}
+	return leaderboard, nil
+}
+
+func (h *handler) stats(params StatsParams) (map[string]interface{}, error) {
+	breaches, err := h.checkSLAs(false)
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]interface{}{
+		"errors":      errorStats(),
+		"slaBreaches": breaches,
+		"anchoring":   anchorMetrics.report(),
+	}
+	if repoDir := getRepoDirFromDir(h.rootPath); repoDir != "" {
+		leaderboard, err := reviewerMetrics(repoDir, params.Anonymize)
+		if err != nil {
+			return nil, err
+		}
+		stats["reviewers"] = leaderboard
+	}
+	return stats, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Comment files record the version of their schema. Files of a previous
+// version are migrated when read, one migration at a time, and written back
+// in the current schema. Files of a newer version are refused: rewriting them
+// in this schema would drop what this server does not know.
+
+type schemaMigration struct {
+	To      int // Schema version of the migrated file
+	Migrate func(commentFilePath string, commentFile *CommentFile)
+}
+
+// Migrations by schema version they upgrade from
+var schemaMigrations = map[int]schemaMigration{
+	// First layout: no ID, author or date
+	0: {To: 3, Migrate: backfillFirstLayout},
+	// Never written, read like the first layout
+	1: {To: 3, Migrate: backfillFirstLayout},
+	// Authors and dates but no ID
+	2: {To: 3, Migrate: func(commentFilePath string, commentFile *CommentFile) {
+		assignCommentIDs(commentFile)
+	}},
+}
+
+func backfillFirstLayout(commentFilePath string, commentFile *CommentFile) {
+	backfillComments(commentFilePath, commentFile)
+}
+
+// Migrated comment files by path, with the state of the stored file they
+// were migrated from. Migrating reads the history of the file, once while
+// the file is not written back, e.g. in untrusted workspaces.
+var migratedCommentFiles = struct {
+	sync.Mutex
+	files map[string]migratedCommentFile
+}{files: map[string]migratedCommentFile{}}
+
+type migratedCommentFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte // The migrated file, as JSON
+}
+
+func checkSchemaVersion(commentFilePath string, commentFile *CommentFile) error {
+	if commentFile.Version > commentFileVersion {
+		return newCommentError(ErrSchemaTooNew, "%s has schema version %d, this server reads up to version %d",
+			commentFilePath, commentFile.Version, commentFileVersion)
+	}
+	return nil
+}
+
+// Migrates the comment file to the current schema in place, and gives their
+// ID to the comments without one, reports whether it was changed
+func migrateCommentFile(commentFilePath string, commentFile *CommentFile) (bool, error) {
+	if err := checkSchemaVersion(commentFilePath, commentFile); err != nil {
+		return false, err
+	}
+	if commentFile.Version == commentFileVersion && !lacksCommentIDs(commentFile) {
+		return false, nil
+	}
+	info, statErr := os.Stat(storedCommentFilePath(commentFilePath))
+	migratedCommentFiles.Lock()
+	defer migratedCommentFiles.Unlock()
+	if cached, ok := migratedCommentFiles.files[commentFilePath]; ok && statErr == nil &&
+		cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		var migratedFile CommentFile
+		if err := json.Unmarshal(cached.data, &migratedFile); err == nil {
+			*commentFile = migratedFile
+			return true, nil
+		}
+	}
+	delete(migratedCommentFiles.files, commentFilePath)
+	migrated := false
+	for commentFile.Version < commentFileVersion {
+		migration, ok := schemaMigrations[commentFile.Version]
+		if !ok || migration.To <= commentFile.Version {
+			return false, newCommentError(ErrStoreCorrupt, "%s has schema version %d, which cannot be migrated", commentFilePath, commentFile.Version)
+		}
+		storeLog.infof("Migrate %s from schema version %d to %d", commentFilePath, commentFile.Version, migration.To)
+		migration.Migrate(commentFilePath, commentFile)
+		commentFile.Version = migration.To
+		migrated = true
+	}
+	// Comments added by hand, or by a tool not knowing IDs, are given
+	// theirs like those of a previous schema
+	if lacksCommentIDs(commentFile) {
+		storeLog.infof("Assign IDs to the comments of %s", commentFilePath)
+		assignCommentIDs(commentFile)
+		migrated = true
+	}
+	if data, err := json.Marshal(commentFile); err == nil && statErr == nil {
+		migratedCommentFiles.files[commentFilePath] = migratedCommentFile{info.ModTime(), info.Size(), data}
+	}
+	return migrated, nil
+}
+
+// Writes a migrated comment file back in the current schema so that it is
+// migrated once. Skipped when the file is locked, by the caller or another
+// process: the holder writes it in the current schema anyway. The file is
+// read again under the lock, it may have changed since.
+func writeBackMigratedCommentFile(commentFilePath string) {
+	unlock, err := tryLockCommentFile(commentFilePath)
+	if err != nil {
+		recordError(err)
+		return
+	}
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	commentFile, err := getCommentStore().Get(commentFilePath)
+	if err != nil {
+		recordError(err)
+		return
+	}
+	if migrated, err := migrateCommentFile(commentFilePath, commentFile); err != nil || !migrated {
+		return
+	}
+	if err := writeCommentFile(commentFilePath, commentFile); err != nil {
+		recordError(fmt.Errorf("error while writing back migrated comment file: %w", err))
+		return
+	}
+	migratedCommentFiles.Lock()
+	delete(migratedCommentFiles.files, commentFilePath)
+	migratedCommentFiles.Unlock()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPatch = "@@ -1,3 +1,3 @@\n a\n-b\n+c\n d\n"
+
+func copyCommentFile(t *testing.T, commentFile *CommentFile) *CommentFile {
+	t.Helper()
+	data, err := json.Marshal(commentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied CommentFile
+	if err := json.Unmarshal(data, &copied); err != nil {
+		t.Fatal(err)
+	}
+	return &copied
+}
+
+// Migrates a copy of the comment file as a clone of its own would
+func migrateInClone(t *testing.T, commentFile *CommentFile) *CommentFile {
+	t.Helper()
+	migrated := copyCommentFile(t, commentFile)
+	path := filepath.Join(t.TempDir(), "comments", "main.go.json")
+	if _, err := migrateCommentFile(path, migrated); err != nil {
+		t.Fatal(err)
+	}
+	return migrated
+}
+
+func commentIDsOf(commentFile *CommentFile) []string {
+	ids := []string{}
+	for idx := range commentFile.Patches {
+		ids = append(ids, commentFile.Patches[idx].ID)
+	}
+	for _, cell := range commentFile.Cells {
+		ids = append(ids, commentIDsOf(cell)...)
+	}
+	return ids
+}
+
+func TestMigrationGivesTheSameIDsInEveryClone(t *testing.T) {
+	tests := []struct {
+		name string
+		file CommentFile
+		// IDs of the migrated comments, "" for one to compare only
+		want []string
+	}{
+		{
+			name: "first layout",
+			file: CommentFile{Commit: "abc", Patches: []Patch{
+				{Message: "Why?", Patch: testPatch},
+				{Message: "Rename it", Patch: testPatch},
+			}},
+			want: []string{
+				commentID(&Patch{Message: "Why?", Patch: testPatch}),
+				commentID(&Patch{Message: "Rename it", Patch: testPatch}),
+			},
+		},
+		{
+			name: "schema version 2",
+			file: CommentFile{Version: 2, Patches: []Patch{
+				{Message: "Why?", Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"},
+			}},
+			want: []string{commentID(&Patch{Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"})},
+		},
+		{
+			name: "identical comments",
+			file: CommentFile{Version: 2, Patches: []Patch{
+				{Message: "Twice", Patch: testPatch},
+				{Message: "Twice", Patch: testPatch},
+			}},
+			want: []string{commentID(&Patch{Message: "Twice", Patch: testPatch}), ""},
+		},
+		{
+			name: "comment added by hand",
+			file: CommentFile{Version: commentFileVersion, Patches: []Patch{
+				{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "Kept", Patch: testPatch},
+				{Message: "By hand", Patch: testPatch},
+			}},
+			want: []string{"6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", commentID(&Patch{Message: "By hand", Patch: testPatch})},
+		},
+		{
+			name: "notebook cells",
+			file: CommentFile{Version: 2, Cells: map[string]*CommentFile{
+				"cell-1": {Patches: []Patch{{Message: "In a cell", Patch: testPatch}}},
+			}},
+			want: []string{commentID(&Patch{Message: "In a cell", Patch: testPatch})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := commentIDsOf(migrateInClone(t, &test.file))
+			second := commentIDsOf(migrateInClone(t, &test.file))
+			if len(first) != len(test.want) {
+				t.Fatalf("got IDs %q, want %d", first, len(test.want))
+			}
+			seen := map[string]bool{}
+			for idx, id := range first {
+				if id == "" || seen[id] {
+					t.Errorf("ID %d is %q, want a unique one", idx, id)
+				}
+				seen[id] = true
+				if id != second[idx] {
+					t.Errorf("ID %d is %q in a clone and %q in another", idx, id, second[idx])
+				}
+				if test.want[idx] != "" && id != test.want[idx] {
+					t.Errorf("ID %d is %q, want %q", idx, id, test.want[idx])
+				}
+			}
+		})
+	}
+}
+
+func writeTestCommentFile(t *testing.T, path string, commentFile *CommentFile) {
+	t.Helper()
+	data, err := json.Marshal(commentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeOfTwoMigratedSides(t *testing.T) {
+	base := &CommentFile{Version: 2, Patches: []Patch{
+		{Message: "Why?", Patch: testPatch, CreatedAt: "2024-01-02T03:04:05Z"},
+		{Message: "Rename it", Patch: testPatch, CreatedAt: "2024-01-03T03:04:05Z"},
+	}}
+	tests := []struct {
+		name   string
+		ours   func(commentFile *CommentFile)
+		theirs func(commentFile *CommentFile)
+		want   []string // Messages of the merged comments
+	}{
+		{
+			name:   "unchanged",
+			ours:   func(commentFile *CommentFile) {},
+			theirs: func(commentFile *CommentFile) {},
+			want:   []string{"Why?", "Rename it"},
+		},
+		{
+			name: "changed on both sides",
+			ours: func(commentFile *CommentFile) {
+				commentFile.Patches[0].Replies = append(commentFile.Patches[0].Replies, Reply{Message: "Because"})
+			},
+			theirs: func(commentFile *CommentFile) {
+				commentFile.Patches = append(commentFile.Patches, Patch{ID: newCommentUUID(), Message: "New", Patch: testPatch})
+			},
+			want: []string{"Why?", "Rename it", "New"},
+		},
+		{
+			name: "deleted by them",
+			ours: func(commentFile *CommentFile) {},
+			theirs: func(commentFile *CommentFile) {
+				commentFile.Patches = commentFile.Patches[1:]
+			},
+			want: []string{"Rename it"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ours, theirs := migrateInClone(t, base), migrateInClone(t, base)
+			test.ours(ours)
+			test.theirs(theirs)
+			paths := []string{filepath.Join(dir, "base.json"), filepath.Join(dir, "ours.json"), filepath.Join(dir, "theirs.json")}
+			writeTestCommentFile(t, paths[0], base)
+			writeTestCommentFile(t, paths[1], ours)
+			writeTestCommentFile(t, paths[2], theirs)
+			if code := runMergeDriver(paths); code != 0 {
+				t.Fatalf("merge driver exited with %d", code)
+			}
+			merged, err := getCommentStore().Get(paths[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := []string{}
+			for _, patch := range merged.Patches {
+				messages = append(messages, patch.Message)
+			}
+			if len(messages) != len(test.want) {
+				t.Fatalf("merged %q, want %q", messages, test.want)
+			}
+			for idx := range messages {
+				if messages[idx] != test.want[idx] {
+					t.Errorf("merged %q, want %q", messages, test.want)
+				}
+			}
+			if len(merged.Patches) > 0 && merged.Patches[0].Message == "Why?" && len(ours.Patches[0].Replies) != len(merged.Patches[0].Replies) {
+				t.Errorf("merged %d replies, want ours", len(merged.Patches[0].Replies))
+			}
+		})
+	}
+}
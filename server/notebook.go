@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.lsp.dev/protocol"
+)
+
+// Notebook documents (LSP 3.17) are not part of go.lsp.dev/protocol yet.
+//
+// The cells of a notebook have no file of their own: a cell is addressed by
+// the path of its notebook and its id, "analysis.ipynb#cell=<id>", and its
+// comments are a section of the comment file of the notebook. Cell ids come
+// from the notebook on disk, so cells added in the editor can be commented
+// once the notebook is saved.
+
+// Separator of the notebook path and the cell id in the path of a cell
+const cellSeparator = "#cell="
+
+type NotebookCell struct {
+	Kind     int                  `json:"kind"` // 1 for markup, 2 for code
+	Document protocol.DocumentURI `json:"document"`
+}
+
+type NotebookDocument struct {
+	URI          protocol.DocumentURI `json:"uri"`
+	NotebookType string               `json:"notebookType"`
+	Version      int32                `json:"version"`
+	Cells        []NotebookCell       `json:"cells"`
+}
+
+type NotebookDocumentIdentifier struct {
+	URI protocol.DocumentURI `json:"uri"`
+}
+
+type DidOpenNotebookDocumentParams struct {
+	NotebookDocument  NotebookDocument            `json:"notebookDocument"`
+	CellTextDocuments []protocol.TextDocumentItem `json:"cellTextDocuments"`
+}
+
+type DidChangeNotebookDocumentParams struct {
+	NotebookDocument NotebookDocumentIdentifier `json:"notebookDocument"`
+	Change           struct {
+		Cells *struct {
+			Structure *struct {
+				Array struct {
+					Start       int            `json:"start"`
+					DeleteCount int            `json:"deleteCount"`
+					Cells       []NotebookCell `json:"cells,omitempty"`
+				} `json:"array"`
+			} `json:"structure,omitempty"`
+			TextContent []struct {
+				Document protocol.VersionedTextDocumentIdentifier `json:"document"`
+			} `json:"textContent,omitempty"`
+		} `json:"cells,omitempty"`
+	} `json:"change"`
+}
+
+type DidSaveNotebookDocumentParams struct {
+	NotebookDocument NotebookDocumentIdentifier `json:"notebookDocument"`
+}
+
+type DidCloseNotebookDocumentParams struct {
+	NotebookDocument NotebookDocumentIdentifier `json:"notebookDocument"`
+}
+
+type NotebookDocumentSyncOptions struct {
+	NotebookSelector []NotebookSelector `json:"notebookSelector"`
+	Save             bool               `json:"save,omitempty"`
+}
+
+type NotebookSelector struct {
+	Notebook NotebookDocumentFilter `json:"notebook"`
+}
+
+type NotebookDocumentFilter struct {
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Cells of the open notebooks, read by uriToPath and pathToURI
+type notebookRegistry struct {
+	mutex sync.RWMutex
+	// Cells of each notebook in order, with their id, empty until the
+	// notebook is saved for the cells added in the editor
+	notebooks map[protocol.DocumentURI][]notebookCell
+	cells     map[protocol.DocumentURI]string // Cell URI to cell path
+	uris      map[string]protocol.DocumentURI // Cell path to cell URI
+}
+
+type notebookCell struct {
+	uri protocol.DocumentURI
+	id  string
+}
+
+var notebooks = notebookRegistry{
+	notebooks: map[protocol.DocumentURI][]notebookCell{},
+	cells:     map[protocol.DocumentURI]string{},
+	uris:      map[string]protocol.DocumentURI{},
+}
+
+func (registry *notebookRegistry) open(notebook NotebookDocument) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	cells := make([]notebookCell, len(notebook.Cells))
+	for idx, cell := range notebook.Cells {
+		cells[idx] = notebookCell{uri: cell.Document}
+	}
+	registry.notebooks[notebook.URI] = cells
+	registry.resolve(notebook.URI)
+}
+
+// Applies a change of the cells of a notebook, returns the added cells and
+// the removed ones
+func (registry *notebookRegistry) change(notebookURI protocol.DocumentURI, start int, deleteCount int, added []NotebookCell) ([]protocol.DocumentURI, []protocol.DocumentURI) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	cells, ok := registry.notebooks[notebookURI]
+	if !ok || start < 0 || start+deleteCount > len(cells) {
+		protocolLog.errorf("Invalid change of the cells of %s", notebookURI)
+		return nil, nil
+	}
+	removed := []protocol.DocumentURI{}
+	for _, cell := range cells[start : start+deleteCount] {
+		removed = append(removed, cell.uri)
+		registry.forget(cell)
+	}
+	inserted := make([]notebookCell, len(added))
+	addedURIs := make([]protocol.DocumentURI, len(added))
+	for idx, cell := range added {
+		inserted[idx] = notebookCell{uri: cell.Document}
+		addedURIs[idx] = cell.Document
+		// Known once the notebook is saved
+		registry.cells[cell.Document] = ""
+	}
+	registry.notebooks[notebookURI] = slices.Replace(cells, start, start+deleteCount, inserted...)
+	return addedURIs, removed
+}
+
+// Reads the ids of the cells again, once the notebook on disk matches the
+// editor, returns its cells
+func (registry *notebookRegistry) saved(notebookURI protocol.DocumentURI) []protocol.DocumentURI {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.resolve(notebookURI)
+	uris := []protocol.DocumentURI{}
+	for _, cell := range registry.notebooks[notebookURI] {
+		uris = append(uris, cell.uri)
+	}
+	return uris
+}
+
+// Removes a closed notebook, returns its cells
+func (registry *notebookRegistry) close(notebookURI protocol.DocumentURI) []protocol.DocumentURI {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	uris := []protocol.DocumentURI{}
+	for _, cell := range registry.notebooks[notebookURI] {
+		uris = append(uris, cell.uri)
+		registry.forget(cell)
+	}
+	delete(registry.notebooks, notebookURI)
+	return uris
+}
+
+// Ids of the cells, by position in the notebook on disk. Must hold the lock.
+func (registry *notebookRegistry) resolve(notebookURI protocol.DocumentURI) {
+	cells := registry.notebooks[notebookURI]
+	notebookPath := uriToFilePath(notebookURI)
+	ids, err := notebookCellIDs(notebookPath)
+	if err != nil {
+		protocolLog.errorf("Cells of %s not read, they cannot be commented: %v", notebookPath, err)
+	}
+	for idx := range cells {
+		registry.forget(cells[idx])
+		cells[idx].id = ""
+		if len(cells) == len(ids) {
+			cells[idx].id = ids[idx]
+		}
+		path := ""
+		if cells[idx].id != "" {
+			path = notebookPath + cellSeparator + cells[idx].id
+			registry.uris[path] = cells[idx].uri
+		}
+		registry.cells[cells[idx].uri] = path
+	}
+}
+
+// Must hold the lock
+func (registry *notebookRegistry) forget(cell notebookCell) {
+	if path := registry.cells[cell.uri]; path != "" {
+		delete(registry.uris, path)
+	}
+	delete(registry.cells, cell.uri)
+}
+
+// Path of a cell, empty for cells not saved yet. False when uri is not a
+// cell of an open notebook.
+func (registry *notebookRegistry) cellPath(uri protocol.DocumentURI) (string, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	path, ok := registry.cells[uri]
+	return path, ok
+}
+
+func (registry *notebookRegistry) cellURI(path string) (protocol.DocumentURI, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	uri, ok := registry.uris[path]
+	return uri, ok
+}
+
+// Notebook path and cell id of the path of a cell
+func splitCellPath(path string) (string, string, bool) {
+	return strings.Cut(path, cellSeparator)
+}
+
+// Cells of a notebook file in the Jupyter format
+type jupyterNotebook struct {
+	Cells []struct {
+		ID     string          `json:"id"`
+		Source json.RawMessage `json:"source"`
+	} `json:"cells"`
+}
+
+// Ids of the cells of a notebook. Cells of notebooks older than nbformat 4.5
+// have no id, their position is used instead.
+func notebookCellIDs(notebookPath string) ([]string, error) {
+	notebook, err := readNotebook(notebookPath)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(notebook.Cells))
+	for idx, cell := range notebook.Cells {
+		ids[idx] = cell.ID
+		if ids[idx] == "" {
+			ids[idx] = "index-" + strconv.Itoa(idx)
+		}
+	}
+	return ids, nil
+}
+
+func readNotebook(notebookPath string) (*jupyterNotebook, error) {
+	data, err := os.ReadFile(notebookPath)
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading notebook %s: %w", notebookPath, err)
+	}
+	var notebook jupyterNotebook
+	if err := json.Unmarshal(data, &notebook); err != nil {
+		return nil, fmt.Errorf("invalid notebook %s: %w", notebookPath, err)
+	}
+	return &notebook, nil
+}
+
+// Content of a source file, or of a cell as saved in its notebook
+func readSourceFile(filePath string) ([]byte, error) {
+	notebookPath, id, ok := splitCellPath(filePath)
+	if !ok {
+		return os.ReadFile(filePath)
+	}
+	ids, err := notebookCellIDs(notebookPath)
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.Index(ids, id)
+	if idx < 0 {
+		return nil, fmt.Errorf("no cell %s in %s: %w", id, notebookPath, os.ErrNotExist)
+	}
+	notebook, err := readNotebook(notebookPath)
+	if err != nil {
+		return nil, err
+	}
+	// The source is a string or its lines
+	var source string
+	if err := json.Unmarshal(notebook.Cells[idx].Source, &source); err == nil {
+		return []byte(source), nil
+	}
+	var lines []string
+	if err := json.Unmarshal(notebook.Cells[idx].Source, &lines); err != nil {
+		return nil, fmt.Errorf("invalid source of cell %s in %s: %w", id, notebookPath, err)
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// Comments of a cell, in the section of the comment file of its notebook
+func readCellSection(commentFilePath string, id string) (*CommentFile, error) {
+	commentFile, err := readCommentFile(commentFilePath)
+	if err != nil {
+		return nil, err
+	}
+	section, ok := commentFile.Cells[id]
+	if !ok {
+		return nil, fmt.Errorf("no comments for cell %s in %s: %w", id, commentFilePath, os.ErrNotExist)
+	}
+	return section, nil
+}
+
+// Rewrites the comment file of the notebook, under the lock of the cell that
+// the caller holds: cells are locked with their notebook
+func writeCellSection(commentFilePath string, id string, section *CommentFile) error {
+	commentFile, err := readCommentFile(commentFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		commentFile = &CommentFile{Version: commentFileVersion, Commit: section.Commit, Patches: []Patch{}}
+	} else if err != nil {
+		return err
+	}
+	if commentFile.Cells == nil {
+		commentFile.Cells = map[string]*CommentFile{}
+	}
+	commentFile.Cells[id] = section
+	return writeCommentFile(commentFilePath, commentFile)
+}
+
+// Three-way merge of the cell sections of comment files
+func mergeCellSections(base *CommentFile, ours *CommentFile, theirs *CommentFile) (map[string]*CommentFile, []MergeConflict) {
+	if len(ours.Cells) == 0 && len(theirs.Cells) == 0 {
+		return nil, nil
+	}
+	section := func(commentFile *CommentFile, id string) *CommentFile {
+		if cell, ok := commentFile.Cells[id]; ok {
+			return cell
+		}
+		return &CommentFile{}
+	}
+	merged := map[string]*CommentFile{}
+	conflicts := []MergeConflict{}
+	for _, cells := range []map[string]*CommentFile{ours.Cells, theirs.Cells} {
+		for id := range cells {
+			if _, done := merged[id]; done {
+				continue
+			}
+			cell, cellConflicts := mergeCommentVersions(section(base, id), section(ours, id), section(theirs, id))
+			for _, conflict := range cellConflicts {
+				conflict.Cell = id
+				conflicts = append(conflicts, conflict)
+			}
+			if len(cell.Patches) > 0 {
+				merged[id] = cell
+			}
+		}
+	}
+	return merged, conflicts
+}
+
+// Cells are open documents for the rest of the server
+func (h *handler) openCell(ctx context.Context, uri protocol.DocumentURI) {
+	h.documentsMutex.Lock()
+	h.openDocuments[uri] = true
+	h.documentsMutex.Unlock()
+	h.publishDiagnostics(ctx, uri)
+	if !isWorkspaceTrusted() {
+		return
+	}
+	if err := markCommentsViewed(uri); err != nil {
+		logDebugf("Comments not marked as viewed: %v", err)
+	}
+}
+
+func (h *handler) closeCell(uri protocol.DocumentURI) {
+	h.documentsMutex.Lock()
+	delete(h.openDocuments, uri)
+	h.documentsMutex.Unlock()
+	h.expanded.set(uri, false)
+}
+
+func (h *handler) didOpenNotebook(ctx context.Context, params DidOpenNotebookDocumentParams) {
+	notebooks.open(params.NotebookDocument)
+	for _, cell := range params.NotebookDocument.Cells {
+		h.openCell(ctx, cell.Document)
+	}
+}
+
+func (h *handler) didChangeNotebook(ctx context.Context, params DidChangeNotebookDocumentParams) {
+	cells := params.Change.Cells
+	if cells == nil || cells.Structure == nil {
+		return
+	}
+	array := cells.Structure.Array
+	added, removed := notebooks.change(params.NotebookDocument.URI, array.Start, array.DeleteCount, array.Cells)
+	for _, uri := range removed {
+		h.closeCell(uri)
+	}
+	for _, uri := range added {
+		h.openCell(ctx, uri)
+	}
+}
+
+func (h *handler) didSaveNotebook(ctx context.Context, params DidSaveNotebookDocumentParams) {
+	for _, uri := range notebooks.saved(params.NotebookDocument.URI) {
+		h.publishDiagnostics(ctx, uri)
+	}
+}
+
+func (h *handler) didCloseNotebook(params DidCloseNotebookDocumentParams) {
+	for _, uri := range notebooks.close(params.NotebookDocument.URI) {
+		h.closeCell(uri)
+	}
+}
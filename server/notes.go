@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Private notes are comments kept to the local user: they are stored in the
+// git folder of the repository, which is neither versioned nor synced, in a
+// comment file per source file like the shared comments. The comments of a
+// document are its shared comments followed by its notes, so that commands
+// find both by their ID.
+
+const (
+	VisibilityShared  = "shared"
+	VisibilityPrivate = "private"
+)
+
+const notesDirName = "lsp-comments-notes"
+
+func validateVisibility(visibility string) error {
+	switch visibility {
+	case "", VisibilityShared, VisibilityPrivate:
+		return nil
+	}
+	return fmt.Errorf("unknown visibility %q, expected shared or private", visibility)
+}
+
+func (patch *Patch) isPrivate() bool {
+	return patch.Visibility == VisibilityPrivate
+}
+
+// Git folders by repository, they do not move while the server runs
+var gitDirs sync.Map
+
+func absoluteGitDir(repoDir string) (string, error) {
+	if gitDir, ok := gitDirs.Load(repoDir); ok {
+		return gitDir.(string), nil
+	}
+	cmd := gitCommand("rev-parse", "--absolute-git-dir")
+	cmd.Dir = repoDir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", newCommentError(ErrVCSUnavailable, "error while locating git folder: %w", err)
+	}
+	gitDir := strings.TrimSpace(string(output))
+	gitDirs.Store(repoDir, gitDir)
+	return gitDir, nil
+}
+
+// File holding the private notes of the comment file of a repository
+func notesFilePath(repoDir string, commentFilePath string) (string, error) {
+	rel, err := filepath.Rel(commentsDirOf(repoDir), commentFilePath)
+	if err != nil {
+		return "", fmt.Errorf("error while getting relative path : %v", err)
+	}
+	gitDir, err := absoluteGitDir(repoDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gitDir, notesDirName, rel), nil
+}
+
+// Appends the private notes to the shared comments of a comment file, which
+// may not exist
+func withNotes(commentFile *CommentFile, sharedErr error, repoDir string, commentFilePath string) (*CommentFile, error) {
+	if sharedErr != nil && !errors.Is(sharedErr, os.ErrNotExist) {
+		return nil, sharedErr
+	}
+	if repoDir == "" {
+		return commentFile, sharedErr
+	}
+	if _, _, ok := splitCellPath(commentFilePath); ok {
+		return commentFile, sharedErr
+	}
+	notesPath, err := notesFilePath(repoDir, commentFilePath)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := readCommentFile(notesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return commentFile, sharedErr
+	} else if err != nil {
+		return nil, err
+	}
+	if commentFile == nil {
+		commentFile = &CommentFile{Version: commentFileVersion, Commit: notes.Commit, Patches: []Patch{}}
+	}
+	for _, note := range notes.Patches {
+		note.Visibility = VisibilityPrivate
+		commentFile.Patches = append(commentFile.Patches, note)
+	}
+	return commentFile, nil
+}
+
+// Writes the shared comments of a document to its comment file and its
+// private notes to its notes file
+func saveCommentFile(filePath string, commentFile *CommentFile) error {
+	commentFilePath, repoDir, err := getCommentFilePath(filePath)
+	if err != nil {
+		return err
+	}
+	shared := *commentFile
+	shared.Patches = []Patch{}
+	notes := *commentFile
+	notes.Patches = []Patch{}
+	for _, patch := range commentFile.Patches {
+		if patch.isPrivate() {
+			notes.Patches = append(notes.Patches, patch)
+		} else {
+			shared.Patches = append(shared.Patches, patch)
+		}
+	}
+	_, _, isCell := splitCellPath(commentFilePath)
+	if len(notes.Patches) > 0 {
+		if repoDir == "" {
+			return fmt.Errorf("private notes are kept in a git repository")
+		}
+		if isCell {
+			return fmt.Errorf("notebook cells cannot have private notes")
+		}
+	}
+	// Files are kept even when empty so that diagnostics get cleared, but
+	// not created for nothing
+	if len(shared.Patches) > 0 || isCell || commentFileExists(commentFilePath) {
+		if err := writeCommentFile(commentFilePath, &shared); err != nil {
+			return err
+		}
+	}
+	if repoDir == "" || isCell {
+		return nil
+	}
+	notesPath, err := notesFilePath(repoDir, commentFilePath)
+	if err != nil {
+		return err
+	}
+	if len(notes.Patches) > 0 || commentFileExists(notesPath) {
+		return writeCommentFile(notesPath, &notes)
+	}
+	return nil
+}
+
+// Moves the private notes of a renamed file or folder, like its comments
+func migrateNotes(oldPath string, newPath string, isDir bool) error {
+	repoDir := repoDirOfPath(oldPath)
+	if repoDir == "" || repoDirOfPath(newPath) != repoDir {
+		return nil
+	}
+	oldNotesPath, err := notesFilePath(repoDir, commentPathOf(oldPath))
+	if err != nil {
+		return err
+	}
+	newNotesPath, err := notesFilePath(repoDir, commentPathOf(newPath))
+	if err != nil {
+		return err
+	}
+	if !isDir {
+		return moveCommentFile(oldNotesPath, newNotesPath)
+	}
+	return moveCommentDir(strings.TrimSuffix(oldNotesPath, ".json"), strings.TrimSuffix(newNotesPath, ".json"))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Errors of the same code are shown to the user at most once per interval
+const errorMessageInterval = 10 * time.Minute
+
+const bugReportAction = "Create bug report"
+
+var errorNotifierMutex sync.Mutex
+var errorNotifier func(err error)
+
+// Sets the function called with each recorded error having a code
+func setErrorNotifier(notifier func(err error)) {
+	errorNotifierMutex.Lock()
+	defer errorNotifierMutex.Unlock()
+	errorNotifier = notifier
+}
+
+func notifyError(err error) {
+	errorNotifierMutex.Lock()
+	notifier := errorNotifier
+	errorNotifierMutex.Unlock()
+	if notifier != nil {
+		notifier(err)
+	}
+}
+
+// Text shown to the user for each error code, telling what to do. Comments
+// failing to anchor are only logged: a file edited away from its comments
+// fails on every change.
+var errorAdvices = map[ErrorCode]struct {
+	format      string
+	messageType protocol.MessageType
+	actions     []string
+}{
+	ErrStoreCorrupt:     {"A comment file is invalid and its comments are hidden, fix or restore it: %v", protocol.MessageTypeError, []string{bugReportAction}},
+	ErrSyncConflict:     {"The comments repository could not be synchronised, resolve its conflicts with git: %v", protocol.MessageTypeWarning, nil},
+	ErrPermissionDenied: {"Comments could not be read or written, check the permissions of the comment folder: %v", protocol.MessageTypeError, nil},
+	ErrVCSUnavailable:   {"Git failed and comments may be missing, check that git is installed and configured: %v", protocol.MessageTypeError, nil},
+	ErrAuthFailed:       {"The comments repository refused your credentials and comments are not synchronised: %v", protocol.MessageTypeWarning, []string{reauthenticateAction}},
+	ErrSchemaTooNew:     {"Comments were written by a newer version of the extension and are hidden, update it to read them: %v", protocol.MessageTypeError, nil},
+}
+
+type errorThrottle struct {
+	mutex sync.Mutex
+	shown map[string]time.Time
+}
+
+func (throttle *errorThrottle) allow(key string, now time.Time) bool {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	if throttle.shown == nil {
+		throttle.shown = map[string]time.Time{}
+	}
+	if last, ok := throttle.shown[key]; ok && now.Sub(last) < errorMessageInterval {
+		return false
+	}
+	throttle.shown[key] = now
+	return true
+}
+
+// Shows an error to the user with window/showMessage, or with
+// window/showMessageRequest when an action can help.
+func (h *handler) showError(err error) {
+	if errors.Is(err, errUntrustedWorkspace) {
+		// Expected until the user trusts the workspace
+		return
+	}
+	code := errorCodeOf(err)
+	advice, ok := errorAdvices[code]
+	if !ok || !h.errorThrottle.allow(string(code), time.Now()) {
+		return
+	}
+	message := fmt.Sprintf(advice.format, err)
+	ctx := context.Background()
+	if len(advice.actions) == 0 {
+		h.conn.Notify(ctx, "window/showMessage", protocol.ShowMessageParams{Type: advice.messageType, Message: message})
+		return
+	}
+	// Errors are recorded from the handler goroutine, which must not wait for
+	// the client
+	go func() {
+		params := protocol.ShowMessageRequestParams{Type: advice.messageType, Message: message}
+		for _, action := range advice.actions {
+			params.Actions = append(params.Actions, protocol.MessageActionItem{Title: action})
+		}
+		var chosen *protocol.MessageActionItem
+		if _, err := h.conn.Call(ctx, "window/showMessageRequest", params, &chosen); err != nil || chosen == nil {
+			return
+		}
+		if chosen.Title == reauthenticateAction {
+			if err := h.reauthenticate(ctx); err != nil {
+				recordError(err)
+			}
+			return
+		}
+		if chosen.Title == bugReportAction {
+			bundlePath, err := h.debugBundle("")
+			if err != nil {
+				logErrorf("Error while creating bug report bundle: %v", err)
+				return
+			}
+			h.conn.Notify(ctx, "window/showMessage", protocol.ShowMessageParams{
+				Type:    protocol.MessageTypeInfo,
+				Message: "Bug report written to " + bundlePath + ", attach it to an issue.",
+			})
+		}
+	}()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+type Participation struct {
+	User     string `json:"user"`
+	Authored bool   `json:"authored,omitempty"`
+	Replied  bool   `json:"replied,omitempty"`
+	ViewedAt string `json:"viewedAt,omitempty"` // RFC3339, first time the user saw the thread
+}
+
+type ParticipationKind int
+
+const (
+	ParticipationAuthored ParticipationKind = iota
+	ParticipationReplied
+	ParticipationViewed
+)
+
+// Records that user took part in the thread of patch. Returns false if
+// this was already recorded.
+func (patch *Patch) recordParticipation(user string, kind ParticipationKind) bool {
+	if user == "" {
+		return false
+	}
+	var participation *Participation
+	for idx := range patch.Participants {
+		if patch.Participants[idx].User == user {
+			participation = &patch.Participants[idx]
+			break
+		}
+	}
+	if participation == nil {
+		patch.Participants = append(patch.Participants, Participation{User: user})
+		participation = &patch.Participants[len(patch.Participants)-1]
+	}
+	switch kind {
+	case ParticipationAuthored:
+		if participation.Authored {
+			return false
+		}
+		participation.Authored = true
+	case ParticipationReplied:
+		if participation.Replied {
+			return false
+		}
+		participation.Replied = true
+	case ParticipationViewed:
+		if participation.ViewedAt != "" {
+			return false
+		}
+		participation.ViewedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	return true
+}
+
+// A thread was never viewed if nobody but its authors saw it
+func (patch *Patch) neverViewed() bool {
+	for _, participation := range patch.Participants {
+		if !participation.Authored && participation.ViewedAt != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Marks every comment of the document as viewed by the local user
+func markCommentsViewed(uri protocol.DocumentURI) error {
+	filePath := uriToPath(uri)
+	unlock, err := lockDocumentComments(filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return err
+	}
+	user := currentUser(filepath.Dir(filePath))
+	changed := false
+	for idx := range commentFile.Patches {
+		if commentFile.Patches[idx].recordParticipation(user, ParticipationViewed) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveCommentFile(filePath, commentFile)
+}
+
+type ThreadParticipation struct {
+	URI          protocol.DocumentURI `json:"uri"`
+	Index        int                  `json:"index"` // Index of the comment in the comment file
+	ID           string               `json:"id"`
+	Message      string               `json:"message"`
+	Participants []Participation      `json:"participants"`
+	NeverViewed  bool                 `json:"neverViewed"`
+}
+
+type ParticipationParams struct {
+	// Document to report, the whole workspace if empty
+	URI protocol.DocumentURI `json:"uri,omitempty"`
+	// Only report threads nobody but their authors has seen
+	NeverViewedOnly bool `json:"neverViewedOnly,omitempty"`
+}
+
+// Reports the participation to every thread of a document or of the workspace
+func (h *handler) participationReport(params ParticipationParams) ([]ThreadParticipation, error) {
+	report := []ThreadParticipation{}
+	addThreads := func(uri protocol.DocumentURI, commentFile *CommentFile) {
+		for idx, patch := range commentFile.Patches {
+			thread := ThreadParticipation{
+				URI:          uri,
+				Index:        idx,
+				ID:           commentID(&patch),
+				Message:      patch.Message,
+				Participants: patch.Participants,
+				NeverViewed:  patch.neverViewed(),
+			}
+			if thread.Participants == nil {
+				thread.Participants = []Participation{}
+			}
+			if params.NeverViewedOnly && !thread.NeverViewed {
+				continue
+			}
+			report = append(report, thread)
+		}
+	}
+
+	if params.URI != "" {
+		commentFile, err := loadCommentFile(uriToPath(params.URI))
+		if err != nil {
+			return nil, err
+		}
+		addThreads(params.URI, commentFile)
+		return report, nil
+	}
+
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return nil, fmt.Errorf("workspace is not a git repository")
+	}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		addThreads(pathToURI(filepath.Join(repoDir, rel)), commentFile)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing comment files: %v", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	mathrand "math/rand/v2"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Stable identifier of a comment, kept when other comments of its file are
+// added or removed. Comments without one are given the hash of their anchor
+// when their file is read or written, only comments built in memory keep
+// falling back on it.
+func commentID(patch *Patch) string {
+	if patch.ID != "" {
+		return patch.ID
+	}
+	hash := sha256.Sum256([]byte(commentKey(patch)))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// Random (version 4) UUID of a new comment
+func newCommentUUID() string {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		// Comment IDs are not secrets, they only need to be unique
+		storeLog.errorf("Error while generating a UUID, using a pseudo-random one: %v", err)
+		binary.BigEndian.PutUint64(uuid[:8], mathrand.Uint64())
+		binary.BigEndian.PutUint64(uuid[8:], mathrand.Uint64())
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	hexUUID := hex.EncodeToString(uuid[:])
+	return hexUUID[:8] + "-" + hexUUID[8:12] + "-" + hexUUID[12:16] + "-" + hexUUID[16:20] + "-" + hexUUID[20:]
+}
+
+// Page showing the thread of a comment, from the permalink template of the
+// settings, e.g. "https://review.example.com/threads/{id}" with {id}, {path}
+// (the commented file) and {commentFile} (relative to the comment folder).
+// Defaults to the comment file in the comments repository, if it is hosted.
+func commentPermalink(current Settings, patch *Patch, rel string) string {
+	rel = filepath.ToSlash(rel)
+	commentFile := rel + commentFileExtension(current)
+	if current.PermalinkURL != "" {
+		return strings.NewReplacer(
+			"{id}", commentID(patch),
+			"{path}", escapePath(rel),
+			"{commentFile}", escapePath(commentFile),
+		).Replace(current.PermalinkURL)
+	}
+	if current.CommentsRepoURL == "" {
+		return ""
+	}
+	// Only hosted repositories have a web page
+	repo := normalizeRemoteURL(current.CommentsRepoURL)
+	if strings.HasPrefix(repo, "/") || !strings.Contains(repo, "/") {
+		return ""
+	}
+	return "https://" + repo + "/blob/HEAD/" + escapePath(commentFile)
+}
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		segments[idx] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Code of the diagnostic of a comment, with a link to its thread. rel is the
+// path of the commented file, relative to the repository.
+func diagnosticCode(current Settings, rel string, patch *Patch) (string, *protocol.CodeDescription) {
+	href := commentPermalink(current, patch, rel)
+	if href == "" {
+		return commentID(patch), nil
+	}
+	return commentID(patch), &protocol.CodeDescription{Href: protocol.URI(href)}
+}
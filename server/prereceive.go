@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Server side validation of the pushes to a shared comments repository.
+// Install it as the pre-receive hook of the hosted repository:
+//
+//	#!/bin/sh
+//	exec separate_comments pre-receive --max-size 1048576
+//
+// Pushes holding malformed comment files are rejected.
+
+const zeroCommit = "0000000000000000000000000000000000000000"
+
+// Default size limit of a comment file
+const defaultMaxCommentFileSize = 1 << 20
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+
+func runPreReceive(args []string, input io.Reader, output io.Writer) int {
+	flags := flag.NewFlagSet("pre-receive", flag.ContinueOnError)
+	flags.SetOutput(output)
+	maxSize := flags.Int64("max-size", defaultMaxCommentFileSize, "size limit of a comment file in bytes")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	rejected := false
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		// <old> <new> <ref> per updated ref
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] == zeroCommit {
+			continue
+		}
+		problems, err := validatePushedRef(fields[0], fields[1], *maxSize)
+		if err != nil {
+			fmt.Fprintf(output, "lsp-comments: %s: %v\n", fields[2], err)
+			return 1
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(output, "lsp-comments: %s: %s\n", fields[2], problem)
+			rejected = true
+		}
+	}
+	if rejected {
+		fmt.Fprintln(output, "lsp-comments: push rejected, fix the comment files above")
+		return 1
+	}
+	return 0
+}
+
+func gitOutput(args ...string) ([]byte, error) {
+	cmd := gitCommand(args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Validates the comment files changed between two commits of a ref
+func validatePushedRef(oldCommit string, newCommit string, maxSize int64) ([]string, error) {
+	var output []byte
+	var err error
+	if oldCommit == zeroCommit {
+		output, err = gitOutput("ls-tree", "-r", "--name-only", newCommit)
+	} else {
+		output, err = gitOutput("diff", "--name-only", "--diff-filter=AM", oldCommit, newCommit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	for _, filePath := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if !strings.HasSuffix(filePath, ".json") && !strings.HasSuffix(filePath, ".yaml") || isMetadataPath(filePath) || isAttachmentPath(filePath) || filePath == projectConfigName {
+			continue
+		}
+		sizeOutput, err := gitOutput("cat-file", "-s", newCommit+":"+filePath)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		fmt.Sscan(string(sizeOutput), &size)
+		if size > maxSize {
+			problems = append(problems, fmt.Sprintf("%s: %d bytes, more than the limit of %d", filePath, size, maxSize))
+			continue
+		}
+		data, err := gitOutput("cat-file", "blob", newCommit+":"+filePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, problem := range validateCommentFile(data) {
+			problems = append(problems, filePath+": "+problem)
+		}
+	}
+	return problems, nil
+}
+
+// Attached files (attachments/<uuid>/<name>), a log may well be JSON
+func isAttachmentPath(filePath string) bool {
+	parts := strings.Split(filePath, "/")
+	return len(parts) >= 3 && parts[len(parts)-3] == attachmentsDirName
+}
+
+func isMetadataPath(filePath string) bool {
+	for _, part := range strings.Split(path.Dir(filePath), "/") {
+		if part == metaDirName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the problems of a stored comment file, none when it is valid
+func validateCommentFile(data []byte) []string {
+	if isYAMLCommentFile(data) {
+		converted, err := yamlToJSON(data)
+		if err != nil {
+			return []string{fmt.Sprintf("invalid YAML: %v", err)}
+		}
+		data = converted
+	}
+	var commentFile CommentFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&commentFile); err != nil {
+		return []string{fmt.Sprintf("invalid comment file: %v", err)}
+	}
+	problems := []string{}
+	if commentFile.Commit != "" && !commitPattern.MatchString(commentFile.Commit) {
+		problems = append(problems, fmt.Sprintf("invalid commit %q", commentFile.Commit))
+	}
+	for idx, patch := range commentFile.Patches {
+		if patch.Visibility != "" && patch.Visibility != VisibilityShared {
+			problems = append(problems, fmt.Sprintf("comment %d is a private note, it must not be shared", idx))
+		}
+		if patch.isFileLevel() && len(patch.SecondaryPatches) > 0 {
+			problems = append(problems, fmt.Sprintf("comment %d is about the whole file but has secondary ranges", idx))
+		}
+		if _, ok := stateTransitions[patch.state()]; !ok {
+			problems = append(problems, fmt.Sprintf("comment %d has an unknown state %q", idx, patch.State))
+		}
+		if err := validateCommentSeverity(patch.Severity); err != nil {
+			problems = append(problems, fmt.Sprintf("comment %d: %v", idx, err))
+		}
+		if err := validateCommentPriority(patch.Priority); err != nil {
+			problems = append(problems, fmt.Sprintf("comment %d: %v", idx, err))
+		}
+		if err := validateDueDate(patch.DueDate); err != nil {
+			problems = append(problems, fmt.Sprintf("comment %d: %v", idx, err))
+		}
+		if _, err := time.Parse(time.RFC3339, patch.ExpiresAt); patch.ExpiresAt != "" && err != nil {
+			problems = append(problems, fmt.Sprintf("comment %d has an invalid expiry %q", idx, patch.ExpiresAt))
+		}
+		for user, vote := range patch.Votes {
+			if vote != 1 && vote != -1 {
+				problems = append(problems, fmt.Sprintf("comment %d has an invalid vote %d of %s", idx, vote, user))
+			}
+		}
+		for _, anchor := range patch.FileAnchors {
+			if anchor.Path == "" || path.IsAbs(anchor.Path) || path.Clean(anchor.Path) != anchor.Path || strings.HasPrefix(anchor.Path, "../") {
+				problems = append(problems, fmt.Sprintf("comment %d has an anchor in an invalid path %q", idx, anchor.Path))
+			}
+		}
+		for _, attachment := range patch.Attachments {
+			if !validAttachmentPath(attachment.Path) {
+				problems = append(problems, fmt.Sprintf("comment %d has an invalid attachment path %q", idx, attachment.Path))
+			}
+		}
+		timestamps := map[string]string{"createdAt": patch.CreatedAt, "resolvedAt": patch.ResolvedAt, "slaBreachedAt": patch.SLABreachedAt}
+		for replyIdx, reply := range patch.Replies {
+			timestamps[fmt.Sprintf("createdAt of reply %d", replyIdx)] = reply.CreatedAt
+		}
+		for name, timestamp := range timestamps {
+			if _, err := time.Parse(time.RFC3339, timestamp); timestamp != "" && err != nil {
+				problems = append(problems, fmt.Sprintf("comment %d has an invalid %s %q", idx, name, timestamp))
+			}
+		}
+	}
+	// References to missing blobs
+	if err := decodePatchBlobs(&commentFile); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
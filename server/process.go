@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Git runs with a timeout, a capped output and a non-interactive
+// environment: git waiting for credentials or an editor would otherwise
+// block the handler, and the diagnostics with it, indefinitely.
+
+// Timeout of the local git commands
+const gitTimeout = 30 * time.Second
+
+// Timeout of the git commands reaching a remote: clone, pull, push...
+const gitRemoteTimeout = 5 * time.Minute
+
+// Output of a git command kept in memory
+const gitOutputLimit = 64 << 20
+
+// Time left to the children of git (ssh, credential helpers...) to close the
+// output once git exited or was killed
+const gitWaitDelay = 5 * time.Second
+
+var errGitTimeout = errors.New("git timed out")
+var errGitOutputTooLarge = errors.New("git output too large")
+
+// Variables making git fail instead of prompting or opening a program
+var nonInteractiveEnv = []string{
+	"GIT_TERMINAL_PROMPT=0",
+	"GCM_INTERACTIVE=never",
+	"SSH_ASKPASS_REQUIRE=never",
+	"GIT_EDITOR=true",
+	"GIT_PAGER=cat",
+}
+
+// Variables of the user environment removed: prompts and traces
+var scrubbedEnvPrefixes = []string{"GIT_ASKPASS=", "SSH_ASKPASS=", "GIT_TRACE"}
+
+func gitEnvironment(environ []string) []string {
+	env := []string{}
+	for _, variable := range environ {
+		scrubbed := false
+		for _, prefix := range append(scrubbedEnvPrefixes, nonInteractiveEnv...) {
+			name, _, _ := strings.Cut(prefix, "=")
+			if strings.HasPrefix(variable, name) {
+				scrubbed = true
+				break
+			}
+		}
+		if !scrubbed {
+			env = append(env, variable)
+		}
+	}
+	return append(env, nonInteractiveEnv...)
+}
+
+// A git command killed after its timeout. Run, Output and CombinedOutput
+// apply the timeout and the output limit, Start and Wait do not.
+type gitProcess struct {
+	*exec.Cmd
+	timeout time.Duration
+}
+
+func newGitProcess(ctx context.Context, timeout time.Duration, args []string) *gitProcess {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = gitEnvironment(os.Environ())
+	cmd.WaitDelay = gitWaitDelay
+	if !isWorkspaceTrusted() {
+		// Returned by Start
+		cmd.Err = errUntrustedWorkspace
+	}
+	return &gitProcess{Cmd: cmd, timeout: timeout}
+}
+
+// Runs a local git command, failing on Start in untrusted workspaces
+func gitCommand(args ...string) *gitProcess {
+	return gitCommandContext(context.Background(), args...)
+}
+
+// Runs a local git command, killed when ctx is cancelled
+func gitCommandContext(ctx context.Context, args ...string) *gitProcess {
+	return newGitProcess(ctx, gitTimeout, args)
+}
+
+// Runs a git command reaching a remote, killed when ctx is cancelled
+func gitRemoteCommand(ctx context.Context, args ...string) *gitProcess {
+	return newGitProcess(ctx, gitRemoteTimeout, args)
+}
+
+// Lets git prompt the user, for the subcommands run in a terminal
+func (process *gitProcess) interactive() *gitProcess {
+	process.Env = nil
+	return process
+}
+
+// Lets the credential helpers ask for credentials in their own window, git
+// itself still cannot prompt
+func (process *gitProcess) withCredentialPrompts() *gitProcess {
+	env := []string{}
+	for _, variable := range process.Env {
+		if !strings.HasPrefix(variable, "GCM_INTERACTIVE=") {
+			env = append(env, variable)
+		}
+	}
+	process.Env = env
+	return process
+}
+
+func (process *gitProcess) Run() error {
+	var stderr *limitedBuffer
+	if process.Stderr == nil {
+		// Kept in the exit error, as exec.Cmd.Output does, to tell why git
+		// failed
+		stderr = &limitedBuffer{limit: 64 << 10}
+		process.Stderr = stderr
+	}
+	if err := process.Start(); err != nil {
+		return err
+	}
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(process.timeout, func() {
+		timedOut.Store(true)
+		process.Process.Kill()
+	})
+	err := process.Wait()
+	timer.Stop()
+	if timedOut.Load() {
+		return fmt.Errorf("git %s: %w after %s", strings.Join(process.Args[1:], " "), errGitTimeout, process.timeout)
+	}
+	var exitErr *exec.ExitError
+	if stderr != nil && errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return err
+}
+
+func (process *gitProcess) Output() ([]byte, error) {
+	if process.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	stdout := &limitedBuffer{limit: gitOutputLimit}
+	process.Stdout = stdout
+	err := process.Run()
+	return stdout.Bytes(), process.limitError(stdout, err)
+}
+
+func (process *gitProcess) CombinedOutput() ([]byte, error) {
+	if process.Stdout != nil || process.Stderr != nil {
+		return nil, errors.New("exec: Stdout or Stderr already set")
+	}
+	output := &limitedBuffer{limit: gitOutputLimit}
+	process.Stdout = output
+	process.Stderr = output
+	err := process.Run()
+	return output.Bytes(), process.limitError(output, err)
+}
+
+func (process *gitProcess) limitError(output *limitedBuffer, err error) error {
+	if output.exceeded.Load() {
+		return fmt.Errorf("git %s: %w, more than %d bytes", strings.Join(process.Args[1:], " "), errGitOutputTooLarge, output.limit)
+	}
+	return err
+}
+
+// Buffer failing the writes past its limit, git then fails on a closed pipe
+type limitedBuffer struct {
+	buffer   bytes.Buffer
+	limit    int
+	exceeded atomic.Bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buffer.Len()+len(p) > b.limit {
+		b.exceeded.Store(true)
+		return 0, errGitOutputTooLarge
+	}
+	return b.buffer.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buffer.Bytes()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Git configuration key remembering the profile chosen with
+// comment.switchProfile, local to the repository of the workspace
+const profileGitKey = "lsp-comments.profile"
+
+// Identity used for a workspace: work account, client project, personal...
+type IdentityProfile struct {
+	Name string `json:"name"`
+	// Recorded as author of comments, replies and participations
+	User string `json:"user"`
+	// GPG or SSH key signing the commits of the shared comments repository
+	SigningKey string `json:"signingKey,omitempty"`
+	// Private SSH key used to clone and pull the shared comments repository
+	SSHKey string `json:"sshKey,omitempty"`
+}
+
+func (s Settings) findProfile(name string) (IdentityProfile, bool) {
+	for _, profile := range s.Profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return IdentityProfile{}, false
+}
+
+// Returns the profile active in dir: the one switched to with
+// comment.switchProfile, or the one selected in the settings.
+func activeProfile(dir string) (IdentityProfile, bool) {
+	current := getSettings()
+	name := current.Profile
+	cmd := gitCommand("config", profileGitKey)
+	cmd.Dir = dir
+	if output, err := cmd.Output(); err == nil && strings.TrimSpace(string(output)) != "" {
+		name = strings.TrimSpace(string(output))
+	}
+	if name == "" {
+		return IdentityProfile{}, false
+	}
+	profile, ok := current.findProfile(name)
+	if !ok {
+		logErrorf("Unknown identity profile %q", name)
+	}
+	return profile, ok
+}
+
+// Git command syncing the comments repository with the credentials and
+// signing key of the profile active in the workspace dir.
+func gitSyncCommand(ctx context.Context, dir string, args ...string) *gitProcess {
+	profile, ok := activeProfile(dir)
+	if ok && profile.SigningKey != "" {
+		args = append([]string{"-c", "user.signingkey=" + profile.SigningKey, "-c", "commit.gpgSign=true"}, args...)
+	}
+	if ok && profile.User != "" {
+		args = append([]string{"-c", "user.email=" + profile.User}, args...)
+	}
+	gitLog.debugf("git %s", strings.Join(args, " "))
+	cmd := gitRemoteCommand(ctx, args...)
+	cmd.Dir = dir
+	if ok && profile.SSHKey != "" {
+		sshKey := profile.SSHKey
+		if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(sshKey, "~/") {
+			sshKey = filepath.Join(home, sshKey[2:])
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %q -o IdentitiesOnly=yes -o BatchMode=yes", sshKey))
+	}
+	return cmd
+}
+
+// Switches the profile of the workspace, or back to the profile of the
+// settings when name is empty.
+func (h *handler) switchProfile(name string) error {
+	if h.rootPath == "" {
+		return fmt.Errorf("no workspace")
+	}
+	args := []string{"config", profileGitKey, name}
+	if name == "" {
+		args = []string{"config", "--unset", profileGitKey}
+	} else if _, ok := getSettings().findProfile(name); !ok {
+		return fmt.Errorf("unknown identity profile %q", name)
+	}
+	cmd := gitCommand(args...)
+	cmd.Dir = h.rootPath
+	if err := cmd.Run(); err != nil && name != "" {
+		return newCommentError(ErrVCSUnavailable, "error while switching profile: %w", err)
+	}
+	logInfof("Switched to identity profile %q", name)
+	return nil
+}
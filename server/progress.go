@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"go.lsp.dev/protocol"
+)
+
+var progressTokenCounter atomic.Int32
+
+// Progress of a long operation shown by the client, does nothing when the
+// client gave no token and cannot create one.
+type workDoneProgress struct {
+	h     *handler
+	token *protocol.ProgressToken
+}
+
+// Starts reporting progress with the token sent by the client in the request.
+func (h *handler) beginProgress(ctx context.Context, token *protocol.ProgressToken, title string) *workDoneProgress {
+	progress := &workDoneProgress{h: h, token: token}
+	progress.notify(ctx, protocol.WorkDoneProgressBegin{Kind: protocol.WorkDoneProgressKindBegin, Title: title})
+	return progress
+}
+
+// Starts reporting progress for an operation started by the server.
+// Must not be called from the handler goroutine: it waits for the client reply.
+func (h *handler) createProgress(ctx context.Context, title string) *workDoneProgress {
+	if !h.canCreateProgress {
+		return &workDoneProgress{h: h}
+	}
+	token := protocol.NewProgressToken(fmt.Sprintf("lsp-comments-%d", progressTokenCounter.Add(1)))
+	if _, err := h.conn.Call(ctx, "window/workDoneProgress/create", protocol.WorkDoneProgressCreateParams{Token: *token}, nil); err != nil {
+		logErrorf("Error while creating progress: %v", err)
+		return &workDoneProgress{h: h}
+	}
+	return h.beginProgress(ctx, token, title)
+}
+
+func (progress *workDoneProgress) notify(ctx context.Context, value interface{}) {
+	if progress.token == nil {
+		return
+	}
+	progress.h.conn.Notify(ctx, "$/progress", protocol.ProgressParams{Token: *progress.token, Value: value})
+}
+
+func (progress *workDoneProgress) report(ctx context.Context, message string, percentage uint32) {
+	progress.notify(ctx, protocol.WorkDoneProgressReport{Kind: protocol.WorkDoneProgressKindReport, Message: message, Percentage: percentage})
+}
+
+func (progress *workDoneProgress) end(ctx context.Context, message string) {
+	progress.notify(ctx, protocol.WorkDoneProgressEnd{Kind: protocol.WorkDoneProgressKindEnd, Message: message})
+}
+
+// Streams the results of a request in chunks when the client gave a
+// partialResultToken, so that big listings show up while they are computed.
+// The reply then carries an empty result.
+type partialResults struct {
+	h     *handler
+	token *protocol.ProgressToken
+}
+
+func (h *handler) partialResults(token *protocol.ProgressToken) *partialResults {
+	return &partialResults{h: h, token: token}
+}
+
+// Sends a chunk of results, returns false when they are not streamed and
+// belong to the reply
+func (results *partialResults) send(ctx context.Context, chunk interface{}) bool {
+	if results.token == nil {
+		return false
+	}
+	results.h.conn.Notify(ctx, "$/progress", protocol.ProgressParams{Token: *results.token, Value: chunk})
+	return true
+}
+
+// Clones or pulls the comments repository, showing progress in the client
+func (h *handler) syncCommentsRepo(ctx context.Context) {
+	if getSettings().CommentsRepoURL == "" {
+		if err := h.updateCommentsRepo(ctx); err != nil {
+			recordError(fmt.Errorf("error while updating comments: %w", err))
+		}
+		return
+	}
+	progress := h.createProgress(ctx, "Synchronising comments")
+	if err := h.updateCommentsRepo(ctx); err != nil {
+		recordError(fmt.Errorf("error while updating comments: %w", err))
+		progress.end(ctx, "Comments could not be synchronised")
+		return
+	}
+	progress.end(ctx, "Comments synchronised from "+h.sync.get().Source)
+	h.republishDiagnostics(ctx)
+}
+
+// Publishes the diagnostics of the open documents again once their comments
+// are there, documents opened during the sync got none
+func (h *handler) republishDiagnostics(ctx context.Context) {
+	if h.canPullDiagnostics {
+		h.refreshDiagnostics()
+		return
+	}
+	for _, uri := range h.openURIs() {
+		h.publishDiagnostics(ctx, uri)
+	}
+}
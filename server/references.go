@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Location of another repository a comment refers to, e.g. the service a
+// client change depends on. It is resolved when the repository is one of
+// the workspace folders.
+type ThreadReference struct {
+	Repo   string `json:"repo"`   // Identity of the repository, see repoIdentity
+	Path   string `json:"path"`   // Relative to the repository
+	Anchor string `json:"anchor"` // Patch anchoring the location, like comments
+}
+
+// A reference with its location in the open workspaces
+type ResolvedReference struct {
+	ThreadReference
+	Location *protocol.Location `json:"location,omitempty"`
+	Error    string             `json:"error,omitempty"` // Why it could not be resolved
+}
+
+type ThreadReferencesParams struct {
+	URI   protocol.DocumentURI `json:"uri"`
+	Index int                  `json:"index"`
+	ID    string               `json:"id,omitempty"` // Preferred to the index when set
+}
+
+// Identifies a repository across machines by its origin remote, without
+// scheme, credentials and .git suffix so that SSH and HTTPS clones match:
+// git@github.com:org/repo.git and https://github.com/org/repo are both
+// github.com/org/repo. Repositories without origin use their folder name.
+func repoIdentity(repoDir string) string {
+	output, err := gitCommand("-C", repoDir, "remote", "get-url", "origin").Output()
+	if err != nil {
+		return filepath.Base(repoDir)
+	}
+	return normalizeRemoteURL(strings.TrimSpace(string(output)))
+}
+
+func normalizeRemoteURL(remote string) string {
+	identity := remote
+	if _, rest, ok := strings.Cut(identity, "://"); ok {
+		identity = rest
+	} else if host, path, ok := strings.Cut(identity, ":"); ok && !strings.Contains(host, "/") {
+		// scp-like syntax: user@host:path
+		identity = host + "/" + path
+	}
+	// Credentials are before the host
+	if at := strings.Index(identity, "@"); at >= 0 && !strings.Contains(identity[:at], "/") {
+		identity = identity[at+1:]
+	}
+	identity = strings.TrimSuffix(strings.TrimSuffix(identity, "/"), ".git")
+	return strings.ToLower(identity)
+}
+
+// Repositories of the workspace folders, by identity
+func (h *handler) workspaceRepos() map[string]string {
+	repos := map[string]string{}
+	folders := append([]string{h.rootPath}, h.workspaceFolders...)
+	for _, folder := range folders {
+		if folder == "" {
+			continue
+		}
+		if repoDir := getRepoDirFromDir(folder); repoDir != "" {
+			repos[repoIdentity(repoDir)] = repoDir
+		}
+	}
+	return repos
+}
+
+func (h *handler) setWorkspaceFolders(event protocol.WorkspaceFoldersChangeEvent) {
+	removed := map[string]bool{}
+	for _, folder := range event.Removed {
+		removed[uriToPath(protocol.DocumentURI(folder.URI))] = true
+	}
+	folders := []string{}
+	for _, folder := range h.workspaceFolders {
+		if !removed[folder] {
+			folders = append(folders, folder)
+		}
+	}
+	for _, folder := range event.Added {
+		folders = append(folders, uriToPath(protocol.DocumentURI(folder.URI)))
+	}
+	h.workspaceFolders = folders
+}
+
+// Adds to a comment a reference to a range of a file of another repository
+func addReference(uri protocol.DocumentURI, id string, targetURI protocol.DocumentURI, rng protocol.Range) error {
+	targetPath := uriToPath(targetURI)
+	repoDir := getUserRepoDir(targetPath)
+	if repoDir == "" {
+		return fmt.Errorf("%s is not in a git repository", targetPath)
+	}
+	content, err := os.ReadFile(targetPath)
+	if err != nil {
+		return wrapFileError(err, "error while reading file %s: %w", targetPath, err)
+	}
+	rel, err := filepath.Rel(repoDir, targetPath)
+	if err != nil {
+		return fmt.Errorf("error while getting relative path : %v", err)
+	}
+	reference := ThreadReference{
+		Repo:   repoIdentity(repoDir),
+		Path:   filepath.ToSlash(rel),
+		Anchor: buildCommentPatch(targetPath, string(content), rng),
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.References = append(patch.References, reference)
+		return nil
+	})
+}
+
+// Anchors a reference in its repository, when it is open
+func resolveReference(repos map[string]string, reference ThreadReference) ResolvedReference {
+	resolved := ResolvedReference{ThreadReference: reference}
+	repoDir, ok := repos[reference.Repo]
+	if !ok {
+		resolved.Error = fmt.Sprintf("repository %s is not open", reference.Repo)
+		return resolved
+	}
+	filePath := filepath.Join(repoDir, filepath.FromSlash(reference.Path))
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		resolved.Error = fmt.Sprintf("file %s not found in %s", reference.Path, reference.Repo)
+		return resolved
+	}
+	rng, _, err := anchorPatch(anchorInput{content: string(content), patchText: reference.Anchor, filePath: filePath})
+	if err != nil {
+		anchorLog.debugf("Reference to %s not anchored: %v", filePath, err)
+		resolved.Error = fmt.Sprintf("referenced code not found in %s", reference.Path)
+		return resolved
+	}
+	resolved.Location = &protocol.Location{URI: pathToURI(filePath), Range: rng}
+	return resolved
+}
+
+// References of a comment, resolved in the workspace folders
+func (h *handler) threadReferences(params ThreadReferencesParams) ([]ResolvedReference, error) {
+	comment, err := getComment(GetCommentParams{URI: params.URI, Index: params.Index, ID: params.ID})
+	if err != nil {
+		return nil, err
+	}
+	repos := h.workspaceRepos()
+	resolved := []ResolvedReference{}
+	for _, reference := range comment.References {
+		resolved = append(resolved, resolveReference(repos, reference))
+	}
+	return resolved, nil
+}
+
+// Links from the commented ranges of a document to the locations they refer
+// to in other repositories
+func (h *handler) referenceLinks(uri protocol.DocumentURI) []protocol.DocumentLink {
+	links := []protocol.DocumentLink{}
+	comments, err := anchorComments(uri)
+	if err != nil {
+		return links
+	}
+	var repos map[string]string
+	for _, comment := range comments {
+		if len(comment.Patch.References) == 0 {
+			continue
+		}
+		if repos == nil {
+			repos = h.workspaceRepos()
+		}
+		for _, reference := range comment.Patch.References {
+			resolved := resolveReference(repos, reference)
+			if resolved.Location == nil {
+				continue
+			}
+			links = append(links, protocol.DocumentLink{
+				Range:   comment.Range,
+				Target:  protocol.DocumentURI(fmt.Sprintf("%s#L%d", resolved.Location.URI, resolved.Location.Range.Start.Line+1)),
+				Tooltip: reference.Repo + "/" + reference.Path,
+			})
+		}
+	}
+	return links
+}
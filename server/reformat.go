@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"go.lsp.dev/protocol"
+)
+
+// A formatter run on save, or a reformat of the whole code base, rewraps and
+// reindents most lines of a file: the recorded patches no longer match and
+// the comments drift to their line fallback. Saves changing the whitespace
+// only re-anchor the comments in the previous content, follow them through
+// the reformat and rewrite their patches in the new content.
+
+// Minimum similarity of the contents without whitespace, from 0 to 1
+const reformatSimilarity = 0.98
+
+// Smaller changes are left to the anchoring strategies
+const reformatMinLines = 10
+
+// Keeps the content of a document as it was on disk when opened or saved
+func (h *handler) rememberContent(uri protocol.DocumentURI) {
+	content, err := os.ReadFile(uriToPath(uri))
+	if err != nil {
+		delete(h.savedContents, uri)
+		return
+	}
+	h.savedContents[uri] = string(content)
+}
+
+// Rewrites the patches of a saved document when the save reformatted it
+func (h *handler) followReformat(ctx context.Context, uri protocol.DocumentURI) {
+	before, known := h.savedContents[uri]
+	h.rememberContent(uri)
+	after, saved := h.savedContents[uri]
+	if !known || !saved || !isReformat(before, after) {
+		return
+	}
+	if !isWorkspaceTrusted() || h.sync.get().ReadOnly {
+		anchorLog.infof("Comments of %s not rewritten after its reformat: they are read-only", uri)
+		return
+	}
+	rewritten, err := rewriteReformattedPatches(uriToPath(uri), before, after)
+	if err != nil {
+		recordError(fmt.Errorf("error while following the reformat of %s: %w", uri, err))
+		return
+	}
+	if rewritten == 0 {
+		return
+	}
+	anchorLog.infof("Rewrote %d comments of %s after its reformat", rewritten, uri)
+	h.notifyCommentsChanged(ctx, ChangeLocal, CommentChange{URI: uri})
+}
+
+// Whitespace changes on many lines, nothing else or almost
+func isReformat(before string, after string) bool {
+	if before == after || changedLines(before, after) < reformatMinLines {
+		return false
+	}
+	strippedBefore, _ := stripWhitespace(before)
+	strippedAfter, _ := stripWhitespace(after)
+	longest := max(len(strippedBefore), len(strippedAfter))
+	if longest == 0 {
+		return true
+	}
+	matcher := dmp.New()
+	distance := matcher.DiffLevenshtein(matcher.DiffMain(strippedBefore, strippedAfter, false))
+	return 1-float64(distance)/float64(longest) >= reformatSimilarity
+}
+
+// Lines of before missing from after
+func changedLines(before string, after string) int {
+	remaining := map[string]int{}
+	for _, line := range strings.Split(after, "\n") {
+		remaining[line]++
+	}
+	changed := 0
+	for _, line := range strings.Split(before, "\n") {
+		if remaining[line] > 0 {
+			remaining[line]--
+		} else {
+			changed++
+		}
+	}
+	return changed
+}
+
+// Text without whitespace, the offset in it where each line starts and its
+// length last
+func stripWhitespace(text string) (string, []int) {
+	var stripped strings.Builder
+	starts := []int{0}
+	for _, char := range text {
+		switch {
+		case char == '\n':
+			starts = append(starts, stripped.Len())
+		case !unicode.IsSpace(char):
+			stripped.WriteRune(char)
+		}
+	}
+	return stripped.String(), append(starts, stripped.Len())
+}
+
+// Anchors each comment in the content before the reformat and records it
+// again at the same code in the content after
+func rewriteReformattedPatches(filePath string, before string, after string) (int, error) {
+	unlock, err := lockDocumentComments(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	strippedBefore, startsBefore := stripWhitespace(before)
+	strippedAfter, startsAfter := stripWhitespace(after)
+	matcher := dmp.New()
+	diffs := matcher.DiffMain(strippedBefore, strippedAfter, false)
+	// Line of after holding an offset of the stripped text
+	lineAfter := func(offset int) int {
+		line := sort.Search(len(startsAfter)-1, func(line int) bool {
+			return startsAfter[line+1] > offset
+		})
+		return min(line, len(startsAfter)-2)
+	}
+
+	// Patch of the lines of patchText once reformatted
+	rewrite := func(patchText string) (string, error) {
+		rng, _, err := anchorPatch(anchorInput{content: before, patchText: patchText, filePath: filePath})
+		if err != nil {
+			return "", err
+		}
+		first, last := int(rng.Start.Line), max(int(rng.End.Line)-1, int(rng.Start.Line))
+		start := lineAfter(matcher.DiffXIndex(diffs, startsBefore[first]))
+		end := start
+		if lastOffset := startsBefore[last+1] - 1; lastOffset >= startsBefore[first] {
+			end = max(lineAfter(matcher.DiffXIndex(diffs, lastOffset)), start)
+		}
+		return buildCommentPatch(filePath, after, protocol.Range{
+			Start: protocol.Position{Line: uint32(start)},
+			End:   protocol.Position{Line: uint32(end)},
+		}), nil
+	}
+	rewritten := 0
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		if patch.isFileLevel() {
+			continue
+		}
+		patchText, err := rewrite(patch.Patch)
+		if err != nil {
+			anchorLog.debugf("Comment %d of %s not anchored before its reformat: %v", idx, filePath, err)
+			continue
+		}
+		patch.Patch = patchText
+		patch.PatchRef = nil
+		for secondaryIdx, secondaryPatch := range patch.SecondaryPatches {
+			if patchText, err := rewrite(secondaryPatch); err == nil {
+				patch.SecondaryPatches[secondaryIdx] = patchText
+			}
+		}
+		rewritten++
+	}
+	if rewritten == 0 {
+		return 0, nil
+	}
+	storeLog.infof("Rewrite the patches of %s after its reformat", filePath)
+	if err := saveCommentFile(filePath, commentFile); err != nil {
+		return 0, err
+	}
+	return rewritten, updateCommentsRepoAfterChange()
+}
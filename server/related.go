@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Offsets of the patches in the raw content of a comment file
+func patchOffsets(data []byte) []int {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		if key != "patches" {
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return nil
+			}
+			continue
+		}
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			return nil
+		}
+		offsets := []int{}
+		for decoder.More() {
+			// The offset is before the separator of the previous patch
+			offset := int(decoder.InputOffset())
+			for offset < len(data) && strings.ContainsRune(", \t\r\n", rune(data[offset])) {
+				offset++
+			}
+			offsets = append(offsets, offset)
+			var patch json.RawMessage
+			if err := decoder.Decode(&patch); err != nil {
+				return nil
+			}
+		}
+		return offsets
+	}
+	return nil
+}
+
+// Offsets of the entries of the patches sequence of a YAML comment file
+func yamlPatchOffsets(data []byte) []int {
+	offsets := []int{}
+	inPatches := false
+	entryIndent := -1
+	offset := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		lineOffset := offset
+		offset += len(line)
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := indentOf(line)
+		if !inPatches {
+			inPatches = indent == 0 && strings.HasPrefix(trimmed, "patches:")
+			continue
+		}
+		if entryIndent < 0 {
+			entryIndent = indent
+		}
+		if indent < entryIndent || indent == entryIndent && !isYAMLSequenceEntry(trimmed) {
+			break
+		}
+		if indent == entryIndent {
+			offsets = append(offsets, lineOffset+indent)
+		}
+	}
+	return offsets
+}
+
+// LSP position of a byte offset of content
+func offsetPosition(content []byte, offset int) protocol.Position {
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n"))
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	character := encodedLength(string(before[lineStart:]))
+	return protocol.Position{Line: uint32(line), Character: uint32(character)}
+}
+
+// Line of the commented code when the comment was made, zero based: the
+// line after the context lines of the first hunk.
+func recordedLine(patchText string) (int, bool) {
+	lines := strings.Split(patchText, "\n")
+	var start, length int
+	if _, err := fmt.Sscanf(lines[0], "@@ -%d,%d", &start, &length); err != nil {
+		return 0, false
+	}
+	line := start - 1
+	for _, patchLine := range lines[1:] {
+		if !strings.HasPrefix(patchLine, " ") {
+			break
+		}
+		line++
+	}
+	return line, true
+}
+
+// Related information of the diagnostics of a document, by comment index:
+// where the comment is stored, and where it was anchored when it was made.
+func diagnosticsRelatedInformation(uri protocol.DocumentURI, comments []anchoredComment) map[int][]protocol.DiagnosticRelatedInformation {
+	related := map[int][]protocol.DiagnosticRelatedInformation{}
+	commentFilePath, _, err := getCommentFilePath(uriToPath(uri))
+	if err != nil {
+		return related
+	}
+	commentFilePath = storedCommentFilePath(commentFilePath)
+	data, err := os.ReadFile(commentFilePath)
+	if err != nil {
+		return related
+	}
+	var header struct {
+		Commit string `json:"commit"`
+	}
+	offsets := patchOffsets(data)
+	if isYAMLCommentFile(data) {
+		converted, _ := yamlToJSON(data)
+		json.Unmarshal(converted, &header)
+		offsets = yamlPatchOffsets(data)
+	} else {
+		json.Unmarshal(data, &header)
+	}
+	for _, comment := range comments {
+		if comment.Index < len(offsets) {
+			position := offsetPosition(data, offsets[comment.Index])
+			related[comment.Index] = append(related[comment.Index], protocol.DiagnosticRelatedInformation{
+				Location: protocol.Location{
+					URI:   pathToURI(commentFilePath),
+					Range: protocol.Range{Start: position, End: position},
+				},
+				Message: "Stored comment",
+			})
+		}
+		line, ok := recordedLine(comment.Patch.Patch)
+		if !ok || header.Commit == "" {
+			continue
+		}
+		position := protocol.Position{Line: uint32(line)}
+		related[comment.Index] = append(related[comment.Index], protocol.DiagnosticRelatedInformation{
+			Location: protocol.Location{URI: uri, Range: protocol.Range{Start: position, End: position}},
+			Message:  fmt.Sprintf("Commented at line %d in commit %.7s", line+1, header.Commit),
+		})
+	}
+	return related
+}
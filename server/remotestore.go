@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With commentsServerUrl set, the comments are kept by a comment server and
+// the comment folder holds a replica of its comment files, read like any
+// other. Each side versions every thread of a comment file, and the fields
+// of the file itself under fileVersionKey: the version vector of the file.
+// Writes send the threads changed since the last sync with the versions they
+// were made on, and receive the threads changed by others since, so that
+// only changed threads are transferred whatever the size of the file. A
+// thread changed on both sides is refused and the replica brought up to date.
+//
+//	POST /sync/push   {path, versions, file, threads, removed} -> delta since versions, 409 on conflict
+//	POST /sync/pull   {path, versions} -> delta since versions, 404 once deleted
+//	POST /sync/delete {path, versions} -> 409 on conflict
+//	GET  /sync/changes?since=cursor -> {cursor, paths}, every path at first
+
+// Read from the environment, sent as bearer token
+const commentServerTokenVariable = "COMMENTS_SERVER_TOKEN"
+
+// Interval of the change requests of Watch
+const commentServerPollInterval = 10 * time.Second
+
+var commentServerClient = &http.Client{Timeout: 30 * time.Second}
+
+// Version of each thread of a comment file by comment ID
+type versionVector map[string]int64
+
+// Key of the fields of the file in its version vector
+const fileVersionKey = ""
+
+// Fields of a comment file besides its threads
+type remoteFileFields struct {
+	Version int    `json:"version,omitempty"`
+	Commit  string `json:"commit"`
+	// IDs of the threads, in the order of the file
+	Order []string                `json:"order"`
+	Cells map[string]*CommentFile `json:"cells,omitempty"`
+}
+
+// Changes of a comment file: the threads and fields changed since a version
+// vector, and the vector of the changed file. Threads missing from the
+// vector were removed.
+type remoteDelta struct {
+	Path     string            `json:"path"` // Of the source file, relative to the comment folder
+	Versions versionVector     `json:"versions"`
+	File     *remoteFileFields `json:"file,omitempty"`
+	Threads  []Patch           `json:"threads,omitempty"`
+	Removed  []string          `json:"removed,omitempty"`
+}
+
+type remoteChanges struct {
+	Cursor string   `json:"cursor"`
+	Paths  []string `json:"paths"`
+}
+
+// Version vector of a replicated comment file, with the hashes of its
+// threads and fields at that version to find those changed since
+type syncedCommentFile struct {
+	Versions versionVector     `json:"versions"`
+	Hashes   map[string]string `json:"hashes"`
+}
+
+type remoteSyncState struct {
+	Cursor string                        `json:"cursor"`
+	Files  map[string]*syncedCommentFile `json:"files"`
+}
+
+type remoteStore struct {
+	serverURL string
+	token     string
+	dir       string // Comment folder holding the replica
+	replica   fileStore
+	mutex     sync.Mutex
+	state     *remoteSyncState
+}
+
+func newRemoteStore(serverURL string, dir string) *remoteStore {
+	store := &remoteStore{
+		serverURL: strings.TrimSuffix(serverURL, "/"),
+		token:     os.Getenv(commentServerTokenVariable),
+		dir:       filepath.Clean(dir),
+		state:     &remoteSyncState{Files: map[string]*syncedCommentFile{}},
+	}
+	data, err := os.ReadFile(store.statePath())
+	if err == nil {
+		var state remoteSyncState
+		if err := json.Unmarshal(data, &state); err == nil && state.Files != nil {
+			store.state = &state
+		} else {
+			syncLog.infof("Sync all the comments of %s again", store.serverURL)
+		}
+	}
+	return store
+}
+
+func (store *remoteStore) statePath() string {
+	return filepath.Join(store.dir, metaDirName, "sync.json")
+}
+
+// Must be called with the store locked
+func (store *remoteStore) saveState() {
+	data, err := json.Marshal(store.state)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(store.statePath()), fs.ModePerm)
+	}
+	if err == nil {
+		err = writeFileAtomic(store.statePath(), data)
+	}
+	if err != nil {
+		recordError(wrapFileError(err, "error while writing the sync state of the comments: %w", err))
+	}
+}
+
+// Path on the server of a comment file of the replica. Files out of the
+// comment folder, e.g. private notes, stay local.
+func (store *remoteStore) remotePath(path string) (string, bool) {
+	jsonPath, ok := strings.CutSuffix(commentFileKey(filepath.Clean(path)), ".json")
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(store.dir, jsonPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(rel, metaDirName+"/") {
+		return "", false
+	}
+	return rel, true
+}
+
+func (store *remoteStore) localPath(rel string) string {
+	return filepath.Join(store.dir, filepath.FromSlash(rel)) + ".json"
+}
+
+func (store *remoteStore) Get(path string) (*CommentFile, error) {
+	return store.replica.Get(path)
+}
+
+func (store *remoteStore) List(dir string, fn func(path string, rel string) error) error {
+	return store.replica.List(dir, fn)
+}
+
+// Pushes the threads changed since the last sync, then writes the replica
+// with those changed by others meanwhile
+func (store *remoteStore) Put(path string, commentFile *CommentFile) error {
+	rel, ok := store.remotePath(path)
+	if !ok {
+		return store.replica.Put(path, commentFile)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	synced := store.synced(rel)
+	hashes := commentFileHashes(commentFile)
+	delta := remoteDelta{Path: rel, Versions: synced.Versions}
+	for idx := range commentFile.Patches {
+		id := commentID(&commentFile.Patches[idx])
+		if hashes[id] != synced.Hashes[id] {
+			delta.Threads = append(delta.Threads, commentFile.Patches[idx])
+		}
+	}
+	for id := range synced.Hashes {
+		if _, ok := hashes[id]; !ok && id != fileVersionKey {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	if hashes[fileVersionKey] != synced.Hashes[fileVersionKey] {
+		delta.File = fileFieldsOf(commentFile)
+	}
+	if len(delta.Threads) == 0 && len(delta.Removed) == 0 && delta.File == nil {
+		return store.replica.Put(path, commentFile)
+	}
+	var changes remoteDelta
+	status, err := store.call(http.MethodPost, "/sync/push", delta, &changes)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		if _, err := store.pull(rel); err != nil {
+			recordError(err)
+		}
+		return newCommentError(ErrSyncConflict, "the comments of %s were changed on the comment server meanwhile, try again", rel)
+	}
+	syncLog.debugf("Pushed %d threads of %s", len(delta.Threads)+len(delta.Removed), rel)
+	return store.apply(rel, commentFile, changes)
+}
+
+func (store *remoteStore) Delete(path string) error {
+	rel, ok := store.remotePath(path)
+	if !ok {
+		return store.replica.Delete(path)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delta := remoteDelta{Path: rel, Versions: store.synced(rel).Versions}
+	status, err := store.call(http.MethodPost, "/sync/delete", delta, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		if _, err := store.pull(rel); err != nil {
+			recordError(err)
+		}
+		return newCommentError(ErrSyncConflict, "the comments of %s were changed on the comment server meanwhile, try again", rel)
+	}
+	delete(store.state.Files, rel)
+	store.saveState()
+	return store.replica.Delete(path)
+}
+
+// Pulls the comment files changed on the server until ctx is done, all of
+// them at first, and reports those of the replica that changed
+func (store *remoteStore) Watch(ctx context.Context, dir string, fn func(paths []string)) error {
+	if filepath.Clean(dir) != store.dir {
+		return nil
+	}
+	ticker := time.NewTicker(commentServerPollInterval)
+	defer ticker.Stop()
+	for {
+		if paths, err := store.pullChanges(); err != nil {
+			syncLog.errorf("Error while pulling the comments of %s: %v", store.serverURL, err)
+		} else if len(paths) > 0 {
+			fn(paths)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (store *remoteStore) pullChanges() ([]string, error) {
+	store.mutex.Lock()
+	cursor := store.state.Cursor
+	store.mutex.Unlock()
+	var changes remoteChanges
+	if _, err := store.call(http.MethodGet, "/sync/changes?since="+url.QueryEscape(cursor), nil, &changes); err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, rel := range changes.Paths {
+		path := store.localPath(rel)
+		if _, ok := store.remotePath(path); !ok {
+			syncLog.errorf("Ignore invalid comment file path %q of the comment server", rel)
+			continue
+		}
+		updated, err := store.pullLocked(rel)
+		if err != nil {
+			// Pulled again from the same cursor
+			return changed, err
+		}
+		if updated {
+			changed = append(changed, path)
+		}
+	}
+	store.mutex.Lock()
+	store.state.Cursor = changes.Cursor
+	store.saveState()
+	store.mutex.Unlock()
+	return changed, nil
+}
+
+// Pulls a comment file under its lock, reports whether the replica changed
+func (store *remoteStore) pullLocked(rel string) (bool, error) {
+	unlock, err := lockCommentFile(store.localPath(rel))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.pull(rel)
+}
+
+// Must be called with the store and the comment file locked
+func (store *remoteStore) pull(rel string) (bool, error) {
+	synced := store.synced(rel)
+	var changes remoteDelta
+	status, err := store.call(http.MethodPost, "/sync/pull", remoteDelta{Path: rel, Versions: synced.Versions}, &changes)
+	if err != nil {
+		return false, err
+	}
+	path := store.localPath(rel)
+	if status == http.StatusNotFound {
+		delete(store.state.Files, rel)
+		store.saveState()
+		if err := store.replica.Delete(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+		return true, nil
+	}
+	if len(changes.Threads) == 0 && changes.File == nil && sameVersions(changes.Versions, synced.Versions) {
+		return false, nil
+	}
+	commentFile, err := store.replica.Get(path)
+	if errors.Is(err, os.ErrNotExist) {
+		commentFile = &CommentFile{}
+	} else if err != nil {
+		return false, err
+	}
+	syncLog.debugf("Pulled %d threads of %s", len(changes.Threads), rel)
+	return true, store.apply(rel, commentFile, changes)
+}
+
+// Writes in the replica the comment file with the changes of the server on
+// top, and records the version vector they bring it to
+func (store *remoteStore) apply(rel string, commentFile *CommentFile, changes remoteDelta) error {
+	if changes.Versions == nil {
+		return fmt.Errorf("invalid comment server answer: no versions for %s", rel)
+	}
+	fields := fileFieldsOf(commentFile)
+	if changes.File != nil {
+		fields = changes.File
+	}
+	threads := map[string]Patch{}
+	for _, patch := range commentFile.Patches {
+		threads[commentID(&patch)] = patch
+	}
+	for _, patch := range changes.Threads {
+		threads[commentID(&patch)] = patch
+	}
+	// Threads added by others since the order was last synced go last
+	order := fields.Order
+	for _, patch := range changes.Threads {
+		order = append(order, commentID(&patch))
+	}
+	merged := &CommentFile{Version: fields.Version, Commit: fields.Commit, Cells: fields.Cells, Patches: []Patch{}}
+	for _, id := range order {
+		patch, ok := threads[id]
+		if !ok {
+			continue
+		}
+		delete(threads, id)
+		if _, current := changes.Versions[id]; current {
+			merged.Patches = append(merged.Patches, patch)
+		}
+	}
+	if err := store.replica.Put(store.localPath(rel), merged); err != nil {
+		return err
+	}
+	store.state.Files[rel] = &syncedCommentFile{Versions: changes.Versions, Hashes: commentFileHashes(merged)}
+	store.saveState()
+	return nil
+}
+
+// Must be called with the store locked
+func (store *remoteStore) synced(rel string) *syncedCommentFile {
+	if synced, ok := store.state.Files[rel]; ok {
+		return synced
+	}
+	return &syncedCommentFile{Versions: versionVector{}, Hashes: map[string]string{}}
+}
+
+// Calls the comment server, decoding its answer in result. Conflicts and
+// missing files are reported by their status, not as errors.
+func (store *remoteStore) call(method string, endpoint string, body interface{}, result interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("error while serializing comment server request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, store.serverURL+endpoint, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if store.token != "" {
+		req.Header.Set("Authorization", "Bearer "+store.token)
+	}
+	resp, err := commentServerClient.Do(req)
+	if err != nil {
+		return 0, newCommentError(ErrSyncConflict, "error while calling the comment server: %w", err)
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, newCommentError(ErrSyncConflict, "error while reading the comment server answer: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return resp.StatusCode, newCommentError(ErrAuthFailed, "the comment server rejected the token of %s: %s", commentServerTokenVariable, resp.Status)
+	case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusNotFound:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 300:
+		return resp.StatusCode, newCommentError(ErrSyncConflict, "the comment server returned %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	}
+	if result != nil {
+		if err := json.Unmarshal(answer, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("invalid comment server answer: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func fileFieldsOf(commentFile *CommentFile) *remoteFileFields {
+	fields := &remoteFileFields{
+		Version: commentFile.Version,
+		Commit:  commentFile.Commit,
+		Order:   []string{},
+		Cells:   commentFile.Cells,
+	}
+	for idx := range commentFile.Patches {
+		fields.Order = append(fields.Order, commentID(&commentFile.Patches[idx]))
+	}
+	return fields
+}
+
+// Hashes of the threads of a comment file by comment ID, and of its fields
+func commentFileHashes(commentFile *CommentFile) map[string]string {
+	hash := func(value interface{}) string {
+		data, _ := json.Marshal(value)
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:16])
+	}
+	hashes := map[string]string{fileVersionKey: hash(fileFieldsOf(commentFile))}
+	for idx := range commentFile.Patches {
+		hashes[commentID(&commentFile.Patches[idx])] = hash(commentFile.Patches[idx])
+	}
+	return hashes
+}
+
+func sameVersions(a versionVector, b versionVector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, version := range a {
+		if b[id] != version {
+			return false
+		}
+	}
+	return true
+}
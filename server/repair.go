@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type RepairReport struct {
+	DryRun bool          `json:"dryRun"`
+	Merges []RepairMerge `json:"merges"`
+}
+
+type RepairMerge struct {
+	Canonical string   `json:"canonical"`
+	Sources   []string `json:"sources"`
+	Patches   int      `json:"patches"`
+}
+
+// Detect comment files that point to the same source file under different
+// path spellings (case variants, "./" segments, symlinks) and merge them
+// into the comment file of the canonical path.
+func repairCommentStore(rootPath string, dryRun bool) (*RepairReport, error) {
+	if rootPath == "" {
+		return nil, fmt.Errorf("no workspace root to repair")
+	}
+	repoDir := getRepoDirFromDir(rootPath)
+	if repoDir == "" {
+		return nil, fmt.Errorf("workspace %s is not a git repository", rootPath)
+	}
+	commentsDir := commentsDirOf(repoDir)
+
+	// Group comment files by the canonical path of their source file
+	groups := map[string][]string{}
+	err := walkCommentFiles(commentsDir, func(commentFilePath string, rel string) error {
+		canonical := canonicalSourcePath(repoDir, rel)
+		groups[canonical] = append(groups[canonical], commentFilePath)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while walking comments folder: %v", err)
+	}
+
+	report := &RepairReport{DryRun: dryRun, Merges: []RepairMerge{}}
+	canonicals := make([]string, 0, len(groups))
+	for canonical := range groups {
+		canonicals = append(canonicals, canonical)
+	}
+	sort.Strings(canonicals)
+	for _, canonical := range canonicals {
+		target := filepath.Join(commentsDir, canonical+".json")
+		sources := groups[canonical]
+		if len(sources) == 1 && sources[0] == target {
+			continue
+		}
+		merge, err := mergeCommentFiles(target, sources, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		report.Merges = append(report.Merges, *merge)
+	}
+	return report, nil
+}
+
+func mergeCommentFiles(target string, sources []string, dryRun bool) (*RepairMerge, error) {
+	// The canonical file goes first so its commit and ordering win
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i] == target && sources[j] != target
+	})
+	if !dryRun {
+		var locks commentFileLocks
+		defer func() { locks.release() }()
+		for _, path := range append([]string{target}, sources...) {
+			if path == target && len(locks) > 0 {
+				continue
+			}
+			if err := locks.lock(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	merged := CommentFile{Patches: []Patch{}}
+	// Duplicates are matched like by the merge driver, two comments with the
+	// same message are kept
+	seen := map[string]bool{}
+	for _, source := range sources {
+		commentFile, err := readCommentFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		if merged.Commit == "" {
+			merged.Commit = commentFile.Commit
+			merged.Version = commentFile.Version
+		}
+		// Patches of an older file still need an upgrade
+		merged.Version = min(merged.Version, commentFile.Version)
+		for id, cell := range commentFile.Cells {
+			// Sections of the canonical file win, like its commit
+			if _, ok := merged.Cells[id]; !ok {
+				if merged.Cells == nil {
+					merged.Cells = map[string]*CommentFile{}
+				}
+				merged.Cells[id] = cell
+			}
+		}
+		for _, patch := range commentFile.Patches {
+			key := commentKey(&patch)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged.Patches = append(merged.Patches, patch)
+		}
+	}
+	result := &RepairMerge{Canonical: target, Sources: sources, Patches: len(merged.Patches)}
+	if dryRun {
+		return result, nil
+	}
+
+	storeLog.infof("Merge %d comment files into %s", len(sources), target)
+	if err := writeCommentFile(target, &merged); err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		if source == target {
+			continue
+		}
+		if err := deleteCommentFile(source); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Returns the path of a source file relative to repoDir, using the case
+// found on disk and with symlinks resolved. Parts of the path that do not
+// exist anymore are kept as they are.
+func canonicalSourcePath(repoDir string, rel string) string {
+	rel = filepath.Clean(rel)
+	resolved := repoDir
+	parts := strings.Split(rel, string(filepath.Separator))
+	for idx, part := range parts {
+		entries, err := os.ReadDir(resolved)
+		if err != nil {
+			resolved = filepath.Join(append([]string{resolved}, parts[idx:]...)...)
+			break
+		}
+		name := part
+		for _, entry := range entries {
+			if entry.Name() == part {
+				name = part
+				break
+			}
+			if strings.EqualFold(entry.Name(), part) {
+				name = entry.Name()
+			}
+		}
+		resolved = filepath.Join(resolved, name)
+	}
+
+	realRepoDir, err := filepath.EvalSymlinks(repoDir)
+	if err != nil {
+		realRepoDir = repoDir
+	}
+	if realPath, err := filepath.EvalSymlinks(resolved); err == nil {
+		if realRel, err := filepath.Rel(realRepoDir, realPath); err == nil && !strings.HasPrefix(realRel, "..") {
+			return realRel
+		}
+	}
+	canonical, err := filepath.Rel(repoDir, resolved)
+	if err != nil {
+		return rel
+	}
+	return canonical
+}
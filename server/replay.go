@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Replays the anchoring of the comments of a bug report bundle, tracing each
+// step of the patch matching:
+//
+//	separate_comments replay [--content file] [--index n] bundle.zip
+func runReplay(args []string, output io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(output)
+	contentPath := flags.String("content", "", "document content to use instead of the one of the bundle")
+	onlyIndex := flags.Int("index", -1, "replay only this comment")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(output, "usage: replay [--content file] [--index n] bundle.zip")
+		return 2
+	}
+	bundle, err := readBundle(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(output, "replay: %v\n", err)
+		return 1
+	}
+	if *contentPath != "" {
+		content, err := os.ReadFile(*contentPath)
+		if err != nil {
+			fmt.Fprintf(output, "replay: %v\n", err)
+			return 1
+		}
+		bundle.content = content
+	}
+	if bundle.comments == nil || bundle.content == nil {
+		fmt.Fprintln(output, "replay: the bundle has no document, create it from the document with misplaced comments or use --content")
+		return 1
+	}
+
+	recorded := map[int]bundleAnchor{}
+	for _, anchor := range bundle.anchors {
+		recorded[anchor.Index] = anchor
+	}
+	for idx, patch := range bundle.comments.Patches {
+		if *onlyIndex >= 0 && idx != *onlyIndex {
+			continue
+		}
+		fmt.Fprintf(output, "=== comment %d\n", idx)
+		traceAnchoring(output, string(bundle.content), patch.Patch)
+		rng, err := applyPatchAndGetPositions(string(bundle.content), patch.Patch)
+		if err != nil {
+			fmt.Fprintf(output, "result: %v\n", err)
+		} else {
+			fmt.Fprintf(output, "result: lines %d to %d\n", rng.Start.Line, rng.End.Line)
+		}
+		if anchor, ok := recorded[idx]; ok {
+			switch {
+			case anchor.Error != "":
+				fmt.Fprintf(output, "recorded: %s\n", anchor.Error)
+			case anchor.Range != nil:
+				fmt.Fprintf(output, "recorded: lines %d to %d\n", anchor.Range.Start.Line, anchor.Range.End.Line)
+			}
+		}
+	}
+	return 0
+}
+
+type replayBundle struct {
+	comments *CommentFile
+	anchors  []bundleAnchor
+	content  []byte
+}
+
+func readBundle(bundlePath string) (*replayBundle, error) {
+	archive, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+	defer archive.Close()
+	bundle := &replayBundle{}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch file.Name {
+		case "comments.json":
+			err = json.Unmarshal(data, &bundle.comments)
+		case "anchors.json":
+			err = json.Unmarshal(data, &bundle.anchors)
+		case bundleDocumentName:
+			bundle.content = data
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", file.Name, err)
+		}
+	}
+	return bundle, nil
+}
+
+// Text a dmp patch expects to find, from its textual form
+func patchText1(patch dmp.Patch) string {
+	var text1 strings.Builder
+	for _, line := range strings.Split(patch.String(), "\n")[1:] {
+		if line == "" || (line[0] != ' ' && line[0] != '-') {
+			continue
+		}
+		decoded, err := url.QueryUnescape(strings.ReplaceAll(line[1:], "+", "%2B"))
+		if err != nil {
+			decoded = line[1:]
+		}
+		text1.WriteString(decoded)
+	}
+	return text1.String()
+}
+
+// Traces the steps of dmp.PatchApply used by applyPatchAndGetPositions
+func traceAnchoring(output io.Writer, content string, patchText string) {
+	matcher := dmp.New()
+	fmt.Fprintf(output, "patch:\n%s", patchText)
+	contextBefore, contextAfter := patchContextLines(patchText)
+	fmt.Fprintf(output, "context: %d lines before, %d lines after\n", contextBefore, contextAfter)
+	patches, err := matcher.PatchFromText(patchText)
+	if err != nil {
+		fmt.Fprintf(output, "parse: %v\n", err)
+		return
+	}
+	fmt.Fprintf(output, "match: threshold %.2f, distance %d, max bits %d\n", matcher.MatchThreshold, matcher.MatchDistance, matcher.MatchMaxBits)
+
+	patches = matcher.PatchDeepCopy(patches)
+	padding := matcher.PatchAddPadding(patches)
+	text := padding + content + padding
+	patches = matcher.PatchSplitMax(patches)
+	delta := 0
+	for idx, patch := range patches {
+		fmt.Fprintf(output, "hunk %d: start1 %d, length1 %d, start2 %d, length2 %d\n", idx, patch.Start1, patch.Length1, patch.Start2, patch.Length2)
+		for _, line := range strings.Split(strings.TrimSuffix(patch.String(), "\n"), "\n")[1:] {
+			fmt.Fprintf(output, "  op %q\n", line)
+		}
+		expectedLoc := patch.Start2 + delta
+		text1 := patchText1(patch)
+		pattern := text1
+		if len(pattern) > matcher.MatchMaxBits {
+			pattern = pattern[:matcher.MatchMaxBits]
+		}
+		startLoc := matcher.MatchMain(text, pattern, expectedLoc)
+		if startLoc == -1 {
+			fmt.Fprintf(output, "  expected at %d, no match\n", expectedLoc-len(padding))
+			delta -= patch.Length2 - patch.Length1
+			continue
+		}
+		delta = startLoc - expectedLoc
+		end := startLoc + len(text1)
+		if end > len(text) {
+			end = len(text)
+		}
+		found := text[startLoc:end]
+		distance := matcher.DiffLevenshtein(matcher.DiffMain(text1, found, false))
+		score := 0.0
+		if len(text1) > 0 {
+			score = float64(distance) / float64(len(text1))
+		}
+		fmt.Fprintf(output, "  expected at %d, found at %d (offset %d), distance %d, score %.3f\n",
+			expectedLoc-len(padding), startLoc-len(padding), delta, distance, score)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Review of a GitHub pull request from the editor: review.openPullRequest
+// checks it out and imports its review comments, the user comments and
+// replies as usual, then review.submit sends the verdict with the comments
+// and replies made since.
+
+// Review of a pull request in progress
+type ReviewSession struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	HeadSHA string `json:"headSha"`
+	// Checkout of the pull request: the workspace, or a worktree next to it
+	// when the workspace has local changes
+	Dir string `json:"dir"`
+	// RFC3339, comments and replies of the user made since are submitted
+	StartedAt string `json:"startedAt"`
+}
+
+type reviewState struct {
+	mutex   sync.Mutex
+	session *ReviewSession
+}
+
+func (state *reviewState) get() *ReviewSession {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.session
+}
+
+func (state *reviewState) set(session *ReviewSession) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.session = session
+}
+
+// Verdicts of review.submit and their GitHub review event
+var reviewEvents = map[string]string{
+	"approve":        "APPROVE",
+	"requestChanges": "REQUEST_CHANGES",
+	"comment":        "COMMENT",
+}
+
+type ReviewSubmitResult struct {
+	Review   int64 `json:"review"`
+	Comments int   `json:"comments"`
+	Replies  int   `json:"replies"`
+}
+
+// Checks out a pull request, imports its comments and starts reviewing it
+func (h *handler) openPullRequest(ctx context.Context, number int) (*ReviewSession, error) {
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return nil, fmt.Errorf("workspace is not a git repository")
+	}
+	repo, err := githubRepoOf(ctx, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	progress := h.createProgress(ctx, fmt.Sprintf("Opening pull request #%d", number))
+	session, imported, err := h.checkoutAndImport(ctx, progress, repo, repoDir, number)
+	if err != nil {
+		progress.end(context.WithoutCancel(ctx), "Pull request not opened")
+		return nil, err
+	}
+	progress.end(ctx, fmt.Sprintf("%d comments imported", imported))
+	h.review.set(session)
+	logInfof("Reviewing pull request #%d in %s", number, session.Dir)
+
+	h.notifyCommentsChanged(ctx, ChangeRemote)
+	h.republishDiagnostics(ctx)
+	message := fmt.Sprintf("Reviewing #%d %s: %d comments imported. Comment the code, then submit the review with review.submit.", number, session.Title, imported)
+	if session.Dir != repoDir {
+		message = fmt.Sprintf("Reviewing #%d %s in the worktree %s since the workspace has local changes: %d comments imported. "+
+			"Open the worktree, comment the code, then submit the review with review.submit.", number, session.Title, session.Dir, imported)
+	}
+	h.conn.Notify(ctx, "window/showMessage", protocol.ShowMessageParams{Type: protocol.MessageTypeInfo, Message: message})
+	return session, nil
+}
+
+func (h *handler) checkoutAndImport(ctx context.Context, progress *workDoneProgress, repo *githubRepo, repoDir string, number int) (*ReviewSession, int, error) {
+	pr, err := repo.pullRequest(ctx, number)
+	if err != nil {
+		return nil, 0, err
+	}
+	progress.report(ctx, "Checking out "+pr.Head.Ref, 20)
+	dir, err := checkoutPullRequest(ctx, repoDir, pr)
+	if err != nil {
+		return nil, 0, err
+	}
+	progress.report(ctx, "Importing comments", 60)
+	comments, err := repo.reviewComments(ctx, number)
+	if err != nil {
+		return nil, 0, err
+	}
+	imported, err := importReviewComments(dir, pr.Head.SHA, comments)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &ReviewSession{
+		Number:    number,
+		Title:     pr.Title,
+		URL:       pr.HTMLURL,
+		HeadSHA:   pr.Head.SHA,
+		Dir:       dir,
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+	}, imported, nil
+}
+
+// Checks out the head of the pull request in the pr-<number> branch, in the
+// workspace or in a worktree when the workspace has local changes. Returns
+// the folder of the checkout.
+func checkoutPullRequest(ctx context.Context, repoDir string, pr *githubPullRequest) (string, error) {
+	fetch := gitRemoteCommand(ctx, "fetch", "origin", fmt.Sprintf("refs/pull/%d/head", pr.Number))
+	fetch.Dir = repoDir
+	if err := fetch.Run(); err != nil {
+		return "", newCommentError(syncErrorCode(err, ErrVCSUnavailable), "error while fetching pull request #%d: %w", pr.Number, err)
+	}
+	branch := fmt.Sprintf("pr-%d", pr.Number)
+	status, err := gitOutput("-C", repoDir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return "", newCommentError(ErrVCSUnavailable, "%w", err)
+	}
+	if len(bytes.TrimSpace(status)) == 0 {
+		if _, err := gitOutput("-C", repoDir, "checkout", "-B", branch, pr.Head.SHA); err != nil {
+			return "", newCommentError(ErrVCSUnavailable, "error while checking out pull request #%d: %w", pr.Number, err)
+		}
+		return repoDir, nil
+	}
+	// Local changes stay where they are
+	worktree := repoDir + "-" + branch
+	if _, err := os.Stat(worktree); err == nil {
+		_, err = gitOutput("-C", worktree, "checkout", "-B", branch, pr.Head.SHA)
+		if err != nil {
+			return "", newCommentError(ErrVCSUnavailable, "error while updating worktree %s: %w", worktree, err)
+		}
+		return worktree, nil
+	}
+	if _, err := gitOutput("-C", repoDir, "worktree", "add", "-B", branch, worktree, pr.Head.SHA); err != nil {
+		return "", newCommentError(ErrVCSUnavailable, "error while creating worktree %s: %w", worktree, err)
+	}
+	return worktree, nil
+}
+
+// Adds the review comments missing from the comment files of the checkout,
+// threads with their replies. Returns the number of threads imported.
+func importReviewComments(dir string, headSHA string, comments []githubReviewComment) (int, error) {
+	threads := map[string][]githubReviewComment{}
+	replies := map[int64][]githubReviewComment{}
+	for _, comment := range comments {
+		switch {
+		case comment.InReplyTo != 0:
+			replies[comment.InReplyTo] = append(replies[comment.InReplyTo], comment)
+		case comment.Side == "LEFT":
+			// Comments on removed lines have no place in the checkout
+		default:
+			threads[comment.Path] = append(threads[comment.Path], comment)
+		}
+	}
+	paths := make([]string, 0, len(threads))
+	for path := range threads {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	imported := 0
+	// Files stay locked until the import is written
+	var locks commentFileLocks
+	defer func() { locks.release() }()
+	for _, path := range paths {
+		filePath := filepath.Join(dir, filepath.FromSlash(path))
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			anchorLog.debugf("Review comments of %s not imported: %v", path, err)
+			continue
+		}
+		commentFilePath, _, err := getCommentFilePath(filePath)
+		if err != nil {
+			return imported, err
+		}
+		if err := locks.lock(commentFilePath); err != nil {
+			return imported, err
+		}
+		commentFile, err := readCommentFile(commentFilePath)
+		if errors.Is(err, os.ErrNotExist) {
+			commentFile = &CommentFile{Version: commentFileVersion, Commit: headSHA, Patches: []Patch{}}
+		} else if err != nil {
+			return imported, err
+		}
+		known := map[int64]int{}
+		for idx, patch := range commentFile.Patches {
+			if patch.GitHubComment != 0 {
+				known[patch.GitHubComment] = idx
+			}
+		}
+		changed := false
+		for _, thread := range threads[path] {
+			idx, ok := known[thread.ID]
+			if !ok {
+				if thread.Line == nil {
+					// Outdated, the commented lines are not in the head anymore
+					continue
+				}
+				last := *thread.Line - 1
+				first := last
+				if thread.StartLine != nil {
+					first = *thread.StartLine - 1
+				}
+				patch := Patch{
+					Message: thread.Body,
+					Patch: buildCommentPatch(filePath, string(content), protocol.Range{
+						Start: protocol.Position{Line: uint32(first)},
+						End:   protocol.Position{Line: uint32(last)},
+					}),
+					CreatedAt:     thread.CreatedAt,
+					UpdatedAt:     thread.CreatedAt,
+					GitHubComment: thread.ID,
+				}
+				patch.recordParticipation(thread.User.Login, ParticipationAuthored)
+				commentFile.Patches = append(commentFile.Patches, patch)
+				idx = len(commentFile.Patches) - 1
+				imported++
+				changed = true
+			}
+			patch := &commentFile.Patches[idx]
+			existing := map[int64]bool{}
+			for _, reply := range patch.Replies {
+				existing[reply.GitHubComment] = true
+			}
+			for _, reply := range replies[thread.ID] {
+				if existing[reply.ID] {
+					continue
+				}
+				patch.Replies = append(patch.Replies, Reply{
+					Message:       reply.Body,
+					Author:        reply.User.Login,
+					CreatedAt:     reply.CreatedAt,
+					UpdatedAt:     reply.CreatedAt,
+					GitHubComment: reply.ID,
+				})
+				patch.UpdatedAt = max(patch.UpdatedAt, reply.CreatedAt)
+				patch.recordParticipation(reply.User.Login, ParticipationReplied)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		storeLog.infof("Import review comments of %s", path)
+		if err := writeCommentFile(commentFilePath, commentFile); err != nil {
+			return imported, err
+		}
+	}
+	return imported, updateCommentsRepoAfterChange()
+}
+
+// Comment or reply of the user waiting for review.submit
+type pendingReviewItem struct {
+	commentFile *CommentFile
+	index       int
+	reply       int // Index of the reply, -1 for the comment itself
+	draft       githubDraftComment
+}
+
+// Sends the verdict of the review with the comments and replies made by the
+// user since the pull request was opened, then ends the review
+func (h *handler) submitReview(ctx context.Context, verdict string, body string) (*ReviewSubmitResult, error) {
+	session := h.review.get()
+	if session == nil {
+		return nil, fmt.Errorf("no review in progress, open a pull request with review.openPullRequest")
+	}
+	event, ok := reviewEvents[verdict]
+	if !ok {
+		return nil, fmt.Errorf("unknown verdict %q, expected approve, requestChanges or comment", verdict)
+	}
+	repoDir := getRepoDirFromDir(session.Dir)
+	if repoDir == "" {
+		return nil, fmt.Errorf("checkout %s of pull request #%d is gone", session.Dir, session.Number)
+	}
+	repo, err := githubRepoOf(ctx, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	files, pending, err := pendingReviewItems(repoDir, session, currentUser(repoDir))
+	if err != nil {
+		return nil, err
+	}
+
+	review := githubReview{CommitID: session.HeadSHA, Body: body, Event: event, Comments: []githubDraftComment{}}
+	for _, item := range pending {
+		if item.reply == -1 {
+			review.Comments = append(review.Comments, item.draft)
+		}
+	}
+	reviewID, err := repo.submitReview(ctx, session.Number, review)
+	if err != nil {
+		return nil, err
+	}
+	result := &ReviewSubmitResult{Review: reviewID}
+	// Remember the ids so that the comments are neither submitted nor
+	// imported again
+	created, err := repo.reviewCommentsOf(ctx, session.Number, reviewID)
+	if err != nil {
+		recordError(fmt.Errorf("error while reading the comments of review %d: %w", reviewID, err))
+	}
+	for _, item := range pending {
+		patch := &item.commentFile.Patches[item.index]
+		if item.reply != -1 {
+			id, err := repo.replyToReviewComment(ctx, session.Number, patch.GitHubComment, item.draft.Body)
+			if err != nil {
+				recordError(fmt.Errorf("error while replying to review comment %d: %w", patch.GitHubComment, err))
+				continue
+			}
+			patch.Replies[item.reply].GitHubComment = id
+			result.Replies++
+			continue
+		}
+		for _, comment := range created {
+			if comment.Path == item.draft.Path && comment.Body == item.draft.Body {
+				patch.GitHubComment = comment.ID
+				break
+			}
+		}
+		result.Comments++
+	}
+	for commentFilePath, submitted := range files {
+		if err := recordSubmittedComments(commentFilePath, submitted); err != nil {
+			return result, err
+		}
+	}
+	h.review.set(nil)
+	logInfof("Submitted review %d of pull request #%d: %d comments, %d replies", reviewID, session.Number, result.Comments, result.Replies)
+	h.notifyCommentsChanged(ctx, ChangeLocal)
+	return result, updateCommentsRepoAfterChange()
+}
+
+// Copies the ids of the submitted comments and replies to the comment file.
+// It is read again under its lock: it may have changed during the requests.
+func recordSubmittedComments(commentFilePath string, submitted *CommentFile) error {
+	unlock, err := lockCommentFile(commentFilePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	commentFile, err := readCommentFile(commentFilePath)
+	if err != nil {
+		return err
+	}
+	patches := map[string]*Patch{}
+	for idx := range commentFile.Patches {
+		patches[commentID(&commentFile.Patches[idx])] = &commentFile.Patches[idx]
+	}
+	for idx := range submitted.Patches {
+		submittedPatch := &submitted.Patches[idx]
+		patch, ok := patches[commentID(submittedPatch)]
+		if !ok {
+			// Deleted meanwhile
+			continue
+		}
+		if patch.GitHubComment == 0 {
+			patch.GitHubComment = submittedPatch.GitHubComment
+		}
+		for _, submittedReply := range submittedPatch.Replies {
+			if submittedReply.GitHubComment == 0 {
+				continue
+			}
+			for replyIdx := range patch.Replies {
+				reply := &patch.Replies[replyIdx]
+				if reply.GitHubComment == 0 && reply.Author == submittedReply.Author &&
+					reply.CreatedAt == submittedReply.CreatedAt && reply.Message == submittedReply.Message {
+					reply.GitHubComment = submittedReply.GitHubComment
+					break
+				}
+			}
+		}
+	}
+	return writeCommentFile(commentFilePath, commentFile)
+}
+
+// Comments and replies of user made during the session, with the comment
+// files holding them
+func pendingReviewItems(repoDir string, session *ReviewSession, user string) (map[string]*CommentFile, []pendingReviewItem, error) {
+	files := map[string]*CommentFile{}
+	pending := []pendingReviewItem{}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		var ranges map[int]protocol.Range
+		found := len(pending)
+		for idx, patch := range commentFile.Patches {
+			if patch.GitHubComment != 0 {
+				for replyIdx, reply := range patch.Replies {
+					if reply.GitHubComment == 0 && reply.Author == user && reply.CreatedAt >= session.StartedAt {
+						pending = append(pending, pendingReviewItem{commentFile: commentFile, index: idx, reply: replyIdx, draft: githubDraftComment{Body: reply.Message}})
+					}
+				}
+				continue
+			}
+			if patch.author() != user || patch.CreatedAt < session.StartedAt || patch.isClosed() {
+				continue
+			}
+			if ranges == nil {
+				ranges = map[int]protocol.Range{}
+				anchored, err := anchorComments(pathToURI(filepath.Join(repoDir, rel)))
+				if err != nil {
+					return err
+				}
+				for _, comment := range anchored {
+					ranges[comment.Index] = comment.Range
+				}
+			}
+			rng, ok := ranges[idx]
+			if !ok {
+				return newCommentError(ErrAnchorFailed, "comment %d of %s cannot be anchored for the review", idx, rel)
+			}
+			draft := githubDraftComment{Path: filepath.ToSlash(rel), Body: patch.Message, Side: "RIGHT", Line: int(rng.End.Line)}
+			if rng.End.Line <= rng.Start.Line {
+				draft.Line = int(rng.Start.Line) + 1
+			} else if rng.End.Line > rng.Start.Line+1 {
+				draft.StartLine = int(rng.Start.Line) + 1
+			}
+			pending = append(pending, pendingReviewItem{commentFile: commentFile, index: idx, reply: -1, draft: draft})
+		}
+		if len(pending) > found {
+			files[commentFilePath] = commentFile
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, pending, nil
+}
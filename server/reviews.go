@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reviews group the comments of a code review round: comment.startReview
+// records the reviewed commits, the comments the author makes until
+// comment.submitReview join the review, and submitting publishes the drafts
+// of the author. Each review is a file of the metadata folder of the comments
+// repository, shared like the comments.
+
+// States of a review
+const (
+	ReviewInProgress = "inProgress"
+	ReviewSubmitted  = "submitted"
+)
+
+type Review struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	// Reviewed changes: from the base commit, when given, to the head commit
+	BaseCommit string `json:"baseCommit,omitempty"`
+	HeadCommit string `json:"headCommit"`
+	// IDs of the comments of the review
+	Comments    []string `json:"comments"`
+	State       string   `json:"state"`
+	CreatedAt   string   `json:"createdAt"` // RFC3339
+	SubmittedAt string   `json:"submittedAt,omitempty"`
+}
+
+func reviewsDir(repoDir string) string {
+	return filepath.Join(commentsDirOf(repoDir), metaDirName, "reviews")
+}
+
+func loadReviews(repoDir string) ([]Review, error) {
+	entries, err := os.ReadDir(reviewsDir(repoDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Review{}, nil
+	}
+	if err != nil {
+		return nil, wrapFileError(err, "error while listing reviews: %w", err)
+	}
+	reviews := []Review{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(reviewsDir(repoDir), entry.Name()))
+		if err != nil {
+			return nil, wrapFileError(err, "error while reading review: %w", err)
+		}
+		var review Review
+		if err := json.Unmarshal(data, &review); err != nil {
+			// A review mangled by a merge does not hide the others
+			recordError(newCommentError(ErrStoreCorrupt, "error while parsing review %s: %w", entry.Name(), err))
+			continue
+		}
+		reviews = append(reviews, review)
+	}
+	sort.Slice(reviews, func(i, j int) bool {
+		return reviews[i].CreatedAt < reviews[j].CreatedAt
+	})
+	return reviews, nil
+}
+
+func saveReview(repoDir string, review *Review) error {
+	data, err := json.MarshalIndent(review, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while serializing review: %v", err)
+	}
+	path := filepath.Join(reviewsDir(repoDir), review.ID+".json")
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return wrapFileError(err, "error while writing review: %w", err)
+	}
+	return nil
+}
+
+// The review user is making, nil when none
+func activeReview(repoDir string, user string) (*Review, error) {
+	reviews, err := loadReviews(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range reviews {
+		if reviews[idx].State == ReviewInProgress && reviews[idx].Author == user {
+			return &reviews[idx], nil
+		}
+	}
+	return nil, nil
+}
+
+// Starts a review of the changes from base, optional, to the current commit
+func startReview(repoDir string, user string, title string, base string) (*Review, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return nil, fmt.Errorf("review title cannot be empty")
+	}
+	if active, err := activeReview(repoDir, user); err != nil {
+		return nil, err
+	} else if active != nil {
+		return nil, fmt.Errorf("review %q is in progress, submit it first", active.Title)
+	}
+	head, err := gitOutput("-C", repoDir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, newCommentError(ErrVCSUnavailable, "error while reading the reviewed commit: %w", err)
+	}
+	if base != "" {
+		output, err := gitOutput("-C", repoDir, "rev-parse", "--verify", base+"^{commit}")
+		if err != nil {
+			return nil, fmt.Errorf("unknown base commit %s: %w", base, err)
+		}
+		base = strings.TrimSpace(string(output))
+	}
+	review := &Review{
+		ID:         newCommentUUID(),
+		Title:      title,
+		Author:     user,
+		BaseCommit: base,
+		HeadCommit: strings.TrimSpace(string(head)),
+		Comments:   []string{},
+		State:      ReviewInProgress,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := saveReview(repoDir, review); err != nil {
+		return nil, err
+	}
+	return review, updateCommentsRepoAfterChange()
+}
+
+// Adds a new comment of user to the review they are making, if any
+func addToActiveReview(repoDir string, user string, id string) error {
+	review, err := activeReview(repoDir, user)
+	if err != nil || review == nil {
+		return err
+	}
+	review.Comments = append(review.Comments, id)
+	return saveReview(repoDir, review)
+}
+
+// Submits the review user is making and publishes their drafts
+func submitLocalReview(ctx context.Context, repoDir string, user string) (*Review, error) {
+	review, err := activeReview(repoDir, user)
+	if err != nil {
+		return nil, err
+	}
+	if review == nil {
+		return nil, fmt.Errorf("no review in progress, start one with comment.startReview")
+	}
+	if _, err := publishDrafts(ctx, repoDir, user); err != nil {
+		return nil, err
+	}
+	review.State = ReviewSubmitted
+	review.SubmittedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := saveReview(repoDir, review); err != nil {
+		return nil, err
+	}
+	return review, updateCommentsRepoAfterChange()
+}
+
+// Comment IDs of the review id, for comment/list
+func reviewComments(repoDir string, id string) ([]string, error) {
+	reviews, err := loadReviews(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	index := slices.IndexFunc(reviews, func(review Review) bool { return review.ID == id })
+	if index < 0 {
+		return nil, fmt.Errorf("no review %s", id)
+	}
+	return reviews[index].Comments, nil
+}
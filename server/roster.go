@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Team members sharing the comments, stored in the metadata folder of the
+// comments repository so that everyone sees who is away.
+type Roster struct {
+	Members []RosterMember `json:"members"`
+}
+
+type RosterMember struct {
+	User      string `json:"user"` // Same identity as the comment participants
+	Away      bool   `json:"away,omitempty"`
+	AwayUntil string `json:"awayUntil,omitempty"` // YYYY-MM-DD, away until the end of this day
+	Backup    string `json:"backup,omitempty"`    // Receives assignments and mentions when away
+}
+
+func rosterFilePath(repoDir string) string {
+	return filepath.Join(commentsDirOf(repoDir), metaDirName, "roster.json")
+}
+
+func loadRoster(repoDir string) (*Roster, error) {
+	data, err := os.ReadFile(rosterFilePath(repoDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Roster{}, nil
+	}
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading roster: %w", err)
+	}
+	var roster Roster
+	if err := json.Unmarshal(data, &roster); err != nil {
+		return nil, newCommentError(ErrStoreCorrupt, "error while parsing roster: %w", err)
+	}
+	return &roster, nil
+}
+
+func saveRoster(repoDir string, roster *Roster) error {
+	data, err := json.MarshalIndent(roster, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while serializing roster: %v", err)
+	}
+	path := rosterFilePath(repoDir)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return wrapFileError(err, "error while writing roster: %w", err)
+	}
+	return nil
+}
+
+// Finds a member by identity, or by handle (user name or email local part)
+func (roster *Roster) find(user string) *RosterMember {
+	user = strings.TrimPrefix(user, "@")
+	for idx := range roster.Members {
+		member := &roster.Members[idx]
+		if strings.EqualFold(member.User, user) || strings.EqualFold(member.handle(), user) {
+			return member
+		}
+	}
+	return nil
+}
+
+// Whether someone, an identity or a handle as typed in mentions, designates
+// user
+func sameUser(someone string, user string) bool {
+	someone = strings.TrimPrefix(someone, "@")
+	if someone == "" || user == "" {
+		return false
+	}
+	handle, _, _ := strings.Cut(user, "@")
+	return strings.EqualFold(someone, user) || strings.EqualFold(someone, handle)
+}
+
+func (member *RosterMember) handle() string {
+	handle, _, _ := strings.Cut(member.User, "@")
+	return handle
+}
+
+func (member *RosterMember) isAway(now time.Time) bool {
+	if !member.Away {
+		return false
+	}
+	if member.AwayUntil == "" {
+		return true
+	}
+	until, err := time.ParseInLocation("2006-01-02", member.AwayUntil, now.Location())
+	if err != nil {
+		return true
+	}
+	return now.Before(until.AddDate(0, 0, 1))
+}
+
+// Returns who should receive work meant for user: user itself, or its backup
+// (and the backup's backup...) while it is away.
+func (roster *Roster) route(user string, now time.Time) string {
+	visited := map[string]bool{}
+	for {
+		member := roster.find(user)
+		if member == nil || !member.isAway(now) || member.Backup == "" || visited[member.User] {
+			return user
+		}
+		visited[member.User] = true
+		logInfof("%s is away, route to %s", user, member.Backup)
+		user = member.Backup
+	}
+}
+
+// Sets the away status of user, adding it to the roster if needed
+func (roster *Roster) setAway(user string, away bool, backup string, until string) {
+	member := roster.find(user)
+	if member == nil {
+		roster.Members = append(roster.Members, RosterMember{User: user})
+		member = &roster.Members[len(roster.Members)-1]
+	}
+	member.Away = away
+	member.AwayUntil = until
+	if backup != "" {
+		member.Backup = backup
+	}
+}
+
+var mentionRegexp = regexp.MustCompile(`(?:^|\s)@([\w.+-]+(?:@[\w-]+(?:\.[\w-]+)+)?)`)
+
+// Returns the users mentioned with @user in a message
+func parseMentions(message string) []string {
+	mentions := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionRegexp.FindAllStringSubmatch(message, -1) {
+		mention := strings.TrimRight(match[1], ".")
+		if !seen[mention] {
+			seen[mention] = true
+			mentions = append(mentions, mention)
+		}
+	}
+	return mentions
+}
+
+type MentionNotification struct {
+	User      string `json:"user"`
+	Mentioned string `json:"mentioned"` // Differs from User when routed to a backup
+	Author    string `json:"author"`
+	Path      string `json:"path"`
+	Message   string `json:"message"`
+}
+
+// Sends a webhook notification to every user mentioned in a new comment
+func notifyMentions(repoDir string, author string, path string, message string) {
+	mentions := parseMentions(message)
+	if len(mentions) == 0 {
+		return
+	}
+	roster, err := loadRoster(repoDir)
+	if err != nil {
+		recordError(err)
+		roster = &Roster{}
+	}
+	now := time.Now()
+	for _, mention := range mentions {
+		notifyWebhook("comment.mentioned", MentionNotification{
+			User:      roster.route(mention, now),
+			Mentioned: mention,
+			Author:    author,
+			Path:      path,
+			Message:   message,
+		})
+	}
+}
+
+// Updates the away status of the local user in the workspace roster
+func (h *handler) setAway(away bool, backup string, until string) error {
+	if until != "" {
+		if _, err := time.Parse("2006-01-02", until); err != nil {
+			return fmt.Errorf("invalid away end date %q, expected YYYY-MM-DD", until)
+		}
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return fmt.Errorf("workspace is not a git repository")
+	}
+	user := currentUser(repoDir)
+	if user == "" {
+		return newCommentError(ErrVCSUnavailable, "no git user configured")
+	}
+	roster, err := loadRoster(repoDir)
+	if err != nil {
+		return err
+	}
+	roster.setAway(user, away, backup, until)
+	return saveRoster(repoDir, roster)
+}
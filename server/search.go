@@ -0,0 +1,177 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+type SearchOptions struct {
+	// Also search the archive bundles, decompressed while reading
+	IncludeArchived bool `json:"includeArchived,omitempty"`
+}
+
+type SearchResult struct {
+	URI      protocol.DocumentURI `json:"uri"`
+	Path     string               `json:"path"` // Relative to the repository
+	Index    int                  `json:"index"`
+	ID       string               `json:"id"`
+	Message  string               `json:"message"`
+	State    string               `json:"state,omitempty"`
+	Priority string               `json:"priority,omitempty"`
+	// Bundle holding the comment when it is archived
+	Archived bool   `json:"archived,omitempty"`
+	Bundle   string `json:"bundle,omitempty"`
+}
+
+// Parses the arguments of comment.search: the query, then either an options
+// object or command line like flags ("--include-archived").
+func parseSearchArguments(arguments []interface{}) (string, SearchOptions, error) {
+	var options SearchOptions
+	if len(arguments) < 1 {
+		return "", options, fmt.Errorf("invalid arguments count")
+	}
+	query, ok := arguments[0].(string)
+	if !ok {
+		return "", options, fmt.Errorf("invalid argument type for query")
+	}
+	for _, argument := range arguments[1:] {
+		switch argument := argument.(type) {
+		case string:
+			if argument != "--include-archived" {
+				return "", options, fmt.Errorf("unknown search flag %s", argument)
+			}
+			options.IncludeArchived = true
+		case map[string]interface{}:
+			data, _ := json.Marshal(argument)
+			if err := json.Unmarshal(data, &options); err != nil {
+				return "", options, fmt.Errorf("invalid search options")
+			}
+		default:
+			return "", options, fmt.Errorf("invalid argument type for search options")
+		}
+	}
+	return query, options, nil
+}
+
+func commentMatches(patch *Patch, query string) bool {
+	if strings.Contains(strings.ToLower(patch.Message), query) {
+		return true
+	}
+	for _, reply := range patch.Replies {
+		if strings.Contains(strings.ToLower(reply.Message), query) {
+			return true
+		}
+	}
+	for _, label := range patch.Labels {
+		if strings.EqualFold(label, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// Searches the comments of the workspace containing query (case insensitive)
+func searchComments(ctx context.Context, repoDir string, query string, options SearchOptions) ([]SearchResult, error) {
+	query = strings.ToLower(query)
+	results := []SearchResult{}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		for idx := range commentFile.Patches {
+			patch := &commentFile.Patches[idx]
+			if !commentMatches(patch, query) {
+				continue
+			}
+			results = append(results, SearchResult{
+				URI:      pathToURI(filepath.Join(repoDir, rel)),
+				Path:     filepath.ToSlash(rel),
+				Index:    idx,
+				ID:       commentID(patch),
+				Message:  patch.Message,
+				State:    patch.State,
+				Priority: patch.Priority,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing comment files: %v", err)
+	}
+	if !options.IncludeArchived {
+		return results, nil
+	}
+
+	bundles, err := filepath.Glob(filepath.Join(archiveDir(repoDir), "*.jsonl.gz"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(bundles)
+	for _, bundle := range bundles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		err := readArchiveBundle(bundle, func(index int, archived ArchivedComment) {
+			if !commentMatches(&archived.Comment, query) {
+				return
+			}
+			results = append(results, SearchResult{
+				URI:      pathToURI(filepath.Join(repoDir, filepath.FromSlash(archived.Path))),
+				Path:     archived.Path,
+				Index:    index,
+				ID:       commentID(&archived.Comment),
+				Message:  archived.Comment.Message,
+				State:    archived.Comment.State,
+				Priority: archived.Comment.Priority,
+				Archived: true,
+				Bundle:   filepath.Base(bundle),
+			})
+		})
+		if err != nil {
+			recordError(err)
+		}
+	}
+	return results, nil
+}
+
+// Streams the comments of an archive bundle to fn, without loading the
+// whole bundle in memory. index is the position of the comment in the bundle.
+func readArchiveBundle(bundlePath string, fn func(index int, archived ArchivedComment)) error {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return wrapFileError(err, "error while opening archive bundle: %w", err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return newCommentError(ErrStoreCorrupt, "invalid archive bundle %s: %w", bundlePath, err)
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	for index := 0; ; index++ {
+		var archived ArchivedComment
+		err := decoder.Decode(&archived)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return newCommentError(ErrStoreCorrupt, "invalid archive bundle %s: %w", bundlePath, err)
+		}
+		fn(index, archived)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// go.lsp.dev/protocol has no legend in its SemanticTokensOptions
+type semanticTokensOptions struct {
+	Legend protocol.SemanticTokensLegend `json:"legend"`
+	Full   bool                          `json:"full"`
+}
+
+// Token type of the commented lines, declared in the package.json of the
+// extension so that themes can tint them
+const commentedCodeTokenType = "commentedCode"
+
+// Modifiers of the commented lines, by bit
+const (
+	resolvedTokenModifier = 1 << iota
+)
+
+var semanticTokensLegend = protocol.SemanticTokensLegend{
+	TokenTypes:     []protocol.SemanticTokenTypes{commentedCodeTokenType},
+	TokenModifiers: []protocol.SemanticTokenModifiers{"resolved"},
+}
+
+// Lines covered by a comment range. The end is exclusive when at the start of
+// a line.
+func commentedLines(rng protocol.Range) (uint32, uint32) {
+	last := rng.End.Line
+	if rng.End.Character == 0 && last > rng.Start.Line {
+		last--
+	}
+	return rng.Start.Line, last
+}
+
+// One token per commented line, with the resolved modifier when all the
+// comments of the line are resolved.
+func semanticTokens(uri protocol.DocumentURI) (*protocol.SemanticTokens, error) {
+	tokens := &protocol.SemanticTokens{Data: []uint32{}}
+	comments, err := anchorComments(uri)
+	if err != nil {
+		anchorLog.debugf("No comment tokens for %s: %v", uri, err)
+		return tokens, nil
+	}
+	content, err := readSourceFile(uriToPath(uri))
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading file: %w", err)
+	}
+	lines := strings.Split(string(content), "\n")
+
+	// Modifiers by line, open comments win over resolved ones
+	modifiers := make([]int, len(lines))
+	for idx := range modifiers {
+		modifiers[idx] = -1
+	}
+	for _, comment := range comments {
+		first, last := commentedLines(comment.Range)
+		for line := first; line <= last && int(line) < len(lines); line++ {
+			if !comment.Patch.isClosed() {
+				modifiers[line] = 0
+			} else if modifiers[line] == -1 {
+				modifiers[line] = resolvedTokenModifier
+			}
+		}
+	}
+
+	previousLine := 0
+	for line, modifier := range modifiers {
+		if modifier == -1 {
+			continue
+		}
+		length := encodedLength(strings.TrimRight(lines[line], "\r"))
+		if length == 0 {
+			continue
+		}
+		// Relative line, start character, length, type, modifiers
+		tokens.Data = append(tokens.Data, uint32(line-previousLine), 0, uint32(length), 0, uint32(modifier))
+		previousLine = line
+	}
+	return tokens, nil
+}
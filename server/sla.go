@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comments with Label must be acknowledged (viewed or replied to by someone
+// else than their author) within the given delay.
+type SLARule struct {
+	Label        string `json:"label"`
+	BusinessDays int    `json:"businessDays,omitempty"`
+	Hours        int    `json:"hours,omitempty"`
+}
+
+const slaCheckInterval = 15 * time.Minute
+
+func (rule SLARule) deadline(created time.Time) time.Time {
+	deadline := created.Add(time.Duration(rule.Hours) * time.Hour)
+	for days := rule.BusinessDays; days > 0; {
+		deadline = deadline.AddDate(0, 0, 1)
+		if deadline.Weekday() != time.Saturday && deadline.Weekday() != time.Sunday {
+			days--
+		}
+	}
+	return deadline
+}
+
+// Returns the earliest deadline among the rules matching the comment labels
+func (patch *Patch) slaDeadline(rules []SLARule) (time.Time, string, bool) {
+	created, err := time.Parse(time.RFC3339, patch.CreatedAt)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	var deadline time.Time
+	label := ""
+	for _, rule := range rules {
+		if !patch.hasLabel(rule.Label) {
+			continue
+		}
+		if ruleDeadline := rule.deadline(created); label == "" || ruleDeadline.Before(deadline) {
+			deadline = ruleDeadline
+			label = rule.Label
+		}
+	}
+	return deadline, label, label != ""
+}
+
+// Time of the first acknowledgement by someone else than the authors
+func (patch *Patch) acknowledgedAt() (time.Time, bool) {
+	var first time.Time
+	acknowledged := false
+	for _, participation := range patch.Participants {
+		if participation.Authored {
+			continue
+		}
+		if participation.Replied && participation.ViewedAt == "" {
+			return time.Time{}, true
+		}
+		viewed, err := time.Parse(time.RFC3339, participation.ViewedAt)
+		if err != nil {
+			continue
+		}
+		if !acknowledged || viewed.Before(first) {
+			first = viewed
+			acknowledged = true
+		}
+	}
+	return first, acknowledged
+}
+
+func (patch *Patch) slaBreached(now time.Time, rules []SLARule) (string, time.Time, bool) {
+	deadline, label, ok := patch.slaDeadline(rules)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	acknowledged, ok := patch.acknowledgedAt()
+	if ok {
+		return label, deadline, !acknowledged.IsZero() && acknowledged.After(deadline)
+	}
+	return label, deadline, now.After(deadline)
+}
+
+type SLABreach struct {
+	URI      protocol.DocumentURI `json:"uri"`
+	Index    int                  `json:"index"`
+	ID       string               `json:"id"`
+	Message  string               `json:"message"`
+	Label    string               `json:"label"`
+	Deadline string               `json:"deadline"`
+}
+
+// Lists the comments of the workspace that missed their SLA. New breaches are
+// marked in their comment file and sent to the webhook when mark is set.
+func (h *handler) checkSLAs(mark bool) ([]SLABreach, error) {
+	breaches := []SLABreach{}
+	rules := getSettings().SLAs
+	if len(rules) == 0 {
+		return breaches, nil
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return breaches, nil
+	}
+	now := time.Now()
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		if mark {
+			unlock, err := lockCommentFile(commentFilePath)
+			if err != nil {
+				recordError(err)
+				return nil
+			}
+			defer unlock()
+		}
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		uri := pathToURI(filepath.Join(repoDir, rel))
+		changed := false
+		for idx := range commentFile.Patches {
+			patch := &commentFile.Patches[idx]
+			label, deadline, breached := patch.slaBreached(now, rules)
+			if !breached {
+				continue
+			}
+			breach := SLABreach{
+				URI:      uri,
+				Index:    idx,
+				ID:       commentID(patch),
+				Message:  patch.Message,
+				Label:    label,
+				Deadline: deadline.UTC().Format(time.RFC3339),
+			}
+			breaches = append(breaches, breach)
+			if mark && patch.SLABreachedAt == "" {
+				patch.SLABreachedAt = now.UTC().Format(time.RFC3339)
+				changed = true
+				logInfof("SLA breached for comment %d of %s (%s)", idx, rel, label)
+				notifyWebhook("sla.breached", breach)
+			}
+		}
+		if changed {
+			// Open documents are refreshed by the comments watcher
+			if err := writeCommentFile(commentFilePath, commentFile); err != nil {
+				recordError(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing comment files: %v", err)
+	}
+	return breaches, nil
+}
+
+// Checks the SLAs until ctx is done
+func (h *handler) runSLAChecker(ctx context.Context) {
+	ticker := time.NewTicker(slaCheckInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := h.checkSLAs(true); err != nil {
+			recordError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Breached comments, and comments assigned to the user, are displayed one
+// level above the configured severity
+func escalateSeverity(severity protocol.DiagnosticSeverity) protocol.DiagnosticSeverity {
+	if severity > protocol.DiagnosticSeverityError {
+		return severity - 1
+	}
+	return severity
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comment files are persisted by a CommentStore, addressed by the paths of
+// getCommentFilePath whatever the backend. Sections of notebooks are read and
+// written as parts of their comment file, above the store.
+
+type CommentStore interface {
+	// The comment file at path, an error wrapping os.ErrNotExist when there
+	// is none
+	Get(path string) (*CommentFile, error)
+	Put(path string, commentFile *CommentFile) error
+	// Calls fn for every comment file under dir, with the path of the
+	// commented source file relative to dir
+	List(dir string, fn func(path string, rel string) error) error
+	Delete(path string) error
+	// Calls fn with the comment files changed under dir by others, until ctx
+	// is done
+	Watch(ctx context.Context, dir string, fn func(paths []string)) error
+}
+
+var commentStoreMutex sync.RWMutex
+var commentStore CommentStore = fileStore{}
+
+// Replaced once a trusted workspace uses a comment server, see
+// useCommentServer
+func getCommentStore() CommentStore {
+	commentStoreMutex.RLock()
+	defer commentStoreMutex.RUnlock()
+	return commentStore
+}
+
+func setCommentStore(store CommentStore) {
+	commentStoreMutex.Lock()
+	defer commentStoreMutex.Unlock()
+	commentStore = store
+}
+
+// Whether the store holds a comment file at path, even a corrupt one
+func commentFileExists(path string) bool {
+	_, err := getCommentStore().Get(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// Formats of the comment files
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+func validateStorageFormat(format string) error {
+	if format != "" && format != FormatJSON && format != FormatYAML {
+		return fmt.Errorf("unknown storage format %q, expected json or yaml", format)
+	}
+	return nil
+}
+
+// Extension of the comment files written with the settings
+func commentFileExtension(current Settings) string {
+	if current.StorageFormat == FormatYAML {
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// Path addressing the comment file stored at path, in either format
+func commentFileKey(path string) string {
+	if yamlPath, ok := strings.CutSuffix(path, ".yaml"); ok {
+		return yamlPath + ".json"
+	}
+	return path
+}
+
+// File holding the comment file addressed by path, the JSON one unless only
+// the YAML one exists
+func storedCommentFilePath(path string) string {
+	yamlPath, ok := strings.CutSuffix(path, ".json")
+	if !ok {
+		return path
+	}
+	yamlPath += ".yaml"
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(yamlPath); err == nil {
+			return yamlPath
+		}
+	}
+	return path
+}
+
+// Whether the data is a YAML comment file rather than a JSON one
+func isYAMLCommentFile(data []byte) bool {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\ufeff")))
+	return len(trimmed) > 0 && trimmed[0] != '{'
+}
+
+// One file per source file in the comments folder, JSON or YAML following
+// the storageFormat setting. Files of either format are read, and converted
+// when written.
+type fileStore struct{}
+
+func (fileStore) Get(path string) (*CommentFile, error) {
+	storedPath := storedCommentFilePath(path)
+	data, err := os.ReadFile(storedPath)
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading comment file: %w", err)
+	}
+	if isYAMLCommentFile(data) {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, newCommentError(ErrStoreCorrupt, "error while parsing comment file %s: %w", storedPath, err)
+		}
+	}
+	var commentFile CommentFile
+	err = json.Unmarshal(data, &commentFile)
+	if err != nil {
+		return nil, newCommentError(ErrStoreCorrupt, "error while parsing comment file %s: %w", storedPath, err)
+	}
+	if err := decodePatchBlobs(&commentFile); err != nil {
+		return nil, newCommentError(ErrStoreCorrupt, "error while reading patches of %s: %w", path, err)
+	}
+	return &commentFile, nil
+}
+
+func (fileStore) Put(path string, commentFile *CommentFile) error {
+	storedPath, replacedPath, asYAML := path, "", false
+	if jsonPath, ok := strings.CutSuffix(path, ".json"); ok {
+		asYAML = getSettings().StorageFormat == FormatYAML
+		storedPath, replacedPath = path, jsonPath+".yaml"
+		if asYAML {
+			storedPath, replacedPath = replacedPath, storedPath
+		}
+	} else if existing, err := os.ReadFile(path); err == nil {
+		// Files of the merge driver keep their format
+		asYAML = isYAMLCommentFile(existing)
+	}
+	// YAML files are read for their patches, kept inline
+	stored := commentFile
+	if !asYAML {
+		stored = encodePatchBlobs(commentFile)
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while serializing comment file: %v", err)
+	}
+	if asYAML {
+		if data, err = jsonToYAML(data); err != nil {
+			return fmt.Errorf("error while serializing comment file: %v", err)
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(storedPath), fs.ModePerm)
+	if err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	err = writeFileAtomic(storedPath, data)
+	if err != nil {
+		return wrapFileError(err, "error while writing comment file: %w", err)
+	}
+	// Converted from the other format
+	if replacedPath != "" {
+		if err := os.Remove(replacedPath); err != nil && !os.IsNotExist(err) {
+			return wrapFileError(err, "error while removing comment file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (fileStore) List(dir string, fn func(path string, rel string) error) error {
+	seen := map[string]bool{}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || d.Name() == metaDirName {
+				return filepath.SkipDir
+			}
+			if filepath.Dir(path) == filepath.Clean(dir) && d.Name() == attachmentsDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".json") && !strings.HasSuffix(path, ".yaml") {
+			return nil
+		}
+		// A file converted by another process may still have both formats
+		path = commentFileKey(path)
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		rel, err := filepath.Rel(dir, strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			return err
+		}
+		return fn(path, rel)
+	})
+}
+
+func (fileStore) Delete(path string) error {
+	if err := os.Remove(storedCommentFilePath(path)); err != nil {
+		return wrapFileError(err, "error while removing comment file: %w", err)
+	}
+	if yamlPath, ok := strings.CutSuffix(path, ".json"); ok {
+		os.Remove(yamlPath + ".yaml")
+	}
+	return nil
+}
+
+// The client watches the comment files, see registerCommentsWatcher
+func (fileStore) Watch(ctx context.Context, dir string, fn func(paths []string)) error {
+	return nil
+}
+
+// Publishes the changes of the comment files the store reports
+func (h *handler) watchCommentStore(ctx context.Context, commentsDir string) {
+	err := getCommentStore().Watch(ctx, commentsDir, func(paths []string) {
+		changes := make([]*protocol.FileEvent, len(paths))
+		for idx, path := range paths {
+			changes[idx] = &protocol.FileEvent{URI: pathToURI(path), Type: protocol.FileChangeTypeChanged}
+		}
+		h.commentFilesChanged(ctx, changes)
+	})
+	if err != nil {
+		recordError(fmt.Errorf("error while watching comments: %w", err))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Sets the storage format until the end of the test
+func withStorageFormat(t *testing.T, format string) {
+	t.Helper()
+	previous := getSettings()
+	t.Cleanup(func() { setSettings(previous) })
+	current := getSettings()
+	current.StorageFormat = format
+	setSettings(current)
+}
+
+func TestFileStorePutGet(t *testing.T) {
+	commentFile := &CommentFile{Version: commentFileVersion, Commit: "abc", Patches: []Patch{
+		{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "Why?\n  Because.\n", Patch: testPatch},
+	}}
+	tests := []struct {
+		name string
+		// Format of the file already stored, none when empty
+		previous string
+		format   string
+		wantFile string
+		wantGone string
+	}{
+		{name: "json", format: FormatJSON, wantFile: "main.go.json", wantGone: "main.go.yaml"},
+		{name: "yaml", format: FormatYAML, wantFile: "main.go.yaml", wantGone: "main.go.json"},
+		{name: "json to yaml", previous: FormatJSON, format: FormatYAML, wantFile: "main.go.yaml", wantGone: "main.go.json"},
+		{name: "yaml to json", previous: FormatYAML, format: FormatJSON, wantFile: "main.go.json", wantGone: "main.go.yaml"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "main.go.json")
+			if test.previous != "" {
+				withStorageFormat(t, test.previous)
+				if err := (fileStore{}).Put(path, &CommentFile{Version: commentFileVersion, Patches: []Patch{}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			withStorageFormat(t, test.format)
+			if err := (fileStore{}).Put(path, commentFile); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, test.wantFile)); err != nil {
+				t.Errorf("%s not written: %v", test.wantFile, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, test.wantGone)); !os.IsNotExist(err) {
+				t.Errorf("%s still exists: %v", test.wantGone, err)
+			}
+			got, err := (fileStore{}).Get(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, commentFile) {
+				t.Errorf("got %+v, want %+v", got, commentFile)
+			}
+		})
+	}
+}
+
+func TestFileStoreGetErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		wantCode ErrorCode
+		missing  bool
+	}{
+		{name: "missing", missing: true},
+		{name: "invalid json", file: "main.go.json", content: `{"patches": [`, wantCode: ErrStoreCorrupt},
+		{name: "invalid yaml", file: "main.go.yaml", content: "patches:\n  - &anchor\n", wantCode: ErrStoreCorrupt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.file != "" {
+				if err := os.WriteFile(filepath.Join(dir, test.file), []byte(test.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := (fileStore{}).Get(filepath.Join(dir, "main.go.json"))
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if errors.Is(err, os.ErrNotExist) != test.missing {
+				t.Errorf("got %v, want missing %v", err, test.missing)
+			}
+			if code := errorCodeOf(err); code != test.wantCode {
+				t.Errorf("got code %q, want %q", code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestFileStoreList(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"main.go.json",
+		"pkg/util.go.yaml",
+		// Converted by another process, listed once
+		"both.go.json",
+		"both.go.yaml",
+		".lsp-comments/sync.json",
+		"attachments/image.png.json",
+		"pkg/attachments/kept.go.json",
+		".git/config.json",
+		"README.md",
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listed := []string{}
+	err := (fileStore{}).List(dir, func(path string, rel string) error {
+		if want := filepath.Join(dir, rel) + ".json"; path != want {
+			t.Errorf("listed %s as %s, want %s", rel, path, want)
+		}
+		listed = append(listed, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	want := []string{"both.go", "main.go", "pkg/attachments/kept.go", "pkg/util.go"}
+	if !reflect.DeepEqual(listed, want) {
+		t.Errorf("listed %q, want %q", listed, want)
+	}
+}
+
+func TestFileStoreDelete(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{name: "json", files: []string{"main.go.json"}},
+		{name: "yaml", files: []string{"main.go.yaml"}},
+		{name: "both", files: []string{"main.go.json", "main.go.yaml"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := (fileStore{}).Delete(filepath.Join(dir, "main.go.json")); err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range test.files {
+				if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+					t.Errorf("%s still exists: %v", file, err)
+				}
+			}
+			if err := (fileStore{}).Delete(filepath.Join(dir, "main.go.json")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("deleting again gave %v, want a missing file", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Suggestion comments carry the code that should replace the commented lines.
+// The "Apply suggestion" code action has the editor replace them, through
+// workspace/applyEdit so that the change can be undone like any other edit,
+// and resolves the comment.
+
+// The replacement of whole lines ends with a newline, unless it removes them
+func normalizeSuggestion(suggestion string) string {
+	suggestion = strings.ReplaceAll(suggestion, "\r\n", "\n")
+	if suggestion != "" && !strings.HasSuffix(suggestion, "\n") {
+		suggestion += "\n"
+	}
+	return suggestion
+}
+
+// Suggested code in a fenced block of the language of the file, the fence
+// longer than any backtick run of the code
+func suggestionMarkdown(filePath string, suggestion string) string {
+	fence := "```"
+	for strings.Contains(suggestion, fence) {
+		fence += "`"
+	}
+	return fence + languageOfPath(filePath) + "\n" + suggestion + fence
+}
+
+// Asks the client to apply edits to a document. Must not be called from the
+// handler goroutine.
+func (h *handler) applyDocumentEdits(ctx context.Context, label string, uri protocol.DocumentURI, edits []protocol.TextEdit) error {
+	params := protocol.ApplyWorkspaceEditParams{
+		Label: label,
+		Edit: protocol.WorkspaceEdit{
+			Changes: map[protocol.DocumentURI][]protocol.TextEdit{uri: edits},
+		},
+	}
+	var result protocol.ApplyWorkspaceEditResponse
+	if _, err := h.conn.Call(ctx, "workspace/applyEdit", params, &result); err != nil {
+		return fmt.Errorf("error while editing %s: %w", uriToPath(uri), err)
+	}
+	if !result.Applied {
+		return fmt.Errorf("the editor did not apply the edit: %s", result.FailureReason)
+	}
+	return nil
+}
+
+// Replaces the commented lines by the suggestion of the comment, then
+// resolves it. Must not be called from the handler goroutine.
+func (h *handler) applySuggestion(ctx context.Context, uri protocol.DocumentURI, id string) error {
+	comments, err := anchorComments(uri)
+	if err != nil {
+		return err
+	}
+	var comment *anchoredComment
+	for idx := range comments {
+		if commentID(&comments[idx].Patch) == id {
+			comment = &comments[idx]
+		}
+	}
+	if comment == nil {
+		return newCommentError(ErrAnchorFailed, "comment %s cannot be found in the current content", id)
+	}
+	if comment.Patch.Suggestion == nil {
+		return fmt.Errorf("comment %s does not suggest a change", commentID(&comment.Patch))
+	}
+	if comment.Outdated {
+		// The suggestion would overwrite changes it was not made on
+		return fmt.Errorf("the commented code changed since the suggestion")
+	}
+	edit := protocol.TextEdit{Range: comment.Range, NewText: *comment.Patch.Suggestion}
+	if err := h.applyDocumentEdits(ctx, "Apply suggestion", uri, []protocol.TextEdit{edit}); err != nil {
+		return err
+	}
+	if repoDir := getUserRepoDir(uriToPath(uri)); repoDir != "" {
+		relativePath, _ := filepath.Rel(repoDir, uriToPath(uri))
+		auditSuggestion(repoDir, AuditSuggestionApplied, currentUser(repoDir), relativePath, &comment.Patch)
+	}
+	return resolveComment(uri, id)
+}
+
+// Records a suggestion event, counted by the reviewer metrics
+func auditSuggestion(repoDir string, event string, user string, relativePath string, patch *Patch) {
+	err := appendAuditEvent(repoDir, AuditEvent{
+		Event:   event,
+		User:    user,
+		Author:  patch.author(),
+		Path:    filepath.ToSlash(relativePath),
+		Comment: commentID(patch),
+	})
+	if err != nil {
+		recordError(err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"go.lsp.dev/protocol"
+)
+
+// Data of the diagnostic summarizing the comments of a document
+type summaryDiagnosticData struct {
+	Summary bool `json:"summary"`
+	Count   int  `json:"count"`
+}
+
+// Documents showing all their comments although they have more than the
+// summary threshold
+type expandedDocuments struct {
+	documents sync.Map
+}
+
+func (expanded *expandedDocuments) isExpanded(uri protocol.DocumentURI) bool {
+	_, ok := expanded.documents.Load(uri)
+	return ok
+}
+
+func (expanded *expandedDocuments) set(uri protocol.DocumentURI, expand bool) {
+	if expand {
+		expanded.documents.Store(uri, true)
+	} else {
+		expanded.documents.Delete(uri)
+	}
+}
+
+// Returns true when the count comments of a document are shown as a single
+// summary diagnostic
+func (h *handler) summarized(uri protocol.DocumentURI, count int) bool {
+	threshold := getSettings().SummaryThreshold
+	return threshold > 0 && count > threshold && !h.expanded.isExpanded(uri)
+}
+
+// Replaces the diagnostics of a document by a single one when they exceed the
+// summary threshold. It is located on the first comment, with the highest
+// severity of the comments.
+func (h *handler) summarizeDiagnostics(uri protocol.DocumentURI, diagnostics []protocol.Diagnostic) []protocol.Diagnostic {
+	if !h.summarized(uri, len(diagnostics)) {
+		return diagnostics
+	}
+	summary := protocol.Diagnostic{
+		Range:    diagnostics[0].Range,
+		Severity: diagnostics[0].Severity,
+		Message:  fmt.Sprintf("%d review comments — run comment.expand to show all", len(diagnostics)),
+		Data:     summaryDiagnosticData{Summary: true, Count: len(diagnostics)},
+	}
+	for _, diagnostic := range diagnostics[1:] {
+		// Lower values are more severe
+		if diagnostic.Severity < summary.Severity {
+			summary.Severity = diagnostic.Severity
+		}
+	}
+	return []protocol.Diagnostic{summary}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// One symbol per comment of the document, with its replies as children, so
+// the outline of the editor lists the comments.
+func documentSymbols(uri protocol.DocumentURI) []protocol.DocumentSymbol {
+	symbols := []protocol.DocumentSymbol{}
+	comments, err := anchorComments(uri)
+	if err != nil {
+		anchorLog.debugf("No comment symbols for %s: %v", uri, err)
+		return symbols
+	}
+	for _, comment := range comments {
+		symbol := protocol.DocumentSymbol{
+			Name:           symbolName(comment.Patch.Message),
+			Detail:         comment.Patch.author(),
+			Kind:           protocol.SymbolKindString,
+			Range:          comment.Range,
+			SelectionRange: comment.Range,
+		}
+		if comment.Patch.isClosed() {
+			symbol.Tags = []protocol.SymbolTag{protocol.SymbolTagDeprecated}
+		}
+		for _, reply := range comment.Patch.Replies {
+			symbol.Children = append(symbol.Children, protocol.DocumentSymbol{
+				Name:           symbolName(reply.Message),
+				Detail:         reply.Author,
+				Kind:           protocol.SymbolKindString,
+				Range:          comment.Range,
+				SelectionRange: comment.Range,
+			})
+		}
+		symbols = append(symbols, symbol)
+	}
+	return symbols
+}
+
+// Document symbols as a flat list, replies contained in their comment, for
+// the clients that do not show nested symbols
+func flatSymbols(uri protocol.DocumentURI, symbols []protocol.DocumentSymbol) []protocol.SymbolInformation {
+	flat := []protocol.SymbolInformation{}
+	for _, symbol := range symbols {
+		flat = append(flat, protocol.SymbolInformation{
+			Name:     symbol.Name,
+			Kind:     symbol.Kind,
+			Location: protocol.Location{URI: uri, Range: symbol.Range},
+		})
+		for _, child := range symbol.Children {
+			flat = append(flat, protocol.SymbolInformation{
+				Name:          child.Name,
+				Kind:          child.Kind,
+				Location:      protocol.Location{URI: uri, Range: child.Range},
+				ContainerName: symbol.Name,
+			})
+		}
+	}
+	return flat
+}
+
+// Editors reject symbols without name
+func symbolName(message string) string {
+	if name := truncateMessage(message, 60); name != "" {
+		return name
+	}
+	return "(empty comment)"
+}
+
+// Index of the messages of all the comment files of a workspace, refreshed
+// from the files modified since the previous query.
+type commentIndex struct {
+	mutex sync.Mutex
+	files map[string]*indexedFile // By comment file path
+}
+
+type indexedFile struct {
+	modTime    time.Time
+	size       int64
+	sourcePath string
+	comments   []indexedComment
+}
+
+type indexedComment struct {
+	index    int
+	message  string // Message and replies, lower case
+	name     string
+	resolved bool
+}
+
+// Results are cut beyond this count
+const maxWorkspaceSymbols = 500
+
+func newCommentIndex() *commentIndex {
+	return &commentIndex{files: map[string]*indexedFile{}}
+}
+
+func (index *commentIndex) refresh(repoDir string) error {
+	seen := map[string]bool{}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		seen[commentFilePath] = true
+		info, err := os.Stat(storedCommentFilePath(commentFilePath))
+		if err != nil {
+			return nil
+		}
+		if indexed, ok := index.files[commentFilePath]; ok && indexed.modTime.Equal(info.ModTime()) && indexed.size == info.Size() {
+			return nil
+		}
+		commentFile, err := readCommentFile(commentFilePath)
+		if err != nil {
+			recordError(err)
+			return nil
+		}
+		indexed := &indexedFile{modTime: info.ModTime(), size: info.Size(), sourcePath: filepath.Join(repoDir, rel)}
+		for idx, patch := range commentFile.Patches {
+			message := patch.Message
+			for _, reply := range patch.Replies {
+				message += "\n" + reply.Message
+			}
+			indexed.comments = append(indexed.comments, indexedComment{
+				index:    idx,
+				message:  strings.ToLower(message),
+				name:     symbolName(patch.Message),
+				resolved: patch.isClosed(),
+			})
+		}
+		index.files[commentFilePath] = indexed
+		return nil
+	})
+	for commentFilePath := range index.files {
+		if !seen[commentFilePath] {
+			delete(index.files, commentFilePath)
+		}
+	}
+	return err
+}
+
+// Comments of the workspace whose message or replies contain query, located
+// where they are anchored in the current content of their file.
+func (h *handler) workspaceSymbols(ctx context.Context, query string, partial *partialResults) ([]protocol.SymbolInformation, error) {
+	symbols := []protocol.SymbolInformation{}
+	if h.rootPath == "" {
+		return symbols, nil
+	}
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		repoDir = h.rootPath
+	}
+	h.symbolIndex.mutex.Lock()
+	defer h.symbolIndex.mutex.Unlock()
+	if err := h.symbolIndex.refresh(repoDir); err != nil {
+		return nil, fmt.Errorf("error while indexing comments: %w", err)
+	}
+	query = strings.ToLower(query)
+	found := 0
+	for _, indexed := range h.symbolIndex.files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var matches []indexedComment
+		for _, comment := range indexed.comments {
+			if strings.Contains(comment.message, query) {
+				matches = append(matches, comment)
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		// Only the files with matching comments are anchored
+		uri := pathToURI(indexed.sourcePath)
+		anchored, err := anchorComments(uri)
+		if err != nil {
+			anchorLog.debugf("No comment symbols for %s: %v", uri, err)
+			continue
+		}
+		ranges := map[int]protocol.Range{}
+		for _, comment := range anchored {
+			ranges[comment.Index] = comment.Range
+		}
+		container, _ := filepath.Rel(repoDir, indexed.sourcePath)
+		fileSymbols := []protocol.SymbolInformation{}
+		for _, comment := range matches {
+			rng, ok := ranges[comment.index]
+			if !ok {
+				continue
+			}
+			symbol := protocol.SymbolInformation{
+				Name:          comment.name,
+				Kind:          protocol.SymbolKindString,
+				Location:      protocol.Location{URI: uri, Range: rng},
+				ContainerName: filepath.ToSlash(container),
+			}
+			if comment.resolved {
+				symbol.Tags = []protocol.SymbolTag{protocol.SymbolTagDeprecated}
+			}
+			fileSymbols = append(fileSymbols, symbol)
+			if found+len(fileSymbols) == maxWorkspaceSymbols {
+				break
+			}
+		}
+		found += len(fileSymbols)
+		if len(fileSymbols) > 0 && !partial.send(ctx, fileSymbols) {
+			symbols = append(symbols, fileSymbols...)
+		}
+		if found == maxWorkspaceSymbols {
+			break
+		}
+	}
+	return symbols, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Retry interval of the primary comments repository after a failover
+const syncRetryInterval = 5 * time.Minute
+
+// Synchronisation state of the comments repository, for comment/syncStatus
+type SyncStatus struct {
+	// primary, mirror, or local when no comments repository is configured
+	Source   string `json:"source"`
+	ReadOnly bool   `json:"readOnly"`
+	LastSync string `json:"lastSync,omitempty"` // RFC3339
+	Error    string `json:"error,omitempty"`
+	// Last push of the comments to the mirror
+	MirroredAt  string `json:"mirroredAt,omitempty"` // RFC3339
+	MirrorError string `json:"mirrorError,omitempty"`
+}
+
+type syncState struct {
+	mutex  sync.Mutex
+	status SyncStatus
+}
+
+func (state *syncState) get() SyncStatus {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	status := state.status
+	if status.Source == "" {
+		status.Source = "local"
+	}
+	if !isWorkspaceTrusted() {
+		status.ReadOnly = true
+		status.Error = errUntrustedWorkspace.Error()
+	}
+	return status
+}
+
+func (state *syncState) update(fn func(status *SyncStatus)) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	fn(&state.status)
+}
+
+// Commands writing comments, refused while reading from the mirror
+var writingCommands = map[string]bool{
+	"comment.add":                 true,
+	"comment.reply":               true,
+	"comment.edit":                true,
+	"comment.resolve":             true,
+	"comment.setState":            true,
+	"comment.delete":              true,
+	"comment.archive":             true,
+	"comment.repair":              true,
+	"comment.upgrade":             true,
+	"comment.setAway":             true,
+	"comment.moveToChangelist":    true,
+	"comment.setPriority":         true,
+	"comment.setSeverity":         true,
+	"comment.setLabels":           true,
+	"comment.addLocation":         true,
+	"comment.addFromTemplate":     true,
+	"comment.addRange":            true,
+	"comment.publishDrafts":       true,
+	"comment.startReview":         true,
+	"comment.submitReview":        true,
+	"comment.assign":              true,
+	"comment.setDueDate":          true,
+	"comment.setExpiry":           true,
+	"comment.createIssue":         true,
+	"comment.toggleChecklistItem": true,
+	"comment.convertToTodo":       true,
+	"comment.attach":              true,
+	"comment.vote":                true,
+	"comment.applySuggestion":     true,
+	"comment.addReference":        true,
+	"review.openPullRequest":      true,
+	"review.submit":               true,
+}
+
+func (h *handler) checkWritable(command string) error {
+	if writingCommands[command] && !isWorkspaceTrusted() {
+		return newCommentError(ErrPermissionDenied, "comments are read-only until the workspace is trusted")
+	}
+	if status := h.sync.get(); writingCommands[command] && status.ReadOnly {
+		return newCommentError(ErrPermissionDenied, "comments are read-only, the comments repository is unreachable: %s", status.Error)
+	}
+	return nil
+}
+
+// Returns true when the repository at url answers
+func isRemoteReachable(ctx context.Context, repoDir string, url string) bool {
+	return gitSyncCommand(ctx, repoDir, "ls-remote", url, "HEAD").Run() == nil
+}
+
+func (h *handler) primarySynced(repoDir string, commentsDir string) {
+	h.sync.update(func(status *SyncStatus) {
+		status.Source = "primary"
+		status.ReadOnly = false
+		status.LastSync = time.Now().UTC().Format(time.RFC3339)
+		status.Error = ""
+	})
+	if mirrorURL := getSettings().CommentsMirrorURL; mirrorURL != "" {
+		go h.mirrorComments(repoDir, commentsDir, mirrorURL)
+	}
+}
+
+// Reads the comments from the mirror when the primary is unreachable
+func (h *handler) failover(ctx context.Context, repoDir string, commentsDir string, primaryErr error) error {
+	mirrorURL := getSettings().CommentsMirrorURL
+	if mirrorURL == "" {
+		h.sync.update(func(status *SyncStatus) {
+			status.Error = primaryErr.Error()
+		})
+		return primaryErr
+	}
+	syncLog.errorf("Comments repository unreachable, fail over to %s: %v", mirrorURL, primaryErr)
+	var cmd = gitSyncCommand(ctx, repoDir, "-C", commentsDir, "pull", mirrorURL)
+	if _, err := os.Stat(commentsDir); os.IsNotExist(err) {
+		cmd = gitSyncCommand(ctx, repoDir, "clone", mirrorURL, commentsDir)
+	}
+	if err := cmd.Run(); err != nil {
+		h.sync.update(func(status *SyncStatus) {
+			status.Error = primaryErr.Error()
+		})
+		return newCommentError(syncErrorCode(err, ErrSyncConflict), "error while reading comments from mirror %s: %w (%v)", mirrorURL, err, primaryErr)
+	}
+	invalidateCommentIndex(commentsDir)
+	// Pull from the primary again once back
+	if primaryURL := getSettings().CommentsRepoURL; primaryURL != "" {
+		gitSyncCommand(ctx, repoDir, "-C", commentsDir, "remote", "set-url", "origin", primaryURL).Run()
+	}
+	h.sync.update(func(status *SyncStatus) {
+		status.Source = "mirror"
+		status.ReadOnly = true
+		status.LastSync = time.Now().UTC().Format(time.RFC3339)
+		status.Error = primaryErr.Error()
+	})
+	if errorCodeOf(primaryErr) == ErrAuthFailed {
+		// The mirror hides the failure, signing in again is up to the user
+		recordError(primaryErr)
+	}
+	return nil
+}
+
+// Pushes the branches of the comments repository to the mirror
+func (h *handler) mirrorComments(repoDir string, commentsDir string, mirrorURL string) {
+	confirmed := h.mirrorConsent.get(func() bool {
+		return h.confirm(context.Background(), fmt.Sprintf("Overwrite the branches of the comments mirror %s with those of the comments repository? "+
+			"Asked once per session.", mirrorURL))
+	})
+	if !confirmed {
+		h.sync.update(func(status *SyncStatus) {
+			status.MirrorError = "pushing to the mirror was not confirmed"
+		})
+		return
+	}
+	// The mirror is pushed in the background, whatever started the sync
+	cmd := gitSyncCommand(context.Background(), repoDir, "-C", commentsDir, "push", "--force", mirrorURL, "refs/heads/*:refs/heads/*")
+	err := cmd.Run()
+	h.sync.update(func(status *SyncStatus) {
+		if err != nil {
+			status.MirrorError = err.Error()
+			return
+		}
+		status.MirroredAt = time.Now().UTC().Format(time.RFC3339)
+		status.MirrorError = ""
+	})
+	if err != nil {
+		recordError(newCommentError(syncErrorCode(err, ErrSyncConflict), "error while mirroring comments to %s: %w", mirrorURL, err))
+	}
+}
+
+// Retries the primary comments repository while reading from the mirror
+func (h *handler) runSyncRetry(ctx context.Context) {
+	ticker := time.NewTicker(syncRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !h.sync.get().ReadOnly {
+			continue
+		}
+		if err := h.updateCommentsRepo(ctx); err != nil {
+			recordError(fmt.Errorf("error while updating comments: %w", err))
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Teams define comment templates in the metadata folder of the comments
+// repository, e.g.
+//
+//	{ "templates": [{ "name": "security", "title": "Add security comment",
+//	  "body": "Security finding: \n\nImpact: \n\nFix: ",
+//	  "labels": ["security"], "severity": "issue" }] }
+//
+// Each is offered as a code action on selections. Clients prompt for the
+// comment with the body pre-filled and pass the completed body to
+// comment.addFromTemplate, which otherwise creates it with the body as is.
+
+type TemplateFile struct {
+	Templates []CommentTemplate `json:"templates"`
+}
+
+type CommentTemplate struct {
+	Name string `json:"name"`
+	// Title of the code action, "Add <name> comment" when empty
+	Title    string   `json:"title,omitempty"`
+	Body     string   `json:"body"`
+	Labels   []string `json:"labels,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+	Priority string   `json:"priority,omitempty"`
+	// Comment category giving its code action kind, see CommentCategory
+	Category string `json:"category,omitempty"`
+}
+
+func templatesFilePath(repoDir string) string {
+	return filepath.Join(commentsDirOf(repoDir), metaDirName, "templates.json")
+}
+
+func loadTemplates(repoDir string) ([]CommentTemplate, error) {
+	data, err := os.ReadFile(templatesFilePath(repoDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return []CommentTemplate{}, nil
+	}
+	if err != nil {
+		return nil, wrapFileError(err, "error while reading templates: %w", err)
+	}
+	var file TemplateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, newCommentError(ErrStoreCorrupt, "error while parsing templates: %w", err)
+	}
+	templates := []CommentTemplate{}
+	for _, template := range file.Templates {
+		if err := template.validate(); err != nil {
+			// A broken template does not hide the others
+			recordError(newCommentError(ErrStoreCorrupt, "invalid comment template: %w", err))
+			continue
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+func (template CommentTemplate) validate() error {
+	if strings.TrimSpace(template.Name) == "" {
+		return fmt.Errorf("template without name")
+	}
+	if err := validateCommentSeverity(template.Severity); err != nil {
+		return fmt.Errorf("template %s: %w", template.Name, err)
+	}
+	if err := validateCommentPriority(template.Priority); err != nil {
+		return fmt.Errorf("template %s: %w", template.Name, err)
+	}
+	return nil
+}
+
+func (template CommentTemplate) actionTitle() string {
+	if template.Title != "" {
+		return template.Title
+	}
+	return "Add " + template.Name + " comment"
+}
+
+// Options of the comments made from the template
+func (template CommentTemplate) options() CommentOptions {
+	return CommentOptions{
+		Labels:   template.Labels,
+		Severity: template.Severity,
+		Priority: template.Priority,
+	}
+}
+
+// Template of the repository named name
+func findTemplate(repoDir string, name string) (*CommentTemplate, error) {
+	if repoDir == "" {
+		return nil, fmt.Errorf("comment templates are shared in a git repository")
+	}
+	templates, err := loadTemplates(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range templates {
+		if templates[idx].Name == name {
+			return &templates[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("no comment template %q", name)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comment states
+const (
+	StateOpen     = "open"
+	StateResolved = "resolved"
+	StateWontFix  = "wontfix" // Closed without change
+)
+
+// States a comment can go to from each state
+var stateTransitions = map[string][]string{
+	StateOpen:     {StateResolved, StateWontFix},
+	StateResolved: {StateOpen},
+	StateWontFix:  {StateOpen},
+}
+
+// Audit event of the change to each state
+var stateAuditEvents = map[string]string{
+	StateOpen:     AuditCommentReopened,
+	StateResolved: AuditCommentResolved,
+	StateWontFix:  AuditCommentWontFix,
+}
+
+type Reply struct {
+	Message   string `json:"message"`
+	Author    string `json:"author,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"` // RFC3339
+	// Replies cannot be edited yet, it is their creation
+	UpdatedAt string `json:"updatedAt,omitempty"` // RFC3339
+	// Reply of the GitHub review comment thread, see Patch.GitHubComment
+	GitHubComment int64 `json:"githubComment,omitempty"`
+}
+
+func (patch *Patch) state() string {
+	if patch.State == "" {
+		return StateOpen
+	}
+	return patch.State
+}
+
+// Resolved or won't fix
+func (patch *Patch) isClosed() bool {
+	return patch.state() != StateOpen
+}
+
+// Message of a comment followed by its replies
+func threadMessage(patch Patch) string {
+	message := patch.authorLabel() + ": " + plainMarkdown(displayMessage(patch))
+	if patch.GeneratedFrom != "" {
+		message += fmt.Sprintf(" (on generated %s)", patch.GeneratedFrom)
+	}
+	for _, reply := range patch.Replies {
+		author := reply.Author
+		if author == "" {
+			author = "anonymous"
+		}
+		message += fmt.Sprintf("\n↳ %s: %s", author, plainMarkdown(reply.Message))
+	}
+	return message
+}
+
+// Loads the comment file of a document, calls fn on the comment with the
+// given ID and saves the file.
+func updateComment(uri protocol.DocumentURI, id string, fn func(patch *Patch, user string, repoDir string) error) error {
+	filePath := uriToPath(uri)
+	_, repoDir, err := getCommentFilePath(filePath)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDocumentComments(filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return err
+	}
+	index, err := commentIndexIn(commentFile, filePath, id)
+	if err != nil {
+		return err
+	}
+	user := currentUser(filepath.Dir(filePath))
+	if err := fn(&commentFile.Patches[index], user, repoDir); err != nil {
+		return err
+	}
+	commentFile.Patches[index].UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := saveCommentFile(filePath, commentFile); err != nil {
+		return err
+	}
+	return updateCommentsRepoAfterChange()
+}
+
+func replyToComment(uri protocol.DocumentURI, id string, message string) error {
+	if strings.TrimSpace(message) == "" {
+		return fmt.Errorf("reply cannot be empty")
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		now := time.Now().UTC().Format(time.RFC3339)
+		patch.Replies = append(patch.Replies, Reply{
+			Message:   message,
+			Author:    user,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		patch.recordParticipation(user, ParticipationReplied)
+		return nil
+	})
+}
+
+func resolveComment(uri protocol.DocumentURI, id string) error {
+	return setCommentState(uri, id, StateResolved)
+}
+
+// Moves a comment to state, if its current state allows it
+func setCommentState(uri protocol.DocumentURI, id string, state string) error {
+	if _, ok := stateTransitions[state]; !ok {
+		return fmt.Errorf("unknown state %q", state)
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if !slices.Contains(stateTransitions[patch.state()], state) {
+			return fmt.Errorf("comment %s is %s, it cannot become %s", id, patch.state(), state)
+		}
+		patch.State = state
+		patch.ResolvedAt = ""
+		if patch.isClosed() {
+			patch.ResolvedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+		if repoDir == "" || patch.isPrivate() {
+			return nil
+		}
+		event := AuditEvent{
+			Event:   stateAuditEvents[state],
+			User:    user,
+			Author:  patch.author(),
+			Comment: commentID(patch),
+		}
+		relativePath, _ := filepath.Rel(repoDir, uriToPath(uri))
+		event.Path = filepath.ToSlash(relativePath)
+		if deadline, _, ok := patch.slaDeadline(getSettings().SLAs); ok && state == StateResolved {
+			withinSLA := time.Now().Before(deadline)
+			event.WithinSLA = &withinSLA
+		}
+		if err := appendAuditEvent(repoDir, event); err != nil {
+			recordError(err)
+		}
+		return nil
+	})
+}
+
+// Changes the severity of a comment, only its author can
+func setCommentSeverity(uri protocol.DocumentURI, id string, severity string) error {
+	if err := validateCommentSeverity(severity); err != nil {
+		return err
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if author := patch.author(); author != "" && author != user {
+			return newCommentError(ErrPermissionDenied, "only %s, who wrote comment %s, can change its severity", author, id)
+		}
+		patch.Severity = severity
+		return nil
+	})
+}
+
+// Changes the priority of a comment, P0 to P3, none when empty
+func setCommentPriority(uri protocol.DocumentURI, id string, priority string) error {
+	if err := validateCommentPriority(priority); err != nil {
+		return err
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.Priority = priority
+		return nil
+	})
+}
+
+// Free-form labels of a comment, trimmed and without duplicates, in their
+// first spelling
+func normalizeLabels(labels []string) []string {
+	normalized := []string{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || slices.ContainsFunc(normalized, func(other string) bool { return strings.EqualFold(other, label) }) {
+			continue
+		}
+		normalized = append(normalized, label)
+	}
+	return normalized
+}
+
+// Assigns a comment to assignee, or to their backup while they are away.
+// Unassigns it when assignee is empty.
+func assignComment(uri protocol.DocumentURI, id string, assignee string) error {
+	assignee = strings.TrimPrefix(strings.TrimSpace(assignee), "@")
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if assignee == "" || repoDir == "" {
+			patch.Assignee = assignee
+			return nil
+		}
+		roster, err := loadRoster(repoDir)
+		if err != nil {
+			return err
+		}
+		patch.Assignee = roster.route(assignee, time.Now())
+		return nil
+	})
+}
+
+// Replaces the labels of a comment. Labels are triage information, anybody
+// can change them.
+func setCommentLabels(uri protocol.DocumentURI, id string, labels []string) error {
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		patch.Labels = normalizeLabels(labels)
+		return nil
+	})
+}
+
+// Adds a secondary range to a comment, anchored in the current content of
+// its document
+func addCommentRange(uri protocol.DocumentURI, id string, rng protocol.Range) error {
+	filePath := uriToPath(uri)
+	content, err := readSourceFile(filePath)
+	if err != nil {
+		return wrapFileError(err, "error while reading file %s: %w", filePath, err)
+	}
+	patchText := buildCommentPatch(filePath, string(content), rng)
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if patch.GeneratedFrom != "" {
+			return fmt.Errorf("comment %s was made on generated %s, it has no range in this file", id, patch.GeneratedFrom)
+		}
+		if patch.isFileLevel() {
+			return fmt.Errorf("comment %s is about the whole file, it has no range", id)
+		}
+		patch.SecondaryPatches = append(patch.SecondaryPatches, patchText)
+		return nil
+	})
+}
+
+// Replaces the message of a comment, keeping its anchor
+func editComment(uri protocol.DocumentURI, id string, message string) error {
+	if strings.TrimSpace(message) == "" {
+		return fmt.Errorf("comment cannot be empty")
+	}
+	return updateComment(uri, id, func(patch *Patch, user string, repoDir string) error {
+		if message == patch.Message {
+			return nil
+		}
+		patch.recordRevision(user, time.Now())
+		patch.Message = message
+		if repoDir == "" {
+			return nil
+		}
+		relativePath, _ := filepath.Rel(repoDir, uriToPath(uri))
+		err := appendAuditEvent(repoDir, AuditEvent{
+			Event:   AuditCommentEdited,
+			User:    user,
+			Author:  patch.author(),
+			Path:    filepath.ToSlash(relativePath),
+			Comment: commentID(patch),
+		})
+		if err != nil {
+			recordError(err)
+		}
+		return nil
+	})
+}
+
+// Removes a comment from the comment file of a document
+func deleteComment(uri protocol.DocumentURI, id string) error {
+	filePath := uriToPath(uri)
+	_, repoDir, err := getCommentFilePath(filePath)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDocumentComments(filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return err
+	}
+	index, err := commentIndexIn(commentFile, filePath, id)
+	if err != nil {
+		return err
+	}
+	deleted := commentFile.Patches[index]
+	// The file is kept even when empty so that diagnostics get cleared
+	commentFile.Patches = append(commentFile.Patches[:index], commentFile.Patches[index+1:]...)
+	if err := saveCommentFile(filePath, commentFile); err != nil {
+		return err
+	}
+	if repoDir != "" {
+		removeAttachments(repoDir, &deleted)
+	}
+	if repoDir != "" && !deleted.isPrivate() {
+		relativePath, _ := filepath.Rel(repoDir, filePath)
+		err := appendAuditEvent(repoDir, AuditEvent{
+			Event:   AuditCommentDeleted,
+			User:    currentUser(repoDir),
+			Author:  deleted.author(),
+			Path:    filepath.ToSlash(relativePath),
+			Comment: commentID(&deleted),
+		})
+		if err != nil {
+			recordError(err)
+		}
+	}
+	return updateCommentsRepoAfterChange()
+}
+
+// The first participant flagged as author
+func (patch *Patch) author() string {
+	for _, participation := range patch.Participants {
+		if participation.Authored {
+			return participation.User
+		}
+	}
+	return ""
+}
+
+// Author as shown to users: "name <email>", either alone or anonymous
+func (patch *Patch) authorLabel() string {
+	author := patch.author()
+	switch {
+	case patch.AuthorName != "" && author != "":
+		return fmt.Sprintf("%s <%s>", patch.AuthorName, author)
+	case patch.AuthorName != "":
+		return patch.AuthorName
+	case author != "":
+		return author
+	}
+	return "anonymous"
+}
+
+// Parses the [uri, id] arguments of the commands acting on a comment. The
+// ID is resolved by the command once the comment file is loaded.
+func commentArguments(arguments []interface{}) (protocol.DocumentURI, string, error) {
+	if len(arguments) < 2 {
+		return "", "", fmt.Errorf("invalid arguments count")
+	}
+	uriStr, ok := arguments[0].(string)
+	if !ok {
+		return "", "", fmt.Errorf("invalid argument type for URI")
+	}
+	switch comment := arguments[1].(type) {
+	case string:
+		return protocol.DocumentURI(uriStr), comment, nil
+	case float64:
+		// Indexes shift when the comment file is edited concurrently or
+		// merged, the command would act on another comment
+		return "", "", fmt.Errorf("comments are addressed by their id, not their index %v", comment)
+	}
+	return "", "", fmt.Errorf("invalid argument type for comment")
+}
+
+// Index of the comment with the given identifier in a loaded comment file
+func commentIndexIn(commentFile *CommentFile, filePath string, id string) (int, error) {
+	for idx := range commentFile.Patches {
+		if commentID(&commentFile.Patches[idx]) == id {
+			return idx, nil
+		}
+	}
+	return 0, fmt.Errorf("no comment %s in %s", id, filePath)
+}
+
+// Current index in its comment file of the comment with the given identifier
+func commentIndexByID(uri protocol.DocumentURI, id string) (int, error) {
+	filePath := uriToPath(uri)
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return commentIndexIn(commentFile, filePath, id)
+}
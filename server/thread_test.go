@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+func TestCommentArguments(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments []interface{}
+		wantURI   protocol.DocumentURI
+		wantID    string
+		wantErr   bool
+	}{
+		{
+			name:      "uri and id",
+			arguments: []interface{}{"file:///repo/main.go", "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14"},
+			wantURI:   "file:///repo/main.go",
+			wantID:    "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14",
+		},
+		{
+			name:      "extra arguments",
+			arguments: []interface{}{"file:///repo/main.go", "3b8e41f0c2d9", "reply"},
+			wantURI:   "file:///repo/main.go",
+			wantID:    "3b8e41f0c2d9",
+		},
+		{name: "index", arguments: []interface{}{"file:///repo/main.go", float64(2)}, wantErr: true},
+		{name: "missing id", arguments: []interface{}{"file:///repo/main.go"}, wantErr: true},
+		{name: "no arguments", arguments: nil, wantErr: true},
+		{name: "invalid uri", arguments: []interface{}{3.0, "3b8e41f0c2d9"}, wantErr: true},
+		{name: "invalid id", arguments: []interface{}{"file:///repo/main.go", true}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uri, id, err := commentArguments(test.arguments)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if uri != test.wantURI || id != test.wantID {
+				t.Errorf("got %q %q, want %q %q", uri, id, test.wantURI, test.wantID)
+			}
+		})
+	}
+}
+
+func TestCommentIndexIn(t *testing.T) {
+	commentFile := &CommentFile{Patches: []Patch{
+		{ID: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", Message: "First", Patch: testPatch},
+		{Message: "Without ID", Patch: testPatch},
+	}}
+	tests := []struct {
+		name    string
+		id      string
+		want    int
+		wantErr bool
+	}{
+		{name: "stored id", id: "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14", want: 0},
+		{name: "hashed id", id: commentID(&commentFile.Patches[1]), want: 1},
+		{name: "unknown id", id: "3b8e41f0c2d9", wantErr: true},
+		{name: "index", id: "1", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idx, err := commentIndexIn(commentFile, "main.go.json", test.id)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && idx != test.want {
+				t.Errorf("got index %d, want %d", idx, test.want)
+			}
+		})
+	}
+}
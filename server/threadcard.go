@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Compact rendering of a single thread, for the link previews of chat tools
+// and small screens:
+//
+//	/thread?path=src/main.go&id=ce04b5e1e7d3[&format=text][&width=72]
+//
+// The HTML page holds the Open Graph tags read by Slack or Teams to unfurl
+// pasted links, format=text returns the plain text only.
+
+// Default and bounds of the width of the compact rendering, in characters
+const (
+	defaultCardWidth = 72
+	minCardWidth     = 20
+	maxCardWidth     = 200
+)
+
+// Summary line and body of a compact thread rendering
+type threadCard struct {
+	Title string
+	Body  string
+	URL   string
+}
+
+func (viewer *webViewer) serveThread(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	rel := filepath.Clean(filepath.FromSlash(query.Get("path")))
+	if rel == "." || filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	width := defaultCardWidth
+	if value := query.Get("width"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < minCardWidth || parsed > maxCardWidth {
+			http.Error(w, fmt.Sprintf("width must be between %d and %d", minCardWidth, maxCardWidth), http.StatusBadRequest)
+			return
+		}
+		width = parsed
+	}
+	commentFile, err := readCommentFile(filepath.Join(commentsDirOf(viewer.repoDir), rel+".json"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var patch *Patch
+	for idx := range commentFile.Patches {
+		if commentID(&commentFile.Patches[idx]) == query.Get("id") {
+			patch = &commentFile.Patches[idx]
+			break
+		}
+	}
+	if patch == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The permalink is the page itself, without rendering options
+	permalink := url.URL{Scheme: "http", Host: r.Host, Path: "/thread"}
+	permalink.RawQuery = url.Values{"path": {filepath.ToSlash(rel)}, "id": {query.Get("id")}}.Encode()
+	content, _ := os.ReadFile(filepath.Join(viewer.repoDir, rel))
+	card := compactThread(filepath.ToSlash(rel), string(content), patch, width)
+	card.URL = permalink.String()
+
+	if query.Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n\n%s\n\n%s\n", card.Title, card.Body, card.URL)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := threadCardTemplate.Execute(w, card); err != nil {
+		logErrorf("Error while rendering thread card: %v", err)
+	}
+}
+
+// Renders a thread in a few lines of at most width characters: where and by
+// whom, the first commented line, the message and the replies.
+func compactThread(rel string, content string, patch *Patch, width int) threadCard {
+	location := rel
+	excerpt, anchored := codeExcerpt(content, patch.Patch)
+	var code string
+	for _, line := range excerpt {
+		if line.Commented {
+			code = strings.TrimSpace(line.Text)
+			if anchored {
+				location = fmt.Sprintf("%s:%d", rel, line.Number)
+			}
+			break
+		}
+	}
+	author := patch.author()
+	if author == "" {
+		author = "anonymous"
+	}
+	title := truncateWidth(fmt.Sprintf("%s — %s (%s)", location, author, patch.state()), width)
+
+	var body []string
+	if code != "" {
+		body = append(body, truncateWidth("> "+code, width), "")
+	}
+	body = append(body, wrapText(patch.Message, width)...)
+	for _, reply := range patch.Replies {
+		replyAuthor := reply.Author
+		if replyAuthor == "" {
+			replyAuthor = "anonymous"
+		}
+		body = append(body, wrapText(fmt.Sprintf("↳ %s: %s", replyAuthor, reply.Message), width)...)
+	}
+	return threadCard{Title: title, Body: strings.Join(body, "\n")}
+}
+
+func truncateWidth(text string, width int) string {
+	if utf8.RuneCountInString(text) <= width {
+		return text
+	}
+	return string([]rune(text)[:width-1]) + "…"
+}
+
+// Splits text in lines of at most width characters, at spaces when possible
+func wrapText(text string, width int) []string {
+	lines := []string{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for utf8.RuneCountInString(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+			switch {
+			case line == "":
+				line = word
+			case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+var threadCardTemplate = template.Must(template.New("thread").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.Title}}</title>
+<meta property="og:type" content="article">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Body}}">
+<meta property="og:url" content="{{.URL}}">
+<style>
+body { font-family: sans-serif; margin: 1em; color: #222; }
+pre { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<pre>{{.Body}}</pre>
+<p><a href="{{.URL}}">{{.URL}}</a></p>
+</body>
+</html>
+`))
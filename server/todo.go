@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// comment.convertToTodo turns a comment into a TODO of the code, above the
+// commented lines, and resolves it.
+
+// Line comment syntax of the languages of languageExtensions
+var todoSyntax = map[string][2]string{
+	"python":     {"# ", ""},
+	"yaml":       {"# ", ""},
+	"go":         {"// ", ""},
+	"javascript": {"// ", ""},
+	"typescript": {"// ", ""},
+	"java":       {"// ", ""},
+	"rust":       {"// ", ""},
+	"c":          {"// ", ""},
+	"cpp":        {"// ", ""},
+	"markdown":   {"<!-- ", " -->"},
+}
+
+// Line of code holding the TODO of a comment, indented like line
+func todoLine(filePath string, line string, patch *Patch) (string, error) {
+	syntax, ok := todoSyntax[languageOfPath(filePath)]
+	if !ok {
+		return "", fmt.Errorf("no comment syntax known for %s", filepath.Base(filePath))
+	}
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	owner := ""
+	if author := patch.author(); author != "" {
+		handle, _, _ := strings.Cut(author, "@")
+		owner = "(" + handle + ")"
+	}
+	// Only the first line of the message fits the line of code
+	message, _, _ := strings.Cut(plainMarkdown(patch.Message), "\n")
+	return indent + syntax[0] + "TODO" + owner + ": " + strings.TrimSpace(message) + syntax[1] + "\n", nil
+}
+
+// Inserts the TODO of a comment in its document through the client, then
+// resolves the comment. Must not be called from the handler goroutine.
+func (h *handler) convertToTodo(ctx context.Context, uri protocol.DocumentURI, id string) error {
+	comments, err := anchorComments(uri)
+	if err != nil {
+		return err
+	}
+	var comment *anchoredComment
+	for idx := range comments {
+		if commentID(&comments[idx].Patch) == id {
+			comment = &comments[idx]
+		}
+	}
+	if comment == nil {
+		return newCommentError(ErrAnchorFailed, "comment %s cannot be found in the current content", id)
+	}
+	filePath := uriToPath(uri)
+	content, err := readSourceFile(filePath)
+	if err != nil {
+		return wrapFileError(err, "error while reading file %s: %w", filePath, err)
+	}
+	lines := strings.Split(string(content), "\n")
+	line := comment.Range.Start.Line
+	if int(line) >= len(lines) {
+		line = uint32(max(len(lines)-1, 0))
+	}
+	newText, err := todoLine(filePath, strings.TrimRight(lines[line], "\r"), &comment.Patch)
+	if err != nil {
+		return err
+	}
+	start := protocol.Position{Line: line}
+	edit := protocol.TextEdit{Range: protocol.Range{Start: start, End: start}, NewText: newText}
+	if err := h.applyDocumentEdits(ctx, "Convert comment to TODO", uri, []protocol.TextEdit{edit}); err != nil {
+		return err
+	}
+	return resolveComment(uri, id)
+}
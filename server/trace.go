@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.lsp.dev/jsonrpc2"
+	"go.lsp.dev/protocol"
+)
+
+// Trace of the messages exchanged with the client, sent back to it with
+// $/logTrace so that users can follow the protocol from the editor. Set by
+// the trace of initialize, then by $/setTrace.
+
+// The protocol package names it "message", clients send "messages"
+const traceMessages protocol.TraceValue = "messages"
+
+type tracer struct {
+	// Sends $/logTrace without tracing it
+	conn  jsonrpc2.Conn
+	mutex sync.Mutex
+	value protocol.TraceValue
+}
+
+func (t *tracer) set(value protocol.TraceValue) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.value = value
+}
+
+// Returns whether messages are traced, and with their content
+func (t *tracer) level() (bool, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch t.value {
+	case traceMessages, protocol.TraceMessage:
+		return true, false
+	case protocol.TraceVerbose:
+		return true, true
+	}
+	return false, false
+}
+
+// Sends a trace, with the JSON of content in verbose mode
+func (t *tracer) log(message string, label string, content interface{}) {
+	traced, verbose := t.level()
+	if !traced || t.conn == nil {
+		return
+	}
+	params := protocol.LogTraceParams{Message: message}
+	if verbose && content != nil {
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			data = []byte(err.Error())
+		}
+		params.Verbose = protocol.TraceValue(label + ": " + string(data))
+	}
+	// Traces are sent whatever happens to the request they are about
+	t.conn.Notify(context.Background(), protocol.MethodLogTrace, params)
+}
+
+// Traces a request of the client, and its response through the returned
+// replier
+func (t *tracer) traceRequest(reply jsonrpc2.Replier, req jsonrpc2.Request) jsonrpc2.Replier {
+	if traced, _ := t.level(); !traced || req.Method() == protocol.MethodSetTrace {
+		return reply
+	}
+	call, ok := req.(*jsonrpc2.Call)
+	if !ok {
+		t.log(fmt.Sprintf("Received notification '%s'.", req.Method()), "Params", req.Params())
+		return reply
+	}
+	t.log(fmt.Sprintf("Received request '%s - (%v)'.", req.Method(), call.ID()), "Params", req.Params())
+	start := time.Now()
+	return func(ctx context.Context, result interface{}, err error) error {
+		message := fmt.Sprintf("Sending response '%s - (%v)'. Processing request took %dms", req.Method(), call.ID(), time.Since(start).Milliseconds())
+		if err != nil {
+			t.log(message+" with error.", "Error", err.Error())
+		} else {
+			t.log(message+".", "Result", result)
+		}
+		return reply(ctx, result, err)
+	}
+}
+
+// Connection tracing the requests and notifications sent by the server
+type tracingConn struct {
+	jsonrpc2.Conn
+	tracer *tracer
+}
+
+func (c *tracingConn) Call(ctx context.Context, method string, params, result interface{}) (jsonrpc2.ID, error) {
+	c.tracer.log(fmt.Sprintf("Sending request '%s'.", method), "Params", params)
+	start := time.Now()
+	id, err := c.Conn.Call(ctx, method, params, result)
+	message := fmt.Sprintf("Received response '%s - (%v)' in %dms", method, id, time.Since(start).Milliseconds())
+	if err != nil {
+		c.tracer.log(message+" with error.", "Error", err.Error())
+	} else {
+		c.tracer.log(message+".", "Result", result)
+	}
+	return id, err
+}
+
+func (c *tracingConn) Notify(ctx context.Context, method string, params interface{}) error {
+	c.tracer.log(fmt.Sprintf("Sending notification '%s'.", method), "Params", params)
+	return c.Conn.Notify(ctx, method, params)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Translation uses a LibreTranslate compatible endpoint:
+// POST {"q", "source", "target", "format"} -> {"translatedText"}
+
+type translationRequest struct {
+	Q      string `json:"q"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Format string `json:"format"`
+}
+
+type translationResponse struct {
+	TranslatedText string `json:"translatedText"`
+}
+
+type translationKey struct {
+	source string
+	target string
+	text   string
+}
+
+const (
+	// Translations kept, the oldest are dropped first
+	maxTranslations = 1000
+	// Failed translations are not retried before this delay, so that an
+	// unreachable endpoint is not called for every message displayed
+	translationRetryDelay = 5 * time.Minute
+	// Requests sent to the endpoint at the same time
+	translationWorkers = 4
+	// Translations arriving together are shown with a single refresh
+	translationRefreshDelay = 500 * time.Millisecond
+)
+
+type translation struct {
+	text     string
+	failed   bool
+	pending  bool
+	storedAt time.Time
+}
+
+var translationCacheMutex sync.Mutex
+var translationCache = map[translationKey]*translation{}
+
+var translationClient = &http.Client{Timeout: 5 * time.Second}
+
+var translationSlots = make(chan struct{}, translationWorkers)
+
+var translationListenerMutex sync.Mutex
+var translationListener func()
+var translationRefresh *time.Timer
+
+// Sets the function called when translations requested by displayMessage
+// arrive, to display them
+func setTranslationListener(listener func()) {
+	translationListenerMutex.Lock()
+	defer translationListenerMutex.Unlock()
+	translationListener = listener
+}
+
+// Returns the message to display for a comment, translated in the user
+// language when the comment was written in another one and a translation
+// endpoint is configured. Never waits for the endpoint: the original message
+// is returned until the translation arrives, then the listener is called.
+func displayMessage(patch Patch) string {
+	current := getSettings()
+	source := normalizeLanguage(patch.Language)
+	target := normalizeLanguage(current.Language)
+	if source == "" || target == "" || source == target || current.TranslationEndpoint == "" || !isWorkspaceTrusted() {
+		return patch.Message
+	}
+	key := translationKey{source: source, target: target, text: patch.Message}
+	translationCacheMutex.Lock()
+	cached, ok := translationCache[key]
+	if ok && (cached.pending || !cached.failed || time.Since(cached.storedAt) < translationRetryDelay) {
+		translationCacheMutex.Unlock()
+		if cached.pending || cached.failed {
+			return patch.Message
+		}
+		return fmt.Sprintf("%s [translated from %s]", cached.text, source)
+	}
+	storeTranslation(key, &translation{pending: true, storedAt: time.Now()})
+	translationCacheMutex.Unlock()
+	go translateInBackground(current.TranslationEndpoint, key)
+	return patch.Message
+}
+
+// Must be called with the cache locked
+func storeTranslation(key translationKey, entry *translation) {
+	if _, ok := translationCache[key]; !ok && len(translationCache) >= maxTranslations {
+		var oldestKey translationKey
+		var oldest *translation
+		for cachedKey, cached := range translationCache {
+			if !cached.pending && (oldest == nil || cached.storedAt.Before(oldest.storedAt)) {
+				oldestKey, oldest = cachedKey, cached
+			}
+		}
+		if oldest != nil {
+			delete(translationCache, oldestKey)
+		}
+	}
+	translationCache[key] = entry
+}
+
+func translateInBackground(endpoint string, key translationKey) {
+	translationSlots <- struct{}{}
+	translated, err := translate(endpoint, key.source, key.target, key.text)
+	<-translationSlots
+	entry := &translation{text: translated, storedAt: time.Now()}
+	if err != nil {
+		recordError(fmt.Errorf("error while translating comment: %w", err))
+		entry = &translation{failed: true, storedAt: time.Now()}
+	}
+	translationCacheMutex.Lock()
+	storeTranslation(key, entry)
+	translationCacheMutex.Unlock()
+	if err == nil {
+		scheduleTranslationRefresh()
+	}
+}
+
+func scheduleTranslationRefresh() {
+	translationListenerMutex.Lock()
+	defer translationListenerMutex.Unlock()
+	if translationListener == nil || translationRefresh != nil {
+		return
+	}
+	listener := translationListener
+	translationRefresh = time.AfterFunc(translationRefreshDelay, func() {
+		translationListenerMutex.Lock()
+		translationRefresh = nil
+		translationListenerMutex.Unlock()
+		listener()
+	})
+}
+
+func translate(endpoint string, source string, target string, text string) (string, error) {
+	body, err := json.Marshal(translationRequest{Q: text, Source: source, Target: target, Format: "text"})
+	if err != nil {
+		return "", err
+	}
+	resp, err := translationClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("translation endpoint returned %s", resp.Status)
+	}
+	var result translationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid translation response: %v", err)
+	}
+	return result.TranslatedText, nil
+}
+
+// Keeps the primary language subtag: "fr-FR" -> "fr"
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if idx := strings.IndexAny(language, "-_"); idx >= 0 {
+		language = language[:idx]
+	}
+	return language
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"go.lsp.dev/protocol"
+)
+
+// A workspace can come from anywhere: its git configuration and hooks run
+// commands, and its settings may point to any endpoint. Until the user trusts
+// it, the server never runs git nor calls the configured endpoints, and only
+// reads the comment files already there.
+
+// Name of the folder of the user configuration holding the trusted workspaces
+const trustConfigDir = "separate_comments"
+
+const trustAction = "Trust workspace"
+const stayReadOnlyAction = "Stay read-only"
+
+var errUntrustedWorkspace = errors.New("workspace not trusted")
+
+// Subcommands run where the user asked, only the LSP server checks the trust
+// of its workspace
+var workspaceUntrusted atomic.Bool
+
+func isWorkspaceTrusted() bool {
+	return !workspaceUntrusted.Load()
+}
+
+// Repository of dir found without git, for untrusted workspaces
+func findRepoDir(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func trustFilePath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, trustConfigDir, "trusted-workspaces.json"), nil
+}
+
+func loadTrustedWorkspaces() ([]string, error) {
+	path, err := trustFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapFileError(err, "error while reading trusted workspaces: %w", err)
+	}
+	var workspaces []string
+	if err := json.Unmarshal(data, &workspaces); err != nil {
+		return nil, fmt.Errorf("invalid trusted workspaces %s: %v", path, err)
+	}
+	return workspaces, nil
+}
+
+// Workspaces inside a trusted folder are trusted
+func isTrustedFolder(dir string) bool {
+	workspaces, err := loadTrustedWorkspaces()
+	if err != nil {
+		recordError(err)
+		return false
+	}
+	for _, workspace := range workspaces {
+		if rel, err := filepath.Rel(workspace, dir); err == nil && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func saveTrustedFolder(dir string) error {
+	workspaces, err := loadTrustedWorkspaces()
+	if err != nil {
+		return err
+	}
+	path, err := trustFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(append(workspaces, dir), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return wrapFileError(err, "error while creating folders: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return wrapFileError(err, "error while writing trusted workspaces: %w", err)
+	}
+	return nil
+}
+
+// Asks the user to trust the workspace, and starts the work needing git once
+// trusted
+func (h *handler) askWorkspaceTrust(ctx context.Context) {
+	params := protocol.ShowMessageRequestParams{
+		Type: protocol.MessageTypeWarning,
+		Message: fmt.Sprintf("Comments of %s are read-only: git and the configured endpoints are not run in untrusted workspaces. "+
+			"Trust it to synchronise and edit comments?", h.rootPath),
+		Actions: []protocol.MessageActionItem{{Title: trustAction}, {Title: stayReadOnlyAction}},
+	}
+	var chosen *protocol.MessageActionItem
+	if _, err := h.conn.Call(ctx, "window/showMessageRequest", params, &chosen); err != nil || chosen == nil || chosen.Title != trustAction {
+		logInfof("Workspace %s stays untrusted", h.rootPath)
+		return
+	}
+	if err := saveTrustedFolder(h.rootPath); err != nil {
+		// Trusted for this session only
+		recordError(err)
+	}
+	workspaceUntrusted.Store(false)
+	logInfof("Workspace %s trusted", h.rootPath)
+	// The comment folder of the project file may be outside of the repository
+	setSettings(h.withProjectSettings(getSettings()))
+	h.startWorkspace(ctx)
+}
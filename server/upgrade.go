@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.lsp.dev/protocol"
+)
+
+// Comment files of the first versions of the server hold a commit and bare
+// patches: no author, date or schema version. comment.upgrade backfills the
+// authors and dates from the history of the comment files, gives comments of
+// version 2 and older an ID, checks that every comment still anchors and
+// marks the files with the current version. The original files are kept next
+// to the report. Files not upgraded by the command are migrated when read,
+// see migrations.go.
+
+// Schema of the comment files written by this server
+const commentFileVersion = 3
+
+const upgradeAction = "Upgrade"
+const upgradeLaterAction = "Later"
+
+type UpgradeReport struct {
+	DryRun bool `json:"dryRun"`
+	// Copy of the original files and report, none on dry runs
+	Backup string         `json:"backup,omitempty"`
+	Files  []UpgradedFile `json:"files"`
+}
+
+type UpgradedFile struct {
+	Path     string            `json:"path"` // Relative to the comment folder
+	Comments []UpgradedComment `json:"comments"`
+}
+
+type UpgradedComment struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"` // Given by the upgrade
+	// Backfilled from the history of the comment file
+	Author    string `json:"author,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	// Strategy anchoring the comment in the current content
+	Anchor string `json:"anchor,omitempty"`
+	// Why the comment could not be anchored
+	Error string `json:"error,omitempty"`
+}
+
+// Numbers of the report, for the messages shown to the user
+func (report *UpgradeReport) counts() (comments int, unanchored int) {
+	for _, file := range report.Files {
+		for _, comment := range file.Comments {
+			comments++
+			if comment.Error != "" {
+				unanchored++
+			}
+		}
+	}
+	return comments, unanchored
+}
+
+// Comment files of the repository in a previous schema, relative to the
+// comment folder
+func legacyCommentFiles(repoDir string) ([]string, error) {
+	legacy := []string{}
+	err := walkCommentFiles(commentsDirOf(repoDir), func(commentFilePath string, rel string) error {
+		// As stored, reading migrates it
+		commentFile, err := getCommentStore().Get(commentFilePath)
+		if err == nil && commentFile.Version < commentFileVersion {
+			legacy = append(legacy, rel+".json")
+		}
+		return nil
+	})
+	return legacy, err
+}
+
+// Upgrades the comment files of the workspace to the current schema
+func upgradeCommentStore(ctx context.Context, rootPath string, dryRun bool) (*UpgradeReport, error) {
+	repoDir := getRepoDirFromDir(rootPath)
+	if repoDir == "" {
+		return nil, fmt.Errorf("workspace %s is not a git repository", rootPath)
+	}
+	commentsDir := commentsDirOf(repoDir)
+	report := &UpgradeReport{DryRun: dryRun, Files: []UpgradedFile{}}
+	if !dryRun {
+		report.Backup = filepath.Join(commentsDir, metaDirName, "upgrade-"+time.Now().UTC().Format("20060102-150405"))
+	}
+	err := walkCommentFiles(commentsDir, func(commentFilePath string, rel string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !dryRun {
+			unlock, err := lockCommentFile(commentFilePath)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+		}
+		storedPath := storedCommentFilePath(commentFilePath)
+		original, err := os.ReadFile(storedPath)
+		if err != nil {
+			return wrapFileError(err, "error while reading comment file: %w", err)
+		}
+		// As stored, reading migrates it
+		commentFile, err := getCommentStore().Get(commentFilePath)
+		if err != nil {
+			return err
+		}
+		if commentFile.Version >= commentFileVersion {
+			return nil
+		}
+		file := upgradeCommentFile(commentFilePath, filepath.Join(repoDir, rel), commentFile)
+		file.Path = filepath.ToSlash(rel) + ".json"
+		report.Files = append(report.Files, file)
+		if dryRun {
+			return nil
+		}
+		backupPath := filepath.Join(report.Backup, rel+filepath.Ext(storedPath))
+		if err := os.MkdirAll(filepath.Dir(backupPath), os.ModePerm); err != nil {
+			return wrapFileError(err, "error while creating folders: %w", err)
+		}
+		if err := os.WriteFile(backupPath, original, 0644); err != nil {
+			return wrapFileError(err, "error while keeping the original comment file: %w", err)
+		}
+		storeLog.infof("Upgrade %s to version %d", commentFilePath, commentFileVersion)
+		return writeCommentFile(commentFilePath, commentFile)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(report.Files) == 0 {
+		return report, nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error while serializing upgrade report: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(report.Backup, "report.json"), data, 0644); err != nil {
+		return nil, wrapFileError(err, "error while writing upgrade report: %w", err)
+	}
+	return report, updateCommentsRepoAfterChange()
+}
+
+// Backfills the comments of a file and checks their anchors, in place
+func upgradeCommentFile(commentFilePath string, sourcePath string, commentFile *CommentFile) UpgradedFile {
+	file := UpgradedFile{Comments: backfillComments(commentFilePath, commentFile)}
+	content, readErr := os.ReadFile(sourcePath)
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		comment := &file.Comments[idx]
+		if patch.isFileLevel() {
+			comment.Anchor = "file"
+		} else if readErr != nil {
+			comment.Error = fmt.Sprintf("source file cannot be read: %v", readErr)
+		} else if _, strategy, err := anchorPatch(anchorInput{
+			content:   string(content),
+			patchText: patch.Patch,
+			filePath:  sourcePath,
+			commit:    commentFile.Commit,
+		}); err != nil {
+			comment.Error = err.Error()
+		} else {
+			comment.Anchor = strategy
+		}
+	}
+	commentFile.Version = commentFileVersion
+	return file
+}
+
+// Gives the comments of the first layout an ID and backfills their authors
+// and dates from the history of the comment file, in place
+func backfillComments(commentFilePath string, commentFile *CommentFile) []UpgradedComment {
+	given := make([]bool, len(commentFile.Patches))
+	for idx := range commentFile.Patches {
+		given[idx] = commentFile.Patches[idx].ID == ""
+	}
+	// IDs hash the comments as they were before the backfill
+	assignCommentIDs(commentFile)
+	comments := []UpgradedComment{}
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		comment := UpgradedComment{Index: idx}
+		if given[idx] {
+			comment.ID = patch.ID
+		}
+		if patch.author() == "" || patch.CreatedAt == "" {
+			author, createdAt := commentOrigin(commentFilePath, patch.Message)
+			if patch.author() == "" && author != "" {
+				patch.recordParticipation(author, ParticipationAuthored)
+				comment.Author = author
+			}
+			if patch.CreatedAt == "" && createdAt != "" {
+				patch.CreatedAt = createdAt
+				comment.CreatedAt = createdAt
+			}
+		}
+		comments = append(comments, comment)
+	}
+	return comments
+}
+
+// Whether a comment of the file, or of its cells, has no ID yet
+func lacksCommentIDs(commentFile *CommentFile) bool {
+	for idx := range commentFile.Patches {
+		if commentFile.Patches[idx].ID == "" {
+			return true
+		}
+	}
+	for _, cell := range commentFile.Cells {
+		if lacksCommentIDs(cell) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gives an ID to the comments without one, those of the cells included. It
+// is the hash of the comment given by commentID rather than a UUID, so that
+// every clone migrating the same file gives the same IDs, which the merge
+// driver and permalinks match on. Identical comments are told apart by their
+// rank.
+func assignCommentIDs(commentFile *CommentFile) {
+	taken := map[string]bool{}
+	for idx := range commentFile.Patches {
+		taken[commentFile.Patches[idx].ID] = true
+	}
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		if patch.ID != "" {
+			continue
+		}
+		id := commentID(patch)
+		for rank := 2; taken[id]; rank++ {
+			hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", commentKey(patch), rank)))
+			id = hex.EncodeToString(hash[:])[:12]
+		}
+		patch.ID = id
+		taken[id] = true
+	}
+	for _, cell := range commentFile.Cells {
+		assignCommentIDs(cell)
+	}
+}
+
+// Author and RFC3339 date of the commit adding message to the comment file,
+// empty when it was never committed
+func commentOrigin(commentFilePath string, message string) (string, string) {
+	// Messages are searched as stored, JSON escaped
+	escaped, _ := json.Marshal(message)
+	cmd := gitCommand("log", "--reverse", "--format=%ae%x00%aI", "-S", strings.Trim(string(escaped), `"`), "--", filepath.Base(commentFilePath))
+	cmd.Dir = filepath.Dir(commentFilePath)
+	output, err := cmd.Output()
+	if err != nil {
+		gitLog.debugf("No history for a comment of %s: %v", commentFilePath, err)
+		return "", ""
+	}
+	first, _, _ := strings.Cut(string(output), "\n")
+	author, date, ok := strings.Cut(first, "\x00")
+	if !ok {
+		return "", ""
+	}
+	if parsed, err := time.Parse(time.RFC3339, date); err == nil {
+		date = parsed.UTC().Format(time.RFC3339)
+	}
+	return author, date
+}
+
+// Offers to upgrade the comment files of a previous schema found in the
+// workspace. Must not be called from the handler goroutine: it waits for the
+// client reply.
+func (h *handler) offerUpgrade(ctx context.Context) {
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" || !isWorkspaceTrusted() || h.sync.get().ReadOnly {
+		return
+	}
+	legacy, err := legacyCommentFiles(repoDir)
+	if err != nil || len(legacy) == 0 {
+		return
+	}
+	params := protocol.ShowMessageRequestParams{
+		Type: protocol.MessageTypeInfo,
+		Message: fmt.Sprintf("%d comment files use the layout of a previous version. Upgrade them? "+
+			"Authors and dates are taken from their history and the original files are kept.", len(legacy)),
+		Actions: []protocol.MessageActionItem{{Title: upgradeAction}, {Title: upgradeLaterAction}},
+	}
+	var chosen *protocol.MessageActionItem
+	if _, err := h.conn.Call(ctx, "window/showMessageRequest", params, &chosen); err != nil || chosen == nil || chosen.Title != upgradeAction {
+		return
+	}
+	progress := h.createProgress(ctx, "Upgrading comments")
+	report, err := upgradeCommentStore(ctx, h.rootPath, false)
+	if err != nil {
+		progress.end(ctx, "Comments not upgraded")
+		recordError(fmt.Errorf("error while upgrading comments: %w", err))
+		return
+	}
+	comments, unanchored := report.counts()
+	progress.end(ctx, fmt.Sprintf("%d comments upgraded", comments))
+	h.notifyCommentsChanged(ctx, ChangeLocal)
+	h.republishDiagnostics(ctx)
+	h.conn.Notify(ctx, "window/showMessage", protocol.ShowMessageParams{
+		Type: protocol.MessageTypeInfo,
+		Message: fmt.Sprintf("Upgraded %d comments of %d files, %d could not be anchored. Report and original files: %s",
+			comments, len(report.Files), unanchored, report.Backup),
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"go.lsp.dev/protocol"
+)
+
+// Team members vote comments up or down, one vote each, so that the findings
+// most agree on are addressed first.
+
+type VoteCounts struct {
+	Up   int `json:"up"`
+	Down int `json:"down"`
+}
+
+func (counts VoteCounts) score() int {
+	return counts.Up - counts.Down
+}
+
+func (patch *Patch) voteCounts() VoteCounts {
+	counts := VoteCounts{}
+	for _, vote := range patch.Votes {
+		if vote > 0 {
+			counts.Up++
+		} else if vote < 0 {
+			counts.Down++
+		}
+	}
+	return counts
+}
+
+// Records the vote of the current user on a comment: 1 up, -1 down, 0 to
+// withdraw it. Votes do not update the comment, unlike updateComment.
+func voteComment(uri protocol.DocumentURI, id string, vote int) error {
+	if vote < -1 || vote > 1 {
+		return fmt.Errorf("invalid vote %d, expected 1, -1 or 0", vote)
+	}
+	filePath := uriToPath(uri)
+	unlock, err := lockDocumentComments(filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	commentFile, err := loadCommentFile(filePath)
+	if err != nil {
+		return err
+	}
+	index, err := commentIndexIn(commentFile, filePath, id)
+	if err != nil {
+		return err
+	}
+	if commentFile.Patches[index].isPrivate() {
+		return fmt.Errorf("private notes cannot be voted on")
+	}
+	user := currentUser(filepath.Dir(filePath))
+	if user == "" {
+		return fmt.Errorf("configure your git identity to vote")
+	}
+	patch := &commentFile.Patches[index]
+	if vote == 0 {
+		delete(patch.Votes, user)
+	} else {
+		if patch.Votes == nil {
+			patch.Votes = map[string]int{}
+		}
+		patch.Votes[user] = vote
+	}
+	if err := saveCommentFile(filePath, commentFile); err != nil {
+		return err
+	}
+	return updateCommentsRepoAfterChange()
+}
+
+// "3 up, 1 down", empty without votes
+func votesSummary(counts VoteCounts) string {
+	if counts.Up == 0 && counts.Down == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d up, %d down", counts.Up, counts.Down)
+}
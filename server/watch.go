@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Asks the client to send workspace/didChangeWatchedFiles when comment files
+// change on disk, e.g. after pulling the comments of a teammate.
+// Must not be called from the handler goroutine: it waits for the client reply.
+func (h *handler) registerCommentsWatcher(ctx context.Context) {
+	const commentFilesPattern = "**/*.{json,yaml}"
+	var globPattern interface{} = "**/" + filepath.ToSlash(getSettings().CommentFolder) + "/" + commentFilesPattern
+	if repoDir := getRepoDirFromDir(h.rootPath); repoDir != "" {
+		// The index records the writes of the server, whose change events
+		// are then ignored
+		if _, err := commentIndexOf(commentsDirOf(repoDir)); err != nil {
+			recordError(err)
+		}
+		if rel, ok := commentsDirInRepo(repoDir, commentsDirOf(repoDir)); ok {
+			globPattern = "**/" + filepath.ToSlash(rel) + "/" + commentFilesPattern
+		} else {
+			// Glob patterns only match files of the workspace
+			globPattern = relativePattern{
+				BaseURI: protocol.URI(pathToURI(commentsDirOf(repoDir))),
+				Pattern: commentFilesPattern,
+			}
+		}
+	}
+	params := protocol.RegistrationParams{
+		Registrations: []protocol.Registration{
+			{
+				ID:     "comments-watcher",
+				Method: "workspace/didChangeWatchedFiles",
+				RegisterOptions: didChangeWatchedFilesRegistrationOptions{
+					Watchers: []fileSystemWatcher{{GlobPattern: globPattern}},
+				},
+			},
+		},
+	}
+	if _, err := h.conn.Call(ctx, "client/registerCapability", params, nil); err != nil {
+		recordError(fmt.Errorf("error while registering comments watcher: %w", err))
+		return
+	}
+	logInfof("Watching comment files matching %v", globPattern)
+}
+
+// Relative patterns (LSP 3.17) watch files outside of the workspace, they
+// are not part of go.lsp.dev/protocol yet
+type relativePattern struct {
+	BaseURI protocol.URI `json:"baseUri"`
+	Pattern string       `json:"pattern"`
+}
+
+type fileSystemWatcher struct {
+	GlobPattern interface{} `json:"globPattern"` // A string or a relativePattern
+}
+
+type didChangeWatchedFilesRegistrationOptions struct {
+	Watchers []fileSystemWatcher `json:"watchers"`
+}
+
+// Republishes the diagnostics of the open documents whose comment file changed.
+// The changes made by the server itself, already published, are ignored.
+func (h *handler) commentFilesChanged(ctx context.Context, changes []*protocol.FileEvent) {
+	changed := map[string]bool{}
+	var remoteChanges []*protocol.FileEvent
+	for _, change := range changes {
+		commentFilePath := commentFileKey(filepath.Clean(uriToPath(change.URI)))
+		if commentFileIndexed(commentFilePath) {
+			continue
+		}
+		changed[commentFilePath] = true
+		remoteChanges = append(remoteChanges, change)
+	}
+	if len(remoteChanges) == 0 {
+		return
+	}
+	commentFilesWritten(slices.Collect(maps.Keys(changed))...)
+	h.notifyCommentFilesChanged(ctx, remoteChanges)
+	for _, uri := range h.openURIs() {
+		commentFilePath, _, err := getCommentFilePath(uriToPath(uri))
+		if err != nil || !changed[filepath.Clean(commentFilePath)] {
+			continue
+		}
+		if !commentFileExists(commentFilePath) && !h.canPullDiagnostics {
+			// All the comments of the document were removed
+			h.conn.Notify(ctx, "textDocument/publishDiagnostics", protocol.PublishDiagnosticsParams{
+				URI:         uri,
+				Diagnostics: []protocol.Diagnostic{},
+			})
+			continue
+		}
+		h.publishDiagnostics(ctx, uri)
+	}
+}
+
+// Notifies the documents whose comment file changed on disk
+func (h *handler) notifyCommentFilesChanged(ctx context.Context, changes []*protocol.FileEvent) {
+	repoDir := getRepoDirFromDir(h.rootPath)
+	if repoDir == "" {
+		return
+	}
+	commentsDir := commentsDirOf(repoDir)
+	var commentChanges []CommentChange
+	for _, change := range changes {
+		rel, err := filepath.Rel(commentsDir, uriToPath(change.URI))
+		if err != nil || strings.HasPrefix(rel, "..") || strings.HasPrefix(filepath.ToSlash(rel), metaDirName+"/") {
+			continue
+		}
+		sourcePath := filepath.Join(repoDir, strings.TrimSuffix(commentFileKey(rel), ".json"))
+		commentChanges = append(commentChanges, CommentChange{URI: pathToURI(sourcePath)})
+	}
+	if len(commentChanges) > 0 {
+		h.notifyCommentsChanged(ctx, ChangeRemote, commentChanges...)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type WebhookEvent struct {
+	Event   string      `json:"event"`
+	Time    string      `json:"time"` // RFC3339
+	Payload interface{} `json:"payload"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Posts an event to the configured webhook, if any. Blocks until the
+// webhook answers, call it from a background goroutine.
+func notifyWebhook(event string, payload interface{}) {
+	webhookURL := getSettings().WebhookURL
+	if webhookURL == "" || !isWorkspaceTrusted() {
+		return
+	}
+	body, err := json.Marshal(WebhookEvent{
+		Event:   event,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Payload: payload,
+	})
+	if err != nil {
+		recordError(fmt.Errorf("error while serializing webhook event: %w", err))
+		return
+	}
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		recordError(fmt.Errorf("error while sending webhook event %s: %w", event, err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		recordError(fmt.Errorf("webhook returned %s for event %s", resp.Status, event))
+	}
+}
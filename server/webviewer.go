@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read-only web viewer of the comments of a repository, for the people
+// following reviews outside of an editor:
+//
+//	separate_comments serve [--addr 127.0.0.1:8377] [repository]
+//
+// Pages reload when comment files change, through server-sent events.
+
+const defaultViewerAddr = "127.0.0.1:8377"
+
+// Interval between two scans of the comment files for changes
+const viewerScanInterval = 2 * time.Second
+
+// Lines of code shown around a commented range
+const excerptContext = 2
+
+func runServe(args []string, output io.Writer) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(output)
+	addr := flags.String("addr", defaultViewerAddr, "address to listen on")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		fmt.Fprintln(output, "usage: serve [--addr host:port] [repository]")
+		return 2
+	}
+	dir := "."
+	if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(output, "serve: %v\n", err)
+		return 1
+	}
+	repoDir := getRepoDirFromDir(absDir)
+	if repoDir == "" {
+		fmt.Fprintf(output, "serve: %s is not a git repository\n", absDir)
+		return 1
+	}
+	current, err := loadProjectSettings(repoDir, getSettings())
+	if err != nil {
+		fmt.Fprintf(output, "serve: %v\n", err)
+		return 1
+	}
+	setSettings(current)
+
+	viewer := &webViewer{repoDir: repoDir, subscribers: map[chan string]bool{}}
+	go viewer.watch()
+	fmt.Fprintf(output, "Comments of %s served on http://%s\n", repoDir, *addr)
+	if err := http.ListenAndServe(*addr, viewer.routes()); err != nil {
+		fmt.Fprintf(output, "serve: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+type webViewer struct {
+	repoDir string
+	// Channels of the connected pages, receiving the changed files
+	mutex       sync.Mutex
+	subscribers map[chan string]bool
+}
+
+func (viewer *webViewer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", viewer.serveIndex)
+	mux.HandleFunc("/file", viewer.serveFile)
+	mux.HandleFunc("/thread", viewer.serveThread)
+	mux.HandleFunc("/events", viewer.serveEvents)
+	return mux
+}
+
+// A commented file in the index page
+type viewerFile struct {
+	Path     string
+	Open     int
+	Resolved int
+}
+
+func (viewer *webViewer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	files := []viewerFile{}
+	index, err := commentIndexOf(commentsDirOf(viewer.repoDir))
+	for rel, entry := range index {
+		if entry.Count > 0 {
+			open := entry.States[StateOpen]
+			files = append(files, viewerFile{Path: rel, Open: open, Resolved: entry.Count - open})
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	viewer.render(w, "index", map[string]interface{}{
+		"Repo":  filepath.Base(viewer.repoDir),
+		"Files": files,
+	})
+}
+
+// A thread in the file page, with the code it is about
+type viewerThread struct {
+	Patch    Patch
+	ID       string
+	Author   string
+	Resolved bool
+	Excerpt  []viewerLine
+	Anchored bool // The excerpt is the current code, not the recorded one
+}
+
+type viewerLine struct {
+	Number    int
+	Text      string
+	Commented bool
+}
+
+func (viewer *webViewer) serveFile(w http.ResponseWriter, r *http.Request) {
+	rel := filepath.Clean(filepath.FromSlash(r.URL.Query().Get("path")))
+	if rel == "." || filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	commentFile, err := readCommentFile(filepath.Join(commentsDirOf(viewer.repoDir), rel+".json"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	content, _ := os.ReadFile(filepath.Join(viewer.repoDir, rel))
+	threads := []viewerThread{}
+	for idx := range commentFile.Patches {
+		patch := &commentFile.Patches[idx]
+		thread := viewerThread{
+			Patch:    *patch,
+			ID:       commentID(patch),
+			Author:   patch.author(),
+			Resolved: patch.isClosed(),
+		}
+		thread.Excerpt, thread.Anchored = codeExcerpt(string(content), patch.Patch)
+		threads = append(threads, thread)
+	}
+	viewer.render(w, "file", map[string]interface{}{
+		"Repo":    filepath.Base(viewer.repoDir),
+		"Path":    filepath.ToSlash(rel),
+		"Threads": threads,
+	})
+}
+
+// Lines of the current code around the commented range, or the lines
+// recorded in the patch when it cannot be anchored anymore
+func codeExcerpt(content string, patchText string) ([]viewerLine, bool) {
+	excerpt := []viewerLine{}
+	if rng, err := applyPatchAndGetPositions(content, patchText); err == nil && content != "" {
+		lines := strings.Split(content, "\n")
+		end := int(rng.End.Line)
+		if rng.End.Character == 0 && end > int(rng.Start.Line) {
+			end--
+		}
+		for line := int(rng.Start.Line) - excerptContext; line <= end+excerptContext; line++ {
+			if line < 0 || line >= len(lines) {
+				continue
+			}
+			excerpt = append(excerpt, viewerLine{
+				Number:    line + 1,
+				Text:      lines[line],
+				Commented: line >= int(rng.Start.Line) && line <= end,
+			})
+		}
+		return excerpt, true
+	}
+	for _, patchLine := range strings.Split(patchText, "\n") {
+		if strings.HasPrefix(patchLine, "@@") || strings.HasPrefix(patchLine, "+") || patchLine == "" {
+			continue
+		}
+		excerpt = append(excerpt, viewerLine{Text: patchLine[1:], Commented: patchLine[0] == '-'})
+	}
+	return excerpt, false
+}
+
+// Streams the paths of the changed comment files to a page
+func (viewer *webViewer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	changes := make(chan string, 16)
+	viewer.mutex.Lock()
+	viewer.subscribers[changes] = true
+	viewer.mutex.Unlock()
+	defer func() {
+		viewer.mutex.Lock()
+		delete(viewer.subscribers, changes)
+		viewer.mutex.Unlock()
+	}()
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case path := <-changes:
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", path)
+			flusher.Flush()
+		}
+	}
+}
+
+func (viewer *webViewer) broadcast(path string) {
+	viewer.mutex.Lock()
+	defer viewer.mutex.Unlock()
+	for subscriber := range viewer.subscribers {
+		select {
+		case subscriber <- path:
+		default:
+			// The page is not reading, it reloads on the next change
+		}
+	}
+}
+
+// Scans the comment files periodically and broadcasts the changed ones
+func (viewer *webViewer) watch() {
+	type fileState struct {
+		modTime time.Time
+		size    int64
+	}
+	scan := func() map[string]fileState {
+		states := map[string]fileState{}
+		walkCommentFiles(commentsDirOf(viewer.repoDir), func(commentFilePath string, rel string) error {
+			if info, err := os.Stat(storedCommentFilePath(commentFilePath)); err == nil {
+				states[filepath.ToSlash(rel)] = fileState{info.ModTime(), info.Size()}
+			}
+			return nil
+		})
+		return states
+	}
+	previous := scan()
+	for range time.Tick(viewerScanInterval) {
+		current := scan()
+		for path, state := range current {
+			if previousState, ok := previous[path]; !ok || previousState != state {
+				viewer.broadcast(path)
+			}
+		}
+		for path := range previous {
+			if _, ok := current[path]; !ok {
+				viewer.broadcast(path)
+			}
+		}
+		previous = current
+	}
+}
+
+func (viewer *webViewer) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := viewerTemplates.ExecuteTemplate(w, name, data); err != nil {
+		logErrorf("Error while rendering %s page: %v", name, err)
+	}
+}
+
+var viewerTemplates = template.Must(template.New("viewer").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} comments</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+a { color: #0366d6; text-decoration: none; }
+.thread { border: 1px solid #ddd; border-radius: 4px; margin: 1em 0; padding: 0 1em; }
+.resolved { opacity: 0.6; }
+.meta { color: #666; font-size: 0.9em; }
+pre { background: #f6f8fa; padding: 0.5em; overflow-x: auto; }
+.line { display: block; min-height: 1.2em; }
+.commented { background: #fff5b1; }
+.number { color: #999; display: inline-block; width: 3em; }
+.reply { border-left: 3px solid #ddd; padding-left: 1em; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "footer"}}
+<script>
+// Reloads the page when a comment file it shows changes
+new EventSource("/events").addEventListener("change", function (event) {
+	var path = document.body.dataset.path;
+	if (!path || path === event.data) {
+		location.reload();
+	}
+});
+</script>
+</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header" .Repo}}
+<h1>Comments of {{.Repo}}</h1>
+{{if not .Files}}<p>No comments yet.</p>{{end}}
+<ul>
+{{range .Files}}<li><a href="/file?path={{.Path}}">{{.Path}}</a> <span class="meta">{{.Open}} open, {{.Resolved}} resolved</span></li>
+{{end}}
+</ul>
+{{template "footer"}}{{end}}
+
+{{define "file"}}{{template "header" .Repo}}
+<script>document.body.dataset.path = {{.Path}};</script>
+<p><a href="/">{{.Repo}}</a></p>
+<h1>{{.Path}}</h1>
+{{range .Threads}}
+<div class="thread{{if .Resolved}} resolved{{end}}" id="{{.ID}}">
+<p class="meta">{{if .Author}}{{.Author}}{{else}}anonymous{{end}}{{if .Patch.CreatedAt}}, {{.Patch.CreatedAt}}{{end}}{{if .Resolved}} — resolved{{end}}{{if not .Anchored}} — code changed since{{end}} — <a href="/thread?path={{$.Path}}&id={{.ID}}">permalink</a></p>
+<pre>{{range .Excerpt}}<span class="line{{if .Commented}} commented{{end}}"><span class="number">{{if .Number}}{{.Number}}{{end}}</span>{{.Text}}</span>{{end}}</pre>
+<p>{{.Patch.Message}}</p>
+{{range .Patch.Replies}}<div class="reply"><p class="meta">{{if .Author}}{{.Author}}{{else}}anonymous{{end}}{{if .CreatedAt}}, {{.CreatedAt}}{{end}}</p><p>{{.Message}}</p></div>
+{{end}}
+</div>
+{{end}}
+{{template "footer"}}{{end}}
+`))
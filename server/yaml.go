@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// YAML encoding of comment files, converted from and to their JSON encoding
+// so that both formats hold the same fields in the same order. Multi-line
+// strings, patches and messages, are literal block scalars: a patch reads as
+// in a diff. Other strings are double-quoted as in JSON, which is valid YAML.
+//
+// Comment files are read with the subset of YAML written here, and the hand
+// edits it invites:
+//   - block mappings, with plain or quoted keys, and block sequences, compact
+//     ones included
+//   - plain, single-quoted and double-quoted scalars on a single line, with
+//     numbers, booleans and null as in JSON and ~ as null
+//   - literal block scalars (|), with chomping and indentation indicators
+//   - {} and [] as empty mappings and sequences
+//   - comments, a leading --- and a final ...
+//
+// Anything else is refused with an error naming it, rather than read
+// differently than a YAML library would: anchors and aliases, tags,
+// directives, flow collections, folded block scalars, complex keys, scalars
+// spanning several lines, several documents and indentation by tabs.
+
+// Ordered value of a JSON document
+type yamlNode struct {
+	keys     []string // Of a mapping
+	values   []*yamlNode
+	items    []*yamlNode // Of a sequence
+	mapping  bool
+	sequence bool
+	str      *string
+	literal  string // Numbers, booleans and null as in JSON
+}
+
+func readJSONNode(decoder *json.Decoder) (*yamlNode, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		node := &yamlNode{mapping: token == '{', sequence: token == '['}
+		for decoder.More() {
+			if node.mapping {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			value, err := readJSONNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if node.mapping {
+				node.values = append(node.values, value)
+			} else {
+				node.items = append(node.items, value)
+			}
+		}
+		// Closing delimiter
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &yamlNode{str: &token}, nil
+	case json.Number:
+		return &yamlNode{literal: token.String()}, nil
+	case bool:
+		return &yamlNode{literal: strconv.FormatBool(token)}, nil
+	default:
+		return &yamlNode{literal: "null"}, nil
+	}
+}
+
+// Converts a JSON document to YAML
+func jsonToYAML(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	root, err := readJSONNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	var out strings.Builder
+	switch {
+	case root.mapping && len(root.keys) > 0:
+		writeYAMLMapping(&out, root, 0)
+	case root.sequence && len(root.items) > 0:
+		writeYAMLSequence(&out, root, 0)
+	default:
+		writeYAMLValue(&out, root, 0)
+	}
+	return []byte(strings.TrimPrefix(out.String(), " ")), nil
+}
+
+var plainYAMLKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// Keys read as booleans or null by YAML 1.1 readers
+var ambiguousYAMLKeys = map[string]bool{"y": true, "n": true, "yes": true, "no": true, "on": true, "off": true, "true": true, "false": true, "null": true}
+
+func writeYAMLKey(out *strings.Builder, key string) {
+	if plainYAMLKeyRegexp.MatchString(key) && !ambiguousYAMLKeys[strings.ToLower(key)] {
+		out.WriteString(key)
+	} else {
+		out.WriteString(quoteYAML(key))
+	}
+	out.WriteString(":")
+}
+
+func writeYAMLMapping(out *strings.Builder, node *yamlNode, indent int) {
+	for idx, key := range node.keys {
+		out.WriteString(strings.Repeat(" ", indent))
+		writeYAMLKey(out, key)
+		writeYAMLValue(out, node.values[idx], indent)
+	}
+}
+
+func writeYAMLSequence(out *strings.Builder, node *yamlNode, indent int) {
+	for _, item := range node.items {
+		out.WriteString(strings.Repeat(" ", indent) + "-")
+		if item.mapping && len(item.keys) > 0 {
+			// First key on the line of the dash
+			out.WriteString(" ")
+			writeYAMLKey(out, item.keys[0])
+			writeYAMLValue(out, item.values[0], indent+2)
+			writeYAMLMapping(out, &yamlNode{keys: item.keys[1:], values: item.values[1:]}, indent+2)
+			continue
+		}
+		writeYAMLValue(out, item, indent)
+	}
+}
+
+// Writes the value following a key or dash at indent, with its line break
+func writeYAMLValue(out *strings.Builder, node *yamlNode, indent int) {
+	switch {
+	case node.mapping && len(node.keys) == 0:
+		out.WriteString(" {}\n")
+	case node.mapping:
+		out.WriteString("\n")
+		writeYAMLMapping(out, node, indent+2)
+	case node.sequence && len(node.items) == 0:
+		out.WriteString(" []\n")
+	case node.sequence:
+		out.WriteString("\n")
+		writeYAMLSequence(out, node, indent+2)
+	case node.str != nil && isYAMLBlock(*node.str):
+		writeYAMLBlock(out, *node.str, indent)
+	case node.str != nil:
+		out.WriteString(" " + quoteYAML(*node.str) + "\n")
+	default:
+		out.WriteString(" " + node.literal + "\n")
+	}
+}
+
+func quoteYAML(s string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// Whether the string is written as a literal block scalar: multi-line,
+// printable and not only whitespace
+func isYAMLBlock(s string) bool {
+	if !strings.Contains(s, "\n") || strings.TrimSpace(s) == "" {
+		return false
+	}
+	for _, char := range s {
+		if char == '\n' || char == '\t' {
+			continue
+		}
+		if !unicode.IsPrint(char) || char == '\ufeff' {
+			return false
+		}
+	}
+	return true
+}
+
+// Literal block scalar indented by 2 from indent. Empty lines are written
+// without indentation, the chomping indicator restores the final line breaks.
+func writeYAMLBlock(out *strings.Builder, s string, indent int) {
+	header := " |"
+	body := s
+	switch {
+	case strings.HasSuffix(s, "\n\n"):
+		header += "+"
+		body = strings.TrimSuffix(s, "\n")
+	case strings.HasSuffix(s, "\n"):
+		body = strings.TrimSuffix(s, "\n")
+	default:
+		header += "-"
+	}
+	lines := strings.Split(body, "\n")
+	for _, line := range lines {
+		if line != "" {
+			// Lines starting with whitespace cannot give the indentation
+			if strings.TrimLeft(line, " \t") != line || strings.TrimSpace(line) == "" {
+				header = " |2" + strings.TrimPrefix(header, " |")
+			}
+			break
+		}
+	}
+	out.WriteString(header + "\n")
+	for _, line := range lines {
+		if line != "" {
+			out.WriteString(strings.Repeat(" ", indent+2) + line)
+		}
+		out.WriteString("\n")
+	}
+}
+
+// Reader of the YAML written by jsonToYAML, converting it back to JSON
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func (parser *yamlParser) errorf(format string, args ...interface{}) error {
+	return parser.lineErrorf(parser.pos, format, args...)
+}
+
+func (parser *yamlParser) lineErrorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", line+1, fmt.Sprintf(format, args...))
+}
+
+// Whether the line marks the start or the end of a document
+func isYAMLDocumentMarker(line string) bool {
+	return line == "---" || line == "..." || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "... ")
+}
+
+const yamlTabError = "tabs cannot indent YAML"
+
+// Index of the next line holding a node, skipping blank and comment lines,
+// -1 at the end of the document
+func (parser *yamlParser) next() int {
+	for parser.pos < len(parser.lines) {
+		trimmed := strings.TrimSpace(parser.lines[parser.pos])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if strings.HasPrefix(parser.lines[parser.pos], "\t") {
+				return -2
+			}
+			return parser.pos
+		}
+		parser.pos++
+	}
+	return -1
+}
+
+// Converts a YAML document to JSON
+func yamlToJSON(data []byte) ([]byte, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "\ufeff"), "\n")
+	parser := &yamlParser{lines: strings.Split(text, "\n")}
+	if parser.next() >= 0 && strings.TrimSpace(parser.lines[parser.pos]) == "---" {
+		parser.pos++
+	}
+	var out bytes.Buffer
+	line := parser.next()
+	if line == -1 {
+		return []byte("null"), nil
+	}
+	if err := parser.node(&out, 0); err != nil {
+		return nil, err
+	}
+	if line := parser.next(); line >= 0 && isYAMLDocumentMarker(parser.lines[line]) {
+		if strings.HasPrefix(parser.lines[line], "---") {
+			return nil, parser.errorf("several documents are not supported in comment files")
+		}
+		parser.pos++
+	}
+	if parser.next() != -1 {
+		return nil, parser.errorf("unexpected content")
+	}
+	return out.Bytes(), nil
+}
+
+// YAML feature outside of the subset read here used by a node starting with
+// text, empty if none
+func unsupportedYAMLFeature(text string) string {
+	switch {
+	case text == "{}" || text == "[]":
+		return ""
+	case strings.HasPrefix(text, "&"):
+		return "anchors (&)"
+	case strings.HasPrefix(text, "*"):
+		return "aliases (*)"
+	case strings.HasPrefix(text, "!"):
+		return "tags (!)"
+	case strings.HasPrefix(text, "%"):
+		return "directives (%)"
+	case strings.HasPrefix(text, "{") || strings.HasPrefix(text, "["):
+		return "flow collections"
+	case strings.HasPrefix(text, ">"):
+		return "folded block scalars (>)"
+	case text == "?" || strings.HasPrefix(text, "? "):
+		return "complex keys (?)"
+	case strings.HasPrefix(text, "@") || strings.HasPrefix(text, "`"):
+		return "reserved indicators (@ and `)"
+	}
+	return ""
+}
+
+func isYAMLSequenceEntry(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// Mapping or sequence starting at the next line, indented by at least indent
+func (parser *yamlParser) node(out *bytes.Buffer, indent int) error {
+	line := parser.next()
+	if line == -2 {
+		return parser.errorf(yamlTabError)
+	}
+	if line == -1 || indentOf(parser.lines[line]) < indent {
+		return parser.errorf("missing value")
+	}
+	indent = indentOf(parser.lines[line])
+	if isYAMLSequenceEntry(strings.TrimSpace(parser.lines[line])) {
+		return parser.sequence(out, indent)
+	}
+	return parser.mapping(out, indent)
+}
+
+var yamlKeyRegexp = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'(?:[^']|'')*'|[^\s"'#\[\]{},&*!|>%@` + "`" + `-][^:]*?|-[^\s:][^:]*?)\s*:(?:\s+|$)`)
+
+func (parser *yamlParser) mapping(out *bytes.Buffer, indent int) error {
+	out.WriteString("{")
+	keys := map[string]bool{}
+	for first := true; ; first = false {
+		line := parser.next()
+		if line == -2 {
+			return parser.errorf(yamlTabError)
+		}
+		if line < 0 || indentOf(parser.lines[line]) < indent || isYAMLDocumentMarker(parser.lines[line]) {
+			break
+		}
+		text := parser.lines[line][indent:]
+		if indentOf(parser.lines[line]) > indent {
+			return parser.errorf("unexpected indentation")
+		}
+		if isYAMLSequenceEntry(text) {
+			return parser.errorf("sequence entry in a mapping")
+		}
+		match := yamlKeyRegexp.FindStringSubmatch(text)
+		if match == nil {
+			if feature := unsupportedYAMLFeature(text); feature != "" {
+				return parser.errorf("%s are not supported in comment files", feature)
+			}
+			return parser.errorf("expected a key")
+		}
+		name := match[1]
+		if strings.HasPrefix(name, `"`) || strings.HasPrefix(name, "'") {
+			key, err := parseYAMLScalar(name)
+			if err != nil {
+				return parser.errorf("invalid key: %v", err)
+			}
+			json.Unmarshal(key, &name)
+		}
+		key, _ := json.Marshal(name)
+		if keys[name] {
+			return parser.errorf("duplicate key %s", name)
+		}
+		keys[name] = true
+		if !first {
+			out.WriteString(",")
+		}
+		out.Write(key)
+		out.WriteString(":")
+		parser.pos++
+		if err := parser.value(out, strings.TrimSpace(text[len(match[0]):]), indent, true); err != nil {
+			return err
+		}
+	}
+	out.WriteString("}")
+	return nil
+}
+
+func (parser *yamlParser) sequence(out *bytes.Buffer, indent int) error {
+	out.WriteString("[")
+	for first := true; ; first = false {
+		line := parser.next()
+		if line == -2 {
+			return parser.errorf(yamlTabError)
+		}
+		if line < 0 || indentOf(parser.lines[line]) != indent || !isYAMLSequenceEntry(parser.lines[line][indent:]) {
+			if line >= 0 && indentOf(parser.lines[line]) > indent {
+				return parser.errorf("unexpected indentation")
+			}
+			break
+		}
+		if !first {
+			out.WriteString(",")
+		}
+		rest := parser.lines[line][indent+1:]
+		item := strings.TrimLeft(rest, " ")
+		if yamlKeyRegexp.MatchString(item) || isYAMLSequenceEntry(item) {
+			// Compact mapping or sequence: read as if the dash were a space
+			parser.lines[line] = strings.Repeat(" ", indent+1+len(rest)-len(item)) + item
+			if err := parser.node(out, indent+1); err != nil {
+				return err
+			}
+			continue
+		}
+		parser.pos++
+		if err := parser.value(out, strings.TrimSpace(item), indent, false); err != nil {
+			return err
+		}
+	}
+	out.WriteString("]")
+	return nil
+}
+
+// Value following a key or dash at indent, the rest of the line
+func (parser *yamlParser) value(out *bytes.Buffer, rest string, indent int, inMapping bool) error {
+	if strings.HasPrefix(rest, "|") {
+		return parser.block(out, rest, indent)
+	}
+	if rest == "" || strings.HasPrefix(rest, "#") {
+		line := parser.next()
+		switch {
+		case line == -2:
+			return parser.errorf(yamlTabError)
+		case line >= 0 && indentOf(parser.lines[line]) > indent:
+			return parser.node(out, indent+1)
+		case line >= 0 && inMapping && indentOf(parser.lines[line]) == indent && isYAMLSequenceEntry(parser.lines[line][indent:]):
+			// Sequences may be indented as their key
+			return parser.sequence(out, indent)
+		}
+		out.WriteString("null")
+		return nil
+	}
+	value, err := parseYAMLScalar(rest)
+	if err != nil {
+		// On the line of the key or dash, read already
+		return parser.lineErrorf(parser.pos-1, "%v", err)
+	}
+	if line := parser.next(); line >= 0 && indentOf(parser.lines[line]) > indent {
+		return parser.errorf("scalars spanning several lines are not supported in comment files, use a literal block scalar (|)")
+	}
+	out.Write(value)
+	return nil
+}
+
+var yamlBlockHeaderRegexp = regexp.MustCompile(`^\|([1-9]?)([+-]?)([1-9]?)\s*(#.*)?$`)
+
+// Literal block scalar of the key or dash at indent
+func (parser *yamlParser) block(out *bytes.Buffer, header string, indent int) error {
+	match := yamlBlockHeaderRegexp.FindStringSubmatch(header)
+	if match == nil || match[1] != "" && match[3] != "" {
+		return parser.errorf("invalid block scalar header %q", header)
+	}
+	chomping := match[2]
+	contentIndent := -1
+	if indicator := match[1] + match[3]; indicator != "" {
+		contentIndent = indent + int(indicator[0]-'0')
+	}
+	var lines []string
+	for ; parser.pos < len(parser.lines); parser.pos++ {
+		line := parser.lines[parser.pos]
+		if strings.TrimSpace(line) == "" && (contentIndent < 0 || len(line) <= contentIndent) {
+			lines = append(lines, "")
+			continue
+		}
+		if contentIndent < 0 {
+			contentIndent = indentOf(line)
+			if contentIndent <= indent {
+				break
+			}
+		}
+		if indentOf(line) < contentIndent {
+			break
+		}
+		lines = append(lines, line[contentIndent:])
+	}
+	// Final empty lines are line breaks kept or not by the chomping indicator
+	content := len(lines)
+	for content > 0 && lines[content-1] == "" {
+		content--
+	}
+	text := strings.Join(lines[:content], "\n")
+	switch {
+	case content == 0:
+	case chomping == "-":
+	case chomping == "+":
+		text += strings.Repeat("\n", len(lines)-content+1)
+	default:
+		text += "\n"
+	}
+	value, _ := json.Marshal(text)
+	out.Write(value)
+	return nil
+}
+
+var yamlNumberRegexp = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// JSON value of a scalar on a single line
+func parseYAMLScalar(text string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		end := 1
+		for ; end < len(text) && text[end] != '"'; end++ {
+			if text[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(text) {
+			return nil, fmt.Errorf("unterminated string, quoted strings must end on their line")
+		}
+		if rest := strings.TrimSpace(text[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("unexpected %q after string", rest)
+		}
+		var s string
+		if err := json.Unmarshal([]byte(text[:end+1]), &s); err != nil {
+			return nil, fmt.Errorf("invalid string %s: %v", text[:end+1], err)
+		}
+		return json.Marshal(s)
+	case strings.HasPrefix(text, "'"):
+		end := 1
+		for ; end < len(text); end++ {
+			if text[end] == '\'' {
+				if end+1 < len(text) && text[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end >= len(text) {
+			return nil, fmt.Errorf("unterminated string, quoted strings must end on their line")
+		}
+		if rest := strings.TrimSpace(text[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("unexpected %q after string", rest)
+		}
+		return json.Marshal(strings.ReplaceAll(text[1:end], "''", "'"))
+	}
+	if comment := strings.Index(text, " #"); comment >= 0 {
+		text = strings.TrimSpace(text[:comment])
+	}
+	switch text {
+	case "{}", "[]", "true", "false", "null":
+		return []byte(text), nil
+	case "~":
+		return []byte("null"), nil
+	}
+	if yamlNumberRegexp.MatchString(text) {
+		return []byte(text), nil
+	}
+	if text == "" {
+		return nil, fmt.Errorf("missing value")
+	}
+	if feature := unsupportedYAMLFeature(text); feature != "" {
+		return nil, fmt.Errorf("%s are not supported in comment files", feature)
+	}
+	if strings.Contains(text, ": ") || strings.HasSuffix(text, ":") {
+		return nil, fmt.Errorf("plain scalars cannot hold \": \", quote %q", text)
+	}
+	return json.Marshal(text)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestYAMLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{name: "single line", message: "Rename it"},
+		{name: "multi-line", message: "Rename it\nto something shorter"},
+		{name: "trailing newline", message: "Rename it\nto something shorter\n"},
+		{name: "trailing newlines", message: "Rename it\nto something shorter\n\n\n"},
+		{name: "leading spaces", message: "  indented\nnot indented"},
+		{name: "leading spaces on every line", message: "    code()\n    more()\n"},
+		{name: "leading tab", message: "\tcode()\nmore()"},
+		{name: "leading empty lines", message: "\n\n  indented after empty lines\n"},
+		{name: "whitespace line", message: "   \nafter whitespace"},
+		{name: "empty lines between", message: "first\n\n\nlast"},
+		{name: "only newlines", message: "\n\n"},
+		{name: "yaml syntax", message: "key: value\n- entry\n# not a comment\n|\n"},
+		{name: "quotes", message: "\"quoted\"\n'single'"},
+		{name: "carriage returns", message: "windows\r\nline\r\n"},
+		{name: "unicode", message: "é ✓ 漢字\n🙂\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commentFile := CommentFile{Version: commentFileVersion, Commit: "abc", Patches: []Patch{{
+				ID:      "6f1c2a7e-0d4b-4c61-9a57-3f0e8b2d9c14",
+				Message: test.message,
+				Patch:   testPatch,
+				Replies: []Reply{{Message: test.message}},
+			}}}
+			data, err := json.Marshal(commentFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			yamlData, err := jsonToYAML(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jsonData, err := yamlToJSON(yamlData)
+			if err != nil {
+				t.Fatalf("%v in\n%s", err, yamlData)
+			}
+			var got CommentFile
+			if err := json.Unmarshal(jsonData, &got); err != nil {
+				t.Fatalf("%v in\n%s", err, jsonData)
+			}
+			if !reflect.DeepEqual(got, commentFile) {
+				t.Errorf("got %q, want %q from\n%s", got.Patches[0].Message, test.message, yamlData)
+			}
+		})
+	}
+}